@@ -0,0 +1,30 @@
+// Command schemagen writes the JSON Schema for the device WebSocket protocol.
+//
+// Usage: go run ./cmd/schemagen [output file]
+//
+// The schema is printed to stdout when no output file is given.
+package main
+
+import (
+	"log"
+	"os"
+
+	"remote-sim-gateway/internal/websocket"
+)
+
+func main() {
+	schema, err := websocket.JSONSchema()
+	if err != nil {
+		log.Fatalf("Failed to generate schema: %v", err)
+	}
+	schema = append(schema, '\n')
+
+	if len(os.Args) < 2 {
+		os.Stdout.Write(schema)
+		return
+	}
+
+	if err := os.WriteFile(os.Args[1], schema, 0o644); err != nil {
+		log.Fatalf("Failed to write schema: %v", err)
+	}
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"gorm.io/gorm"
 	"remote-sim-gateway/internal/config"
 	"remote-sim-gateway/internal/database"
 	"remote-sim-gateway/internal/handlers"
 	"remote-sim-gateway/internal/middleware"
+	"remote-sim-gateway/internal/services"
 	"remote-sim-gateway/internal/websocket"
 )
 
@@ -27,37 +37,134 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
-	defer db.Close()
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatalf("Failed to get database handle: %v", err)
+	}
+	defer sqlDB.Close()
+
+	// Handle `migrate` subcommand
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(db, os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
 
 	// Run migrations
-	if err := database.RunMigrations(db); err != nil {
-		log.Fatalf("Failed to run migrations: %v", err)
+	if cfg.Database.AutoMigrate {
+		if err := database.RunMigrations(db); err != nil {
+			log.Fatalf("Failed to run migrations: %v", err)
+		}
 	}
 
 	// Initialize WebSocket hub
-	hub := websocket.NewHub()
+	hub := websocket.NewHub(db)
+	hub.TelemetryRetention = time.Duration(cfg.Devices.TelemetryRetentionDays) * 24 * time.Hour
+	hub.SendWindow = cfg.Devices.SendWindow
+	// Nothing is connected yet, so any device still marked online is stale
+	if err := hub.ReconcilePresence(); err != nil {
+		log.Printf("Failed to reconcile device presence: %v", err)
+	}
 	go hub.Run()
+	// Heartbeat devices every 30 seconds; stopped by hub.Shutdown
+	hub.StartHeartbeat()
+
+	// Dispatch SMS within device and SIM quotas, retrying held messages, and
+	// record the sent and delivery reports devices send back
+	simRouter := services.NewSIMRouter(cfg.Routing)
+	quotaTracker := services.NewQuotaTracker(db, cfg.Quotas)
+	mediaStore := services.NewMediaStore(db, cfg.Media)
+	dispatcher := services.NewDispatcher(db, hub, simRouter, quotaTracker, mediaStore, cfg.Quotas)
+	dispatcher.Start()
+	hub.OnSMSStatus = dispatcher.RecordStatus
+	hub.OnCommandsDropped = dispatcher.Requeue
+
+	contactBook := services.NewContactBook(db, cfg.Recipients)
+
+	// Start device health alerting; alert SMS go through the dispatcher
+	alertService := services.NewAlertService(db, hub, dispatcher, simRouter, contactBook, cfg.Alerts, cfg.SMTP)
+	alertService.Start()
+
+	// Thread messages devices receive into conversations and run inbound rules
+	// on them; devices can't connect before the server starts below
+	inbox := services.NewInbox(db, dispatcher, contactBook, cfg.SMTP)
+	hub.OnSMSReceived = inbox.Receive
+
+	// Run USSD sessions, matching device responses to waiting requests
+	ussdService := services.NewUSSDService(db, hub, cfg.Devices)
+	hub.OnUSSDResponse = ussdService.HandleResponse
+
+	// Record calls reported by devices, collect their recordings and prune
+	// recordings past their retention
+	callRecorder := services.NewCallRecorder(db, hub, cfg.Recordings)
+	hub.OnCallStatus = callRecorder.RecordStatus
+	callRecorder.Start()
+
+	// Feed bulk jobs to devices at a controlled rate
+	bulkSender := services.NewBulkSender(db, dispatcher, cfg.Bulk)
+	bulkSender.Start()
+
+	// Send and check one-time verification codes
+	verifyService, err := services.NewVerifyService(db, hub, simRouter, dispatcher, cfg.Verify)
+	if err != nil {
+		log.Fatalf("Invalid verification config: %v", err)
+	}
 
 	// Initialize Gin router
-	router := gin.Default()
+	router := gin.New()
+	router.Use(gin.Recovery())
 
 	// Apply middleware
 	router.Use(middleware.CORS(cfg.CORS))
 	router.Use(middleware.Logger())
-	router.Use(middleware.RateLimit())
+
+	// Rate limits are applied per route group, after authentication
+	rateLimitPolicy, err := middleware.LoadRateLimitPolicy(cfg.RateLimit)
+	if err != nil {
+		log.Fatalf("Failed to load rate limit policy: %v", err)
+	}
+	rateLimitStore, err := middleware.NewRateLimitStore(cfg.RateLimit, db)
+	if err != nil {
+		log.Fatalf("Failed to create rate limit store: %v", err)
+	}
+	rateLimiter := middleware.NewRateLimiter(rateLimitPolicy, rateLimitStore, db)
+	authRateLimit := middleware.RateLimit(rateLimiter, "auth")
+	smsRateLimit := middleware.RateLimit(rateLimiter, "sms")
+	callRateLimit := middleware.RateLimit(rateLimiter, "calls")
+	verifyRateLimit := middleware.RateLimit(rateLimiter, "verify")
+	replyRateLimit := middleware.RateLimit(rateLimiter, "replies")
+
+	// Safe retries of send requests that carry an Idempotency-Key. Mounted
+	// before the send rate limits so a replayed retry doesn't use up a token.
+	idempotent := middleware.Idempotency(db, cfg.Idempotency)
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(db, cfg.JWT)
-	smsHandler := handlers.NewSMSHandler(db, hub)
-	callHandler := handlers.NewCallHandler(db, hub)
-	deviceHandler := handlers.NewDeviceHandler(db, hub)
+	smsHandler := handlers.NewSMSHandler(db, hub, simRouter, dispatcher, bulkSender, contactBook, mediaStore)
+	callHandler := handlers.NewCallHandler(db, hub, simRouter)
+	callRecordHandler := handlers.NewCallRecordHandler(db, callRecorder)
+	deviceHandler := handlers.NewDeviceHandler(db, hub, quotaTracker)
 	dashboardHandler := handlers.NewDashboardHandler(db)
+	alertHandler := handlers.NewAlertHandler(db)
+	bulkJobHandler := handlers.NewBulkJobHandler(db, bulkSender)
+	recipientUploadHandler := handlers.NewRecipientUploadHandler(db, cfg.Recipients)
+	contactHandler := handlers.NewContactHandler(db, contactBook)
+	conversationHandler := handlers.NewConversationHandler(db, hub, inbox, contactBook)
+	inboundRuleHandler := handlers.NewInboundRuleHandler(db, contactBook)
+	mediaHandler := handlers.NewMediaHandler(mediaStore)
+	ussdHandler := handlers.NewUSSDHandler(db, hub, simRouter, ussdService, cfg.Server)
+	verifyHandler := handlers.NewVerifyHandler(db, hub, simRouter, contactBook, verifyService)
 
 	// Public routes
 	public := router.Group("/")
 	{
-		public.POST("/auth/login", authHandler.Login)
-		public.POST("/auth/register", authHandler.Register)
+		public.POST("/auth/login", authRateLimit, authHandler.Login)
+		public.POST("/auth/register", authRateLimit, authHandler.Register)
+		// Devices fetch MMS media through signed, expiring URLs
+		public.GET("/media/:id", mediaHandler.Download)
+		// and upload call recordings to signed URLs
+		public.POST("/calls/:id/recording", callRecordHandler.UploadRecording)
 		public.GET("/health", func(c *gin.Context) {
 			c.JSON(200, gin.H{"status": "ok"})
 		})
@@ -66,21 +173,90 @@ func main() {
 	// Protected routes
 	api := router.Group("/api")
 	api.Use(middleware.AuthRequired(cfg.JWT.Secret))
+	api.Use(middleware.RateLimit(rateLimiter, "api"))
 	{
 		// SMS routes
-		api.POST("/send-sms", smsHandler.SendSMS)
-		api.POST("/send-bulk-sms", smsHandler.SendBulkSMS)
+		api.POST("/send-sms", idempotent, smsRateLimit, smsHandler.SendSMS)
+		api.POST("/send-bulk-sms", idempotent, smsRateLimit, smsHandler.SendBulkSMS)
 		api.GET("/sms-history", smsHandler.GetHistory)
+		api.GET("/sms/:id", smsHandler.GetMessage)
+		api.POST("/send-mms", idempotent, smsRateLimit, smsHandler.SendMMS)
+		api.POST("/media", mediaHandler.Upload)
+
+		// Recipient list uploads for bulk SMS
+		api.POST("/recipient-uploads", recipientUploadHandler.UploadRecipients)
+		api.GET("/recipient-uploads/:id", recipientUploadHandler.GetUpload)
+
+		// Conversation routes
+		api.GET("/conversations", conversationHandler.GetConversations)
+		api.GET("/conversations/:id", conversationHandler.GetConversation)
+		api.GET("/conversations/:id/messages", conversationHandler.GetMessages)
+		api.POST("/conversations/:id/read", conversationHandler.MarkRead)
+		api.POST("/conversations/:id/reply", idempotent, replyRateLimit, conversationHandler.Reply)
+
+		// Inbound rule routes
+		api.GET("/inbound-rules", inboundRuleHandler.GetRules)
+		api.POST("/inbound-rules", inboundRuleHandler.CreateRule)
+		api.PUT("/inbound-rules/:id", inboundRuleHandler.UpdateRule)
+		api.DELETE("/inbound-rules/:id", inboundRuleHandler.DeleteRule)
+
+		// Contact routes
+		api.GET("/contacts", contactHandler.GetContacts)
+		api.POST("/contacts", contactHandler.CreateContact)
+		api.POST("/contacts/import", contactHandler.ImportContacts)
+		api.GET("/contacts/export", contactHandler.ExportContacts)
+		api.GET("/contacts/:id", contactHandler.GetContact)
+		api.PUT("/contacts/:id", contactHandler.UpdateContact)
+		api.DELETE("/contacts/:id", contactHandler.DeleteContact)
+		api.GET("/contact-groups", contactHandler.GetGroups)
+		api.POST("/contact-groups", contactHandler.CreateGroup)
+		api.PUT("/contact-groups/:id", contactHandler.UpdateGroup)
+		api.DELETE("/contact-groups/:id", contactHandler.DeleteGroup)
+		api.POST("/contact-groups/:id/members", contactHandler.AddGroupMembers)
+		api.DELETE("/contact-groups/:id/members", contactHandler.RemoveGroupMembers)
+		api.GET("/opt-outs", contactHandler.GetOptOuts)
+		api.POST("/opt-outs", contactHandler.CreateOptOut)
+		api.DELETE("/opt-outs/:id", contactHandler.DeleteOptOut)
+
+		// Bulk job routes
+		api.GET("/bulk-jobs", bulkJobHandler.GetJobs)
+		api.GET("/bulk-jobs/:id", bulkJobHandler.GetJob)
+		api.POST("/bulk-jobs/:id/pause", bulkJobHandler.PauseJob)
+		api.POST("/bulk-jobs/:id/resume", bulkJobHandler.ResumeJob)
+		api.POST("/bulk-jobs/:id/cancel", bulkJobHandler.CancelJob)
+
+		// Verification routes
+		api.POST("/verify/start", idempotent, verifyRateLimit, verifyHandler.Start)
+		api.POST("/verify/check", verifyHandler.Check)
 
 		// Call routes
-		api.POST("/make-call", callHandler.MakeCall)
+		api.POST("/make-call", idempotent, callRateLimit, callHandler.MakeCall)
 		api.GET("/call-history", callHandler.GetHistory)
+		api.GET("/calls/cdr", callRecordHandler.ExportCDR)
+		api.GET("/calls/:id/recording", callRecordHandler.GetRecording)
+		api.DELETE("/calls/:id/recording", callRecordHandler.DeleteRecording)
 
 		// Device routes
 		api.GET("/devices", deviceHandler.GetDevices)
+		api.GET("/devices/stats", deviceHandler.GetHubStats)
 		api.POST("/devices", deviceHandler.RegisterDevice)
 		api.PUT("/devices/:id", deviceHandler.UpdateDevice)
 		api.DELETE("/devices/:id", deviceHandler.DeleteDevice)
+		api.GET("/devices/:id/telemetry", deviceHandler.GetTelemetry)
+		api.GET("/devices/:id/sims", deviceHandler.GetSIMs)
+		api.PUT("/devices/:id/sims/:sim_id", deviceHandler.UpdateSIM)
+		api.GET("/devices/:id/ussd", ussdHandler.GetSessions)
+		api.POST("/devices/:id/ussd", ussdHandler.Start)
+		api.GET("/devices/:id/ussd/:session_id", ussdHandler.GetSession)
+		api.POST("/devices/:id/ussd/:session_id/reply", ussdHandler.Reply)
+		api.DELETE("/devices/:id/ussd/:session_id", ussdHandler.Cancel)
+
+		// Alert routes
+		api.GET("/alert-rules", alertHandler.GetRules)
+		api.POST("/alert-rules", alertHandler.CreateRule)
+		api.PUT("/alert-rules/:id", alertHandler.UpdateRule)
+		api.DELETE("/alert-rules/:id", alertHandler.DeleteRule)
+		api.GET("/alerts", alertHandler.GetAlerts)
 
 		// Dashboard routes
 		api.GET("/dashboard/stats", dashboardHandler.GetStats)
@@ -93,13 +269,90 @@ func main() {
 	})
 
 	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	srv := &http.Server{
+		Addr:         ":" + cfg.Server.Port,
+		Handler:      router,
+		ReadTimeout:  time.Duration(cfg.Server.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(cfg.Server.WriteTimeout) * time.Second,
+	}
+
+	go func() {
+		log.Printf("Server starting on port %s", cfg.Server.Port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// Wait for interrupt signal to gracefully shut down the server
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Println("Shutting down server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	// Stop accepting new connections and let in-flight requests finish
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown error: %v", err)
+	}
+
+	// Stop schedulers before the hub so they don't queue new commands
+	alertService.Stop()
+	bulkSender.Stop()
+	callRecorder.Stop()
+
+	// Notify devices, flush queued commands and stop background routines
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("WebSocket hub shutdown error: %v", err)
+	}
+
+	// The hub hands commands still held for devices back to the dispatcher,
+	// so it stops last
+	dispatcher.Stop()
+
+	log.Println("Server stopped")
+}
+
+// runMigrate implements `server migrate up|down|status|to <version>`
+func runMigrate(db *gorm.DB, args []string) error {
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down|status|to <version>")
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := router.Run(":" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	switch args[0] {
+	case "up":
+		return migrator.Up()
+	case "down":
+		return migrator.Down()
+	case "to":
+		if len(args) < 2 {
+			return errors.New("usage: migrate to <version>")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q: %w", args[1], err)
+		}
+		return migrator.To(version)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%03d  %-40s %s\n", status.Version, status.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
 	}
-}
\ No newline at end of file
+}
@@ -7,19 +7,36 @@ import (
 )
 
 type Config struct {
-	Database DatabaseConfig
-	JWT      JWTConfig
-	CORS     CORSConfig
-	Server   ServerConfig
+	Database    DatabaseConfig
+	JWT         JWTConfig
+	CORS        CORSConfig
+	Server      ServerConfig
+	Devices     DevicesConfig
+	Alerts      AlertsConfig
+	SMTP        SMTPConfig
+	Routing     RoutingConfig
+	Quotas      QuotasConfig
+	RateLimit   RateLimitConfig
+	Idempotency IdempotencyConfig
+	Bulk        BulkConfig
+	Recipients  RecipientsConfig
+	Verify      VerifyConfig
+	Media       MediaConfig
+	Recordings  RecordingsConfig
 }
 
 type DatabaseConfig struct {
+	Driver   string // postgres | sqlite
+	Path     string // SQLite database file, or ":memory:"
 	Host     string
 	Port     int
 	Name     string
 	User     string
 	Password string
 	SSLMode  string
+
+	// Apply pending migrations on startup; disable to run them via `migrate up`
+	AutoMigrate bool
 }
 
 type JWTConfig struct {
@@ -40,40 +57,274 @@ type ServerConfig struct {
 	ShutdownTimeout int
 }
 
+type DevicesConfig struct {
+	// Days of device telemetry history to keep; 0 keeps it forever
+	TelemetryRetentionDays int
+	// SMS a device may have in flight before the rest wait in its priority
+	// lanes; 0 means no limit
+	SendWindow int
+	// Seconds to wait for a device's answer to a USSD request
+	USSDTimeout int
+}
+
+type AlertsConfig struct {
+	// Seconds between alert rule evaluations
+	CheckInterval int
+}
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+type RoutingConfig struct {
+	// Destination number prefixes per carrier, used to send through a SIM
+	// of the same carrier as the recipient
+	CarrierPrefixes map[string][]string
+}
+
+type QuotasConfig struct {
+	// Time zone whose midnight starts the daily and monthly quota windows
+	Timezone string
+	// Seconds between attempts to dispatch messages held over quota
+	RetryInterval int
+}
+
+type RateLimitConfig struct {
+	// Default limit: Requests per Window seconds, overridden by the policy file
+	Requests   int
+	Window     int
+	PolicyFile string
+	Store      string // memory | database
+}
+
+type IdempotencyConfig struct {
+	// Hours an Idempotency-Key and its response are kept
+	Window int
+}
+
+type BulkConfig struct {
+	// Bulk job messages handed to each device per second
+	SendRate int
+}
+
+type VerifyConfig struct {
+	// Digits in a code, and seconds it stays valid
+	CodeLength int
+	TTL        int
+	// Wrong codes accepted before a verification fails
+	MaxAttempts int
+	// Seconds before another code can be sent to the same number
+	ResendCooldown int
+	// Codes sent per hour to one number, and by one user across numbers
+	MaxPerNumber int
+	MaxPerUser   int
+	// Default SMS text; {{code}} and {{minutes}} are filled in
+	Template string
+}
+
+type MediaConfig struct {
+	// Where uploaded MMS media is stored
+	Dir string
+	// Most bytes of media in one MMS, and so in one file
+	MaxSize int
+	// Content types accepted, detected from the file's contents
+	AllowedTypes []string
+	// Base URL devices fetch media from, and seconds a signed URL is valid
+	PublicURL string
+	URLTTL    int
+	// Key signing media URLs; defaults to JWT_SECRET
+	SigningKey string
+}
+
+type RecordingsConfig struct {
+	// Where call recordings uploaded by devices are stored
+	Dir string
+	// Most bytes accepted in one recording
+	MaxSize int
+	// Content types accepted, detected from the file's contents
+	AllowedTypes []string
+	// Days recordings are kept; zero keeps them forever
+	RetentionDays int
+	// Seconds a device has to upload a recording after the call ends
+	UploadTTL int
+	// Seconds one upload request may take; replaces SERVER_READ_TIMEOUT
+	// for uploads, which are too large to send within it on slow links
+	UploadTimeout int
+	// Base URL and key for signed upload URLs, shared with media
+	PublicURL  string
+	SigningKey string
+}
+
+type RecipientsConfig struct {
+	// Country code given to uploaded numbers that have none, e.g. "91"
+	DefaultCountryCode string
+	// Most recipients accepted in one uploaded file
+	MaxRows int
+}
+
 func New() *Config {
 	dbPort, _ := strconv.Atoi(getEnv("DB_PORT", "5432"))
 	jwtExpiration, _ := strconv.Atoi(getEnv("JWT_EXPIRATION", "24"))
+	readTimeout, _ := strconv.Atoi(getEnv("SERVER_READ_TIMEOUT", "30"))
+	writeTimeout, _ := strconv.Atoi(getEnv("SERVER_WRITE_TIMEOUT", "30"))
+	shutdownTimeout, _ := strconv.Atoi(getEnv("SERVER_SHUTDOWN_TIMEOUT", "10"))
+	telemetryRetention, _ := strconv.Atoi(getEnv("TELEMETRY_RETENTION_DAYS", "30"))
+	deviceSendWindow, _ := strconv.Atoi(getEnv("DEVICE_SEND_WINDOW", "10"))
+	ussdTimeout, _ := strconv.Atoi(getEnv("USSD_TIMEOUT", "30"))
+	verifyCodeLength, _ := strconv.Atoi(getEnv("VERIFY_CODE_LENGTH", "6"))
+	verifyTTL, _ := strconv.Atoi(getEnv("VERIFY_TTL", "300"))
+	verifyMaxAttempts, _ := strconv.Atoi(getEnv("VERIFY_MAX_ATTEMPTS", "5"))
+	verifyResendCooldown, _ := strconv.Atoi(getEnv("VERIFY_RESEND_COOLDOWN", "30"))
+	verifyMaxPerNumber, _ := strconv.Atoi(getEnv("VERIFY_MAX_PER_NUMBER", "5"))
+	verifyMaxPerUser, _ := strconv.Atoi(getEnv("VERIFY_MAX_PER_USER", "1000"))
+	alertCheckInterval, _ := strconv.Atoi(getEnv("ALERT_CHECK_INTERVAL", "60"))
+	smtpPort, _ := strconv.Atoi(getEnv("SMTP_PORT", "587"))
+	quotaRetryInterval, _ := strconv.Atoi(getEnv("QUOTA_RETRY_INTERVAL", "30"))
+	rateLimitRequests, _ := strconv.Atoi(getEnv("RATE_LIMIT_REQUESTS", "100"))
+	rateLimitWindow, _ := strconv.Atoi(getEnv("RATE_LIMIT_WINDOW", "3600"))
+	idempotencyWindow, _ := strconv.Atoi(getEnv("IDEMPOTENCY_WINDOW", "24"))
+	bulkSendRate, _ := strconv.Atoi(getEnv("BULK_SEND_RATE", "5"))
+	recipientMaxRows, _ := strconv.Atoi(getEnv("RECIPIENT_MAX_ROWS", "100000"))
+	mediaMaxSize, _ := strconv.Atoi(getEnv("MEDIA_MAX_SIZE", "1048576"))
+	mediaURLTTL, _ := strconv.Atoi(getEnv("MEDIA_URL_TTL", "3600"))
+	recordingMaxSize, _ := strconv.Atoi(getEnv("RECORDING_MAX_SIZE", "20971520"))
+	recordingRetention, _ := strconv.Atoi(getEnv("RECORDING_RETENTION_DAYS", "90"))
+	recordingUploadTTL, _ := strconv.Atoi(getEnv("RECORDING_UPLOAD_TTL", "86400"))
+	recordingUploadTimeout, _ := strconv.Atoi(getEnv("RECORDING_UPLOAD_TIMEOUT", "600"))
 
 	origins := strings.Split(getEnv("CORS_ORIGINS", "http://localhost:3000"), ",")
 	for i := range origins {
 		origins[i] = strings.TrimSpace(origins[i])
 	}
 
+	mediaTypes := strings.Split(getEnv("MEDIA_ALLOWED_TYPES", "image/jpeg,image/png,image/gif"), ",")
+	for i := range mediaTypes {
+		mediaTypes[i] = strings.TrimSpace(mediaTypes[i])
+	}
+	recordingTypes := strings.Split(getEnv("RECORDING_ALLOWED_TYPES", "audio/mpeg,audio/wave,audio/amr,audio/3gpp,audio/mp4,video/mp4,application/ogg"), ",")
+	for i := range recordingTypes {
+		recordingTypes[i] = strings.TrimSpace(recordingTypes[i])
+	}
+	jwtSecret := getEnv("JWT_SECRET", "your-super-secret-key")
+	mediaPublicURL := getEnv("MEDIA_PUBLIC_URL", "http://localhost:8080")
+	mediaSigningKey := getEnv("MEDIA_SIGNING_KEY", jwtSecret)
+
 	return &Config{
 		Database: DatabaseConfig{
+			Driver:   getEnv("DB_DRIVER", "postgres"),
+			Path:     getEnv("DB_PATH", "data/simgateway.db"),
 			Host:     getEnv("DB_HOST", "localhost"),
 			Port:     dbPort,
 			Name:     getEnv("DB_NAME", "simgateway"),
 			User:     getEnv("DB_USER", "postgres"),
 			Password: getEnv("DB_PASSWORD", ""),
 			SSLMode:  getEnv("DB_SSL_MODE", "disable"),
+
+			AutoMigrate: getEnv("DB_AUTO_MIGRATE", "true") == "true",
 		},
 		JWT: JWTConfig{
-			Secret:         getEnv("JWT_SECRET", "your-super-secret-key"),
+			Secret:         jwtSecret,
 			ExpirationTime: jwtExpiration,
 		},
 		CORS: CORSConfig{
 			AllowedOrigins: origins,
 			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-			AllowedHeaders: []string{"Content-Type", "Authorization"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "Idempotency-Key"},
 		},
 		Server: ServerConfig{
 			Port:            getEnv("PORT", "8080"),
-			ReadTimeout:     30,
-			WriteTimeout:    30,
-			ShutdownTimeout: 10,
+			ReadTimeout:     readTimeout,
+			WriteTimeout:    writeTimeout,
+			ShutdownTimeout: shutdownTimeout,
+		},
+		Devices: DevicesConfig{
+			TelemetryRetentionDays: telemetryRetention,
+			SendWindow:             deviceSendWindow,
+			USSDTimeout:            ussdTimeout,
+		},
+		Alerts: AlertsConfig{
+			CheckInterval: alertCheckInterval,
+		},
+		SMTP: SMTPConfig{
+			Host:     getEnv("SMTP_HOST", ""),
+			Port:     smtpPort,
+			Username: getEnv("SMTP_USERNAME", ""),
+			Password: getEnv("SMTP_PASSWORD", ""),
+			From:     getEnv("SMTP_FROM", "alerts@simgateway.local"),
+		},
+		Routing: RoutingConfig{
+			CarrierPrefixes: parseCarrierPrefixes(getEnv("SIM_CARRIER_PREFIXES", "")),
 		},
+		Quotas: QuotasConfig{
+			Timezone:      getEnv("QUOTA_TIMEZONE", "UTC"),
+			RetryInterval: quotaRetryInterval,
+		},
+		RateLimit: RateLimitConfig{
+			Requests:   rateLimitRequests,
+			Window:     rateLimitWindow,
+			PolicyFile: getEnv("RATE_LIMIT_POLICY_FILE", "../security/policies/rate-limits.json"),
+			Store:      getEnv("RATE_LIMIT_STORE", "memory"),
+		},
+		Idempotency: IdempotencyConfig{
+			Window: idempotencyWindow,
+		},
+		Bulk: BulkConfig{
+			SendRate: bulkSendRate,
+		},
+		Recipients: RecipientsConfig{
+			DefaultCountryCode: getEnv("RECIPIENT_DEFAULT_COUNTRY_CODE", ""),
+			MaxRows:            recipientMaxRows,
+		},
+		Verify: VerifyConfig{
+			CodeLength:     verifyCodeLength,
+			TTL:            verifyTTL,
+			MaxAttempts:    verifyMaxAttempts,
+			ResendCooldown: verifyResendCooldown,
+			MaxPerNumber:   verifyMaxPerNumber,
+			MaxPerUser:     verifyMaxPerUser,
+			Template:       getEnv("VERIFY_TEMPLATE", "Your verification code is {{code}}. It expires in {{minutes}} minutes."),
+		},
+		Media: MediaConfig{
+			Dir:          getEnv("MEDIA_DIR", "data/media"),
+			MaxSize:      mediaMaxSize,
+			AllowedTypes: mediaTypes,
+			PublicURL:    mediaPublicURL,
+			URLTTL:       mediaURLTTL,
+			SigningKey:   mediaSigningKey,
+		},
+		Recordings: RecordingsConfig{
+			Dir:           getEnv("RECORDING_DIR", "data/recordings"),
+			MaxSize:       recordingMaxSize,
+			AllowedTypes:  recordingTypes,
+			RetentionDays: recordingRetention,
+			UploadTTL:     recordingUploadTTL,
+			UploadTimeout: recordingUploadTimeout,
+			PublicURL:     mediaPublicURL,
+			SigningKey:    mediaSigningKey,
+		},
+	}
+}
+
+// parseCarrierPrefixes reads "Carrier A:+9198,+9199;Carrier B:+9170"
+func parseCarrierPrefixes(value string) map[string][]string {
+	carriers := make(map[string][]string)
+	for _, entry := range strings.Split(value, ";") {
+		carrier, prefixes, ok := strings.Cut(entry, ":")
+		carrier = strings.TrimSpace(carrier)
+		if !ok || carrier == "" {
+			continue
+		}
+		for _, prefix := range strings.Split(prefixes, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				carriers[carrier] = append(carriers[carrier], prefix)
+			}
+		}
 	}
+	return carriers
 }
 
 func getEnv(key, defaultValue string) string {
@@ -3,20 +3,34 @@ package database
 import (
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/glebarez/sqlite"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"remote-sim-gateway/internal/config"
-	"remote-sim-gateway/internal/models"
+)
+
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
 )
 
 func NewConnection(cfg config.DatabaseConfig) (*gorm.DB, error) {
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s",
-		cfg.Host, cfg.User, cfg.Password, cfg.Name, cfg.Port, cfg.SSLMode)
+	dialector, err := newDialector(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+	db, err := gorm.Open(dialector, &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
+		// SQLite compares timestamps as text, so keep every stored time in UTC
+		NowFunc: func() time.Time {
+			return time.Now().UTC()
+		},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
@@ -28,27 +42,36 @@ func NewConnection(cfg config.DatabaseConfig) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to get underlying sql.DB: %w", err)
 	}
 
-	sqlDB.SetMaxIdleConns(10)
-	sqlDB.SetMaxOpenConns(100)
+	if cfg.Driver == DriverSQLite {
+		// SQLite allows a single writer; serialize access instead of
+		// failing with "database is locked"
+		sqlDB.SetMaxOpenConns(1)
+	} else {
+		sqlDB.SetMaxIdleConns(10)
+		sqlDB.SetMaxOpenConns(100)
+	}
 
-	log.Println("Database connected successfully")
+	log.Printf("Database connected successfully (%s)", cfg.Driver)
 	return db, nil
 }
 
-func RunMigrations(db *gorm.DB) error {
-	log.Println("Running database migrations...")
-	
-	err := db.AutoMigrate(
-		&models.User{},
-		&models.Device{},
-		&models.Message{},
-		&models.Call{},
-	)
-	
-	if err != nil {
-		return fmt.Errorf("failed to run migrations: %w", err)
+func newDialector(cfg config.DatabaseConfig) (gorm.Dialector, error) {
+	switch cfg.Driver {
+	case DriverPostgres, "":
+		dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s",
+			cfg.Host, cfg.User, cfg.Password, cfg.Name, cfg.Port, cfg.SSLMode)
+		return postgres.Open(dsn), nil
+
+	case DriverSQLite:
+		if cfg.Path != ":memory:" {
+			if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755); err != nil {
+				return nil, fmt.Errorf("failed to create database directory: %w", err)
+			}
+		}
+		dsn := cfg.Path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+		return sqlite.Open(dsn), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q (expected %q or %q)", cfg.Driver, DriverPostgres, DriverSQLite)
 	}
-	
-	log.Println("Database migrations completed successfully")
-	return nil
-}
\ No newline at end of file
+}
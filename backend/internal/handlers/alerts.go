@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"net/http"
+	"net/mail"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+)
+
+type AlertHandler struct {
+	db *gorm.DB
+}
+
+func NewAlertHandler(db *gorm.DB) *AlertHandler {
+	return &AlertHandler{
+		db: db,
+	}
+}
+
+func (h *AlertHandler) GetRules(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var rules []models.AlertRule
+	if err := h.db.Where("user_id = ?", userID).Order("id").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch alert rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func (h *AlertHandler) CreateRule(c *gin.Context) {
+	var req models.AlertRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	if msg := h.validateRule(req, userID.(uint)); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	rule := models.AlertRule{UserID: userID.(uint), Enabled: true}
+	applyAlertRuleRequest(&rule, req)
+
+	if err := h.db.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create alert rule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Alert rule created successfully",
+		"rule":    rule,
+	})
+}
+
+func (h *AlertHandler) UpdateRule(c *gin.Context) {
+	ruleID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert rule ID"})
+		return
+	}
+
+	var req models.AlertRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var rule models.AlertRule
+	if err := h.db.Where("id = ? AND user_id = ?", ruleID, userID).First(&rule).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert rule not found"})
+		return
+	}
+
+	if msg := h.validateRule(req, userID.(uint)); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	applyAlertRuleRequest(&rule, req)
+
+	if err := h.db.Save(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update alert rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Alert rule updated successfully",
+		"rule":    rule,
+	})
+}
+
+func (h *AlertHandler) DeleteRule(c *gin.Context) {
+	ruleID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert rule ID"})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var rule models.AlertRule
+	if err := h.db.Where("id = ? AND user_id = ?", ruleID, userID).First(&rule).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert rule not found"})
+		return
+	}
+
+	if err := h.db.Delete(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete alert rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted successfully"})
+}
+
+func (h *AlertHandler) GetAlerts(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	state := c.Query("state")
+
+	offset := (page - 1) * limit
+	userID, _ := c.Get("user_id")
+
+	var alerts []models.Alert
+	var total int64
+
+	query := h.db.Where("user_id = ?", userID)
+	if state != "" {
+		query = query.Where("state = ?", state)
+	}
+
+	if err := query.Model(&models.Alert{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count alerts"})
+		return
+	}
+
+	if err := query.Preload("Rule").Offset(offset).Limit(limit).Order("fired_at DESC").Find(&alerts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch alerts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"alerts": alerts,
+		"total":  total,
+		"page":   page,
+		"limit":  limit,
+	})
+}
+
+// validateRule returns a user-facing error message, or "" if the rule is valid
+func (h *AlertHandler) validateRule(req models.AlertRuleRequest, userID uint) string {
+	if req.DeviceID != nil {
+		var device models.Device
+		if err := h.db.Where("id = ? AND user_id = ?", *req.DeviceID, userID).First(&device).Error; err != nil {
+			return "Device not found"
+		}
+	}
+
+	switch req.Metric {
+	case models.AlertMetricBattery, models.AlertMetricFailureRate:
+		if req.Threshold > 100 {
+			return "Threshold must be between 0 and 100"
+		}
+	case models.AlertMetricSignal:
+		if req.Threshold > 4 {
+			return "Signal threshold must be between 0 and 4"
+		}
+	}
+
+	switch req.Channel {
+	case models.AlertChannelEmail:
+		if _, err := mail.ParseAddress(req.Target); err != nil {
+			return "Target must be a valid email address"
+		}
+	case models.AlertChannelWebhook:
+		if err := services.ValidateWebhookURL(req.Target); err != nil {
+			return "Target " + err.Error()
+		}
+	}
+
+	return ""
+}
+
+func applyAlertRuleRequest(rule *models.AlertRule, req models.AlertRuleRequest) {
+	rule.DeviceID = req.DeviceID
+	rule.Name = req.Name
+	rule.Metric = req.Metric
+	rule.Threshold = req.Threshold
+	rule.Hysteresis = req.Hysteresis
+	rule.WindowMinutes = req.WindowMinutes
+	rule.Channel = req.Channel
+	rule.Target = req.Target
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+}
@@ -75,6 +75,7 @@ func (h *AuthHandler) Register(c *gin.Context) {
 	user := models.User{
 		Email: req.Email,
 		Role:  "user",
+		Plan:  "free",
 	}
 
 	if err := user.HashPassword(req.Password); err != nil {
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+)
+
+type BulkJobHandler struct {
+	db     *gorm.DB
+	sender *services.BulkSender
+}
+
+func NewBulkJobHandler(db *gorm.DB, sender *services.BulkSender) *BulkJobHandler {
+	return &BulkJobHandler{
+		db:     db,
+		sender: sender,
+	}
+}
+
+func (h *BulkJobHandler) GetJobs(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	status := c.Query("status")
+
+	offset := (page - 1) * limit
+	userID, _ := c.Get("user_id")
+
+	var jobs []models.BulkJob
+	var total int64
+
+	query := h.db.Where("user_id = ?", userID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	if err := query.Model(&models.BulkJob{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count bulk jobs"})
+		return
+	}
+
+	if err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch bulk jobs"})
+		return
+	}
+
+	for i := range jobs {
+		progress, err := h.sender.Progress(jobs[i].ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch bulk job progress"})
+			return
+		}
+		jobs[i].Progress = progress
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":  jobs,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+func (h *BulkJobHandler) GetJob(c *gin.Context) {
+	job, ok := h.findJob(c)
+	if !ok {
+		return
+	}
+
+	h.respondWithProgress(c, job)
+}
+
+func (h *BulkJobHandler) PauseJob(c *gin.Context) {
+	h.transition(c, h.sender.Pause, "Only running bulk jobs can be paused")
+}
+
+func (h *BulkJobHandler) ResumeJob(c *gin.Context) {
+	h.transition(c, h.sender.Resume, "Only paused bulk jobs can be resumed")
+}
+
+func (h *BulkJobHandler) CancelJob(c *gin.Context) {
+	h.transition(c, h.sender.Cancel, "Bulk job has already finished")
+}
+
+func (h *BulkJobHandler) transition(c *gin.Context, apply func(*models.BulkJob) (bool, error), conflictMsg string) {
+	job, ok := h.findJob(c)
+	if !ok {
+		return
+	}
+
+	changed, err := apply(job)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update bulk job"})
+		return
+	}
+	if !changed {
+		c.JSON(http.StatusConflict, gin.H{"error": conflictMsg, "status": job.Status})
+		return
+	}
+
+	h.respondWithProgress(c, job)
+}
+
+// findJob loads the user's job named in the URL, responding with an error if
+// there is none
+func (h *BulkJobHandler) findJob(c *gin.Context) (*models.BulkJob, bool) {
+	jobID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bulk job ID"})
+		return nil, false
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var job models.BulkJob
+	if err := h.db.Where("id = ? AND user_id = ?", jobID, userID).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bulk job not found"})
+		return nil, false
+	}
+	return &job, true
+}
+
+func (h *BulkJobHandler) respondWithProgress(c *gin.Context, job *models.BulkJob) {
+	progress, err := h.sender.Progress(job.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch bulk job progress"})
+		return
+	}
+	job.Progress = progress
+
+	c.JSON(http.StatusOK, job)
+}
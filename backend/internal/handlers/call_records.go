@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+)
+
+// Room in an upload request for the multipart headers around the file
+const recordingFormOverhead = 64 * 1024
+
+// File extensions for recording downloads, by content type
+var recordingExtensions = map[string]string{
+	"audio/mpeg":      ".mp3",
+	"audio/wave":      ".wav",
+	"audio/amr":       ".amr",
+	"audio/3gpp":      ".3gp",
+	"audio/mp4":       ".m4a",
+	"video/mp4":       ".m4a",
+	"application/ogg": ".ogg",
+}
+
+var cdrHeader = []string{
+	"call_id", "user", "device", "sim_slot", "sim_iccid", "sim_carrier", "sim_number",
+	"phone_number", "status", "created_at", "started_at", "ended_at", "duration", "error", "recording",
+}
+
+type CallRecordHandler struct {
+	db       *gorm.DB
+	recorder *services.CallRecorder
+}
+
+func NewCallRecordHandler(db *gorm.DB, recorder *services.CallRecorder) *CallRecordHandler {
+	return &CallRecordHandler{
+		db:       db,
+		recorder: recorder,
+	}
+}
+
+// UploadRecording stores the audio of a call, sent by the device as the
+// "file" form field to the signed URL from upload_recording; it needs no
+// other authentication. The signature is checked before the body is read,
+// and the file is streamed to disk rather than buffered.
+func (h *CallRecordHandler) UploadRecording(c *gin.Context) {
+	callID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Call not found"})
+		return
+	}
+
+	if err := h.recorder.Verify(uint(callID), c.Query("expires"), c.Query("signature")); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired link"})
+		return
+	}
+
+	// Recordings take longer than SERVER_READ_TIMEOUT to send on slow links
+	if err := http.NewResponseController(c.Writer).SetReadDeadline(time.Now().Add(h.recorder.UploadTimeout())); err != nil {
+		log.Printf("Failed to extend read deadline for recording of call %d: %v", callID, err)
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(h.recorder.MaxSize())+recordingFormOverhead)
+
+	file, err := recordingPart(c.Request)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Recording must be at most %d bytes", h.recorder.MaxSize())})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A recording file is required"})
+		return
+	}
+
+	recording, err := h.recorder.Save(uint(callID), file.Header.Get("Content-Type"), file)
+	switch {
+	case errors.Is(err, services.ErrRecordingTooLarge), errors.As(err, &tooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Recording must be at most %d bytes", h.recorder.MaxSize())})
+		return
+	case errors.Is(err, services.ErrRecordingType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported recording format"})
+		return
+	case errors.Is(err, services.ErrRecordingExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Call already has a recording"})
+		return
+	case errors.Is(err, services.ErrRecordingUpload):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Call not found"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store recording"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, recording)
+}
+
+// recordingPart reads the multipart form up to its "file" field, skipping
+// any fields before it
+func recordingPart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
+func (h *CallRecordHandler) GetRecording(c *gin.Context) {
+	recording, ok := h.findRecording(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", recording.ContentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="call-%d%s"`, recording.CallID, recordingExtensions[recording.ContentType]))
+	c.File(h.recorder.Path(recording))
+}
+
+func (h *CallRecordHandler) DeleteRecording(c *gin.Context) {
+	recording, ok := h.findRecording(c)
+	if !ok {
+		return
+	}
+
+	if err := h.recorder.Delete(recording); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete recording"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Recording deleted successfully"})
+}
+
+// ExportCDR downloads call detail records as CSV for reconciling with
+// carrier bills. Calls are selected by when they were placed, between the
+// optional from and to times; admins get every user's calls.
+func (h *CallRecordHandler) ExportCDR(c *gin.Context) {
+	query := h.db.Table("calls").
+		Select(`calls.id, users.email AS user_email, devices.device_id AS device,
+			sims.slot AS sim_slot, sims.iccid AS sim_iccid, sims.carrier AS sim_carrier, sims.phone_number AS sim_number,
+			calls.phone_number, calls.status, calls.created_at, calls.started_at, calls.ended_at, calls.duration,
+			calls.error_msg, call_recordings.id IS NOT NULL AS has_recording`).
+		Joins("LEFT JOIN users ON users.id = calls.user_id").
+		Joins("LEFT JOIN devices ON devices.id = calls.device_id").
+		Joins("LEFT JOIN sims ON sims.id = calls.sim_id").
+		Joins("LEFT JOIN call_recordings ON call_recordings.call_id = calls.id")
+
+	if role, _ := c.Get("role"); role == "admin" {
+		if userID := c.Query("user_id"); userID != "" {
+			query = query.Where("calls.user_id = ?", userID)
+		}
+	} else {
+		userID, _ := c.Get("user_id")
+		query = query.Where("calls.user_id = ?", userID)
+	}
+
+	if raw := c.Query("from"); raw != "" {
+		from, err := parseTimeParam(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' time: use RFC 3339 or unix seconds"})
+			return
+		}
+		query = query.Where("calls.created_at >= ?", from.UTC())
+	}
+	if raw := c.Query("to"); raw != "" {
+		to, err := parseTimeParam(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' time: use RFC 3339 or unix seconds"})
+			return
+		}
+		query = query.Where("calls.created_at <= ?", to.UTC())
+	}
+	if deviceID := c.Query("device_id"); deviceID != "" {
+		query = query.Where("calls.device_id = ?", deviceID)
+	}
+	if simID := c.Query("sim_id"); simID != "" {
+		query = query.Where("calls.sim_id = ?", simID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("calls.status = ?", status)
+	}
+
+	rows, err := query.Order("calls.created_at, calls.id").Rows()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export call records"})
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="cdr.csv"`)
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(cdrHeader)
+	for rows.Next() {
+		var record struct {
+			ID           uint
+			UserEmail    *string
+			Device       *string
+			SIMSlot      *int    `gorm:"column:sim_slot"`
+			SIMICCID     *string `gorm:"column:sim_iccid"`
+			SIMCarrier   *string `gorm:"column:sim_carrier"`
+			SIMNumber    *string `gorm:"column:sim_number"`
+			PhoneNumber  string
+			Status       string
+			CreatedAt    time.Time
+			StartedAt    *time.Time
+			EndedAt      *time.Time
+			Duration     *int
+			ErrorMsg     *string
+			HasRecording bool
+		}
+		if err := h.db.ScanRows(rows, &record); err != nil {
+			c.Error(err)
+			break
+		}
+
+		slot := ""
+		if record.SIMSlot != nil {
+			slot = strconv.Itoa(*record.SIMSlot)
+		}
+		duration := 0
+		if record.Duration != nil {
+			duration = *record.Duration
+		}
+		writer.Write([]string{
+			strconv.FormatUint(uint64(record.ID), 10),
+			stringValue(record.UserEmail),
+			stringValue(record.Device),
+			slot,
+			stringValue(record.SIMICCID),
+			stringValue(record.SIMCarrier),
+			stringValue(record.SIMNumber),
+			record.PhoneNumber,
+			record.Status,
+			cdrTime(&record.CreatedAt),
+			cdrTime(record.StartedAt),
+			cdrTime(record.EndedAt),
+			strconv.Itoa(duration),
+			stringValue(record.ErrorMsg),
+			strconv.FormatBool(record.HasRecording),
+		})
+	}
+	writer.Flush()
+}
+
+// findRecording loads the recording of the user's call from the :id
+// parameter, or responds with an error
+func (h *CallRecordHandler) findRecording(c *gin.Context) (*models.CallRecording, bool) {
+	callID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid call ID"})
+		return nil, false
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var recording models.CallRecording
+	if err := h.db.Where("call_id = ? AND user_id = ?", callID, userID).First(&recording).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return nil, false
+	}
+	return &recording, true
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// cdrTime formats a CDR timestamp in UTC; calls that never connected have
+// no start time
+func cdrTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
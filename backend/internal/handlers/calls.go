@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+	"remote-sim-gateway/internal/websocket"
+)
+
+type CallHandler struct {
+	db     *gorm.DB
+	hub    *websocket.Hub
+	router *services.SIMRouter
+}
+
+func NewCallHandler(db *gorm.DB, hub *websocket.Hub, router *services.SIMRouter) *CallHandler {
+	return &CallHandler{
+		db:     db,
+		hub:    hub,
+		router: router,
+	}
+}
+
+func (h *CallHandler) MakeCall(c *gin.Context) {
+	var req models.MakeCallRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	// Pick a device that can call if none was specified, and verify it
+	// belongs to the user and is online
+	device, status, errMsg := resolveCapableDevice(h.db, h.hub, h.router, userID, req.DeviceID, req.SIMID, req.PhoneNumber, "make_call")
+	if device == nil {
+		c.JSON(status, gin.H{"error": errMsg})
+		return
+	}
+
+	sim, status, errMsg := selectSIM(h.hub, h.router, device, req.SIMID, req.SIMSlot, req.PhoneNumber)
+	if errMsg != "" {
+		c.JSON(status, gin.H{"error": errMsg})
+		return
+	}
+
+	call := models.Call{
+		PhoneNumber: req.PhoneNumber,
+		Status:      "pending",
+		DeviceID:    device.ID,
+		SIMID:       simID(sim),
+		UserID:      userID.(uint),
+	}
+	if err := h.db.Create(&call).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create call"})
+		return
+	}
+
+	frame := websocket.MakeCallFrame{
+		ID:          call.ID,
+		PhoneNumber: call.PhoneNumber,
+		DeviceID:    device.DeviceID,
+	}
+	if sim != nil && h.hub.HasCapability(device.DeviceID, websocket.CapabilityDualSIM) {
+		slot := sim.Slot
+		frame.SIMSlot = &slot
+	}
+
+	if err := h.hub.SendCommand(device.DeviceID, websocket.Message{Type: "make_call", Data: frame}); err != nil {
+		h.db.Model(&call).Updates(map[string]interface{}{"status": "failed", "error_msg": err.Error()})
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error(), "id": call.ID})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.CallResponse{
+		ID:          call.ID,
+		PhoneNumber: call.PhoneNumber,
+		Status:      call.Status,
+	})
+}
+
+func (h *CallHandler) GetHistory(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	status := c.Query("status")
+	phoneNumber := c.Query("phone_number")
+
+	offset := (page - 1) * limit
+	userID, _ := c.Get("user_id")
+
+	var calls []models.Call
+	var total int64
+
+	query := h.db.Where("user_id = ?", userID).Preload("Device").Preload("Recording")
+
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	if phoneNumber != "" {
+		query = query.Where("LOWER(phone_number) LIKE LOWER(?)", "%"+phoneNumber+"%")
+	}
+
+	if err := query.Model(&models.Call{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count calls"})
+		return
+	}
+
+	if err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&calls).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch calls"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"calls": calls,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
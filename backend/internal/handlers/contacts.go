@@ -0,0 +1,577 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+)
+
+type ContactHandler struct {
+	db       *gorm.DB
+	contacts *services.ContactBook
+}
+
+func NewContactHandler(db *gorm.DB, contacts *services.ContactBook) *ContactHandler {
+	return &ContactHandler{
+		db:       db,
+		contacts: contacts,
+	}
+}
+
+func (h *ContactHandler) GetContacts(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	search := c.Query("search")
+	groupID := c.Query("group_id")
+
+	tagQuery, err := services.ParseTagQuery(c.Query("tags"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	offset := (page - 1) * limit
+	userID, _ := c.Get("user_id")
+
+	var contacts []models.Contact
+	var total int64
+
+	query := h.db.Model(&models.Contact{}).Where("user_id = ?", userID)
+	if search != "" {
+		query = query.Where("(LOWER(name) LIKE LOWER(?) OR phone_number LIKE ?)", "%"+search+"%", "%"+search+"%")
+	}
+	if groupID != "" {
+		query = query.Where("id IN (?)", h.db.Table("contact_group_members").Select("contact_id").Where("contact_group_id = ?", groupID))
+	}
+	query = tagQuery.Apply(query)
+
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count contacts"})
+		return
+	}
+
+	if err := query.Preload("Groups").Offset(offset).Limit(limit).Order("name, id").Find(&contacts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contacts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"contacts": contacts,
+		"total":    total,
+		"page":     page,
+		"limit":    limit,
+	})
+}
+
+func (h *ContactHandler) GetContact(c *gin.Context) {
+	contact, ok := h.findContact(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, contact)
+}
+
+func (h *ContactHandler) CreateContact(c *gin.Context) {
+	var req models.ContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	contact := models.Contact{UserID: userID.(uint)}
+	groups, status, errMsg := h.applyContactRequest(&contact, req)
+	if errMsg != "" {
+		c.JSON(status, gin.H{"error": errMsg})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Groups").Create(&contact).Error; err != nil {
+			return err
+		}
+		return tx.Model(&contact).Association("Groups").Replace(groups)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create contact"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Contact created successfully",
+		"contact": contact,
+	})
+}
+
+func (h *ContactHandler) UpdateContact(c *gin.Context) {
+	contact, ok := h.findContact(c)
+	if !ok {
+		return
+	}
+
+	var req models.ContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	groups, status, errMsg := h.applyContactRequest(contact, req)
+	if errMsg != "" {
+		c.JSON(status, gin.H{"error": errMsg})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Groups").Save(contact).Error; err != nil {
+			return err
+		}
+		return tx.Model(contact).Association("Groups").Replace(groups)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update contact"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Contact updated successfully",
+		"contact": contact,
+	})
+}
+
+func (h *ContactHandler) DeleteContact(c *gin.Context) {
+	contact, ok := h.findContact(c)
+	if !ok {
+		return
+	}
+
+	if err := h.db.Select("Groups").Delete(contact).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete contact"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Contact deleted successfully"})
+}
+
+// ImportContacts creates or updates contacts from a CSV or XLSX "file". The
+// phone_column form field names the number column, and group_id adds every
+// imported contact to that group.
+func (h *ContactHandler) ImportContacts(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var groupID *uint
+	if value := c.PostForm("group_id"); value != "" {
+		group, ok := h.findGroupByID(c, value)
+		if !ok {
+			return
+		}
+		groupID = &group.ID
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A CSV or XLSX file is required"})
+		return
+	}
+	if fileHeader.Size > maxRecipientFileSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File must be at most 10 MB"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxRecipientFileSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	rows, err := services.ReadSpreadsheet(fileHeader.Filename, data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := h.contacts.Import(userID.(uint), rows, c.PostForm("phone_column"), groupID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+func (h *ContactHandler) ExportContacts(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="contacts.csv"`)
+	if err := h.contacts.Export(userID.(uint), c.Writer); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export contacts"})
+	}
+}
+
+func (h *ContactHandler) GetGroups(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var groups []models.ContactGroup
+	if err := h.db.Where("user_id = ?", userID).Order("name").Find(&groups).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contact groups"})
+		return
+	}
+
+	var counts []struct {
+		ContactGroupID uint
+		Members        int64
+	}
+	err := h.db.Table("contact_group_members").
+		Select("contact_group_id, COUNT(*) AS members").
+		Where("contact_group_id IN (?)", h.db.Model(&models.ContactGroup{}).Select("id").Where("user_id = ?", userID)).
+		Group("contact_group_id").
+		Scan(&counts).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count group members"})
+		return
+	}
+
+	members := make(map[uint]int64, len(counts))
+	for _, count := range counts {
+		members[count.ContactGroupID] = count.Members
+	}
+	for i := range groups {
+		groups[i].Members = members[groups[i].ID]
+	}
+
+	c.JSON(http.StatusOK, gin.H{"groups": groups})
+}
+
+func (h *ContactHandler) CreateGroup(c *gin.Context) {
+	var req models.ContactGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	if h.groupNameTaken(userID, req.Name, 0) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A group with this name already exists"})
+		return
+	}
+
+	group := models.ContactGroup{
+		UserID:      userID.(uint),
+		Name:        req.Name,
+		Description: req.Description,
+	}
+	if err := h.db.Create(&group).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create contact group"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Contact group created successfully",
+		"group":   group,
+	})
+}
+
+func (h *ContactHandler) UpdateGroup(c *gin.Context) {
+	group, ok := h.findGroupByID(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	var req models.ContactGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if h.groupNameTaken(group.UserID, req.Name, group.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A group with this name already exists"})
+		return
+	}
+
+	group.Name = req.Name
+	group.Description = req.Description
+	if err := h.db.Save(group).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update contact group"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Contact group updated successfully",
+		"group":   group,
+	})
+}
+
+// DeleteGroup deletes the group but not its contacts
+func (h *ContactHandler) DeleteGroup(c *gin.Context) {
+	group, ok := h.findGroupByID(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM contact_group_members WHERE contact_group_id = ?", group.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(group).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete contact group"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Contact group deleted successfully"})
+}
+
+func (h *ContactHandler) AddGroupMembers(c *gin.Context) {
+	group, contactIDs, ok := h.memberRequest(c)
+	if !ok {
+		return
+	}
+
+	if err := services.AddGroupMembers(h.db, group.ID, contactIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add group members"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Contacts added to group"})
+}
+
+func (h *ContactHandler) RemoveGroupMembers(c *gin.Context) {
+	group, contactIDs, ok := h.memberRequest(c)
+	if !ok {
+		return
+	}
+
+	err := h.db.Exec("DELETE FROM contact_group_members WHERE contact_group_id = ? AND contact_id IN ?", group.ID, contactIDs).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove group members"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Contacts removed from group"})
+}
+
+// memberRequest reads the group and the user's contacts named in a group
+// membership request, responding with an error if either is invalid
+func (h *ContactHandler) memberRequest(c *gin.Context) (*models.ContactGroup, []uint, bool) {
+	group, ok := h.findGroupByID(c, c.Param("id"))
+	if !ok {
+		return nil, nil, false
+	}
+
+	var req models.ContactGroupMembersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, nil, false
+	}
+
+	var contactIDs []uint
+	if err := h.db.Model(&models.Contact{}).Where("id IN ? AND user_id = ?", req.ContactIDs, group.UserID).Pluck("id", &contactIDs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contacts"})
+		return nil, nil, false
+	}
+	if len(contactIDs) != len(uniqueIDs(req.ContactIDs)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Contact not found"})
+		return nil, nil, false
+	}
+
+	return group, contactIDs, true
+}
+
+// applyContactRequest validates req into contact and returns the groups to
+// put it in, or an error status and message
+func (h *ContactHandler) applyContactRequest(contact *models.Contact, req models.ContactRequest) ([]models.ContactGroup, int, string) {
+	phoneNumber, err := h.contacts.NormalizeNumber(req.PhoneNumber)
+	if err != nil {
+		return nil, http.StatusBadRequest, "Invalid phone number: " + err.Error()
+	}
+
+	var existing int64
+	h.db.Model(&models.Contact{}).
+		Where("user_id = ? AND phone_number = ? AND id <> ?", contact.UserID, phoneNumber, contact.ID).
+		Count(&existing)
+	if existing > 0 {
+		return nil, http.StatusConflict, "A contact with this phone number already exists"
+	}
+
+	tags, err := services.NormalizeTags(req.Tags)
+	if err != nil {
+		return nil, http.StatusBadRequest, err.Error()
+	}
+
+	fields := make(models.StringMap, len(req.Fields))
+	for key, value := range req.Fields {
+		if key == "" || services.FieldKey(key) != key {
+			return nil, http.StatusBadRequest, "Invalid field name \"" + key + "\": use lowercase letters, digits and underscores"
+		}
+		fields[key] = value
+	}
+
+	var groups []models.ContactGroup
+	if len(req.GroupIDs) > 0 {
+		if err := h.db.Where("id IN ? AND user_id = ?", req.GroupIDs, contact.UserID).Find(&groups).Error; err != nil {
+			return nil, http.StatusInternalServerError, "Failed to fetch contact groups"
+		}
+		if len(groups) != len(uniqueIDs(req.GroupIDs)) {
+			return nil, http.StatusBadRequest, "Contact group not found"
+		}
+	}
+
+	contact.Name = req.Name
+	contact.PhoneNumber = phoneNumber
+	contact.Tags = tags
+	contact.Fields = fields
+	contact.Groups = groups
+	return groups, 0, ""
+}
+
+// GetOptOuts lists the numbers sends are refused to
+func (h *ContactHandler) GetOptOuts(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	phoneNumber := c.Query("phone_number")
+
+	offset := (page - 1) * limit
+	userID, _ := c.Get("user_id")
+
+	var optOuts []models.OptOut
+	var total int64
+
+	query := h.db.Where("user_id = ?", userID)
+	if phoneNumber != "" {
+		query = query.Where("phone_number LIKE ?", "%"+phoneNumber+"%")
+	}
+
+	if err := query.Model(&models.OptOut{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count opt-outs"})
+		return
+	}
+
+	if err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&optOuts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch opt-outs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"opt_outs": optOuts,
+		"total":    total,
+		"page":     page,
+		"limit":    limit,
+	})
+}
+
+func (h *ContactHandler) CreateOptOut(c *gin.Context) {
+	var req models.OptOutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	if _, err := h.contacts.NormalizeNumber(req.PhoneNumber); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number: " + err.Error()})
+		return
+	}
+
+	optOut, err := h.contacts.OptOut(userID.(uint), req.PhoneNumber, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save opt-out"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Number opted out",
+		"opt_out": optOut,
+	})
+}
+
+// DeleteOptOut lets the user send to the number again
+func (h *ContactHandler) DeleteOptOut(c *gin.Context) {
+	optOutID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid opt-out ID"})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	result := h.db.Where("id = ? AND user_id = ?", optOutID, userID).Delete(&models.OptOut{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete opt-out"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Opt-out not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Opt-out deleted successfully"})
+}
+
+func (h *ContactHandler) groupNameTaken(userID interface{}, name string, exceptID uint) bool {
+	var count int64
+	h.db.Model(&models.ContactGroup{}).Where("user_id = ? AND name = ? AND id <> ?", userID, name, exceptID).Count(&count)
+	return count > 0
+}
+
+func (h *ContactHandler) findContact(c *gin.Context) (*models.Contact, bool) {
+	contactID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid contact ID"})
+		return nil, false
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var contact models.Contact
+	if err := h.db.Preload("Groups").Where("id = ? AND user_id = ?", contactID, userID).First(&contact).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
+		return nil, false
+	}
+	return &contact, true
+}
+
+func (h *ContactHandler) findGroupByID(c *gin.Context, value string) (*models.ContactGroup, bool) {
+	groupID, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid contact group ID"})
+		return nil, false
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var group models.ContactGroup
+	if err := h.db.Where("id = ? AND user_id = ?", groupID, userID).First(&group).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact group not found"})
+		return nil, false
+	}
+	return &group, true
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	unique := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
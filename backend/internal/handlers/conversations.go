@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+	"remote-sim-gateway/internal/websocket"
+)
+
+type ConversationHandler struct {
+	db       *gorm.DB
+	hub      *websocket.Hub
+	inbox    *services.Inbox
+	contacts *services.ContactBook
+}
+
+func NewConversationHandler(db *gorm.DB, hub *websocket.Hub, inbox *services.Inbox, contacts *services.ContactBook) *ConversationHandler {
+	return &ConversationHandler{
+		db:       db,
+		hub:      hub,
+		inbox:    inbox,
+		contacts: contacts,
+	}
+}
+
+// GetConversations lists threads, most recent first, with their last message
+func (h *ConversationHandler) GetConversations(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	deviceID := c.Query("device_id")
+	simID := c.Query("sim_id")
+	phoneNumber := c.Query("phone_number")
+
+	offset := (page - 1) * limit
+	userID, _ := c.Get("user_id")
+
+	var conversations []models.Conversation
+	var total int64
+
+	query := h.db.Where("user_id = ?", userID)
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	if simID != "" {
+		query = query.Where("sim_id = ?", simID)
+	}
+	if phoneNumber != "" {
+		query = query.Where("LOWER(phone_number) LIKE LOWER(?)", "%"+phoneNumber+"%")
+	}
+	if c.Query("unread") == "true" {
+		query = query.Where("unread_count > 0")
+	}
+
+	if err := query.Model(&models.Conversation{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count conversations"})
+		return
+	}
+
+	if err := query.Preload("LastMessage").Offset(offset).Limit(limit).Order("last_message_at DESC").Find(&conversations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch conversations"})
+		return
+	}
+
+	// Link threads to the contacts with the same number
+	phoneNumbers := make([]string, 0, len(conversations))
+	for _, conversation := range conversations {
+		phoneNumbers = append(phoneNumbers, conversation.PhoneNumber)
+	}
+	contacts, err := h.contacts.Lookup(userID.(uint), phoneNumbers)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contacts"})
+		return
+	}
+	for i := range conversations {
+		conversations[i].Contact = contacts[conversations[i].PhoneNumber]
+	}
+
+	var unread int64
+	if err := h.db.Model(&models.Conversation{}).Where("user_id = ? AND unread_count > 0", userID).Count(&unread).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count conversations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conversations": conversations,
+		"unread":        unread,
+		"total":         total,
+		"page":          page,
+		"limit":         limit,
+	})
+}
+
+func (h *ConversationHandler) GetConversation(c *gin.Context) {
+	conversation, ok := h.findConversation(c)
+	if !ok {
+		return
+	}
+
+	if err := h.db.Preload("LastMessage").First(conversation, conversation.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch conversation"})
+		return
+	}
+
+	contacts, err := h.contacts.Lookup(conversation.UserID, []string{conversation.PhoneNumber})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contacts"})
+		return
+	}
+	conversation.Contact = contacts[conversation.PhoneNumber]
+
+	c.JSON(http.StatusOK, conversation)
+}
+
+// GetMessages pages through a thread, newest first
+func (h *ConversationHandler) GetMessages(c *gin.Context) {
+	conversation, ok := h.findConversation(c)
+	if !ok {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset := (page - 1) * limit
+
+	var messages []models.Message
+	var total int64
+
+	query := h.db.Where("conversation_id = ?", conversation.ID)
+
+	if err := query.Model(&models.Message{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count messages"})
+		return
+	}
+
+	if err := query.Offset(offset).Limit(limit).Order("id DESC").Find(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages": messages,
+		"total":    total,
+		"page":     page,
+		"limit":    limit,
+	})
+}
+
+func (h *ConversationHandler) MarkRead(c *gin.Context) {
+	conversation, ok := h.findConversation(c)
+	if !ok {
+		return
+	}
+
+	if err := h.inbox.MarkRead(conversation); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update conversation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Conversation marked as read"})
+}
+
+// Reply sends a message to the thread's number through the SIM the thread
+// is on. It is queued, not rerouted, while that SIM is over quota.
+func (h *ConversationHandler) Reply(c *gin.Context) {
+	conversation, ok := h.findConversation(c)
+	if !ok {
+		return
+	}
+
+	var req models.ConversationReplyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var device models.Device
+	if err := h.db.Where("id = ? AND user_id = ?", conversation.DeviceID, conversation.UserID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	if err := h.hub.CheckCommand(device.DeviceID, "send_sms"); err != nil {
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// Send to the device, or hold it if over quota
+	message, err := h.inbox.Reply(conversation, req.Message)
+	if message == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message"})
+		return
+	}
+	if err != nil {
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error(), "id": message.ID})
+		return
+	}
+
+	if message.Status == "queued" {
+		c.JSON(http.StatusAccepted, models.SMSResponse{
+			ID:          message.ID,
+			PhoneNumber: message.PhoneNumber,
+			Status:      message.Status,
+			Message:     heldMessage(message),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SMSResponse{
+		ID:          message.ID,
+		PhoneNumber: message.PhoneNumber,
+		Status:      message.Status,
+	})
+}
+
+// findConversation loads the user's conversation from the :id parameter, or
+// responds with an error if there is none
+func (h *ConversationHandler) findConversation(c *gin.Context) (*models.Conversation, bool) {
+	conversationID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+		return nil, false
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var conversation models.Conversation
+	if err := h.db.Where("id = ? AND user_id = ?", conversationID, userID).First(&conversation).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return nil, false
+	}
+	return &conversation, true
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+)
+
+// Most items GetRecentActivity returns
+const maxActivityLimit = 50
+
+type DashboardHandler struct {
+	db *gorm.DB
+}
+
+func NewDashboardHandler(db *gorm.DB) *DashboardHandler {
+	return &DashboardHandler{
+		db: db,
+	}
+}
+
+// activityItem is a message or call in the recent activity feed
+type activityItem struct {
+	Type        string    `json:"type"` // sms or call
+	ID          uint      `json:"id"`
+	PhoneNumber string    `json:"phone_number"`
+	Status      string    `json:"status"`
+	Direction   string    `json:"direction,omitempty"`
+	DeviceID    uint      `json:"device_id"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// GetStats compares today's traffic (UTC) with yesterday's. The success
+// rate is the share of messages the radio sent, the delivery rate the share
+// of delivery reports that said delivered.
+func (h *DashboardHandler) GetStats(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	yesterday := today.AddDate(0, 0, -1)
+
+	messagesToday, err := h.messageCounts(userID, today, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch message statistics"})
+		return
+	}
+	messagesYesterday, err := h.messageCounts(userID, yesterday, today)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch message statistics"})
+		return
+	}
+
+	var callsToday, callsYesterday int64
+	calls := h.db.Model(&models.Call{}).Where("user_id = ?", userID)
+	if err := calls.Session(&gorm.Session{}).Where("created_at >= ?", today).Count(&callsToday).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch call statistics"})
+		return
+	}
+	if err := calls.Session(&gorm.Session{}).Where("created_at >= ? AND created_at < ?", yesterday, today).Count(&callsYesterday).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch call statistics"})
+		return
+	}
+
+	var devices, onlineDevices int64
+	deviceQuery := h.db.Model(&models.Device{}).Where("user_id = ?", userID)
+	if err := deviceQuery.Session(&gorm.Session{}).Count(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch device statistics"})
+		return
+	}
+	if err := deviceQuery.Session(&gorm.Session{}).Where("is_online = ?", true).Count(&onlineDevices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch device statistics"})
+		return
+	}
+
+	successToday, successYesterday := successRate(messagesToday), successRate(messagesYesterday)
+	deliveryToday, deliveryYesterday := deliveryRate(messagesToday), deliveryRate(messagesYesterday)
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages_today":       sumCounts(messagesToday),
+		"messages_growth":      growth(sumCounts(messagesToday), sumCounts(messagesYesterday)),
+		"calls_today":          callsToday,
+		"calls_growth":         growth(callsToday, callsYesterday),
+		"success_rate":         successToday,
+		"success_rate_change":  round1(successToday - successYesterday),
+		"delivered_today":      messagesToday["delivered"],
+		"undelivered_today":    messagesToday["undelivered"],
+		"delivery_rate":        deliveryToday,
+		"delivery_rate_change": round1(deliveryToday - deliveryYesterday),
+		"devices":              devices,
+		"online_devices":       onlineDevices,
+	})
+}
+
+// GetRecentActivity lists the latest messages and calls, newest first
+func (h *DashboardHandler) GetRecentActivity(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if limit <= 0 {
+		limit = 10
+	}
+	if limit > maxActivityLimit {
+		limit = maxActivityLimit
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var messages []models.Message
+	if err := h.db.Where("user_id = ?", userID).Order("created_at DESC").Limit(limit).Find(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+
+	var calls []models.Call
+	if err := h.db.Where("user_id = ?", userID).Order("created_at DESC").Limit(limit).Find(&calls).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch calls"})
+		return
+	}
+
+	activity := make([]activityItem, 0, len(messages)+len(calls))
+	for _, message := range messages {
+		activity = append(activity, activityItem{
+			Type:        "sms",
+			ID:          message.ID,
+			PhoneNumber: message.PhoneNumber,
+			Status:      message.Status,
+			Direction:   message.Direction,
+			DeviceID:    message.DeviceID,
+			CreatedAt:   message.CreatedAt,
+		})
+	}
+	for _, call := range calls {
+		activity = append(activity, activityItem{
+			Type:        "call",
+			ID:          call.ID,
+			PhoneNumber: call.PhoneNumber,
+			Status:      call.Status,
+			DeviceID:    call.DeviceID,
+			CreatedAt:   call.CreatedAt,
+		})
+	}
+
+	sort.SliceStable(activity, func(i, j int) bool {
+		return activity[i].CreatedAt.After(activity[j].CreatedAt)
+	})
+	if len(activity) > limit {
+		activity = activity[:limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{"activity": activity})
+}
+
+// messageCounts counts the user's outbound messages created in [from, to)
+// by status
+func (h *DashboardHandler) messageCounts(userID interface{}, from, to time.Time) (map[string]int64, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	err := h.db.Model(&models.Message{}).
+		Select("status, COUNT(*) AS count").
+		Where("user_id = ? AND direction = ? AND created_at >= ? AND created_at < ?", userID, models.MessageOutbound, from, to).
+		Group("status").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+func sumCounts(counts map[string]int64) int64 {
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
+
+// successRate is the percentage of messages with a result from the radio
+// that it sent
+func successRate(counts map[string]int64) float64 {
+	sent := counts["sent"] + counts["delivered"] + counts["undelivered"]
+	return percent(sent, sent+counts["failed"])
+}
+
+// deliveryRate is the percentage of delivery reports that said delivered;
+// messages from devices without delivery_reports don't count
+func deliveryRate(counts map[string]int64) float64 {
+	return percent(counts["delivered"], counts["delivered"]+counts["undelivered"])
+}
+
+func growth(current, previous int64) float64 {
+	return percent(current-previous, previous)
+}
+
+func percent(part, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return round1(float64(part) / float64(whole) * 100)
+}
+
+func round1(value float64) float64 {
+	return math.Round(value*10) / 10
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -8,18 +9,21 @@ import (
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
 	"remote-sim-gateway/internal/websocket"
 )
 
 type DeviceHandler struct {
-	db  *gorm.DB
-	hub *websocket.Hub
+	db     *gorm.DB
+	hub    *websocket.Hub
+	quotas *services.QuotaTracker
 }
 
-func NewDeviceHandler(db *gorm.DB, hub *websocket.Hub) *DeviceHandler {
+func NewDeviceHandler(db *gorm.DB, hub *websocket.Hub, quotas *services.QuotaTracker) *DeviceHandler {
 	return &DeviceHandler{
-		db:  db,
-		hub: hub,
+		db:     db,
+		hub:    hub,
+		quotas: quotas,
 	}
 }
 
@@ -27,25 +31,61 @@ func (h *DeviceHandler) GetDevices(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 
 	var devices []models.Device
-	if err := h.db.Where("user_id = ?", userID).Find(&devices).Error; err != nil {
+	if err := h.db.Preload("SIMs", orderBySlot).Where("user_id = ?", userID).Find(&devices).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
 		return
 	}
 
-	// Update online status based on WebSocket connections
-	connectedDevices := h.hub.GetConnectedDevices()
+	if err := h.loadUsage(devices); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quota usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"devices": devices})
+}
+
+// loadUsage fills in the quota usage of the devices and their preloaded
+// SIMs, with one query for the devices and one for the SIMs
+func (h *DeviceHandler) loadUsage(devices []models.Device) error {
+	now := time.Now().UTC()
+
+	var deviceIDs, simIDs []uint
+	for _, device := range devices {
+		deviceIDs = append(deviceIDs, device.ID)
+		for _, sim := range device.SIMs {
+			simIDs = append(simIDs, sim.ID)
+		}
+	}
+
+	deviceUsage, err := h.quotas.DeviceUsages(deviceIDs, now)
+	if err != nil {
+		return err
+	}
+	simUsage, err := h.quotas.SIMUsages(simIDs, now)
+	if err != nil {
+		return err
+	}
+
 	for i := range devices {
-		devices[i].IsOnline = false
-		for _, connectedID := range connectedDevices {
-			if devices[i].DeviceID == connectedID {
-				devices[i].IsOnline = true
-				devices[i].LastSeenAt = time.Now()
-				break
-			}
+		devices[i].Usage = deviceUsage[devices[i].ID]
+		for j := range devices[i].SIMs {
+			devices[i].SIMs[j].Usage = simUsage[devices[i].SIMs[j].ID]
 		}
 	}
+	return nil
+}
 
-	c.JSON(http.StatusOK, gin.H{"devices": devices})
+// quotaColumns are the columns a QuotaRequest edits
+func quotaColumns(quota models.Quota) map[string]interface{} {
+	return map[string]interface{}{
+		"daily_limit":      quota.DailyLimit,
+		"monthly_limit":    quota.MonthlyLimit,
+		"per_minute_limit": quota.PerMinuteLimit,
+	}
+}
+
+func (h *DeviceHandler) GetHubStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.hub.GetHubStats())
 }
 
 func (h *DeviceHandler) RegisterDevice(c *gin.Context) {
@@ -69,8 +109,8 @@ func (h *DeviceHandler) RegisterDevice(c *gin.Context) {
 		Name:        req.Name,
 		PhoneNumber: req.PhoneNumber,
 		UserID:      userID.(uint),
-		IsOnline:    false,
-		LastSeenAt:  time.Now(),
+		IsOnline:    h.hub.IsDeviceConnected(req.DeviceID),
+		LastSeenAt:  time.Now().UTC(),
 	}
 
 	if err := h.db.Create(&device).Error; err != nil {
@@ -112,8 +152,13 @@ func (h *DeviceHandler) UpdateDevice(c *gin.Context) {
 	if req.PhoneNumber != "" {
 		device.PhoneNumber = req.PhoneNumber
 	}
+	req.QuotaRequest.Apply(&device.Quota)
 
-	if err := h.db.Save(&device).Error; err != nil {
+	// Only the editable columns, so presence the hub stored meanwhile stays
+	columns := quotaColumns(device.Quota)
+	columns["name"] = device.Name
+	columns["phone_number"] = device.PhoneNumber
+	if err := h.db.Model(&device).Updates(columns).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device"})
 		return
 	}
@@ -145,4 +190,235 @@ func (h *DeviceHandler) DeleteDevice(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Device deleted successfully"})
+}
+
+func (h *DeviceHandler) GetTelemetry(c *gin.Context) {
+	deviceID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device ID"})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var device models.Device
+	if err := h.db.Where("id = ? AND user_id = ?", deviceID, userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	// Default to the last 24 hours
+	to := time.Now()
+	if raw := c.Query("to"); raw != "" {
+		if to, err = parseTimeParam(raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' time: use RFC 3339 or unix seconds"})
+			return
+		}
+	}
+
+	from := to.Add(-24 * time.Hour)
+	if raw := c.Query("from"); raw != "" {
+		if from, err = parseTimeParam(raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' time: use RFC 3339 or unix seconds"})
+			return
+		}
+	}
+
+	if from.After(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "'from' must be before 'to'"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	if limit <= 0 || limit > maxTelemetryPoints {
+		limit = maxTelemetryPoints
+	}
+
+	var telemetry []models.DeviceTelemetry
+	err = h.db.Where("device_id = ? AND recorded_at >= ? AND recorded_at <= ?", device.ID, from.UTC(), to.UTC()).
+		Order("recorded_at ASC").
+		Limit(limit).
+		Find(&telemetry).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch telemetry"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"device_id": device.ID,
+		"from":      from,
+		"to":        to,
+		"telemetry": telemetry,
+	})
+}
+
+// GetSIMs lists the device's SIMs with the traffic sent through each, over
+// all time or between the optional from/to
+func (h *DeviceHandler) GetSIMs(c *gin.Context) {
+	deviceID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device ID"})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var device models.Device
+	if err := h.db.Preload("SIMs", orderBySlot).Where("id = ? AND user_id = ?", deviceID, userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	messages := h.db.Model(&models.Message{}).Where("device_id = ?", device.ID)
+	calls := h.db.Model(&models.Call{}).Where("device_id = ?", device.ID)
+	if raw := c.Query("from"); raw != "" {
+		from, err := parseTimeParam(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' time: use RFC 3339 or unix seconds"})
+			return
+		}
+		messages = messages.Where("created_at >= ?", from.UTC())
+		calls = calls.Where("created_at >= ?", from.UTC())
+	}
+	if raw := c.Query("to"); raw != "" {
+		to, err := parseTimeParam(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' time: use RFC 3339 or unix seconds"})
+			return
+		}
+		messages = messages.Where("created_at <= ?", to.UTC())
+		calls = calls.Where("created_at <= ?", to.UTC())
+	}
+
+	var messageCounts []struct {
+		SIMID  uint `gorm:"column:sim_id"`
+		Status string
+		Count  int64
+	}
+	if err := messages.Select("sim_id, status, COUNT(*) AS count").Where("sim_id IS NOT NULL").Group("sim_id, status").Scan(&messageCounts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch SIM statistics"})
+		return
+	}
+
+	var callCounts []struct {
+		SIMID   uint `gorm:"column:sim_id"`
+		Count   int64
+		Seconds int64
+	}
+	if err := calls.Select("sim_id, COUNT(*) AS count, COALESCE(SUM(duration), 0) AS seconds").Where("sim_id IS NOT NULL").Group("sim_id").Scan(&callCounts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch SIM statistics"})
+		return
+	}
+
+	devices := []models.Device{device}
+	if err := h.loadUsage(devices); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quota usage"})
+		return
+	}
+	device = devices[0]
+
+	stats := make([]models.SIMStats, len(device.SIMs))
+	index := make(map[uint]*models.SIMStats, len(device.SIMs))
+	for i, sim := range device.SIMs {
+		stats[i].SIM = sim
+		index[sim.ID] = &stats[i]
+	}
+
+	for _, row := range messageCounts {
+		simStats, ok := index[row.SIMID]
+		if !ok {
+			continue
+		}
+		switch row.Status {
+		case "sent":
+			simStats.MessagesSent += row.Count
+		case "delivered":
+			simStats.MessagesDelivered += row.Count
+		case "undelivered":
+			simStats.MessagesUndelivered += row.Count
+		case "failed":
+			simStats.MessagesFailed += row.Count
+		case "pending":
+			simStats.MessagesPending += row.Count
+		}
+	}
+
+	for _, row := range callCounts {
+		if simStats, ok := index[row.SIMID]; ok {
+			simStats.Calls = row.Count
+			simStats.CallSeconds = row.Seconds
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"device_id": device.ID,
+		"sims":      stats,
+	})
+}
+
+// UpdateSIM sets the quota limits of one of the device's SIMs
+func (h *DeviceHandler) UpdateSIM(c *gin.Context) {
+	deviceID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device ID"})
+		return
+	}
+
+	simID, err := strconv.ParseUint(c.Param("sim_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SIM ID"})
+		return
+	}
+
+	var req models.QuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var sim models.SIM
+	err = h.db.Joins("JOIN devices ON devices.id = sims.device_id").
+		Where("sims.id = ? AND sims.device_id = ? AND devices.user_id = ?", simID, deviceID, userID).
+		First(&sim).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SIM not found"})
+		return
+	}
+
+	req.Apply(&sim.Quota)
+
+	// Only the limits, so the status the device reported meanwhile stays
+	if err := h.db.Model(&sim).Updates(quotaColumns(sim.Quota)).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update SIM"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "SIM updated successfully",
+		"sim":     sim,
+	})
+}
+
+const maxTelemetryPoints = 10000
+
+// parseTimeParam accepts RFC 3339 timestamps or unix seconds
+func parseTimeParam(raw string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// commandErrorStatus maps a hub routing error to an HTTP status code
+func commandErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, websocket.ErrCommandNotSupported):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, websocket.ErrDeviceNotConnected), errors.Is(err, websocket.ErrSendQueueFull):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
 }
\ No newline at end of file
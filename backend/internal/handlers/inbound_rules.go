@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+)
+
+// Longest regular expression accepted in a rule
+const maxRulePatternLength = 500
+
+type InboundRuleHandler struct {
+	db       *gorm.DB
+	contacts *services.ContactBook
+}
+
+func NewInboundRuleHandler(db *gorm.DB, contacts *services.ContactBook) *InboundRuleHandler {
+	return &InboundRuleHandler{
+		db:       db,
+		contacts: contacts,
+	}
+}
+
+// GetRules lists the user's rules in the order they run
+func (h *InboundRuleHandler) GetRules(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var rules []models.InboundRule
+	if err := h.db.Where("user_id = ?", userID).Order("priority, id").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch inbound rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func (h *InboundRuleHandler) CreateRule(c *gin.Context) {
+	var req models.InboundRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	rule := models.InboundRule{UserID: userID.(uint), Enabled: true}
+	if msg := h.applyRuleRequest(&rule, req); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	if err := h.db.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create inbound rule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Inbound rule created successfully",
+		"rule":    rule,
+	})
+}
+
+func (h *InboundRuleHandler) UpdateRule(c *gin.Context) {
+	rule, ok := h.findRule(c)
+	if !ok {
+		return
+	}
+
+	var req models.InboundRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if msg := h.applyRuleRequest(rule, req); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	if err := h.db.Save(rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update inbound rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Inbound rule updated successfully",
+		"rule":    rule,
+	})
+}
+
+func (h *InboundRuleHandler) DeleteRule(c *gin.Context) {
+	rule, ok := h.findRule(c)
+	if !ok {
+		return
+	}
+
+	if err := h.db.Delete(rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete inbound rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Inbound rule deleted successfully"})
+}
+
+func (h *InboundRuleHandler) findRule(c *gin.Context) (*models.InboundRule, bool) {
+	ruleID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid inbound rule ID"})
+		return nil, false
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var rule models.InboundRule
+	if err := h.db.Where("id = ? AND user_id = ?", ruleID, userID).First(&rule).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Inbound rule not found"})
+		return nil, false
+	}
+	return &rule, true
+}
+
+// applyRuleRequest validates req and copies it into rule, normalizing
+// keywords and targets. It returns a user-facing error message, or "" if
+// the rule is valid.
+func (h *InboundRuleHandler) applyRuleRequest(rule *models.InboundRule, req models.InboundRuleRequest) string {
+	if req.SIMID != nil {
+		var sim models.SIM
+		err := h.db.Joins("JOIN devices ON devices.id = sims.device_id").
+			Where("sims.id = ? AND devices.user_id = ?", *req.SIMID, rule.UserID).
+			First(&sim).Error
+		if err != nil {
+			return "SIM not found"
+		}
+	}
+
+	var keywords models.StringList
+	for _, keyword := range req.Keywords {
+		keyword = strings.TrimSpace(keyword)
+		if keyword == "" {
+			continue
+		}
+		if strings.ContainsAny(keyword, " \t,") {
+			return "Keywords must be single words"
+		}
+		if !keywords.Contains(strings.ToUpper(keyword)) {
+			keywords = append(keywords, strings.ToUpper(keyword))
+		}
+	}
+
+	if len(req.Pattern) > maxRulePatternLength {
+		return "Pattern must be at most 500 characters"
+	}
+	if _, err := regexp.Compile(req.Pattern); err != nil {
+		return "Invalid pattern: " + err.Error()
+	}
+
+	target := strings.TrimSpace(req.Target)
+	switch req.Action {
+	case models.InboundActionReply:
+		if strings.TrimSpace(req.Template) == "" {
+			return "Reply rules need a template"
+		}
+	case models.InboundActionWebhook:
+		if err := services.ValidateWebhookURL(target); err != nil {
+			return "Target " + err.Error()
+		}
+	case models.InboundActionForwardSMS:
+		normalized, err := h.contacts.NormalizeNumber(target)
+		if err != nil {
+			return "Target must be a valid phone number: " + err.Error()
+		}
+		target = normalized
+	case models.InboundActionForwardEmail:
+		if _, err := mail.ParseAddress(target); err != nil {
+			return "Target must be a valid email address"
+		}
+	case models.InboundActionTag:
+		tags, err := services.NormalizeTags([]string{target})
+		if err != nil {
+			return err.Error()
+		}
+		if len(tags) != 1 {
+			return "Target must be a single tag"
+		}
+		target = tags[0]
+	case models.InboundActionOptOut:
+		target = ""
+	}
+
+	rule.Name = req.Name
+	rule.Priority = req.Priority
+	rule.Keywords = keywords
+	rule.Pattern = req.Pattern
+	rule.Sender = strings.TrimSpace(req.Sender)
+	rule.SIMID = req.SIMID
+	rule.Action = req.Action
+	rule.Target = target
+	rule.Template = req.Template
+	rule.StopProcessing = req.StopProcessing
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"remote-sim-gateway/internal/services"
+)
+
+type MediaHandler struct {
+	media *services.MediaStore
+}
+
+func NewMediaHandler(media *services.MediaStore) *MediaHandler {
+	return &MediaHandler{
+		media: media,
+	}
+}
+
+// Upload stores a file sent as the "file" form field for use in MMS
+func (h *MediaHandler) Upload(c *gin.Context) {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A media file is required"})
+		return
+	}
+	if fileHeader.Size > int64(h.media.MaxSize()) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File must be at most %d bytes", h.media.MaxSize())})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, int64(h.media.MaxSize())+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	media, err := h.media.Save(userID.(uint), fileHeader.Filename, data)
+	switch {
+	case errors.Is(err, services.ErrMediaTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File must be at most %d bytes", h.media.MaxSize())})
+		return
+	case errors.Is(err, services.ErrMediaType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Only " + strings.Join(h.media.AllowedTypes(), ", ") + " files are allowed"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, media)
+}
+
+// Download serves media to devices through the signed URL in send_mms; it
+// needs no other authentication
+func (h *MediaHandler) Download(c *gin.Context) {
+	mediaID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+
+	media, path, err := h.media.Open(uint(mediaID), c.Query("expires"), c.Query("signature"))
+	switch {
+	case errors.Is(err, services.ErrMediaSignature):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired link"})
+		return
+	case err != nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+
+	c.Header("Content-Type", media.ContentType)
+	c.Header("Cache-Control", "private, no-store")
+	c.File(path)
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+)
+
+// Largest recipient file accepted
+const maxRecipientFileSize = 10 << 20
+
+type RecipientUploadHandler struct {
+	db     *gorm.DB
+	config config.RecipientsConfig
+}
+
+func NewRecipientUploadHandler(db *gorm.DB, recipientsConfig config.RecipientsConfig) *RecipientUploadHandler {
+	return &RecipientUploadHandler{
+		db:     db,
+		config: recipientsConfig,
+	}
+}
+
+// UploadRecipients validates a CSV or XLSX recipient list sent as the "file"
+// form field. phone_column names the phone number column, and variables maps
+// template variables to columns ("name,city" or "first_name=First Name").
+// The cleaned list is stored and its report returned; nothing is sent until
+// the upload_id is passed to send-bulk-sms.
+func (h *RecipientUploadHandler) UploadRecipients(c *gin.Context) {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A CSV or XLSX file is required"})
+		return
+	}
+	if fileHeader.Size > maxRecipientFileSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File must be at most 10 MB"})
+		return
+	}
+
+	variables, err := services.ParseVariableMapping(c.PostForm("variables"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxRecipientFileSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	rows, err := services.ReadSpreadsheet(fileHeader.Filename, data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	mapping := services.RecipientMapping{
+		PhoneColumn: c.PostForm("phone_column"),
+		Variables:   variables,
+	}
+	report, err := services.ParseRecipients(rows, mapping, h.config.DefaultCountryCode, h.config.MaxRows)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	upload := models.RecipientUpload{
+		UserID:        userID.(uint),
+		FileName:      fileHeader.Filename,
+		PhoneColumn:   report.PhoneColumn,
+		TotalRows:     report.TotalRows,
+		ValidRows:     len(report.Recipients),
+		InvalidRows:   report.InvalidCount,
+		DuplicateRows: report.DuplicateCount,
+		Recipients:    report.Recipients,
+	}
+	for name := range variables {
+		upload.Variables = append(upload.Variables, name)
+	}
+	sort.Strings(upload.Variables)
+
+	if err := h.db.Create(&upload).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save recipient list"})
+		return
+	}
+
+	// Show the first few rows as they will be sent
+	preview := report.Recipients
+	if len(preview) > 10 {
+		preview = preview[:10]
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"upload":     upload,
+		"invalid":    report.Invalid,
+		"duplicates": report.Duplicates,
+		"preview":    preview,
+	})
+}
+
+func (h *RecipientUploadHandler) GetUpload(c *gin.Context) {
+	uploadID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload ID"})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var upload models.RecipientUpload
+	if err := h.db.Where("id = ? AND user_id = ?", uploadID, userID).First(&upload).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, upload)
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+	"remote-sim-gateway/internal/websocket"
+)
+
+// resolveDevice returns the user's online device to send through, with its
+// SIMs loaded: the requested device, the device holding the requested SIM, or
+// one picked by carrier. It returns a user-facing message if there is none.
+func resolveDevice(db *gorm.DB, router *services.SIMRouter, userID interface{}, deviceID uint, simID *uint, phoneNumber string) (*models.Device, string) {
+	if deviceID == 0 && simID != nil {
+		var sim models.SIM
+		err := db.Joins("JOIN devices ON devices.id = sims.device_id").
+			Where("sims.id = ? AND devices.user_id = ?", *simID, userID).
+			First(&sim).Error
+		if err != nil {
+			return nil, "SIM not found"
+		}
+		deviceID = sim.DeviceID
+	}
+
+	if deviceID == 0 {
+		var devices []models.Device
+		err := db.Preload("SIMs", orderBySlot).
+			Where("user_id = ? AND is_online = ?", userID, true).
+			Order("id").Find(&devices).Error
+		if err != nil || len(devices) == 0 {
+			return nil, "No online device available"
+		}
+		return router.SelectDevice(devices, phoneNumber), ""
+	}
+
+	var device models.Device
+	if err := db.Preload("SIMs", orderBySlot).Where("id = ? AND user_id = ? AND is_online = ?", deviceID, userID, true).First(&device).Error; err != nil {
+		return nil, "Device not found or offline"
+	}
+	return &device, ""
+}
+
+// resolveCapableDevice is resolveDevice for commands not every device
+// supports: when no device or SIM was requested it only picks among online
+// devices that can run command. On failure it returns a status and message.
+func resolveCapableDevice(db *gorm.DB, hub *websocket.Hub, router *services.SIMRouter, userID interface{}, deviceID uint, simID *uint, phoneNumber, command string) (*models.Device, int, string) {
+	if deviceID != 0 || simID != nil {
+		device, errMsg := resolveDevice(db, router, userID, deviceID, simID, phoneNumber)
+		if device == nil {
+			return nil, http.StatusBadRequest, errMsg
+		}
+		if err := hub.CheckCommand(device.DeviceID, command); err != nil {
+			return nil, commandErrorStatus(err), err.Error()
+		}
+		return device, 0, ""
+	}
+
+	var devices []models.Device
+	err := db.Preload("SIMs", orderBySlot).
+		Where("user_id = ? AND is_online = ?", userID, true).
+		Order("id").Find(&devices).Error
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Failed to fetch devices"
+	}
+
+	capable := make([]models.Device, 0, len(devices))
+	for _, device := range devices {
+		if hub.CheckCommand(device.DeviceID, command) == nil {
+			capable = append(capable, device)
+		}
+	}
+	if len(capable) == 0 {
+		return nil, http.StatusUnprocessableEntity, fmt.Sprintf("No online device supports %s", command)
+	}
+	return router.SelectDevice(capable, phoneNumber), 0, ""
+}
+
+// selectSIM returns the requested SIM of the device, or routes by carrier if
+// none was requested. A nil SIM means the device hasn't reported its SIMs and
+// will use its default one. On failure it returns a status and message.
+func selectSIM(hub *websocket.Hub, router *services.SIMRouter, device *models.Device, simID *uint, simSlot *int, phoneNumber string) (*models.SIM, int, string) {
+	if simID == nil && simSlot == nil {
+		return router.SelectSIM(device.SIMs, phoneNumber), 0, ""
+	}
+
+	if !hub.HasCapability(device.DeviceID, websocket.CapabilityDualSIM) {
+		return nil, http.StatusUnprocessableEntity, "Device does not support choosing a SIM"
+	}
+
+	for i := range device.SIMs {
+		sim := &device.SIMs[i]
+		if (simID != nil && sim.ID == *simID) || (simID == nil && sim.Slot == *simSlot) {
+			if sim.Status != models.SIMStatusReady {
+				return nil, http.StatusBadRequest, fmt.Sprintf("SIM in slot %d is not ready (%s)", sim.Slot, sim.Status)
+			}
+			return sim, 0, ""
+		}
+	}
+	return nil, http.StatusBadRequest, "SIM not found on device"
+}
+
+// pinnedTo records what the sender chose explicitly, so the dispatcher
+// doesn't reroute it when over quota
+func pinnedTo(deviceID uint, simID *uint, simSlot *int) string {
+	switch {
+	case simID != nil || simSlot != nil:
+		return models.PinnedToSIM
+	case deviceID != 0:
+		return models.PinnedToDevice
+	default:
+		return ""
+	}
+}
+
+// heldMessage explains a queued message in API responses
+func heldMessage(message *models.Message) string {
+	held := "Queued"
+	if message.HeldUntil != nil {
+		held += " until " + message.HeldUntil.Format(time.RFC3339)
+	}
+	if message.ExpiresAt != nil {
+		held += ", expires at " + message.ExpiresAt.Format(time.RFC3339)
+	}
+	return held
+}
+
+// messageExpiry turns a request's valid_until or ttl into the message's
+// expiry, or returns a user-facing error message
+func messageExpiry(validUntil *time.Time, ttl int) (*time.Time, string) {
+	if validUntil != nil && ttl != 0 {
+		return nil, "Set either valid_until or ttl, not both"
+	}
+	now := time.Now().UTC()
+	switch {
+	case ttl < 0:
+		return nil, "ttl must be a positive number of seconds"
+	case ttl > 0:
+		expiresAt := now.Add(time.Duration(ttl) * time.Second)
+		return &expiresAt, ""
+	case validUntil != nil:
+		if !validUntil.After(now) {
+			return nil, "valid_until must be in the future"
+		}
+		expiresAt := validUntil.UTC()
+		return &expiresAt, ""
+	}
+	return nil, ""
+}
+
+func simID(sim *models.SIM) *uint {
+	if sim == nil {
+		return nil
+	}
+	return &sim.ID
+}
+
+func orderBySlot(db *gorm.DB) *gorm.DB {
+	return db.Order("slot")
+}
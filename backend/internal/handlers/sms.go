@@ -1,24 +1,36 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
 	"remote-sim-gateway/internal/websocket"
 )
 
 type SMSHandler struct {
-	db  *gorm.DB
-	hub *websocket.Hub
+	db         *gorm.DB
+	hub        *websocket.Hub
+	router     *services.SIMRouter
+	dispatcher *services.Dispatcher
+	bulkSender *services.BulkSender
+	contacts   *services.ContactBook
+	media      *services.MediaStore
 }
 
-func NewSMSHandler(db *gorm.DB, hub *websocket.Hub) *SMSHandler {
+func NewSMSHandler(db *gorm.DB, hub *websocket.Hub, router *services.SIMRouter, dispatcher *services.Dispatcher, bulkSender *services.BulkSender, contacts *services.ContactBook, media *services.MediaStore) *SMSHandler {
 	return &SMSHandler{
-		db:  db,
-		hub: hub,
+		db:         db,
+		hub:        hub,
+		router:     router,
+		dispatcher: dispatcher,
+		bulkSender: bulkSender,
+		contacts:   contacts,
+		media:      media,
 	}
 }
 
@@ -29,22 +41,40 @@ func (h *SMSHandler) SendSMS(c *gin.Context) {
 		return
 	}
 
+	expiresAt, errMsg := messageExpiry(req.ValidUntil, req.TTL)
+	if errMsg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errMsg})
+		return
+	}
+
 	userID, _ := c.Get("user_id")
+
+	optedOut, err := h.contacts.OptedOut(userID.(uint), []string{req.PhoneNumber})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check opt-outs"})
+		return
+	}
+	if optedOut[req.PhoneNumber] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Recipient has opted out"})
+		return
+	}
 	
-	// Get available device if not specified
-	if req.DeviceID == 0 {
-		var device models.Device
-		if err := h.db.Where("user_id = ? AND is_online = ?", userID, true).First(&device).Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "No online device available"})
-			return
-		}
-		req.DeviceID = device.ID
+	// Pick a device if not specified and verify it belongs to the user and is online
+	device, errMsg := resolveDevice(h.db, h.router, userID, req.DeviceID, req.SIMID, req.PhoneNumber)
+	if device == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errMsg})
+		return
 	}
 
-	// Verify device belongs to user and is online
-	var device models.Device
-	if err := h.db.Where("id = ? AND user_id = ? AND is_online = ?", req.DeviceID, userID, true).First(&device).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Device not found or offline"})
+	// Refuse early if the device can't handle SMS
+	if err := h.hub.CheckCommand(device.DeviceID, "send_sms"); err != nil {
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	sim, status, errMsg := selectSIM(h.hub, h.router, device, req.SIMID, req.SIMSlot, req.PhoneNumber)
+	if errMsg != "" {
+		c.JSON(status, gin.H{"error": errMsg})
 		return
 	}
 
@@ -53,8 +83,15 @@ func (h *SMSHandler) SendSMS(c *gin.Context) {
 		PhoneNumber: req.PhoneNumber,
 		Content:     req.Message,
 		Status:      "pending",
-		DeviceID:    req.DeviceID,
+		DeviceID:    device.ID,
+		SIMID:       simID(sim),
 		UserID:      userID.(uint),
+		PinnedTo:    pinnedTo(req.DeviceID, req.SIMID, req.SIMSlot),
+		ExpiresAt:   expiresAt,
+		Priority:    req.Priority,
+	}
+	if message.Priority == "" {
+		message.Priority = models.PriorityNormal
 	}
 
 	if err := h.db.Create(&message).Error; err != nil {
@@ -62,23 +99,123 @@ func (h *SMSHandler) SendSMS(c *gin.Context) {
 		return
 	}
 
-	// Send to device via WebSocket
-	wsMessage := websocket.Message{
-		Type: "send_sms",
-		Data: map[string]interface{}{
-			"id":           message.ID,
-			"phone_number": req.PhoneNumber,
-			"message":      req.Message,
-			"device_id":    device.DeviceID,
-		},
+	// Send to the device, or hold it if over quota
+	if err := h.dispatcher.SendSMS(&message, device, sim); err != nil {
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error(), "id": message.ID})
+		return
 	}
 
-	h.hub.SendToDevice(device.DeviceID, wsMessage)
+	if message.Status == "queued" {
+		c.JSON(http.StatusAccepted, models.SMSResponse{
+			ID:          message.ID,
+			PhoneNumber: req.PhoneNumber,
+			Status:      message.Status,
+			Message:     heldMessage(&message),
+		})
+		return
+	}
 
 	c.JSON(http.StatusOK, models.SMSResponse{
 		ID:          message.ID,
 		PhoneNumber: req.PhoneNumber,
+		Status:      message.Status,
+	})
+}
+
+// SendMMS sends media uploaded with POST /api/media, through a device with
+// the mms capability. The message is tracked like an SMS.
+func (h *SMSHandler) SendMMS(c *gin.Context) {
+	var req models.SendMMSRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	expiresAt, errMsg := messageExpiry(req.ValidUntil, req.TTL)
+	if errMsg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errMsg})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	attachments, err := h.media.Attachments(userID.(uint), req.MediaIDs)
+	switch {
+	case errors.Is(err, services.ErrMediaNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Media file not found"})
+		return
+	case errors.Is(err, services.ErrMediaTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Attachments are too large for one MMS"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load attachments"})
+		return
+	}
+
+	optedOut, err := h.contacts.OptedOut(userID.(uint), []string{req.PhoneNumber})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check opt-outs"})
+		return
+	}
+	if optedOut[req.PhoneNumber] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Recipient has opted out"})
+		return
+	}
+
+	device, status, errMsg := resolveCapableDevice(h.db, h.hub, h.router, userID, req.DeviceID, req.SIMID, req.PhoneNumber, "send_mms")
+	if device == nil {
+		c.JSON(status, gin.H{"error": errMsg})
+		return
+	}
+
+	sim, status, errMsg := selectSIM(h.hub, h.router, device, req.SIMID, req.SIMSlot, req.PhoneNumber)
+	if errMsg != "" {
+		c.JSON(status, gin.H{"error": errMsg})
+		return
+	}
+
+	message := models.Message{
+		PhoneNumber: req.PhoneNumber,
+		Content:     req.Message,
+		Type:        models.MessageTypeMMS,
+		Subject:     req.Subject,
+		Attachments: attachments,
 		Status:      "pending",
+		DeviceID:    device.ID,
+		SIMID:       simID(sim),
+		UserID:      userID.(uint),
+		PinnedTo:    pinnedTo(req.DeviceID, req.SIMID, req.SIMSlot),
+		ExpiresAt:   expiresAt,
+		Priority:    req.Priority,
+	}
+	if message.Priority == "" {
+		message.Priority = models.PriorityNormal
+	}
+
+	if err := h.db.Create(&message).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message"})
+		return
+	}
+
+	if err := h.dispatcher.SendSMS(&message, device, sim); err != nil {
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error(), "id": message.ID})
+		return
+	}
+
+	if message.Status == "queued" {
+		c.JSON(http.StatusAccepted, models.SMSResponse{
+			ID:          message.ID,
+			PhoneNumber: req.PhoneNumber,
+			Status:      message.Status,
+			Message:     heldMessage(&message),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SMSResponse{
+		ID:          message.ID,
+		PhoneNumber: req.PhoneNumber,
+		Status:      message.Status,
 	})
 }
 
@@ -89,65 +226,204 @@ func (h *SMSHandler) SendBulkSMS(c *gin.Context) {
 		return
 	}
 
+	sources := 0
+	for _, set := range []bool{len(req.PhoneNumbers) > 0, req.UploadID != nil, req.GroupID != nil || req.TagQuery != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Send to one of phone_numbers, upload_id or group_id/tag_query"})
+		return
+	}
+	if sources == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one phone number is required"})
+		return
+	}
+
+	expiresAt, errMsg := messageExpiry(req.ValidUntil, req.TTL)
+	if errMsg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errMsg})
+		return
+	}
+
 	userID, _ := c.Get("user_id")
-	var responses []models.SMSResponse
 
-	// Get available device if not specified
-	if req.DeviceID == 0 {
-		var device models.Device
-		if err := h.db.Where("user_id = ? AND is_online = ?", userID, true).First(&device).Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "No online device available"})
+	// Recipients come from the request, a validated upload or the contacts
+	var upload *models.RecipientUpload
+	var recipients []models.Recipient
+	switch {
+	case req.UploadID != nil:
+		var status int
+		var errMsg string
+		upload, status, errMsg = h.findUpload(userID, *req.UploadID, req.Message)
+		if upload == nil {
+			c.JSON(status, gin.H{"error": errMsg})
 			return
 		}
-		req.DeviceID = device.ID
+		recipients = upload.Recipients
+	case req.GroupID != nil || req.TagQuery != "":
+		var status int
+		var errMsg string
+		recipients, status, errMsg = h.contactRecipients(userID.(uint), req.GroupID, req.TagQuery, req.Message)
+		if errMsg != "" {
+			c.JSON(status, gin.H{"error": errMsg})
+			return
+		}
+	default:
+		for _, phoneNumber := range req.PhoneNumbers {
+			recipients = append(recipients, models.Recipient{PhoneNumber: phoneNumber})
+		}
 	}
 
-	// Verify device belongs to user and is online
-	var device models.Device
-	if err := h.db.Where("id = ? AND user_id = ? AND is_online = ?", req.DeviceID, userID, true).First(&device).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Device not found or offline"})
+	// Numbers that opted out are left out of the job
+	phoneNumbers := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		phoneNumbers = append(phoneNumbers, recipient.PhoneNumber)
+	}
+	optedOut, err := h.contacts.OptedOut(userID.(uint), phoneNumbers)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check opt-outs"})
 		return
 	}
+	if len(optedOut) > 0 {
+		allowed := make([]models.Recipient, 0, len(recipients))
+		for _, recipient := range recipients {
+			if !optedOut[recipient.PhoneNumber] {
+				allowed = append(allowed, recipient)
+			}
+		}
+		if len(allowed) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "All recipients have opted out"})
+			return
+		}
+		recipients = allowed
+	}
 
-	for _, phoneNumber := range req.PhoneNumbers {
-		message := models.Message{
-			PhoneNumber: phoneNumber,
-			Content:     req.Message,
-			Status:      "pending",
-			DeviceID:    req.DeviceID,
+	// The whole batch goes through one device; SIMs are still routed per recipient
+	device, errMsg := resolveDevice(h.db, h.router, userID, req.DeviceID, req.SIMID, "")
+	if device == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errMsg})
+		return
+	}
+
+	if err := h.hub.CheckCommand(device.DeviceID, "send_sms"); err != nil {
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// An explicitly requested SIM is the same for every recipient
+	explicitSIM, status, errMsg := selectSIM(h.hub, h.router, device, req.SIMID, req.SIMSlot, "")
+	if errMsg != "" {
+		c.JSON(status, gin.H{"error": errMsg})
+		return
+	}
+
+	priority := req.Priority
+	if priority == "" {
+		priority = models.PriorityBulk
+	}
+
+	messages := make([]models.Message, 0, len(recipients))
+	for _, recipient := range recipients {
+		sim := explicitSIM
+		if req.SIMID == nil && req.SIMSlot == nil {
+			sim = h.router.SelectSIM(device.SIMs, recipient.PhoneNumber)
+		}
+
+		messages = append(messages, models.Message{
+			PhoneNumber: recipient.PhoneNumber,
+			Content:     services.RenderTemplate(req.Message, recipient.Variables),
+			DeviceID:    device.ID,
+			SIMID:       simID(sim),
 			UserID:      userID.(uint),
+			PinnedTo:    pinnedTo(req.DeviceID, req.SIMID, req.SIMSlot),
+			ExpiresAt:   expiresAt,
+			Priority:    priority,
+		})
+	}
+
+	// Recipients are sent in the background; poll the job for progress
+	job := models.BulkJob{
+		UserID:   userID.(uint),
+		DeviceID: &device.ID,
+		Content:  req.Message,
+	}
+	// An upload is sent once; a concurrent request may have claimed it first
+	if err := h.bulkSender.CreateJob(&job, messages, upload); err != nil {
+		if errors.Is(err, services.ErrUploadSent) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Recipient list was already sent"})
+			return
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bulk job"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":   "Bulk job created",
+		"job":       job,
+		"opted_out": len(phoneNumbers) - len(messages),
+	})
+}
+
+// findUpload loads the user's recipient upload for sending with template,
+// or returns an error status and message
+func (h *SMSHandler) findUpload(userID interface{}, uploadID uint, template string) (*models.RecipientUpload, int, string) {
+	var upload models.RecipientUpload
+	if err := h.db.Where("id = ? AND user_id = ?", uploadID, userID).First(&upload).Error; err != nil {
+		return nil, http.StatusNotFound, "Upload not found"
+	}
+
+	if upload.BulkJobID != nil {
+		return nil, http.StatusConflict, "Recipient list was already sent as bulk job " + strconv.FormatUint(uint64(*upload.BulkJobID), 10)
+	}
+	if len(upload.Recipients) == 0 {
+		return nil, http.StatusBadRequest, "Recipient list has no valid recipients"
+	}
 
-		if err := h.db.Create(&message).Error; err != nil {
-			responses = append(responses, models.SMSResponse{
-				PhoneNumber: phoneNumber,
-				Status:      "failed",
-				Message:     "Failed to create message",
-			})
-			continue
+	for _, name := range services.TemplateVariables(template) {
+		if !upload.Variables.Contains(name) {
+			return nil, http.StatusBadRequest, "Message uses {{" + name + "}}, which is not a variable of the recipient list"
 		}
+	}
 
-		// Send to device via WebSocket
-		wsMessage := websocket.Message{
-			Type: "send_sms",
-			Data: map[string]interface{}{
-				"id":           message.ID,
-				"phone_number": phoneNumber,
-				"message":      req.Message,
-				"device_id":    device.DeviceID,
-			},
+	return &upload, 0, ""
+}
+
+// contactRecipients lists the contacts a bulk send targets, or returns an
+// error status and message. Every contact must have a value for each
+// variable the template uses.
+func (h *SMSHandler) contactRecipients(userID uint, groupID *uint, tagQuery, template string) ([]models.Recipient, int, string) {
+	if groupID != nil {
+		var group models.ContactGroup
+		if err := h.db.Where("id = ? AND user_id = ?", *groupID, userID).First(&group).Error; err != nil {
+			return nil, http.StatusNotFound, "Contact group not found"
 		}
+	}
 
-		h.hub.SendToDevice(device.DeviceID, wsMessage)
+	query, err := services.ParseTagQuery(tagQuery)
+	if err != nil {
+		return nil, http.StatusBadRequest, err.Error()
+	}
 
-		responses = append(responses, models.SMSResponse{
-			ID:          message.ID,
-			PhoneNumber: phoneNumber,
-			Status:      "pending",
-		})
+	recipients, err := h.contacts.Recipients(userID, groupID, query)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Failed to fetch contacts"
+	}
+	if len(recipients) == 0 {
+		return nil, http.StatusBadRequest, "No contacts match the group and tag query"
 	}
 
-	c.JSON(http.StatusOK, gin.H{"messages": responses})
+	variables := services.TemplateVariables(template)
+	for _, recipient := range recipients {
+		for _, name := range variables {
+			if _, ok := recipient.Variables[name]; !ok {
+				return nil, http.StatusBadRequest, "Contact " + recipient.PhoneNumber + " has no value for {{" + name + "}}"
+			}
+		}
+	}
+
+	return recipients, 0, ""
 }
 
 func (h *SMSHandler) GetHistory(c *gin.Context) {
@@ -155,6 +431,7 @@ func (h *SMSHandler) GetHistory(c *gin.Context) {
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
 	status := c.Query("status")
 	phoneNumber := c.Query("phone_number")
+	direction := c.Query("direction")
 	
 	offset := (page - 1) * limit
 	userID, _ := c.Get("user_id")
@@ -168,8 +445,13 @@ func (h *SMSHandler) GetHistory(c *gin.Context) {
 		query = query.Where("status = ?", status)
 	}
 	
+	if direction != "" {
+		query = query.Where("direction = ?", direction)
+	}
+	
 	if phoneNumber != "" {
-		query = query.Where("phone_number ILIKE ?", "%"+phoneNumber+"%")
+		// LOWER/LIKE instead of ILIKE so this works on both Postgres and SQLite
+		query = query.Where("LOWER(phone_number) LIKE LOWER(?)", "%"+phoneNumber+"%")
 	}
 	
 	if err := query.Model(&models.Message{}).Count(&total).Error; err != nil {
@@ -182,10 +464,55 @@ func (h *SMSHandler) GetHistory(c *gin.Context) {
 		return
 	}
 
+	// Link rows to the contacts with the same number
+	phoneNumbers := make([]string, 0, len(messages))
+	for _, message := range messages {
+		phoneNumbers = append(phoneNumbers, message.PhoneNumber)
+	}
+	contacts, err := h.contacts.Lookup(userID.(uint), phoneNumbers)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contacts"})
+		return
+	}
+	for i := range messages {
+		messages[i].Contact = contacts[messages[i].PhoneNumber]
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"messages": messages,
 		"total":    total,
 		"page":     page,
 		"limit":    limit,
 	})
-}
\ No newline at end of file
+}
+// GetMessage returns one message with the per-segment sent and delivery
+// reports of multipart messages and the attachments of MMS
+func (h *SMSHandler) GetMessage(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var message models.Message
+	err = h.db.Preload("Device").
+		Preload("SegmentReports", func(db *gorm.DB) *gorm.DB { return db.Order("segment") }).
+		Preload("Attachments").
+		Where("id = ? AND user_id = ?", messageID, userID).
+		First(&message).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	contacts, err := h.contacts.Lookup(message.UserID, []string{message.PhoneNumber})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contacts"})
+		return
+	}
+	message.Contact = contacts[message.PhoneNumber]
+
+	c.JSON(http.StatusOK, message)
+}
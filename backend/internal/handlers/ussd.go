@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+	"remote-sim-gateway/internal/websocket"
+)
+
+const (
+	// Longest USSD message: 182 7-bit characters
+	maxUSSDLength = 182
+
+	// Time left to write the response after waiting for the device
+	ussdResponseMargin = 5 * time.Second
+)
+
+// USSD codes start with * or # and end with #, e.g. *123# or *100*2#
+var ussdCodePattern = regexp.MustCompile(`^[*#][0-9*#+]*#$`)
+
+type USSDHandler struct {
+	db           *gorm.DB
+	hub          *websocket.Hub
+	router       *services.SIMRouter
+	ussd         *services.USSDService
+	writeTimeout time.Duration
+}
+
+func NewUSSDHandler(db *gorm.DB, hub *websocket.Hub, router *services.SIMRouter, ussd *services.USSDService, serverConfig config.ServerConfig) *USSDHandler {
+	return &USSDHandler{
+		db:           db,
+		hub:          hub,
+		router:       router,
+		ussd:         ussd,
+		writeTimeout: time.Duration(serverConfig.WriteTimeout) * time.Second,
+	}
+}
+
+// Start dials a USSD code on the device and returns the session once the
+// device answers. A session whose status is active shows a menu; reply to
+// it with Reply.
+func (h *USSDHandler) Start(c *gin.Context) {
+	device, ok := h.findDevice(c)
+	if !ok {
+		return
+	}
+
+	var req models.USSDRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Code) > maxUSSDLength || !ussdCodePattern.MatchString(req.Code) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid USSD code"})
+		return
+	}
+
+	sim, status, errMsg := selectSIM(h.hub, h.router, device, req.SIMID, req.SIMSlot, "")
+	if errMsg != "" {
+		c.JSON(status, gin.H{"error": errMsg})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	timeout := h.waitFor(c, time.Duration(req.Timeout)*time.Second)
+	session, err := h.ussd.Start(userID.(uint), device, sim, req.Code, timeout)
+	ussdResult(c, session, err)
+}
+
+// Reply sends the input for the menu an active session is showing
+func (h *USSDHandler) Reply(c *gin.Context) {
+	device, ok := h.findDevice(c)
+	if !ok {
+		return
+	}
+	session, ok := h.findSession(c, device)
+	if !ok {
+		return
+	}
+
+	var req models.USSDReplyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Input) > maxUSSDLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Input is too long"})
+		return
+	}
+
+	timeout := h.waitFor(c, time.Duration(req.Timeout)*time.Second)
+	updated, err := h.ussd.Reply(session, device, req.Input, timeout)
+	ussdResult(c, updated, err)
+}
+
+// waitFor returns how long the request may wait for the device and extends
+// the response's write deadline, which SERVER_WRITE_TIMEOUT would otherwise
+// hit first, to cover the wait. If the deadline can't be extended the wait
+// is cut to fit within SERVER_WRITE_TIMEOUT instead.
+func (h *USSDHandler) waitFor(c *gin.Context, requested time.Duration) time.Duration {
+	timeout := h.ussd.Timeout(requested)
+
+	err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(timeout + ussdResponseMargin))
+	if err == nil || h.writeTimeout <= 0 {
+		return timeout
+	}
+	return max(min(timeout, h.writeTimeout-ussdResponseMargin), time.Second)
+}
+
+// Cancel closes an active session
+func (h *USSDHandler) Cancel(c *gin.Context) {
+	device, ok := h.findDevice(c)
+	if !ok {
+		return
+	}
+	session, ok := h.findSession(c, device)
+	if !ok {
+		return
+	}
+
+	if err := h.ussd.Cancel(session, device); err != nil {
+		if errors.Is(err, services.ErrUSSDSessionClosed) {
+			c.JSON(http.StatusConflict, gin.H{"error": "USSD session is not active"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel USSD session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// GetSessions lists the device's USSD sessions with their steps, newest first
+func (h *USSDHandler) GetSessions(c *gin.Context) {
+	device, ok := h.findDevice(c)
+	if !ok {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	offset := (page - 1) * limit
+
+	query := h.db.Model(&models.USSDSession{}).Where("device_id = ?", device.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count USSD sessions"})
+		return
+	}
+
+	var sessions []models.USSDSession
+	err := query.Preload("Steps", orderByID).
+		Order("created_at DESC, id DESC").
+		Offset(offset).Limit(limit).
+		Find(&sessions).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch USSD sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": sessions,
+		"total":    total,
+		"page":     page,
+		"limit":    limit,
+	})
+}
+
+func (h *USSDHandler) GetSession(c *gin.Context) {
+	device, ok := h.findDevice(c)
+	if !ok {
+		return
+	}
+	session, ok := h.findSession(c, device)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// findDevice loads the user's device from the :id parameter with its SIMs,
+// or responds with an error
+func (h *USSDHandler) findDevice(c *gin.Context) (*models.Device, bool) {
+	deviceID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device ID"})
+		return nil, false
+	}
+
+	userID, _ := c.Get("user_id")
+
+	var device models.Device
+	if err := h.db.Preload("SIMs", orderBySlot).Where("id = ? AND user_id = ?", deviceID, userID).First(&device).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return nil, false
+	}
+	return &device, true
+}
+
+// findSession loads the device's session from the :session_id parameter
+// with its steps, or responds with an error
+func (h *USSDHandler) findSession(c *gin.Context, device *models.Device) (*models.USSDSession, bool) {
+	sessionID, err := strconv.ParseUint(c.Param("session_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return nil, false
+	}
+
+	var session models.USSDSession
+	if err := h.db.Preload("Steps", orderByID).Where("id = ? AND device_id = ?", sessionID, device.ID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "USSD session not found"})
+		return nil, false
+	}
+	return &session, true
+}
+
+// ussdResult responds with the session after a request, or why it failed.
+// Timed out requests still return the session.
+func ussdResult(c *gin.Context, session *models.USSDSession, err error) {
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, session)
+	case errors.Is(err, services.ErrUSSDTimeout):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Device did not answer in time", "session": session})
+	case errors.Is(err, services.ErrUSSDBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": "USSD session is still waiting for a response"})
+	case errors.Is(err, services.ErrUSSDSessionClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": "USSD session is not waiting for a reply"})
+	case errors.Is(err, websocket.ErrDeviceNotConnected), errors.Is(err, websocket.ErrCommandNotSupported), errors.Is(err, websocket.ErrSendQueueFull):
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run USSD request"})
+	}
+}
+
+func orderByID(db *gorm.DB) *gorm.DB {
+	return db.Order("id")
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+	"remote-sim-gateway/internal/websocket"
+)
+
+type VerifyHandler struct {
+	db       *gorm.DB
+	hub      *websocket.Hub
+	router   *services.SIMRouter
+	contacts *services.ContactBook
+	verify   *services.VerifyService
+}
+
+func NewVerifyHandler(db *gorm.DB, hub *websocket.Hub, router *services.SIMRouter, contacts *services.ContactBook, verify *services.VerifyService) *VerifyHandler {
+	return &VerifyHandler{
+		db:       db,
+		hub:      hub,
+		router:   router,
+		contacts: contacts,
+		verify:   verify,
+	}
+}
+
+// Start sends a new code to a phone number by SMS or voice call. The code is
+// never returned. An SMS code still waiting for its device gets 202.
+func (h *VerifyHandler) Start(c *gin.Context) {
+	var req models.VerifyStartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Channel == "" {
+		req.Channel = models.VerifyChannelSMS
+	}
+	if req.Template != "" && !services.HasTemplateVariable(req.Template, "code") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Template must contain {{code}}"})
+		return
+	}
+
+	phoneNumber, err := h.contacts.NormalizeNumber(req.PhoneNumber)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	if req.Channel == models.VerifyChannelSMS {
+		optedOut, err := h.contacts.OptedOut(userID.(uint), []string{phoneNumber})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check opt-outs"})
+			return
+		}
+		if optedOut[phoneNumber] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Recipient has opted out"})
+			return
+		}
+	}
+
+	command := "send_sms"
+	if req.Channel == models.VerifyChannelCall {
+		command = "make_call"
+	}
+	device, status, errMsg := h.healthyDevice(userID, req.DeviceID, phoneNumber, command)
+	if device == nil {
+		c.JSON(status, gin.H{"error": errMsg})
+		return
+	}
+
+	verification, err := h.verify.Start(userID.(uint), device, phoneNumber, req.Channel, req.CodeLength, req.TTL, req.Template)
+	var throttled *services.VerifyThrottleError
+	var commandErr *websocket.CommandError
+	switch {
+	case errors.As(err, &throttled):
+		seconds := int(math.Ceil(throttled.RetryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": throttled.Reason, "retry_after": seconds})
+	case errors.As(err, &commandErr):
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification code"})
+	case verification.MessageStatus == "queued":
+		c.JSON(http.StatusAccepted, verification)
+	default:
+		c.JSON(http.StatusCreated, verification)
+	}
+}
+
+// Check validates a code. Every check counts as an attempt; the verification
+// fails once MaxAttempts wrong codes were given.
+func (h *VerifyHandler) Check(c *gin.Context) {
+	var req models.VerifyCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ID == 0 && req.PhoneNumber == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set id or phone_number"})
+		return
+	}
+
+	var phoneNumber string
+	if req.ID == 0 {
+		var err error
+		phoneNumber, err = h.contacts.NormalizeNumber(req.PhoneNumber)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	userID, _ := c.Get("user_id")
+
+	verification, valid, err := h.verify.Check(userID.(uint), req.ID, phoneNumber, req.Code)
+	if errors.Is(err, services.ErrVerificationNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Verification not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+		return
+	}
+
+	remaining := 0
+	if verification.Status == models.VerificationPending {
+		remaining = verification.MaxAttempts - verification.Attempts
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":                 verification.ID,
+		"valid":              valid,
+		"status":             verification.Status,
+		"attempts_remaining": remaining,
+	})
+}
+
+// healthyDevice picks the device to send a code from: the requested one, or
+// the best-routed online device that can run the command and doesn't report
+// a missing SIM or no network. On failure it returns a status and message.
+func (h *VerifyHandler) healthyDevice(userID interface{}, deviceID uint, phoneNumber, command string) (*models.Device, int, string) {
+	if deviceID != 0 {
+		device, errMsg := resolveDevice(h.db, h.router, userID, deviceID, nil, phoneNumber)
+		if device == nil {
+			return nil, http.StatusBadRequest, errMsg
+		}
+		if err := h.hub.CheckCommand(device.DeviceID, command); err != nil {
+			return nil, commandErrorStatus(err), err.Error()
+		}
+		return device, 0, ""
+	}
+
+	var devices []models.Device
+	err := h.db.Preload("SIMs", orderBySlot).
+		Where("user_id = ? AND is_online = ?", userID, true).
+		Order("id").Find(&devices).Error
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Failed to fetch devices"
+	}
+
+	healthy := make([]models.Device, 0, len(devices))
+	for _, device := range devices {
+		if h.hub.CheckCommand(device.DeviceID, command) != nil {
+			continue
+		}
+		if info, ok := h.hub.GetDeviceStatus(device.DeviceID); ok {
+			if info.NetworkType == "none" || (info.SIMState != "" && info.SIMState != "ready" && info.SIMState != "unknown") {
+				continue
+			}
+		}
+		healthy = append(healthy, device)
+	}
+	if len(healthy) == 0 {
+		return nil, http.StatusServiceUnavailable, "No healthy device available"
+	}
+	return h.router.SelectDevice(healthy, phoneNumber), 0, ""
+}
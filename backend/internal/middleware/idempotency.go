@@ -0,0 +1,203 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+)
+
+const (
+	maxIdempotencyKeyLength = 255
+
+	// A first request still unfinished after this is assumed to have died
+	idempotencyLockTimeout = time.Minute
+)
+
+type idempotencyStore struct {
+	db     *gorm.DB
+	window time.Duration
+
+	sweepMutex sync.Mutex
+	lastSweep  time.Time
+}
+
+// Idempotency makes retries of a request with the same Idempotency-Key
+// header safe: the first response is stored and replayed, and reusing the
+// key for a different request gets 409. Keys are scoped per user, so mount
+// it after AuthRequired.
+func Idempotency(db *gorm.DB, idempotencyConfig config.IdempotencyConfig) gin.HandlerFunc {
+	window := time.Duration(idempotencyConfig.Window) * time.Hour
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	store := &idempotencyStore{db: db, window: window, lastSweep: time.Now()}
+
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			c.Abort()
+			return
+		}
+
+		userID, exists := c.Get("user_id")
+		if !exists {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now().UTC()
+		store.sweep(now)
+
+		record := models.IdempotencyKey{
+			UserID:      userID.(uint),
+			Key:         key,
+			RequestHash: requestHash(c.Request.Method, c.Request.URL.Path, body),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(store.window),
+		}
+
+		existing, err := store.claim(&record, now)
+		if err != nil {
+			// Fail open rather than refuse to send
+			log.Printf("Idempotency store error, processing request anyway: %v", err)
+			c.Next()
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.RequestHash != record.RequestHash:
+				c.JSON(http.StatusConflict, gin.H{"error": "Idempotency-Key was already used for a different request"})
+			case existing.StatusCode == 0:
+				c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.StatusCode, existing.ContentType, []byte(existing.ResponseBody))
+			}
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		c.Next()
+
+		// Server errors and rate limit rejections aren't stored so the client
+		// can retry with the same key
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			store.db.Delete(&record)
+			return
+		}
+
+		err = store.db.Model(&record).Updates(map[string]interface{}{
+			"status_code":   status,
+			"content_type":  recorder.Header().Get("Content-Type"),
+			"response_body": recorder.body.String(),
+		}).Error
+		if err != nil {
+			log.Printf("Failed to store response for Idempotency-Key %q: %v", key, err)
+		}
+	}
+}
+
+// claim inserts the record for a new key. If the key is taken it returns the
+// existing record instead, after clearing it away if it expired or its
+// request died.
+func (s *idempotencyStore) claim(record *models.IdempotencyKey, now time.Time) (*models.IdempotencyKey, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected > 0 {
+			return nil, nil
+		}
+
+		var existing models.IdempotencyKey
+		err := s.db.Where("user_id = ? AND idempotency_key = ?", record.UserID, record.Key).First(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		abandoned := existing.StatusCode == 0 && existing.CreatedAt.Before(now.Add(-idempotencyLockTimeout))
+		if !existing.ExpiresAt.After(now) || abandoned {
+			if err := s.db.Delete(&existing).Error; err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return &existing, nil
+	}
+
+	// Lost two races in a row; treat it as a concurrent duplicate
+	return &models.IdempotencyKey{RequestHash: record.RequestHash}, nil
+}
+
+// sweep deletes expired keys at most every ten minutes
+func (s *idempotencyStore) sweep(now time.Time) {
+	s.sweepMutex.Lock()
+	if now.Sub(s.lastSweep) < 10*time.Minute {
+		s.sweepMutex.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.sweepMutex.Unlock()
+
+	if err := s.db.Where("expires_at < ?", now).Delete(&models.IdempotencyKey{}).Error; err != nil {
+		log.Printf("Failed to delete expired idempotency keys: %v", err)
+	}
+}
+
+func requestHash(method, path string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder keeps a copy of the response body
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Logger logs one line per request once it is handled. Query strings are
+// left out since media and recording URLs carry their signatures there.
+func Logger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		user := "-"
+		if userID, ok := c.Get("user_id"); ok {
+			if id, ok := userID.(uint); ok {
+				user = fmt.Sprintf("user %d", id)
+			}
+		}
+
+		log.Printf("%s %s %d %v %s %s", c.Request.Method, c.Request.URL.Path, c.Writer.Status(), time.Since(start).Round(time.Microsecond), c.ClientIP(), user)
+		for _, err := range c.Errors {
+			log.Printf("%s %s error: %v", c.Request.Method, c.Request.URL.Path, err.Err)
+		}
+	}
+}
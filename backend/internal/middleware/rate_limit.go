@@ -1,134 +1,336 @@
 package middleware
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
 )
 
-type RateLimiter struct {
-	requests map[string][]time.Time
-	mutex    sync.RWMutex
-	limit    int
-	window   time.Duration
+// How long a user's plan is cached before it is read again, so plan
+// changes apply within a minute
+const planCacheTTL = time.Minute
+
+// RateLimitRule is a token bucket: it holds up to Burst tokens and refills
+// at Requests per Window seconds. Each request takes one token.
+type RateLimitRule struct {
+	Requests int `json:"requests"`
+	Window   int `json:"window"`          // seconds
+	Burst    int `json:"burst,omitempty"` // defaults to Requests
 }
 
-func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
-	rl := &RateLimiter{
-		requests: make(map[string][]time.Time),
-		limit:    limit,
-		window:   window,
+func (r RateLimitRule) capacity() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
 	}
+	return float64(r.Requests)
+}
 
-	// Clean up old entries every minute
-	go func() {
-		ticker := time.NewTicker(time.Minute)
-		defer ticker.Stop()
-		for range ticker.C {
-			rl.cleanup()
-		}
-	}()
+// refillRate is in tokens per second
+func (r RateLimitRule) refillRate() float64 {
+	return float64(r.Requests) / float64(r.Window)
+}
 
-	return rl
+// fillTime is how long an empty bucket takes to refill completely
+func (r RateLimitRule) fillTime() time.Duration {
+	return time.Duration(r.capacity() / r.refillRate() * float64(time.Second))
 }
 
-func (rl *RateLimiter) Allow(key string) bool {
-	rl.mutex.Lock()
-	defer rl.mutex.Unlock()
+func (r RateLimitRule) validate() error {
+	if r.Requests <= 0 || r.Window <= 0 || r.Burst < 0 {
+		return fmt.Errorf("requests and window must be positive, got %d per %ds", r.Requests, r.Window)
+	}
+	return nil
+}
 
-	now := time.Now()
-	windowStart := now.Add(-rl.window)
+// RateLimitPolicy is the format of security/policies/rate-limits.json.
+// Overrides map a route group, or "*" for every group, to a rule. The most
+// specific match wins: API key, then user ID, then plan, then route group.
+type RateLimitPolicy struct {
+	Default RateLimitRule                       `json:"default"`
+	Groups  map[string]RateLimitRule            `json:"groups"`
+	Plans   map[string]map[string]RateLimitRule `json:"plans"`
+	Users   map[string]map[string]RateLimitRule `json:"users"`
+	APIKeys map[string]map[string]RateLimitRule `json:"api_keys"`
+}
 
-	// Get existing requests for this key
-	requests := rl.requests[key]
+// LoadRateLimitPolicy reads the policy file, using the RATE_LIMIT_REQUESTS
+// and RATE_LIMIT_WINDOW default when it is missing, empty or has no default
+func LoadRateLimitPolicy(rateLimitConfig config.RateLimitConfig) (*RateLimitPolicy, error) {
+	policy := &RateLimitPolicy{}
 
-	// Filter out old requests
-	var validRequests []time.Time
-	for _, req := range requests {
-		if req.After(windowStart) {
-			validRequests = append(validRequests, req)
+	raw, err := os.ReadFile(rateLimitConfig.PolicyFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, policy); err != nil {
+			return nil, fmt.Errorf("invalid rate limit policy %s: %w", rateLimitConfig.PolicyFile, err)
 		}
 	}
 
-	// Check if limit exceeded
-	if len(validRequests) >= rl.limit {
-		rl.requests[key] = validRequests
-		return false
+	if policy.Default.Requests == 0 && policy.Default.Window == 0 {
+		policy.Default = RateLimitRule{Requests: rateLimitConfig.Requests, Window: rateLimitConfig.Window}
 	}
 
-	// Add current request
-	validRequests = append(validRequests, now)
-	rl.requests[key] = validRequests
-	return true
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid rate limit policy %s: %w", rateLimitConfig.PolicyFile, err)
+	}
+	return policy, nil
 }
 
-func (rl *RateLimiter) cleanup() {
-	rl.mutex.Lock()
-	defer rl.mutex.Unlock()
-
-	now := time.Now()
-	windowStart := now.Add(-rl.window)
-
-	for key, requests := range rl.requests {
-		var validRequests []time.Time
-		for _, req := range requests {
-			if req.After(windowStart) {
-				validRequests = append(validRequests, req)
+func (p *RateLimitPolicy) validate() error {
+	if err := p.Default.validate(); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for group, rule := range p.Groups {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("groups.%s: %w", group, err)
+		}
+	}
+	for section, overrides := range map[string]map[string]map[string]RateLimitRule{
+		"plans":    p.Plans,
+		"users":    p.Users,
+		"api_keys": p.APIKeys,
+	} {
+		for name, rules := range overrides {
+			for group, rule := range rules {
+				if err := rule.validate(); err != nil {
+					return fmt.Errorf("%s.%s.%s: %w", section, name, group, err)
+				}
 			}
 		}
+	}
+	return nil
+}
 
-		if len(validRequests) == 0 {
-			delete(rl.requests, key)
-		} else {
-			rl.requests[key] = validRequests
-		}
+// rule picks the rule for a request in a route group
+func (p *RateLimitPolicy) rule(group, apiKeyID, userID, plan string) RateLimitRule {
+	if rule, ok := lookupRule(p.APIKeys, apiKeyID, group); ok && apiKeyID != "" {
+		return rule
+	}
+	if rule, ok := lookupRule(p.Users, userID, group); ok && userID != "" {
+		return rule
 	}
+	if rule, ok := lookupRule(p.Plans, plan, group); ok && plan != "" {
+		return rule
+	}
+	if rule, ok := p.Groups[group]; ok {
+		return rule
+	}
+	return p.Default
 }
 
-// Global rate limiter instance
-var globalRateLimiter = NewRateLimiter(100, time.Hour) // 100 requests per hour
+func lookupRule(overrides map[string]map[string]RateLimitRule, name, group string) (RateLimitRule, bool) {
+	rules, ok := overrides[name]
+	if !ok {
+		return RateLimitRule{}, false
+	}
+	if rule, ok := rules[group]; ok {
+		return rule, true
+	}
+	rule, ok := rules["*"]
+	return rule, ok
+}
 
-func RateLimit() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// Use IP address as the key
-		key := c.ClientIP()
-		
-		// For authenticated requests, use user ID as key
-		if userID, exists := c.Get("user_id"); exists {
-			key = string(rune(userID.(uint)))
+// maxFillTime is the longest any bucket takes to refill; idle buckets older
+// than this are full and can be forgotten
+func (p *RateLimitPolicy) maxFillTime() time.Duration {
+	longest := p.Default.fillTime()
+	consider := func(rule RateLimitRule) {
+		if fill := rule.fillTime(); fill > longest {
+			longest = fill
 		}
+	}
 
-		if !globalRateLimiter.Allow(key) {
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error": "Rate limit exceeded. Please try again later.",
-			})
-			c.Abort()
-			return
+	for _, rule := range p.Groups {
+		consider(rule)
+	}
+	for _, overrides := range []map[string]map[string]RateLimitRule{p.Plans, p.Users, p.APIKeys} {
+		for _, rules := range overrides {
+			for _, rule := range rules {
+				consider(rule)
+			}
 		}
+	}
+	return longest
+}
 
-		c.Next()
+// RateLimitResult is the outcome of taking a token from a bucket
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // until a token is available, if not allowed
+	ResetAfter time.Duration // until the bucket is full again
+}
+
+// RateLimitStore keeps token buckets. MemoryRateLimitStore suits a single
+// instance; DatabaseRateLimitStore shares buckets between instances.
+type RateLimitStore interface {
+	Take(key string, rule RateLimitRule, now time.Time) (RateLimitResult, error)
+	// Sweep forgets buckets untouched since before, which are full by then
+	Sweep(before time.Time) error
+}
+
+// takeToken refills a bucket last updated at updated and takes a token from
+// it, returning the new token count
+func takeToken(tokens float64, updated time.Time, rule RateLimitRule, now time.Time) (float64, RateLimitResult) {
+	capacity, rate := rule.capacity(), rule.refillRate()
+
+	if elapsed := now.Sub(updated).Seconds(); elapsed > 0 {
+		tokens += elapsed * rate
+	}
+	tokens = math.Min(tokens, capacity)
+
+	result := RateLimitResult{}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(tokens)
+	result.ResetAfter = time.Duration((capacity - tokens) / rate * float64(time.Second))
+	return tokens, result
+}
+
+type RateLimiter struct {
+	policy *RateLimitPolicy
+	store  RateLimitStore
+	db     *gorm.DB
+
+	sweepEvery time.Duration
+	sweepMutex sync.Mutex
+	lastSweep  time.Time
+
+	// Users' plans, read from the users table rather than trusted from the
+	// token, which keeps the plan it was issued with until it expires
+	planMutex sync.Mutex
+	plans     map[uint]cachedPlan
+}
+
+type cachedPlan struct {
+	plan      string
+	expiresAt time.Time
+}
+
+func NewRateLimiter(policy *RateLimitPolicy, store RateLimitStore, db *gorm.DB) *RateLimiter {
+	return &RateLimiter{
+		policy:     policy,
+		store:      store,
+		db:         db,
+		sweepEvery: time.Minute,
+		lastSweep:  time.Now(),
+		plans:      make(map[uint]cachedPlan),
+	}
+}
+
+// plan returns the user's plan, cached for planCacheTTL. A failed lookup
+// falls back to no plan, so the route group's rule applies.
+func (rl *RateLimiter) plan(userID uint, now time.Time) string {
+	rl.planMutex.Lock()
+	cached, ok := rl.plans[userID]
+	rl.planMutex.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.plan
+	}
+
+	var user models.User
+	if err := rl.db.Select("plan").First(&user, userID).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Failed to look up plan of user %d: %v", userID, err)
+		}
+		return ""
 	}
+
+	rl.planMutex.Lock()
+	rl.plans[userID] = cachedPlan{plan: user.Plan, expiresAt: now.Add(planCacheTTL)}
+	rl.planMutex.Unlock()
+	return user.Plan
 }
 
-// SMS specific rate limiter (more restrictive)
-var smsRateLimiter = NewRateLimiter(10, time.Hour) // 10 SMS per hour
+// sweep drops full buckets at most once a minute so the store stays bounded
+func (rl *RateLimiter) sweep(now time.Time) {
+	rl.sweepMutex.Lock()
+	if now.Sub(rl.lastSweep) < rl.sweepEvery {
+		rl.sweepMutex.Unlock()
+		return
+	}
+	rl.lastSweep = now
+	rl.sweepMutex.Unlock()
+
+	if err := rl.store.Sweep(now.Add(-rl.policy.maxFillTime())); err != nil {
+		log.Printf("Failed to sweep rate limit buckets: %v", err)
+	}
+
+	rl.planMutex.Lock()
+	for userID, cached := range rl.plans {
+		if !now.Before(cached.expiresAt) {
+			delete(rl.plans, userID)
+		}
+	}
+	rl.planMutex.Unlock()
+}
 
-func SMSRateLimit() gin.HandlerFunc {
+// RateLimit limits requests in a route group. Mount it after AuthRequired on
+// protected groups so requests are counted per API key or user rather than
+// per IP address.
+func RateLimit(limiter *RateLimiter, group string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID, exists := c.Get("user_id")
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
-			c.Abort()
+		now := time.Now().UTC()
+
+		var apiKeyID, userID, plan string
+		if value, exists := c.Get("api_key_id"); exists {
+			apiKeyID = fmt.Sprint(value)
+		}
+		if value, exists := c.Get("user_id"); exists {
+			userID = strconv.FormatUint(uint64(value.(uint)), 10)
+			plan = limiter.plan(value.(uint), now)
+		}
+
+		var key string
+		switch {
+		case apiKeyID != "":
+			key = group + ":key:" + apiKeyID
+		case userID != "":
+			key = group + ":user:" + userID
+		default:
+			key = group + ":ip:" + c.ClientIP()
+		}
+
+		rule := limiter.policy.rule(group, apiKeyID, userID, plan)
+		result, err := limiter.store.Take(key, rule, now)
+		if err != nil {
+			// Fail open: a broken store shouldn't take the API down
+			log.Printf("Rate limit store error, allowing request: %v", err)
+			c.Next()
 			return
 		}
+		limiter.sweep(now)
 
-		key := "sms_" + string(rune(userID.(uint)))
+		c.Header("RateLimit-Limit", strconv.Itoa(int(rule.capacity())))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", rule.Requests, rule.Window, int(rule.capacity())))
 
-		if !smsRateLimiter.Allow(key) {
+		if !result.Allowed {
+			retryAfter := ceilSeconds(result.RetryAfter)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
 			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error": "SMS rate limit exceeded. Maximum 10 SMS per hour.",
+				"error":       "Rate limit exceeded. Please try again later.",
+				"retry_after": retryAfter,
 			})
 			c.Abort()
 			return
@@ -136,4 +338,8 @@ func SMSRateLimit() gin.HandlerFunc {
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+)
+
+// NewRateLimitStore returns the store selected by RATE_LIMIT_STORE
+func NewRateLimitStore(rateLimitConfig config.RateLimitConfig, db *gorm.DB) (RateLimitStore, error) {
+	switch rateLimitConfig.Store {
+	case "", "memory":
+		return NewMemoryRateLimitStore(), nil
+	case "database":
+		return NewDatabaseRateLimitStore(db), nil
+	default:
+		return nil, fmt.Errorf("unsupported rate limit store %q (expected memory or database)", rateLimitConfig.Store)
+	}
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// MemoryRateLimitStore keeps buckets in process memory
+type MemoryRateLimitStore struct {
+	buckets map[string]*memoryBucket
+	mutex   sync.Mutex
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(key string, rule RateLimitRule, now time.Time) (RateLimitResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: rule.capacity(), updated: now}
+		s.buckets[key] = bucket
+	}
+
+	tokens, result := takeToken(bucket.tokens, bucket.updated, rule, now)
+	bucket.tokens = tokens
+	bucket.updated = now
+	return result, nil
+}
+
+func (s *MemoryRateLimitStore) Sweep(before time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, bucket := range s.buckets {
+		if bucket.updated.Before(before) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
+
+// DatabaseRateLimitStore keeps buckets in the rate_limit_buckets table so
+// every instance behind a load balancer shares them. On Postgres each bucket
+// row is locked while a token is taken.
+type DatabaseRateLimitStore struct {
+	db *gorm.DB
+}
+
+func NewDatabaseRateLimitStore(db *gorm.DB) *DatabaseRateLimitStore {
+	return &DatabaseRateLimitStore{db: db}
+}
+
+func (s *DatabaseRateLimitStore) Take(key string, rule RateLimitRule, now time.Time) (RateLimitResult, error) {
+	var result RateLimitResult
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(
+			"INSERT INTO rate_limit_buckets (bucket_key, tokens, updated_at) VALUES (?, ?, ?) ON CONFLICT (bucket_key) DO NOTHING",
+			key, rule.capacity(), now,
+		).Error
+		if err != nil {
+			return err
+		}
+
+		query := "SELECT tokens, updated_at FROM rate_limit_buckets WHERE bucket_key = ?"
+		if tx.Dialector.Name() == "postgres" {
+			query += " FOR UPDATE"
+		}
+
+		var bucket struct {
+			Tokens    float64
+			UpdatedAt time.Time
+		}
+		if err := tx.Raw(query, key).Scan(&bucket).Error; err != nil {
+			return err
+		}
+
+		var tokens float64
+		tokens, result = takeToken(bucket.Tokens, bucket.UpdatedAt, rule, now)
+
+		return tx.Exec(
+			"UPDATE rate_limit_buckets SET tokens = ?, updated_at = ? WHERE bucket_key = ?",
+			tokens, now, key,
+		).Error
+	})
+	return result, err
+}
+
+func (s *DatabaseRateLimitStore) Sweep(before time.Time) error {
+	return s.db.Exec("DELETE FROM rate_limit_buckets WHERE updated_at < ?", before.UTC()).Error
+}
@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+// Alert rule metrics
+const (
+	AlertMetricBattery     = "battery"      // battery level in %, fires below threshold
+	AlertMetricSignal      = "signal"       // signal level 0-4, fires below threshold
+	AlertMetricOffline     = "offline"      // minutes offline, fires above threshold
+	AlertMetricFailureRate = "failure_rate" // % of failed SMS over the window, fires above threshold
+)
+
+// Alert delivery channels
+const (
+	AlertChannelEmail   = "email"
+	AlertChannelWebhook = "webhook"
+	AlertChannelSMS     = "sms"
+)
+
+// AlertRule watches one metric for a single device, or for every device of
+// the user when DeviceID is nil
+type AlertRule struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	UserID        uint      `json:"user_id" gorm:"not null"`
+	DeviceID      *uint     `json:"device_id"`
+	Name          string    `json:"name"`
+	Metric        string    `json:"metric" gorm:"not null"`
+	Threshold     float64   `json:"threshold"`
+	Hysteresis    float64   `json:"hysteresis"`     // how far past the threshold a value must recover before the alert resolves
+	WindowMinutes int       `json:"window_minutes"` // evaluation window for failure_rate
+	Channel       string    `json:"channel" gorm:"not null"`
+	Target        string    `json:"target" gorm:"not null"` // email address, webhook URL or phone number
+	Enabled       bool      `json:"enabled"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Alert is one firing of a rule for a device. It stays "firing" until the
+// metric recovers past the rule's hysteresis band.
+type Alert struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	RuleID     uint       `json:"rule_id" gorm:"not null"`
+	Rule       *AlertRule `json:"rule,omitempty" gorm:"foreignKey:RuleID"`
+	DeviceID   uint       `json:"device_id" gorm:"not null"`
+	UserID     uint       `json:"user_id" gorm:"not null"`
+	State      string     `json:"state" gorm:"default:'firing'"` // firing, resolved
+	Value      float64    `json:"value"`
+	Message    string     `json:"message"`
+	FiredAt    time.Time  `json:"fired_at"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+type AlertRuleRequest struct {
+	DeviceID      *uint   `json:"device_id"`
+	Name          string  `json:"name"`
+	Metric        string  `json:"metric" binding:"required,oneof=battery signal offline failure_rate"`
+	Threshold     float64 `json:"threshold" binding:"min=0"`
+	Hysteresis    float64 `json:"hysteresis" binding:"min=0"`
+	WindowMinutes int     `json:"window_minutes" binding:"min=0"`
+	Channel       string  `json:"channel" binding:"required,oneof=email webhook sms"`
+	Target        string  `json:"target" binding:"required"`
+	Enabled       *bool   `json:"enabled"`
+}
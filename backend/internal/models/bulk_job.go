@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// Bulk job statuses
+const (
+	BulkJobRunning   = "running"
+	BulkJobPaused    = "paused"
+	BulkJobCancelled = "cancelled"
+	BulkJobCompleted = "completed"
+)
+
+// BulkJob is one send-bulk-sms request. Its recipients are stored as queued
+// messages and fed to devices in the background at a controlled rate.
+type BulkJob struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"user_id" gorm:"not null"`
+	DeviceID   *uint      `json:"device_id"`
+	Content    string     `json:"content" gorm:"not null"`
+	Status     string     `json:"status" gorm:"default:'running'"` // running, paused, cancelled, completed
+	Total      int        `json:"total"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	Progress *BulkJobProgress `json:"progress,omitempty" gorm:"-"`
+}
+
+// BulkJobProgress counts the job's messages by status. Pending messages
+// were handed to a device that hasn't reported back yet; sent ones have no
+// delivery report yet.
+type BulkJobProgress struct {
+	Queued      int64 `json:"queued"`
+	Pending     int64 `json:"pending"`
+	Sent        int64 `json:"sent"`
+	Delivered   int64 `json:"delivered"`
+	Undelivered int64 `json:"undelivered"`
+	Failed      int64 `json:"failed"`
+	Expired     int64 `json:"expired"`
+	Cancelled   int64 `json:"cancelled"`
+}
@@ -3,24 +3,44 @@ package models
 import "time"
 
 type Call struct {
+	ID          uint           `json:"id" gorm:"primaryKey"`
+	PhoneNumber string         `json:"phone_number" gorm:"not null"`
+	Duration    int            `json:"duration"`                        // in seconds
+	Status      string         `json:"status" gorm:"default:'pending'"` // pending, connected, failed, ended
+	ErrorMsg    string         `json:"error_msg,omitempty"`
+	DeviceID    uint           `json:"device_id"`
+	Device      Device         `json:"device" gorm:"foreignKey:DeviceID"`
+	SIMID       *uint          `json:"sim_id,omitempty" gorm:"column:sim_id"`
+	UserID      uint           `json:"user_id"`
+	User        User           `json:"user" gorm:"foreignKey:UserID"`
+	Recording   *CallRecording `json:"recording,omitempty" gorm:"foreignKey:CallID"`
+	StartedAt   time.Time      `json:"started_at"`
+	EndedAt     time.Time      `json:"ended_at"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+}
+
+// CallRecording is the audio of a call, uploaded by the device after the
+// call ends. Recordings are deleted after RECORDING_RETENTION_DAYS.
+type CallRecording struct {
 	ID          uint      `json:"id" gorm:"primaryKey"`
-	PhoneNumber string    `json:"phone_number" gorm:"not null"`
-	Duration    int       `json:"duration"` // in seconds
-	Status      string    `json:"status" gorm:"default:'pending'"` // pending, connected, failed, ended
-	ErrorMsg    string    `json:"error_msg,omitempty"`
-	DeviceID    uint      `json:"device_id"`
-	Device      Device    `json:"device" gorm:"foreignKey:DeviceID"`
-	UserID      uint      `json:"user_id"`
-	User        User      `json:"user" gorm:"foreignKey:UserID"`
-	StartedAt   time.Time `json:"started_at"`
-	EndedAt     time.Time `json:"ended_at"`
+	CallID      uint      `json:"call_id" gorm:"not null"`
+	UserID      uint      `json:"user_id" gorm:"not null"`
+	ContentType string    `json:"content_type" gorm:"not null"`
+	Size        int64     `json:"size"`
+	Path        string    `json:"-" gorm:"not null"` // relative to RECORDING_DIR
 	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (CallRecording) TableName() string {
+	return "call_recordings"
 }
 
 type MakeCallRequest struct {
 	PhoneNumber string `json:"phone_number" binding:"required"`
 	DeviceID    uint   `json:"device_id"`
+	SIMID       *uint  `json:"sim_id"`   // call from this SIM
+	SIMSlot     *int   `json:"sim_slot"` // or from this slot of the device
 }
 
 type CallResponse struct {
@@ -36,4 +56,4 @@ type CallStatusUpdate struct {
 	ErrorMsg  string    `json:"error_msg,omitempty"`
 	StartedAt time.Time `json:"started_at"`
 	EndedAt   time.Time `json:"ended_at"`
-}
\ No newline at end of file
+}
@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// Contact is a named recipient in a user's address book. PhoneNumber is
+// normalized so history rows can be matched to it.
+type Contact struct {
+	ID          uint           `json:"id" gorm:"primaryKey"`
+	UserID      uint           `json:"user_id" gorm:"not null"`
+	Name        string         `json:"name"`
+	PhoneNumber string         `json:"phone_number" gorm:"not null"`
+	Tags        StringList     `json:"tags" gorm:"type:text"`
+	Fields      StringMap      `json:"fields" gorm:"type:text"` // custom fields, usable as template variables
+	Groups      []ContactGroup `json:"groups,omitempty" gorm:"many2many:contact_group_members"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+}
+
+type ContactGroup struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	UserID      uint      `json:"user_id" gorm:"not null"`
+	Name        string    `json:"name" gorm:"not null"`
+	Description string    `json:"description"`
+	Members     int64     `json:"members" gorm:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type ContactRequest struct {
+	Name        string            `json:"name"`
+	PhoneNumber string            `json:"phone_number" binding:"required"`
+	Tags        []string          `json:"tags"`
+	Fields      map[string]string `json:"fields"`
+	GroupIDs    []uint            `json:"group_ids"`
+}
+
+type ContactGroupRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+type ContactGroupMembersRequest struct {
+	ContactIDs []uint `json:"contact_ids" binding:"required"`
+}
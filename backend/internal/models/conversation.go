@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Conversation is the thread of messages exchanged with one remote number
+// through one SIM (or device, if it doesn't report SIMs). It is started by
+// the first message received from that number.
+type Conversation struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	UserID        uint       `json:"user_id" gorm:"not null"`
+	DeviceID      uint       `json:"device_id" gorm:"not null"`
+	SIMID         *uint      `json:"sim_id,omitempty" gorm:"column:sim_id"`
+	PhoneNumber   string     `json:"phone_number" gorm:"not null"`
+	UnreadCount   int        `json:"unread_count"`
+	LastMessageID *uint      `json:"last_message_id,omitempty"`
+	LastMessage   *Message   `json:"last_message,omitempty" gorm:"foreignKey:LastMessageID"`
+	LastMessageAt time.Time  `json:"last_message_at"`
+	LastReadAt    *time.Time `json:"last_read_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	// Contact with the same number, filled in for listings
+	Contact *Contact `json:"contact,omitempty" gorm:"-"`
+}
+
+type ConversationReplyRequest struct {
+	Message string `json:"message" binding:"required"`
+}
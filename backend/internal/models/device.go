@@ -9,6 +9,17 @@ type Device struct {
 	PhoneNumber  string    `json:"phone_number"`
 	IsOnline     bool      `json:"is_online" gorm:"default:false"`
 	LastSeenAt   time.Time `json:"last_seen_at"`
+
+	// Reported by the device in its hello frame
+	AppVersion      string     `json:"app_version"`
+	ProtocolVersion int        `json:"protocol_version"`
+	Capabilities    StringList `json:"capabilities" gorm:"type:text"`
+
+	SIMs         []SIM     `json:"sims,omitempty" gorm:"foreignKey:DeviceID"`
+
+	Quota
+	Usage *QuotaUsage `json:"usage,omitempty" gorm:"-"`
+
 	UserID       uint      `json:"user_id"`
 	User         User      `json:"user" gorm:"foreignKey:UserID"`
 	CreatedAt    time.Time `json:"created_at"`
@@ -24,7 +35,7 @@ type DeviceRegisterRequest struct {
 type DeviceUpdateRequest struct {
 	Name        string `json:"name"`
 	PhoneNumber string `json:"phone_number"`
-	IsOnline    bool   `json:"is_online"`
+	QuotaRequest
 }
 
 type DeviceStatusUpdate struct {
@@ -0,0 +1,67 @@
+package models
+
+import "time"
+
+// Inbound rule actions
+const (
+	InboundActionReply        = "reply"         // auto-reply through the receiving SIM
+	InboundActionWebhook      = "webhook"       // POST the message to Target
+	InboundActionForwardSMS   = "forward_sms"   // send it on to the number in Target
+	InboundActionForwardEmail = "forward_email" // email it to Target
+	InboundActionTag          = "tag"           // add the tag in Target to the sender's contact
+	InboundActionOptOut       = "opt_out"       // stop sending to the sender
+)
+
+// InboundRule acts on received messages. Every condition that is set must
+// match; a rule without conditions matches every message. A user's rules
+// run in priority order, lowest first.
+type InboundRule struct {
+	ID       uint   `json:"id" gorm:"primaryKey"`
+	UserID   uint   `json:"user_id" gorm:"not null"`
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+
+	Keywords StringList `json:"keywords" gorm:"type:text"` // first word of the message, any case
+	Pattern  string     `json:"pattern"`                   // regular expression on the message text
+	Sender   string     `json:"sender"`                    // sender number; a trailing * matches a prefix
+	SIMID    *uint      `json:"sim_id" gorm:"column:sim_id"`
+
+	Action   string `json:"action" gorm:"not null"`
+	Target   string `json:"target"`   // webhook URL, phone number, email address or tag
+	Template string `json:"template"` // reply or forward text with {{variables}}
+
+	// Skip the lower priority rules when this one matches
+	StopProcessing bool `json:"stop_processing"`
+
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type InboundRuleRequest struct {
+	Name           string   `json:"name"`
+	Priority       int      `json:"priority"`
+	Keywords       []string `json:"keywords"`
+	Pattern        string   `json:"pattern"`
+	Sender         string   `json:"sender"`
+	SIMID          *uint    `json:"sim_id"`
+	Action         string   `json:"action" binding:"required,oneof=reply webhook forward_sms forward_email tag opt_out"`
+	Target         string   `json:"target"`
+	Template       string   `json:"template"`
+	StopProcessing bool     `json:"stop_processing"`
+	Enabled        *bool    `json:"enabled"`
+}
+
+// OptOut is a number the user must no longer send to, added by an opt_out
+// rule or by hand
+type OptOut struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	UserID      uint      `json:"user_id" gorm:"not null"`
+	PhoneNumber string    `json:"phone_number" gorm:"not null"`
+	RuleID      *uint     `json:"rule_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type OptOutRequest struct {
+	PhoneNumber string `json:"phone_number" binding:"required"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// MediaFile is an uploaded file that can be attached to MMS. Devices fetch
+// it through a signed, expiring URL.
+type MediaFile struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	UserID      uint      `json:"user_id" gorm:"not null"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type" gorm:"not null"`
+	Size        int64     `json:"size"`
+	Path        string    `json:"-" gorm:"not null"` // relative to MEDIA_DIR
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (MediaFile) TableName() string {
+	return "media_files"
+}
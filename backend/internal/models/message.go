@@ -6,27 +6,127 @@ type Message struct {
 	ID          uint      `json:"id" gorm:"primaryKey"`
 	PhoneNumber string    `json:"phone_number" gorm:"not null"`
 	Content     string    `json:"content" gorm:"not null"`
-	Status      string    `json:"status" gorm:"default:'pending'"` // pending, sent, failed
+	Status      string    `json:"status" gorm:"default:'pending'"` // queued, pending, sent, delivered, undelivered, failed, expired, cancelled; inbound: received
 	ErrorMsg    string    `json:"error_msg,omitempty"`
 	DeviceID    uint      `json:"device_id"`
 	Device      Device    `json:"device" gorm:"foreignKey:DeviceID"`
+	SIMID       *uint     `json:"sim_id,omitempty" gorm:"column:sim_id"`
 	UserID      uint      `json:"user_id"`
 	User        User      `json:"user" gorm:"foreignKey:UserID"`
 	SentAt      time.Time `json:"sent_at"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Set when the message is handed to a device; quotas count these
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty"`
+	// Queued messages are retried after this time
+	HeldUntil *time.Time `json:"held_until,omitempty"`
+	// Not sent after this time: queued messages expire and devices skip it
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Lane the message waits in for its device: high, normal or bulk
+	Priority string `json:"priority" gorm:"default:'normal'"`
+	// What the sender chose explicitly and must not be rerouted: "", "device" or "sim"
+	PinnedTo string `json:"pinned_to,omitempty"`
+	// Bulk job the message belongs to; its sender dispatches it
+	BulkJobID *uint `json:"bulk_job_id,omitempty"`
+	// "outbound" for messages we send, "inbound" for ones a device received
+	Direction string `json:"direction" gorm:"default:'outbound'"`
+	// Thread of received messages and replies sent from it
+	ConversationID *uint `json:"conversation_id,omitempty"`
+	// Parts the device split the message into, and when the carrier
+	// reported the last of them delivered
+	Segments    int        `json:"segments" gorm:"default:1"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	// Per-segment reports, loaded for a single message
+	SegmentReports []MessageSegment `json:"segment_reports,omitempty" gorm:"foreignKey:MessageID"`
+	// "sms", or "mms" for messages with a subject and attachments
+	Type        string      `json:"type" gorm:"default:'sms'"`
+	Subject     string      `json:"subject,omitempty"`
+	Attachments []MediaFile `json:"attachments,omitempty" gorm:"many2many:message_attachments;joinForeignKey:MessageID;joinReferences:MediaID"`
+
+	// Contact with the same number, filled in for history listings
+	Contact *Contact `json:"contact,omitempty" gorm:"-"`
+}
+
+// MessageSegment is the radio's and the carrier's report for one part of a
+// multipart message; single-part messages have one, segment 0
+type MessageSegment struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	MessageID   uint       `json:"message_id"`
+	Segment     int        `json:"segment"`
+	Status      string     `json:"status" gorm:"default:'pending'"` // pending, sent, failed, expired, delivered, undelivered
+	ErrorMsg    string     `json:"error_msg,omitempty"`
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
 }
 
+// Values of Message.Direction
+const (
+	MessageOutbound = "outbound"
+	MessageInbound  = "inbound"
+)
+
+// Values of Message.Priority. Devices are handed high priority messages
+// first, then normal ones, then bulk.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityBulk   = "bulk"
+)
+
+// Values of Message.Type
+const (
+	MessageTypeSMS = "sms"
+	MessageTypeMMS = "mms"
+)
+
+// Route pins for Message.PinnedTo
+const (
+	PinnedToDevice = "device"
+	PinnedToSIM    = "sim"
+)
+
 type SendSMSRequest struct {
 	PhoneNumber string `json:"phone_number" binding:"required"`
 	Message     string `json:"message" binding:"required"`
 	DeviceID    uint   `json:"device_id"`
+	SIMID       *uint  `json:"sim_id"`   // send through this SIM
+	SIMSlot     *int   `json:"sim_slot"` // or through this slot of the device
+
+	// Don't send after this time, or after TTL seconds; both are optional
+	ValidUntil *time.Time `json:"valid_until"`
+	TTL        int        `json:"ttl"`
+	Priority   string     `json:"priority" binding:"omitempty,oneof=high normal bulk"` // default normal
 }
 
 type BulkSMSRequest struct {
-	PhoneNumbers []string `json:"phone_numbers" binding:"required"`
+	PhoneNumbers []string `json:"phone_numbers"`
+	UploadID     *uint    `json:"upload_id"` // or a recipient upload; Message may then use its {{variables}}
+	GroupID      *uint    `json:"group_id"`  // or contacts in this group
+	TagQuery     string   `json:"tag_query"` // and/or with these tags, e.g. "vip -churned"; contact fields are variables
 	Message      string   `json:"message" binding:"required"`
 	DeviceID     uint     `json:"device_id"`
+	SIMID        *uint    `json:"sim_id"`
+	SIMSlot      *int     `json:"sim_slot"`
+	ValidUntil   *time.Time `json:"valid_until"` // applies to every recipient
+	TTL          int        `json:"ttl"`
+	Priority     string     `json:"priority" binding:"omitempty,oneof=high normal bulk"` // default bulk
+}
+
+type SendMMSRequest struct {
+	PhoneNumber string `json:"phone_number" binding:"required"`
+	Message     string `json:"message"` // optional text
+	Subject     string `json:"subject" binding:"max=40"`
+	MediaIDs    []uint `json:"media_ids" binding:"required,min=1,max=10"` // uploaded with POST /api/media
+	DeviceID    uint   `json:"device_id"`
+	SIMID       *uint  `json:"sim_id"`
+	SIMSlot     *int   `json:"sim_slot"`
+
+	ValidUntil *time.Time `json:"valid_until"`
+	TTL        int        `json:"ttl"`
+	Priority   string     `json:"priority" binding:"omitempty,oneof=high normal bulk"` // default normal
 }
 
 type SMSResponse struct {
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// Quota caps the SMS segments dispatched through a device or SIM, usually to
+// stay within the carrier plan, which bills each part of a long message. 0
+// means unlimited.
+type Quota struct {
+	DailyLimit     int `json:"daily_limit"`
+	MonthlyLimit   int `json:"monthly_limit"`
+	PerMinuteLimit int `json:"per_minute_limit"` // throttles bursts that trip carrier spam detection
+}
+
+// QuotaUsage counts the SMS segments dispatched in the current quota windows
+type QuotaUsage struct {
+	PerMinute       int64     `json:"per_minute"`
+	Daily           int64     `json:"daily"`
+	Monthly         int64     `json:"monthly"`
+	DailyResetsAt   time.Time `json:"daily_resets_at"`
+	MonthlyResetsAt time.Time `json:"monthly_resets_at"`
+}
+
+// QuotaRequest updates quota limits; omitted limits are left unchanged
+type QuotaRequest struct {
+	DailyLimit     *int `json:"daily_limit" binding:"omitempty,min=0"`
+	MonthlyLimit   *int `json:"monthly_limit" binding:"omitempty,min=0"`
+	PerMinuteLimit *int `json:"per_minute_limit" binding:"omitempty,min=0"`
+}
+
+func (r QuotaRequest) Apply(quota *Quota) {
+	if r.DailyLimit != nil {
+		quota.DailyLimit = *r.DailyLimit
+	}
+	if r.MonthlyLimit != nil {
+		quota.MonthlyLimit = *r.MonthlyLimit
+	}
+	if r.PerMinuteLimit != nil {
+		quota.PerMinuteLimit = *r.PerMinuteLimit
+	}
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Recipient is one cleaned row of an uploaded recipient list
+type Recipient struct {
+	Row         int               `json:"row"` // spreadsheet row number, the header being row 1
+	PhoneNumber string            `json:"phone_number"`
+	Variables   map[string]string `json:"variables,omitempty"`
+}
+
+// RecipientUpload is a validated recipient spreadsheet waiting to be sent
+// through send-bulk-sms with its upload_id. Only valid, first-seen rows are
+// kept in Recipients.
+type RecipientUpload struct {
+	ID            uint          `json:"id" gorm:"primaryKey"`
+	UserID        uint          `json:"user_id" gorm:"not null"`
+	FileName      string        `json:"file_name"`
+	PhoneColumn   string        `json:"phone_column"`
+	Variables     StringList    `json:"variables" gorm:"type:text"`
+	TotalRows     int           `json:"total_rows"`
+	ValidRows     int           `json:"valid_rows"`
+	InvalidRows   int           `json:"invalid_rows"`
+	DuplicateRows int           `json:"duplicate_rows"`
+	Recipients    RecipientList `json:"-" gorm:"type:text"`
+	BulkJobID     *uint         `json:"bulk_job_id"` // set once the list has been sent
+	CreatedAt     time.Time     `json:"created_at"`
+}
+
+// UploadRowIssue reports why a row was left out of an upload
+type UploadRowIssue struct {
+	Row         int    `json:"row"`
+	Value       string `json:"value"`
+	Error       string `json:"error"`
+	DuplicateOf int    `json:"duplicate_of,omitempty"` // row that has the same number
+}
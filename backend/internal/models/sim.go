@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// SIM states, as reported by the device
+const (
+	SIMStatusReady    = "ready"
+	SIMStatusAbsent   = "absent"
+	SIMStatusLocked   = "locked"
+	SIMStatusNotReady = "not_ready"
+	SIMStatusUnknown  = "unknown"
+)
+
+// SIM is one SIM slot of a device. Rows are created and updated from the
+// SIM list in the device's device_status frames.
+type SIM struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	DeviceID    uint      `json:"device_id" gorm:"not null"`
+	Slot        int       `json:"slot"`
+	ICCID       string    `json:"iccid" gorm:"column:iccid"`
+	Carrier     string    `json:"carrier"`
+	PhoneNumber string    `json:"phone_number"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	Quota
+	Usage *QuotaUsage `json:"usage,omitempty" gorm:"-"`
+}
+
+func (SIM) TableName() string {
+	return "sims"
+}
+
+// SIMStats is the traffic sent through a single SIM
+type SIMStats struct {
+	SIM
+	MessagesSent        int64 `json:"messages_sent"`
+	MessagesDelivered   int64 `json:"messages_delivered"`
+	MessagesUndelivered int64 `json:"messages_undelivered"`
+	MessagesFailed      int64 `json:"messages_failed"`
+	MessagesPending     int64 `json:"messages_pending"`
+	Calls               int64 `json:"calls"`
+	CallSeconds         int64 `json:"call_seconds"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// DeviceTelemetry is one device_status report from a device. Fields the
+// device didn't include in the report are left NULL.
+type DeviceTelemetry struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	DeviceID       uint      `json:"device_id" gorm:"not null"`
+	BatteryLevel   *int      `json:"battery_level"`
+	Charging       *bool     `json:"charging"`
+	SignalStrength *int      `json:"signal_strength"`
+	NetworkType    string    `json:"network_type,omitempty"`
+	Operator       string    `json:"operator,omitempty"`
+	SIMState       string    `json:"sim_state,omitempty"`
+	RecordedAt     time.Time `json:"recorded_at" gorm:"not null"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (DeviceTelemetry) TableName() string {
+	return "device_telemetry"
+}
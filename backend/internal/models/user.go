@@ -10,6 +10,7 @@ type User struct {
 	Email     string    `json:"email" gorm:"unique;not null"`
 	Password  string    `json:"-" gorm:"not null"`
 	Role      string    `json:"role" gorm:"default:'user'"`
+	Plan      string    `json:"plan" gorm:"default:'free'"` // selects rate limits
 	IsActive  bool      `json:"is_active" gorm:"default:true"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -0,0 +1,70 @@
+package models
+
+import "time"
+
+// USSDSession is a USSD dialog run on a device, e.g. a balance check with
+// *123#. Menus that ask for input keep the session active until replied to.
+type USSDSession struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null"`
+	DeviceID  uint       `json:"device_id" gorm:"not null"`
+	SIMID     *uint      `json:"sim_id,omitempty" gorm:"column:sim_id"`
+	Code      string     `json:"code" gorm:"not null"`
+	Status    string     `json:"status" gorm:"default:'active'"`
+	Steps     []USSDStep `json:"steps,omitempty" gorm:"foreignKey:SessionID"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+}
+
+// USSDStep is one request sent in a session (the code, then each menu
+// reply) and the network's response to it
+type USSDStep struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	SessionID   uint       `json:"session_id" gorm:"not null"`
+	Input       string     `json:"input" gorm:"not null"`
+	Response    string     `json:"response,omitempty"`
+	Status      string     `json:"status" gorm:"default:'pending'"`
+	ErrorMsg    string     `json:"error_msg,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+}
+
+// Values of USSDSession.Status
+const (
+	USSDSessionActive    = "active" // waiting for a response or a menu reply
+	USSDSessionCompleted = "completed"
+	USSDSessionFailed    = "failed"
+	USSDSessionTimeout   = "timeout"
+	USSDSessionCancelled = "cancelled"
+)
+
+// Values of USSDStep.Status
+const (
+	USSDStepPending   = "pending"
+	USSDStepContinue  = "continue" // the response is a menu waiting for input
+	USSDStepCompleted = "completed"
+	USSDStepFailed    = "failed"
+	USSDStepTimeout   = "timeout"
+)
+
+type USSDRequest struct {
+	Code    string `json:"code" binding:"required"`
+	SIMID   *uint  `json:"sim_id"`   // dial from this SIM
+	SIMSlot *int   `json:"sim_slot"` // or from this slot of the device
+	// Seconds to wait for the response; defaults to USSD_TIMEOUT
+	Timeout int `json:"timeout" binding:"omitempty,min=1,max=120"`
+}
+
+type USSDReplyRequest struct {
+	Input   string `json:"input" binding:"required"`
+	Timeout int    `json:"timeout" binding:"omitempty,min=1,max=120"`
+}
+
+func (USSDSession) TableName() string {
+	return "ussd_sessions"
+}
+
+func (USSDStep) TableName() string {
+	return "ussd_steps"
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Verification is a one-time code sent to a phone number by SMS or voice
+// call. Only a hash of the code is stored.
+type Verification struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	UserID      uint       `json:"user_id"`
+	PhoneNumber string     `json:"phone_number" gorm:"not null"`
+	Channel     string     `json:"channel" gorm:"default:'sms'"`
+	CodeHash    string     `json:"-" gorm:"not null"`
+	Status      string     `json:"status" gorm:"default:'pending'"`
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	VerifiedAt  *time.Time `json:"verified_at,omitempty"`
+	MessageID   *uint      `json:"message_id,omitempty"`
+	CallID      *uint      `json:"call_id,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+
+	// Status of the SMS carrying the code when the verification started:
+	// pending once handed to a device, queued while it waits for one
+	MessageStatus string `json:"message_status,omitempty" gorm:"-"`
+}
+
+// Values of Verification.Status
+const (
+	VerificationPending   = "pending"
+	VerificationApproved  = "approved"
+	VerificationFailed    = "failed" // out of attempts
+	VerificationExpired   = "expired"
+	VerificationCancelled = "cancelled" // replaced by a newer code for the number
+)
+
+// Values of Verification.Channel
+const (
+	VerifyChannelSMS  = "sms"
+	VerifyChannelCall = "call"
+)
+
+type VerifyStartRequest struct {
+	PhoneNumber string `json:"phone_number" binding:"required"`
+	Channel     string `json:"channel" binding:"omitempty,oneof=sms call"` // default sms
+	DeviceID    uint   `json:"device_id"`
+	// Override the configured code length and lifetime in seconds
+	CodeLength int `json:"code_length" binding:"omitempty,min=4,max=10"`
+	TTL        int `json:"ttl" binding:"omitempty,min=30,max=3600"`
+	// SMS text; must contain {{code}}
+	Template string `json:"template"`
+}
+
+// VerifyCheckRequest identifies the verification by id, or by phone number
+// for the latest one sent to it
+type VerifyCheckRequest struct {
+	ID          uint   `json:"id"`
+	PhoneNumber string `json:"phone_number"`
+	Code        string `json:"code" binding:"required"`
+}
+
+func (v *Verification) HashCode(code string) error {
+	hashedCode, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	v.CodeHash = string(hashedCode)
+	return nil
+}
+
+func (v *Verification) CheckCode(code string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(v.CodeHash), []byte(code)) == nil
+}
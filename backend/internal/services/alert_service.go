@@ -0,0 +1,375 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/websocket"
+)
+
+const (
+	// Battery and signal readings older than this are ignored
+	telemetryMaxAge = 15 * time.Minute
+
+	// failure_rate needs at least this many messages in the window to be meaningful
+	minFailureRateSamples = 5
+
+	defaultFailureRateWindow = 60 * time.Minute
+)
+
+// Hysteresis applied when a rule doesn't set its own
+var defaultHysteresis = map[string]float64{
+	models.AlertMetricBattery:     5,
+	models.AlertMetricSignal:      1,
+	models.AlertMetricOffline:     0,
+	models.AlertMetricFailureRate: 5,
+}
+
+// AlertService periodically evaluates alert rules against device health and
+// delivers notifications when an alert fires or resolves
+type AlertService struct {
+	db         *gorm.DB
+	hub        *websocket.Hub
+	dispatcher *Dispatcher
+	router     *SIMRouter
+	contacts   *ContactBook
+	smtp       config.SMTPConfig
+	interval   time.Duration
+	client     *http.Client
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewAlertService(db *gorm.DB, hub *websocket.Hub, dispatcher *Dispatcher, router *SIMRouter, contacts *ContactBook, alertsConfig config.AlertsConfig, smtpConfig config.SMTPConfig) *AlertService {
+	interval := time.Duration(alertsConfig.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	return &AlertService{
+		db:         db,
+		hub:        hub,
+		dispatcher: dispatcher,
+		router:     router,
+		contacts:   contacts,
+		smtp:       smtpConfig,
+		interval:   interval,
+		client:     newWebhookClient(),
+		quit:       make(chan struct{}),
+	}
+}
+
+// Start runs the evaluation loop in the background until Stop is called
+func (s *AlertService) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.Evaluate()
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the evaluation loop and waits for an in-progress run to finish
+func (s *AlertService) Stop() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+// Evaluate checks every enabled rule once
+func (s *AlertService) Evaluate() {
+	var rules []models.AlertRule
+	if err := s.db.Where("enabled = ?", true).Find(&rules).Error; err != nil {
+		log.Printf("Failed to load alert rules: %v", err)
+		return
+	}
+
+	for _, rule := range rules {
+		var devices []models.Device
+		query := s.db.Where("user_id = ?", rule.UserID)
+		if rule.DeviceID != nil {
+			query = query.Where("id = ?", *rule.DeviceID)
+		}
+		if err := query.Find(&devices).Error; err != nil {
+			log.Printf("Failed to load devices for alert rule %d: %v", rule.ID, err)
+			continue
+		}
+
+		for _, device := range devices {
+			s.evaluateDevice(rule, device)
+		}
+	}
+}
+
+func (s *AlertService) evaluateDevice(rule models.AlertRule, device models.Device) {
+	value, ok := s.measure(rule, device)
+	if !ok {
+		return
+	}
+
+	var active models.Alert
+	err := s.db.Where("rule_id = ? AND device_id = ? AND state = ?", rule.ID, device.ID, "firing").First(&active).Error
+	firing := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Failed to load alert state for rule %d: %v", rule.ID, err)
+		return
+	}
+
+	switch {
+	case !firing && breached(rule, value):
+		alert := models.Alert{
+			RuleID:   rule.ID,
+			DeviceID: device.ID,
+			UserID:   rule.UserID,
+			State:    "firing",
+			Value:    value,
+			Message:  describeAlert(rule, device, value, false),
+			FiredAt:  time.Now().UTC(),
+		}
+		if err := s.db.Create(&alert).Error; err != nil {
+			log.Printf("Failed to store alert for rule %d: %v", rule.ID, err)
+			return
+		}
+		s.notify(rule, device, alert)
+
+	case firing && recovered(rule, value):
+		now := time.Now().UTC()
+		active.State = "resolved"
+		active.Value = value
+		active.Message = describeAlert(rule, device, value, true)
+		active.ResolvedAt = &now
+		if err := s.db.Save(&active).Error; err != nil {
+			log.Printf("Failed to resolve alert %d: %v", active.ID, err)
+			return
+		}
+		s.notify(rule, device, active)
+	}
+}
+
+// measure returns the current value of the rule's metric for a device, or
+// false when there isn't enough data to judge
+func (s *AlertService) measure(rule models.AlertRule, device models.Device) (float64, bool) {
+	switch rule.Metric {
+	case models.AlertMetricBattery, models.AlertMetricSignal:
+		// Readings from a disconnected phone are stale; offline rules cover that case
+		if !s.hub.IsDeviceConnected(device.DeviceID) {
+			return 0, false
+		}
+
+		column := "battery_level"
+		if rule.Metric == models.AlertMetricSignal {
+			column = "signal_strength"
+		}
+
+		var telemetry models.DeviceTelemetry
+		err := s.db.Where("device_id = ? AND recorded_at >= ? AND "+column+" IS NOT NULL", device.ID, time.Now().UTC().Add(-telemetryMaxAge)).
+			Order("recorded_at DESC").
+			First(&telemetry).Error
+		if err != nil {
+			return 0, false
+		}
+
+		if rule.Metric == models.AlertMetricSignal {
+			return float64(*telemetry.SignalStrength), true
+		}
+		return float64(*telemetry.BatteryLevel), true
+
+	case models.AlertMetricOffline:
+		if s.hub.IsDeviceConnected(device.DeviceID) {
+			return 0, true
+		}
+
+		lastSeen := device.LastSeenAt
+		if info, ok := s.hub.GetDeviceStatus(device.DeviceID); ok && info.LastSeen.After(lastSeen) {
+			lastSeen = info.LastSeen
+		}
+		if lastSeen.IsZero() {
+			return 0, false
+		}
+		return time.Since(lastSeen).Minutes(), true
+
+	case models.AlertMetricFailureRate:
+		window := time.Duration(rule.WindowMinutes) * time.Minute
+		if window <= 0 {
+			window = defaultFailureRateWindow
+		}
+		since := time.Now().UTC().Add(-window)
+
+		var total, failed int64
+		base := s.db.Model(&models.Message{}).Where("device_id = ? AND created_at >= ?", device.ID, since)
+		if err := base.Session(&gorm.Session{}).Where("status IN ?", []string{"sent", "delivered", "undelivered", "failed"}).Count(&total).Error; err != nil {
+			return 0, false
+		}
+		if total < minFailureRateSamples {
+			return 0, false
+		}
+		if err := base.Session(&gorm.Session{}).Where("status = ?", "failed").Count(&failed).Error; err != nil {
+			return 0, false
+		}
+		return float64(failed) / float64(total) * 100, true
+	}
+
+	return 0, false
+}
+
+// lowerIsWorse reports whether the metric alerts when it drops below the threshold
+func lowerIsWorse(metric string) bool {
+	return metric == models.AlertMetricBattery || metric == models.AlertMetricSignal
+}
+
+func hysteresis(rule models.AlertRule) float64 {
+	if rule.Hysteresis > 0 {
+		return rule.Hysteresis
+	}
+	return defaultHysteresis[rule.Metric]
+}
+
+func breached(rule models.AlertRule, value float64) bool {
+	if lowerIsWorse(rule.Metric) {
+		return value < rule.Threshold
+	}
+	return value > rule.Threshold
+}
+
+// recovered requires the value to move back past the threshold by the
+// hysteresis margin so a metric hovering around the threshold doesn't flap
+func recovered(rule models.AlertRule, value float64) bool {
+	if lowerIsWorse(rule.Metric) {
+		return value >= rule.Threshold+hysteresis(rule)
+	}
+	return value <= rule.Threshold-hysteresis(rule)
+}
+
+func describeAlert(rule models.AlertRule, device models.Device, value float64, resolved bool) string {
+	name := device.Name
+	if name == "" {
+		name = device.DeviceID
+	}
+
+	var reading string
+	switch rule.Metric {
+	case models.AlertMetricBattery:
+		reading = fmt.Sprintf("battery %.0f%% (threshold %.0f%%)", value, rule.Threshold)
+	case models.AlertMetricSignal:
+		reading = fmt.Sprintf("signal level %.0f (threshold %.0f)", value, rule.Threshold)
+	case models.AlertMetricOffline:
+		reading = fmt.Sprintf("offline for %.0f minutes (threshold %.0f)", value, rule.Threshold)
+	case models.AlertMetricFailureRate:
+		reading = fmt.Sprintf("SMS failure rate %.1f%% (threshold %.1f%%)", value, rule.Threshold)
+	}
+
+	if resolved {
+		return fmt.Sprintf("Resolved: device %s recovered, %s", name, reading)
+	}
+	return fmt.Sprintf("Alert: device %s %s", name, reading)
+}
+
+func (s *AlertService) notify(rule models.AlertRule, device models.Device, alert models.Alert) {
+	var err error
+	switch rule.Channel {
+	case models.AlertChannelEmail:
+		err = s.sendEmail(rule.Target, alert)
+	case models.AlertChannelWebhook:
+		err = s.sendWebhook(rule, device, alert)
+	case models.AlertChannelSMS:
+		err = s.sendSMS(rule, device, alert)
+	default:
+		err = fmt.Errorf("unknown channel %q", rule.Channel)
+	}
+
+	if err != nil {
+		log.Printf("Failed to deliver alert %d via %s: %v", alert.ID, rule.Channel, err)
+		return
+	}
+	log.Printf("Alert %d (%s) delivered via %s", alert.ID, alert.State, rule.Channel)
+}
+
+func (s *AlertService) sendEmail(to string, alert models.Alert) error {
+	text := alert.Message + "\r\n\r\nFired at: " + alert.FiredAt.Format(time.RFC1123)
+	return sendMail(s.smtp, to, "[Remote SIM Gateway] "+alert.Message, text)
+}
+
+func (s *AlertService) sendWebhook(rule models.AlertRule, device models.Device, alert models.Alert) error {
+	return postJSON(s.client, rule.Target, map[string]interface{}{
+		"event": "alert." + alert.State,
+		"alert": alert,
+		"rule":  rule,
+		"device": map[string]interface{}{
+			"id":        device.ID,
+			"device_id": device.DeviceID,
+			"name":      device.Name,
+		},
+	})
+}
+
+// sendSMS delivers the alert through another of the user's devices, since
+// the device the alert is about may be the one that's unhealthy. The message
+// is created once and goes through the dispatcher like any SMS, so quotas
+// apply and it falls back to other devices or waits in the queue.
+func (s *AlertService) sendSMS(rule models.AlertRule, subject models.Device, alert models.Alert) error {
+	optedOut, err := s.contacts.OptedOut(rule.UserID, []string{rule.Target})
+	if err != nil {
+		return err
+	}
+	if optedOut[rule.Target] {
+		return fmt.Errorf("%s has opted out", rule.Target)
+	}
+
+	var candidates []models.Device
+	if err := s.db.Preload("SIMs").Where("user_id = ? AND id <> ?", rule.UserID, subject.ID).Order("id").Find(&candidates).Error; err != nil {
+		return err
+	}
+
+	healthy := make([]models.Device, 0, len(candidates))
+	for _, device := range candidates {
+		if s.hub.CheckCommand(device.DeviceID, "send_sms") != nil {
+			continue
+		}
+
+		// Skip devices with alerts of their own
+		var firing int64
+		s.db.Model(&models.Alert{}).Where("device_id = ? AND state = ?", device.ID, "firing").Count(&firing)
+		if firing == 0 {
+			healthy = append(healthy, device)
+		}
+	}
+	if len(healthy) == 0 {
+		return errors.New("no other healthy device available to send the alert SMS")
+	}
+
+	device := s.router.SelectDevice(healthy, rule.Target)
+	sim := s.router.SelectSIM(device.SIMs, rule.Target)
+	message := models.Message{
+		PhoneNumber: rule.Target,
+		Content:     alert.Message,
+		Status:      "pending",
+		DeviceID:    device.ID,
+		UserID:      rule.UserID,
+		Priority:    models.PriorityHigh,
+	}
+	if sim != nil {
+		message.SIMID = &sim.ID
+	}
+	if err := s.db.Create(&message).Error; err != nil {
+		return err
+	}
+
+	return s.dispatcher.SendSMS(&message, device, sim)
+}
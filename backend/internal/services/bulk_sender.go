@@ -0,0 +1,273 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+)
+
+// Recipients inserted per statement when a bulk job is created
+const bulkInsertBatchSize = 500
+
+var ErrUploadSent = errors.New("recipient list was already sent")
+
+// BulkSender feeds the queued messages of running bulk jobs to the
+// Dispatcher, at most SendRate per device each second, so a large job
+// doesn't flood a device's command queue.
+type BulkSender struct {
+	db         *gorm.DB
+	dispatcher *Dispatcher
+	rate       int
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewBulkSender(db *gorm.DB, dispatcher *Dispatcher, bulkConfig config.BulkConfig) *BulkSender {
+	rate := bulkConfig.SendRate
+	if rate <= 0 {
+		rate = 5
+	}
+
+	return &BulkSender{
+		db:         db,
+		dispatcher: dispatcher,
+		rate:       rate,
+		quit:       make(chan struct{}),
+	}
+}
+
+// Start sends in the background until Stop is called
+func (s *BulkSender) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.SendPending()
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (s *BulkSender) Stop() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+// CreateJob stores the job and its messages, which must be ready to queue.
+// When the recipients come from an upload, the upload is claimed for the
+// job in the same transaction; ErrUploadSent means another job claimed it
+// first and nothing was stored. The job only starts sending once committed.
+func (s *BulkSender) CreateJob(job *models.BulkJob, messages []models.Message, upload *models.RecipientUpload) error {
+	job.Status = models.BulkJobRunning
+	job.Total = len(messages)
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(job).Error; err != nil {
+			return err
+		}
+
+		if upload != nil {
+			result := tx.Model(&models.RecipientUpload{}).
+				Where("id = ? AND bulk_job_id IS NULL", upload.ID).
+				Update("bulk_job_id", job.ID)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return ErrUploadSent
+			}
+			upload.BulkJobID = &job.ID
+		}
+
+		for i := range messages {
+			messages[i].BulkJobID = &job.ID
+			messages[i].Status = "queued"
+		}
+		return tx.CreateInBatches(messages, bulkInsertBatchSize).Error
+	})
+}
+
+// SendPending hands each device up to one second's worth of messages from
+// the running jobs, oldest job first, and completes jobs with nothing left
+// to send. Bulk commands still waiting in a device's lane count against its
+// second, so a slow device's backlog stays in the database where the job
+// can be paused or cancelled.
+func (s *BulkSender) SendPending() {
+	var jobs []models.BulkJob
+	if err := s.db.Where("status = ?", models.BulkJobRunning).Order("id").Find(&jobs).Error; err != nil {
+		log.Printf("Failed to fetch running bulk jobs: %v", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	sent := make(map[uint]int) // per job device
+
+	for _, job := range jobs {
+		var deviceID uint
+		if job.DeviceID != nil {
+			deviceID = *job.DeviceID
+		}
+		if _, seen := sent[deviceID]; !seen {
+			sent[deviceID] = s.heldBulk(deviceID)
+		}
+		budget := s.rate - sent[deviceID]
+		if budget <= 0 {
+			continue
+		}
+
+		var messages []models.Message
+		err := s.db.Where("bulk_job_id = ? AND status = ? AND (held_until IS NULL OR held_until <= ?)", job.ID, "queued", now).
+			Order("id").
+			Limit(budget).
+			Find(&messages).Error
+		if err != nil {
+			log.Printf("Failed to fetch messages of bulk job %d: %v", job.ID, err)
+			continue
+		}
+
+		if len(messages) == 0 {
+			s.completeIfDone(job.ID)
+			continue
+		}
+
+		for i := range messages {
+			// Stop as soon as the job is paused or cancelled
+			if !s.isRunning(job.ID) {
+				break
+			}
+			if err := s.dispatcher.SendQueued(&messages[i]); err != nil {
+				log.Printf("Failed to dispatch message %d of bulk job %d: %v", messages[i].ID, job.ID, err)
+			}
+			sent[deviceID]++
+		}
+	}
+}
+
+// heldBulk counts the bulk commands waiting in a device's priority lanes
+func (s *BulkSender) heldBulk(deviceID uint) int {
+	if deviceID == 0 {
+		return 0
+	}
+	var device models.Device
+	if err := s.db.Select("device_id").First(&device, deviceID).Error; err != nil {
+		return 0
+	}
+	return s.dispatcher.hub.HeldCommands(device.DeviceID, models.PriorityBulk)
+}
+
+func (s *BulkSender) isRunning(jobID uint) bool {
+	var count int64
+	s.db.Model(&models.BulkJob{}).Where("id = ? AND status = ?", jobID, models.BulkJobRunning).Count(&count)
+	return count > 0
+}
+
+// completeIfDone marks the job completed once none of its messages are
+// queued, including ones held over quota
+func (s *BulkSender) completeIfDone(jobID uint) {
+	var queued int64
+	if err := s.db.Model(&models.Message{}).Where("bulk_job_id = ? AND status = ?", jobID, "queued").Count(&queued).Error; err != nil {
+		log.Printf("Failed to count queued messages of bulk job %d: %v", jobID, err)
+		return
+	}
+	if queued > 0 {
+		return
+	}
+
+	err := s.db.Model(&models.BulkJob{}).
+		Where("id = ? AND status = ?", jobID, models.BulkJobRunning).
+		Updates(map[string]interface{}{"status": models.BulkJobCompleted, "finished_at": time.Now().UTC()}).Error
+	if err != nil {
+		log.Printf("Failed to complete bulk job %d: %v", jobID, err)
+	}
+}
+
+// Pause stops sending a running job. It returns false if the job wasn't running.
+func (s *BulkSender) Pause(job *models.BulkJob) (bool, error) {
+	return s.transition(job, []string{models.BulkJobRunning}, models.BulkJobPaused)
+}
+
+// Resume continues a paused job. It returns false if the job wasn't paused.
+func (s *BulkSender) Resume(job *models.BulkJob) (bool, error) {
+	return s.transition(job, []string{models.BulkJobPaused}, models.BulkJobRunning)
+}
+
+// Cancel stops a running or paused job for good and cancels its queued
+// messages. Messages already handed to a device are unaffected. It returns
+// false if the job had already finished.
+func (s *BulkSender) Cancel(job *models.BulkJob) (bool, error) {
+	changed, err := s.transition(job, []string{models.BulkJobRunning, models.BulkJobPaused}, models.BulkJobCancelled)
+	if err != nil || !changed {
+		return changed, err
+	}
+
+	err = s.db.Model(&models.Message{}).
+		Where("bulk_job_id = ? AND status = ?", job.ID, "queued").
+		Updates(map[string]interface{}{"status": "cancelled", "held_until": nil}).Error
+	return true, err
+}
+
+func (s *BulkSender) transition(job *models.BulkJob, from []string, to string) (bool, error) {
+	updates := map[string]interface{}{"status": to}
+	if to == models.BulkJobCancelled {
+		updates["finished_at"] = time.Now().UTC()
+	}
+
+	result := s.db.Model(&models.BulkJob{}).Where("id = ? AND status IN ?", job.ID, from).Updates(updates)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	return true, s.db.First(job, job.ID).Error
+}
+
+// Progress counts the job's messages by status
+func (s *BulkSender) Progress(jobID uint) (*models.BulkJobProgress, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	err := s.db.Model(&models.Message{}).
+		Select("status, COUNT(*) AS count").
+		Where("bulk_job_id = ?", jobID).
+		Group("status").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &models.BulkJobProgress{}
+	for _, row := range rows {
+		switch row.Status {
+		case "queued":
+			progress.Queued = row.Count
+		case "pending":
+			progress.Pending = row.Count
+		case "sent":
+			progress.Sent = row.Count
+		case "delivered":
+			progress.Delivered = row.Count
+		case "undelivered":
+			progress.Undelivered = row.Count
+		case "failed":
+			progress.Failed = row.Count
+		case "expired":
+			progress.Expired = row.Count
+		case "cancelled":
+			progress.Cancelled = row.Count
+		}
+	}
+	return progress, nil
+}
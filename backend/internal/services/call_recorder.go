@@ -0,0 +1,346 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/websocket"
+)
+
+var (
+	ErrRecordingTooLarge  = errors.New("recording is too large")
+	ErrRecordingType      = errors.New("recording type is not allowed")
+	ErrRecordingExists    = errors.New("call already has a recording")
+	ErrRecordingSignature = errors.New("invalid or expired recording upload signature")
+	ErrRecordingUpload    = errors.New("failed to read recording upload")
+)
+
+// Recordings pruned per query once past their retention
+const recordingPruneBatchSize = 500
+
+// CallRecorder records the call_status reports devices send, asks devices
+// with the call_recording capability to upload the audio of ended calls and
+// deletes recordings past their retention
+type CallRecorder struct {
+	db     *gorm.DB
+	hub    *websocket.Hub
+	config config.RecordingsConfig
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewCallRecorder(db *gorm.DB, hub *websocket.Hub, recordingsConfig config.RecordingsConfig) *CallRecorder {
+	return &CallRecorder{
+		db:     db,
+		hub:    hub,
+		config: recordingsConfig,
+		quit:   make(chan struct{}),
+	}
+}
+
+// Start prunes expired recordings every hour until Stop
+func (r *CallRecorder) Start() {
+	if r.config.RetentionDays <= 0 {
+		return
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		r.Prune()
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.Prune()
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (r *CallRecorder) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
+
+// MaxSize is the most bytes accepted in one recording
+func (r *CallRecorder) MaxSize() int {
+	return r.config.MaxSize
+}
+
+// UploadTimeout is how long one upload request may take
+func (r *CallRecorder) UploadTimeout() time.Duration {
+	return time.Duration(r.config.UploadTimeout) * time.Second
+}
+
+// RecordStatus updates a call from a call_status report; it is the hub's
+// OnCallStatus hook. Reports for calls that already ended are ignored.
+func (r *CallRecorder) RecordStatus(deviceID string, frame *websocket.CallStatusFrame) {
+	var call models.Call
+	err := r.db.Select("calls.*").
+		Joins("JOIN devices ON devices.id = calls.device_id").
+		Where("calls.id = ? AND devices.device_id = ?", frame.CallID, deviceID).
+		First(&call).Error
+	if err != nil {
+		log.Printf("Ignoring call status for unknown call %d from device %s", frame.CallID, deviceID)
+		return
+	}
+	if call.Status == "ended" || call.Status == "failed" {
+		return
+	}
+
+	now := time.Now().UTC()
+	updates := map[string]interface{}{"status": frame.Status}
+	if !frame.StartedAt.IsZero() {
+		call.StartedAt = frame.StartedAt.UTC()
+		updates["started_at"] = call.StartedAt
+	} else if frame.Status == "connected" {
+		updates["started_at"] = now
+	}
+
+	if frame.Status != "connected" {
+		endedAt := now
+		if !frame.EndedAt.IsZero() {
+			endedAt = frame.EndedAt.UTC()
+		}
+		updates["ended_at"] = endedAt
+
+		// Older apps don't report the duration of answered calls
+		duration := frame.Duration
+		if duration == 0 && frame.Status == "ended" && !call.StartedAt.IsZero() && endedAt.After(call.StartedAt) {
+			duration = int(endedAt.Sub(call.StartedAt).Seconds())
+		}
+		updates["duration"] = duration
+		if frame.ErrorMsg != "" {
+			updates["error_msg"] = frame.ErrorMsg
+		}
+	}
+
+	if err := r.db.Model(&models.Call{}).Where("id = ?", call.ID).Updates(updates).Error; err != nil {
+		log.Printf("Failed to update call %d: %v", call.ID, err)
+		return
+	}
+
+	if frame.Status == "ended" && r.hub.HasCapability(deviceID, websocket.CapabilityCallRecording) {
+		r.requestUpload(deviceID, call.ID)
+	}
+}
+
+// Save streams the recording a device uploaded for the call to disk. The
+// upload URL must have been checked with Verify first. Its type is detected
+// from the contents; declaredType is only used for formats that can't be
+// detected, like AMR. Failures reading upload wrap ErrRecordingUpload.
+func (r *CallRecorder) Save(callID uint, declaredType string, upload io.Reader) (*models.CallRecording, error) {
+	var call models.Call
+	if err := r.db.First(&call, callID).Error; err != nil {
+		return nil, err
+	}
+
+	var existing int64
+	if err := r.db.Model(&models.CallRecording{}).Where("call_id = ?", call.ID).Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, ErrRecordingExists
+	}
+
+	upload = uploadReader{upload}
+
+	// DetectContentType looks at no more than the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(upload, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if contentType == "application/octet-stream" {
+		contentType, _, _ = mime.ParseMediaType(declaredType)
+	}
+	if !r.allowed(contentType) {
+		return nil, fmt.Errorf("%w: %s", ErrRecordingType, contentType)
+	}
+
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(strconv.FormatUint(uint64(call.UserID), 10), hex.EncodeToString(name))
+
+	fullPath := filepath.Join(r.config.Dir, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o750); err != nil {
+		return nil, err
+	}
+	size, err := r.writeFile(fullPath, io.MultiReader(bytes.NewReader(head), upload))
+	if err != nil {
+		os.Remove(fullPath)
+		return nil, err
+	}
+
+	recording := models.CallRecording{
+		CallID:      call.ID,
+		UserID:      call.UserID,
+		ContentType: contentType,
+		Size:        size,
+		Path:        path,
+	}
+	if err := r.db.Create(&recording).Error; err != nil {
+		os.Remove(fullPath)
+		return nil, err
+	}
+	return &recording, nil
+}
+
+// writeFile copies upload to a new file at path, stopping with
+// ErrRecordingTooLarge once it passes MaxSize
+func (r *CallRecorder) writeFile(path string, upload io.Reader) (int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := io.Copy(file, io.LimitReader(upload, int64(r.config.MaxSize)+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if size > int64(r.config.MaxSize) {
+		return 0, ErrRecordingTooLarge
+	}
+	return size, nil
+}
+
+// uploadReader wraps read errors in ErrRecordingUpload, telling a broken
+// upload apart from a failure to store it
+type uploadReader struct {
+	io.Reader
+}
+
+func (u uploadReader) Read(p []byte) (int, error) {
+	n, err := u.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %w", ErrRecordingUpload, err)
+	}
+	return n, err
+}
+
+// Path is where the recording's file is stored
+func (r *CallRecorder) Path(recording *models.CallRecording) string {
+	return filepath.Join(r.config.Dir, recording.Path)
+}
+
+// Delete removes a recording and its file
+func (r *CallRecorder) Delete(recording *models.CallRecording) error {
+	if err := r.db.Delete(recording).Error; err != nil {
+		return err
+	}
+	if err := os.Remove(r.Path(recording)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove recording file %s: %v", recording.Path, err)
+	}
+	return nil
+}
+
+// Prune deletes recordings older than RECORDING_RETENTION_DAYS
+func (r *CallRecorder) Prune() {
+	cutoff := time.Now().UTC().AddDate(0, 0, -r.config.RetentionDays)
+
+	pruned := 0
+	for {
+		var recordings []models.CallRecording
+		if err := r.db.Where("created_at < ?", cutoff).Order("id").Limit(recordingPruneBatchSize).Find(&recordings).Error; err != nil {
+			log.Printf("Failed to fetch expired recordings: %v", err)
+			return
+		}
+		for i := range recordings {
+			if err := r.Delete(&recordings[i]); err != nil {
+				log.Printf("Failed to prune recording %d: %v", recordings[i].ID, err)
+				return
+			}
+		}
+		pruned += len(recordings)
+		if len(recordings) < recordingPruneBatchSize {
+			break
+		}
+	}
+
+	if pruned > 0 {
+		log.Printf("Pruned %d call recordings older than %d days", pruned, r.config.RetentionDays)
+	}
+}
+
+// requestUpload sends the device a signed URL to upload the call's
+// recording to, valid for RECORDING_UPLOAD_TTL seconds
+func (r *CallRecorder) requestUpload(deviceID string, callID uint) {
+	expiresAt := time.Now().Add(time.Duration(r.config.UploadTTL) * time.Second).UTC().Truncate(time.Second)
+	url := fmt.Sprintf("%s/calls/%d/recording?expires=%d&signature=%s",
+		strings.TrimRight(r.config.PublicURL, "/"), callID, expiresAt.Unix(), r.sign(callID, expiresAt.Unix()))
+
+	err := r.hub.SendCommand(deviceID, websocket.Message{
+		Type: "upload_recording",
+		Data: websocket.UploadRecordingFrame{
+			CallID:    callID,
+			URL:       url,
+			ExpiresAt: expiresAt,
+			MaxSize:   r.config.MaxSize,
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to request recording of call %d from device %s: %v", callID, deviceID, err)
+	}
+}
+
+// Verify checks the expires and signature parameters of an upload URL
+func (r *CallRecorder) Verify(callID uint, expires, signature string) error {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return ErrRecordingSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(r.sign(callID, expiresAt))) {
+		return ErrRecordingSignature
+	}
+	return nil
+}
+
+// sign is keyed like media URLs, so the payload is prefixed to keep a media
+// signature from passing as an upload signature
+func (r *CallRecorder) sign(callID uint, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(r.config.SigningKey))
+	fmt.Fprintf(mac, "recording:%d:%d", callID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (r *CallRecorder) allowed(contentType string) bool {
+	for _, allowed := range r.config.AllowedTypes {
+		if strings.EqualFold(allowed, contentType) {
+			return true
+		}
+	}
+	return false
+}
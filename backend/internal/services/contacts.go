@@ -0,0 +1,458 @@
+package services
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+)
+
+// Contacts looked up or written per statement
+const contactBatchSize = 500
+
+var (
+	tagPattern        = regexp.MustCompile(`^[a-z0-9_:.-]+$`)
+	fieldKeySeparator = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// ContactBook manages users' contacts and matches phone numbers to them.
+// Numbers are stored normalized the same way as uploaded recipient lists.
+type ContactBook struct {
+	db     *gorm.DB
+	config config.RecipientsConfig
+}
+
+func NewContactBook(db *gorm.DB, recipientsConfig config.RecipientsConfig) *ContactBook {
+	return &ContactBook{
+		db:     db,
+		config: recipientsConfig,
+	}
+}
+
+func (b *ContactBook) NormalizeNumber(phoneNumber string) (string, error) {
+	return NormalizePhoneNumber(phoneNumber, b.config.DefaultCountryCode)
+}
+
+// NormalizeTags lowercases tags, splitting any that hold several, and drops
+// repeats
+func NormalizeTags(tags []string) (models.StringList, error) {
+	var normalized models.StringList
+	for _, entry := range tags {
+		for _, tag := range strings.FieldsFunc(entry, func(r rune) bool { return r == ',' || r == ';' || r == '|' }) {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			if tag == "" || normalized.Contains(tag) {
+				continue
+			}
+			if !tagPattern.MatchString(tag) {
+				return nil, fmt.Errorf("invalid tag %q: use letters, digits and _ : . -", tag)
+			}
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized, nil
+}
+
+// TagQuery selects contacts by tag: all of Include and none of Exclude
+type TagQuery struct {
+	Include []string
+	Exclude []string
+}
+
+// ParseTagQuery reads a query like "vip pune -churned"
+func ParseTagQuery(query string) (TagQuery, error) {
+	var q TagQuery
+	for _, term := range strings.FieldsFunc(query, func(r rune) bool { return r == ' ' || r == ',' }) {
+		exclude := strings.HasPrefix(term, "-")
+		tags, err := NormalizeTags([]string{strings.TrimPrefix(term, "-")})
+		if err != nil {
+			return TagQuery{}, err
+		}
+		if len(tags) == 0 {
+			continue
+		}
+		if exclude {
+			q.Exclude = append(q.Exclude, tags[0])
+		} else {
+			q.Include = append(q.Include, tags[0])
+		}
+	}
+	return q, nil
+}
+
+func (q TagQuery) IsEmpty() bool {
+	return len(q.Include) == 0 && len(q.Exclude) == 0
+}
+
+// Apply filters a contacts query. Tags are stored comma-separated, so a tag
+// matches when ",tag," appears in ",tags,".
+func (q TagQuery) Apply(db *gorm.DB) *gorm.DB {
+	escape := strings.NewReplacer(`\`, `\\`, "_", `\_`, "%", `\%`)
+	for _, tag := range q.Include {
+		db = db.Where(`(',' || COALESCE(tags, '') || ',') LIKE ? ESCAPE '\'`, "%,"+escape.Replace(tag)+",%")
+	}
+	for _, tag := range q.Exclude {
+		db = db.Where(`(',' || COALESCE(tags, '') || ',') NOT LIKE ? ESCAPE '\'`, "%,"+escape.Replace(tag)+",%")
+	}
+	return db
+}
+
+// ContactVariables are the template variables of a contact: its custom
+// fields plus name and phone_number
+func ContactVariables(contact *models.Contact) map[string]string {
+	variables := make(map[string]string, len(contact.Fields)+2)
+	for key, value := range contact.Fields {
+		variables[key] = value
+	}
+	if contact.Name != "" {
+		variables["name"] = contact.Name
+	}
+	variables["phone_number"] = contact.PhoneNumber
+	return variables
+}
+
+// Recipients lists the user's contacts in the group, if groupID is set,
+// that match the tag query, as bulk send recipients
+func (b *ContactBook) Recipients(userID uint, groupID *uint, tagQuery TagQuery) ([]models.Recipient, error) {
+	query := b.db.Model(&models.Contact{}).Where("contacts.user_id = ?", userID)
+	if groupID != nil {
+		query = query.Where("contacts.id IN (?)", b.db.Table("contact_group_members").
+			Select("contact_id").
+			Where("contact_group_id = ?", *groupID))
+	}
+	query = tagQuery.Apply(query)
+
+	var contacts []models.Contact
+	if err := query.Order("contacts.id").Find(&contacts).Error; err != nil {
+		return nil, err
+	}
+
+	recipients := make([]models.Recipient, 0, len(contacts))
+	for i := range contacts {
+		recipients = append(recipients, models.Recipient{
+			PhoneNumber: contacts[i].PhoneNumber,
+			Variables:   ContactVariables(&contacts[i]),
+		})
+	}
+	return recipients, nil
+}
+
+// Lookup finds the user's contacts for phone numbers as they appear in
+// message history, keyed by those numbers
+func (b *ContactBook) Lookup(userID uint, phoneNumbers []string) (map[string]*models.Contact, error) {
+	byNormalized, normalized := b.normalizeAll(phoneNumbers)
+
+	found := make(map[string]*models.Contact)
+	for start := 0; start < len(normalized); start += contactBatchSize {
+		end := min(start+contactBatchSize, len(normalized))
+
+		var contacts []models.Contact
+		err := b.db.Where("user_id = ? AND phone_number IN ?", userID, normalized[start:end]).Find(&contacts).Error
+		if err != nil {
+			return nil, err
+		}
+		for i := range contacts {
+			for _, phoneNumber := range byNormalized[contacts[i].PhoneNumber] {
+				found[phoneNumber] = &contacts[i]
+			}
+		}
+	}
+	return found, nil
+}
+
+// normalizeAll maps normalized numbers to the spellings they were given
+// in, and lists them; numbers that don't normalize are left out
+func (b *ContactBook) normalizeAll(phoneNumbers []string) (map[string][]string, []string) {
+	byNormalized := make(map[string][]string)
+	for _, phoneNumber := range phoneNumbers {
+		normalized, err := b.NormalizeNumber(phoneNumber)
+		if err != nil {
+			continue
+		}
+		byNormalized[normalized] = append(byNormalized[normalized], phoneNumber)
+	}
+
+	normalized := make([]string, 0, len(byNormalized))
+	for number := range byNormalized {
+		normalized = append(normalized, number)
+	}
+	return byNormalized, normalized
+}
+
+// OptOut stops sends to a number; ruleID is the inbound rule that asked,
+// if any. Numbers already opted out are left as they are.
+func (b *ContactBook) OptOut(userID uint, phoneNumber string, ruleID *uint) (*models.OptOut, error) {
+	normalized, err := b.NormalizeNumber(phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	optOut := models.OptOut{UserID: userID, PhoneNumber: normalized, RuleID: ruleID}
+	if err := b.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&optOut).Error; err != nil {
+		return nil, err
+	}
+	if optOut.ID == 0 {
+		err = b.db.Where("user_id = ? AND phone_number = ?", userID, normalized).First(&optOut).Error
+	}
+	return &optOut, err
+}
+
+// OptedOut reports which of phoneNumbers the user must not send to, keyed
+// by the numbers as given
+func (b *ContactBook) OptedOut(userID uint, phoneNumbers []string) (map[string]bool, error) {
+	byNormalized, normalized := b.normalizeAll(phoneNumbers)
+
+	optedOut := make(map[string]bool)
+	for start := 0; start < len(normalized); start += contactBatchSize {
+		end := min(start+contactBatchSize, len(normalized))
+
+		var numbers []string
+		err := b.db.Model(&models.OptOut{}).
+			Where("user_id = ? AND phone_number IN ?", userID, normalized[start:end]).
+			Pluck("phone_number", &numbers).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, number := range numbers {
+			for _, phoneNumber := range byNormalized[number] {
+				optedOut[phoneNumber] = true
+			}
+		}
+	}
+	return optedOut, nil
+}
+
+// TagContact adds a tag to the user's contact with phoneNumber, creating
+// the contact if there is none
+func (b *ContactBook) TagContact(userID uint, phoneNumber, tag string) error {
+	normalized, err := b.NormalizeNumber(phoneNumber)
+	if err != nil {
+		return err
+	}
+
+	var contact models.Contact
+	err = b.db.Where("user_id = ? AND phone_number = ?", userID, normalized).First(&contact).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if contact.Tags.Contains(tag) {
+		return nil
+	}
+
+	contact.UserID = userID
+	contact.PhoneNumber = normalized
+	contact.Tags = append(contact.Tags, tag)
+	return b.db.Save(&contact).Error
+}
+
+// ContactImportReport is the outcome of importing a contact spreadsheet
+type ContactImportReport struct {
+	Created       int                     `json:"created"`
+	Updated       int                     `json:"updated"`
+	InvalidRows   int                     `json:"invalid_rows"`
+	DuplicateRows int                     `json:"duplicate_rows"`
+	Invalid       []models.UploadRowIssue `json:"invalid"`
+	Duplicates    []models.UploadRowIssue `json:"duplicates"`
+}
+
+// Import creates or updates the user's contacts from spreadsheet rows. The
+// "name" and "tags" columns fill those fields and every other column except
+// the phone number and "groups" becomes a custom field, so exported files
+// can be imported again. Existing contacts keep fields and tags the file
+// doesn't mention. Imported contacts are added to the group, if groupID is
+// set.
+func (b *ContactBook) Import(userID uint, rows [][]string, phoneColumn string, groupID *uint) (*ContactImportReport, error) {
+	if len(rows) == 0 {
+		return nil, errors.New("the file is empty")
+	}
+
+	header := rows[0]
+	phoneIndex, err := findPhoneColumn(header, phoneColumn)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := RecipientMapping{
+		PhoneColumn:       header[phoneIndex],
+		Variables:         make(map[string]string),
+		OptionalVariables: true,
+	}
+	for i, column := range header {
+		key := FieldKey(column)
+		if i == phoneIndex || key == "" {
+			continue
+		}
+		if _, taken := mapping.Variables[key]; !taken {
+			mapping.Variables[key] = column
+		}
+	}
+
+	parsed, err := ParseRecipients(rows, mapping, b.config.DefaultCountryCode, b.config.MaxRows)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ContactImportReport{
+		InvalidRows:   parsed.InvalidCount,
+		DuplicateRows: parsed.DuplicateCount,
+		Invalid:       parsed.Invalid,
+		Duplicates:    parsed.Duplicates,
+	}
+
+	for _, recipient := range parsed.Recipients {
+		if _, err := NormalizeTags([]string{recipient.Variables["tags"]}); err != nil {
+			report.InvalidRows++
+			if len(report.Invalid) < maxReportedIssues {
+				report.Invalid = append(report.Invalid, models.UploadRowIssue{Row: recipient.Row, Value: recipient.Variables["tags"], Error: err.Error()})
+			}
+		}
+	}
+
+	err = b.db.Transaction(func(tx *gorm.DB) error {
+		for start := 0; start < len(parsed.Recipients); start += contactBatchSize {
+			end := min(start+contactBatchSize, len(parsed.Recipients))
+			if err := b.importBatch(tx, userID, parsed.Recipients[start:end], groupID, report); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (b *ContactBook) importBatch(tx *gorm.DB, userID uint, recipients []models.Recipient, groupID *uint, report *ContactImportReport) error {
+	numbers := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		numbers = append(numbers, recipient.PhoneNumber)
+	}
+
+	var existing []models.Contact
+	if err := tx.Where("user_id = ? AND phone_number IN ?", userID, numbers).Find(&existing).Error; err != nil {
+		return err
+	}
+	byNumber := make(map[string]*models.Contact, len(existing))
+	for i := range existing {
+		byNumber[existing[i].PhoneNumber] = &existing[i]
+	}
+
+	var memberIDs []uint
+	for _, recipient := range recipients {
+		tags, err := NormalizeTags([]string{recipient.Variables["tags"]})
+		if err != nil {
+			continue // reported by Import
+		}
+
+		contact, exists := byNumber[recipient.PhoneNumber]
+		if !exists {
+			contact = &models.Contact{UserID: userID, PhoneNumber: recipient.PhoneNumber}
+		}
+
+		for key, value := range recipient.Variables {
+			switch key {
+			case "name":
+				contact.Name = value
+			case "tags", "groups":
+				// Groups are assigned through groupID, not by name
+			default:
+				if contact.Fields == nil {
+					contact.Fields = make(models.StringMap)
+				}
+				contact.Fields[key] = value
+			}
+		}
+		for _, tag := range tags {
+			if !contact.Tags.Contains(tag) {
+				contact.Tags = append(contact.Tags, tag)
+			}
+		}
+
+		if err := tx.Save(contact).Error; err != nil {
+			return err
+		}
+		if exists {
+			report.Updated++
+		} else {
+			report.Created++
+		}
+		memberIDs = append(memberIDs, contact.ID)
+	}
+
+	if groupID != nil {
+		return AddGroupMembers(tx, *groupID, memberIDs)
+	}
+	return nil
+}
+
+// AddGroupMembers adds contacts to a group, ignoring ones already in it
+func AddGroupMembers(db *gorm.DB, groupID uint, contactIDs []uint) error {
+	if len(contactIDs) == 0 {
+		return nil
+	}
+
+	members := make([]map[string]interface{}, 0, len(contactIDs))
+	for _, contactID := range contactIDs {
+		members = append(members, map[string]interface{}{"contact_group_id": groupID, "contact_id": contactID})
+	}
+	return db.Table("contact_group_members").
+		Clauses(clause.OnConflict{DoNothing: true}).
+		CreateInBatches(members, contactBatchSize).Error
+}
+
+// Export writes the user's contacts as CSV: name, phone_number, tags,
+// groups and then one column per custom field
+func (b *ContactBook) Export(userID uint, w io.Writer) error {
+	var contacts []models.Contact
+	if err := b.db.Preload("Groups").Where("user_id = ?", userID).Order("id").Find(&contacts).Error; err != nil {
+		return err
+	}
+
+	var fieldKeys []string
+	seen := make(map[string]bool)
+	for _, contact := range contacts {
+		for key := range contact.Fields {
+			if !seen[key] {
+				seen[key] = true
+				fieldKeys = append(fieldKeys, key)
+			}
+		}
+	}
+	sort.Strings(fieldKeys)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(append([]string{"name", "phone_number", "tags", "groups"}, fieldKeys...)); err != nil {
+		return err
+	}
+
+	for _, contact := range contacts {
+		groups := make([]string, 0, len(contact.Groups))
+		for _, group := range contact.Groups {
+			groups = append(groups, group.Name)
+		}
+
+		record := []string{contact.Name, contact.PhoneNumber, strings.Join(contact.Tags, ","), strings.Join(groups, ";")}
+		for _, key := range fieldKeys {
+			record = append(record, contact.Fields[key])
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// FieldKey turns a column header like "First Name" into a custom field key
+func FieldKey(header string) string {
+	return strings.Trim(fieldKeySeparator.ReplaceAllString(strings.ToLower(header), "_"), "_")
+}
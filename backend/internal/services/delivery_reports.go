@@ -0,0 +1,181 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/websocket"
+)
+
+// segmentRank orders segment statuses so a late "sent" report can't undo a
+// delivery report that overtook it
+var segmentRank = map[string]int{
+	"pending":     0,
+	"sent":        1,
+	"failed":      1,
+	"expired":     1,
+	"delivered":   2,
+	"undelivered": 2,
+}
+
+// RecordStatus stores an sms_status frame for one of the device's outbound
+// messages and updates the message's status from its segments; it is the
+// hub's OnSMSStatus hook
+func (d *Dispatcher) RecordStatus(deviceID string, frame *websocket.SMSStatusFrame) {
+	if err := d.recordStatus(deviceID, frame); err != nil {
+		log.Printf("Failed to record %s status of message %d from device %s: %v", frame.Status, frame.MessageID, deviceID, err)
+	}
+}
+
+func (d *Dispatcher) recordStatus(deviceID string, frame *websocket.SMSStatusFrame) error {
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+
+	var device models.Device
+	if err := d.db.Select("id").Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return err
+	}
+
+	var message models.Message
+	err := d.db.Where("id = ? AND device_id = ? AND direction = ?", frame.MessageID, device.ID, models.MessageOutbound).
+		First(&message).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errors.New("not a message sent through this device")
+	}
+	if err != nil {
+		return err
+	}
+	if message.Status == "queued" || message.Status == "cancelled" {
+		return fmt.Errorf("message is %s", message.Status)
+	}
+
+	now := time.Now().UTC()
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		var segment models.MessageSegment
+		err := tx.Where("message_id = ? AND segment = ?", message.ID, frame.Segment).First(&segment).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		segment.MessageID = message.ID
+		segment.Segment = frame.Segment
+		applySegmentStatus(&segment, frame, now)
+		if err := tx.Save(&segment).Error; err != nil {
+			return err
+		}
+
+		var segments []models.MessageSegment
+		if err := tx.Where("message_id = ?", message.ID).Order("segment").Find(&segments).Error; err != nil {
+			return err
+		}
+
+		count := message.Segments
+		if frame.Segments > count {
+			count = frame.Segments
+		}
+		updates := messageStatus(segments, count)
+		updates["segments"] = count
+		return tx.Model(&message).Updates(updates).Error
+	})
+}
+
+// applySegmentStatus records a report on one segment. Reports may arrive
+// out of order, so a status only replaces one of the same or lower rank.
+func applySegmentStatus(segment *models.MessageSegment, frame *websocket.SMSStatusFrame, now time.Time) {
+	if segment.Status == "" {
+		segment.Status = "pending"
+	}
+
+	switch frame.Status {
+	case "sent":
+		if segment.SentAt == nil || !frame.SentAt.IsZero() {
+			sentAt := reportTime(frame.SentAt, now)
+			segment.SentAt = &sentAt
+		}
+	case "delivered":
+		deliveredAt := reportTime(frame.DeliveredAt, now)
+		segment.DeliveredAt = &deliveredAt
+	}
+
+	if segmentRank[frame.Status] >= segmentRank[segment.Status] {
+		segment.Status = frame.Status
+		segment.ErrorMsg = frame.ErrorMsg
+	}
+}
+
+// messageStatus derives a message's status from its segment reports; parts
+// without a report yet count as pending. One failed, expired or undelivered
+// part fails the whole message, since the recipient can't read it.
+func messageStatus(segments []models.MessageSegment, count int) map[string]interface{} {
+	var failed, expired, undelivered *models.MessageSegment
+	var sentAt, deliveredAt time.Time
+	sent, delivered := 0, 0
+
+	for i := range segments {
+		segment := &segments[i]
+		if segment.Segment >= count {
+			continue
+		}
+
+		switch segment.Status {
+		case "failed":
+			if failed == nil {
+				failed = segment
+			}
+		case "expired":
+			if expired == nil {
+				expired = segment
+			}
+		case "undelivered":
+			if undelivered == nil {
+				undelivered = segment
+			}
+		case "delivered":
+			delivered++
+			sent++
+		case "sent":
+			sent++
+		}
+
+		if segment.SentAt != nil && segment.SentAt.After(sentAt) {
+			sentAt = *segment.SentAt
+		}
+		if segment.DeliveredAt != nil && segment.DeliveredAt.After(deliveredAt) {
+			deliveredAt = *segment.DeliveredAt
+		}
+	}
+
+	updates := map[string]interface{}{"status": "pending", "error_msg": "", "delivered_at": nil}
+	switch {
+	case failed != nil:
+		updates["status"] = "failed"
+		updates["error_msg"] = failed.ErrorMsg
+	case expired != nil:
+		updates["status"] = "expired"
+		updates["error_msg"] = expired.ErrorMsg
+	case undelivered != nil:
+		updates["status"] = "undelivered"
+		updates["error_msg"] = undelivered.ErrorMsg
+	case delivered == count:
+		updates["status"] = "delivered"
+		updates["delivered_at"] = deliveredAt
+	case sent == count:
+		updates["status"] = "sent"
+	}
+	if !sentAt.IsZero() {
+		updates["sent_at"] = sentAt
+	}
+	return updates
+}
+
+// reportTime is when the device says something happened, or now if it
+// didn't say
+func reportTime(reported, now time.Time) time.Time {
+	if reported.IsZero() {
+		return now
+	}
+	return reported.UTC()
+}
@@ -0,0 +1,394 @@
+package services
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/websocket"
+)
+
+// Queued messages dispatched per retry pass
+const dispatchBatchSize = 500
+
+// priorityOrder sorts queued messages high priority first
+const priorityOrder = "CASE priority WHEN 'high' THEN 0 WHEN 'normal' THEN 1 ELSE 2 END"
+
+// Dispatcher hands stored messages to devices, enforcing device and SIM
+// quotas. A message over quota is sent through another SIM or device when
+// the sender didn't pin it, and otherwise queued until its quota resets.
+type Dispatcher struct {
+	db       *gorm.DB
+	hub      *websocket.Hub
+	router   *SIMRouter
+	quotas   *QuotaTracker
+	media    *MediaStore
+	interval time.Duration
+
+	// Serialize quota checks with the dispatch they allow, per device; a
+	// device's lock covers its SIMs
+	locksMu     sync.Mutex
+	deviceLocks map[uint]*sync.Mutex
+
+	// Serializes status reports, which devices may send for several
+	// segments of a message at once
+	statusMu sync.Mutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+type route struct {
+	device *models.Device
+	sim    *models.SIM
+}
+
+func NewDispatcher(db *gorm.DB, hub *websocket.Hub, router *SIMRouter, quotas *QuotaTracker, media *MediaStore, quotasConfig config.QuotasConfig) *Dispatcher {
+	interval := time.Duration(quotasConfig.RetryInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	return &Dispatcher{
+		db:          db,
+		hub:         hub,
+		router:      router,
+		quotas:      quotas,
+		media:       media,
+		interval:    interval,
+		deviceLocks: make(map[uint]*sync.Mutex),
+		quit:        make(chan struct{}),
+	}
+}
+
+// Start retries queued messages in the background until Stop is called
+func (d *Dispatcher) Start() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				d.DispatchQueued()
+			case <-d.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (d *Dispatcher) Stop() {
+	close(d.quit)
+	d.wg.Wait()
+}
+
+// SendSMS dispatches a stored message through device and sim (nil if the
+// device doesn't report SIMs). Over quota it tries the routes the message
+// isn't pinned away from, and queues it if none has room, leaving
+// message.Status "queued"; so does a message none of whose devices are
+// connected. A message past its expiry is marked expired instead. An error
+// means the device refused the command and the message was marked failed.
+// MMS only go to devices with the mms capability.
+func (d *Dispatcher) SendSMS(message *models.Message, device *models.Device, sim *models.SIM) error {
+	now := time.Now().UTC()
+	if message.ExpiresAt != nil && !now.Before(*message.ExpiresAt) {
+		message.Status = "expired"
+		message.HeldUntil = nil
+		return d.db.Model(message).Updates(map[string]interface{}{
+			"status":     message.Status,
+			"held_until": nil,
+		}).Error
+	}
+
+	segments := messageSegments(message)
+	var heldUntil time.Time
+
+	for _, r := range d.routes(message, device, sim) {
+		if d.hub.CheckCommand(r.device.DeviceID, messageCommand(message)) != nil {
+			continue
+		}
+
+		lock := d.deviceLock(r.device.ID)
+		lock.Lock()
+		resetAt, err := d.quotas.Check(r.device, r.sim, segments, now)
+		if err == nil && resetAt.IsZero() {
+			message.Segments = segments
+			err = d.dispatch(message, r, now)
+			lock.Unlock()
+			return err
+		}
+		lock.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if heldUntil.IsZero() || resetAt.Before(heldUntil) {
+			heldUntil = resetAt
+		}
+	}
+
+	if heldUntil.IsZero() {
+		// Nothing was over quota, the devices just weren't connected
+		heldUntil = now.Add(d.interval)
+	}
+
+	message.Status = "queued"
+	message.HeldUntil = &heldUntil
+	return d.db.Model(message).Updates(map[string]interface{}{
+		"status":     message.Status,
+		"held_until": heldUntil,
+	}).Error
+}
+
+// DispatchQueued expires queued messages past their validity and retries
+// the ones whose hold has ended. Bulk job messages are left to the
+// BulkSender, which paces them.
+func (d *Dispatcher) DispatchQueued() {
+	d.ExpireQueued()
+
+	var messages []models.Message
+	err := d.db.Where("status = ? AND bulk_job_id IS NULL AND (held_until IS NULL OR held_until <= ?)", "queued", time.Now().UTC()).
+		Order(priorityOrder).
+		Order("id").
+		Limit(dispatchBatchSize).
+		Find(&messages).Error
+	if err != nil {
+		log.Printf("Failed to fetch queued messages: %v", err)
+		return
+	}
+
+	for i := range messages {
+		if err := d.SendQueued(&messages[i]); err != nil {
+			log.Printf("Failed to dispatch queued message %d: %v", messages[i].ID, err)
+		}
+	}
+}
+
+// ExpireQueued marks queued messages, bulk ones included, expired once
+// their expiry passes, so they are never sent
+func (d *Dispatcher) ExpireQueued() {
+	result := d.db.Model(&models.Message{}).
+		Where("status = ? AND expires_at IS NOT NULL AND expires_at <= ?", "queued", time.Now().UTC()).
+		Updates(map[string]interface{}{"status": "expired", "held_until": nil})
+	if result.Error != nil {
+		log.Printf("Failed to expire queued messages: %v", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Expired %d queued messages", result.RowsAffected)
+	}
+}
+
+// Requeue puts messages whose send_sms or send_mms command the hub dropped
+// before it reached the device back in the queue; it is the hub's
+// OnCommandsDropped hook. The retry pass sends them again, MMS with freshly
+// signed media URLs, or expires them.
+func (d *Dispatcher) Requeue(deviceID string, messageIDs []uint) {
+	result := d.db.Model(&models.Message{}).
+		Where("id IN ? AND status = ?", messageIDs, "pending").
+		Updates(map[string]interface{}{"status": "queued", "held_until": nil, "dispatched_at": nil})
+	if result.Error != nil {
+		log.Printf("Failed to requeue %d messages dropped for device %s: %v", len(messageIDs), deviceID, result.Error)
+		return
+	}
+	log.Printf("Requeued %d messages dropped for device %s", result.RowsAffected, deviceID)
+}
+
+// SendQueued dispatches a stored message through the device and SIM it was
+// queued for, as SendSMS does
+func (d *Dispatcher) SendQueued(message *models.Message) error {
+	var device models.Device
+	if err := d.db.Preload("SIMs").First(&device, message.DeviceID).Error; err != nil {
+		log.Printf("Dropping queued message %d: device %d not found", message.ID, message.DeviceID)
+		message.Status = "failed"
+		message.ErrorMsg = "device not found"
+		return d.db.Model(message).Updates(map[string]interface{}{"status": message.Status, "error_msg": message.ErrorMsg}).Error
+	}
+
+	var sim *models.SIM
+	if message.SIMID != nil {
+		for j := range device.SIMs {
+			if device.SIMs[j].ID == *message.SIMID {
+				sim = &device.SIMs[j]
+			}
+		}
+	}
+	if sim == nil {
+		// SIMs reported since the message was queued
+		sim = d.router.SelectSIM(device.SIMs, message.PhoneNumber)
+	}
+
+	return d.SendSMS(message, &device, sim)
+}
+
+// routes lists where the message may go, best first: the chosen route, the
+// device's other SIMs unless a SIM was pinned, then the user's other online
+// devices unless a device was pinned
+func (d *Dispatcher) routes(message *models.Message, device *models.Device, sim *models.SIM) []route {
+	routes := []route{{device: device, sim: sim}}
+	if message.PinnedTo == models.PinnedToSIM {
+		return routes
+	}
+
+	for _, other := range d.router.RankSIMs(device.SIMs, message.PhoneNumber) {
+		if sim == nil || other.ID != sim.ID {
+			routes = append(routes, route{device: device, sim: other})
+		}
+	}
+	if message.PinnedTo == models.PinnedToDevice {
+		return routes
+	}
+
+	var devices []models.Device
+	err := d.db.Preload("SIMs").
+		Where("user_id = ? AND is_online = ? AND id <> ?", message.UserID, true, device.ID).
+		Order("id").Find(&devices).Error
+	if err != nil {
+		log.Printf("Failed to load alternative devices for message %d: %v", message.ID, err)
+		return routes
+	}
+
+	for _, other := range d.router.RankDevices(devices, message.PhoneNumber) {
+		sims := d.router.RankSIMs(other.SIMs, message.PhoneNumber)
+		if len(sims) == 0 {
+			routes = append(routes, route{device: other})
+		}
+		for _, s := range sims {
+			routes = append(routes, route{device: other, sim: s})
+		}
+	}
+	return routes
+}
+
+func (d *Dispatcher) dispatch(message *models.Message, r route, now time.Time) error {
+	message.DeviceID = r.device.ID
+	message.SIMID = nil
+	if r.sim != nil {
+		message.SIMID = &r.sim.ID
+	}
+
+	frame, err := d.frame(message, r)
+	if err == nil {
+		err = d.hub.SendCommand(r.device.DeviceID, frame)
+	}
+	if err != nil {
+		message.Status = "failed"
+		message.ErrorMsg = err.Error()
+		d.db.Model(message).Updates(map[string]interface{}{
+			"status":    message.Status,
+			"error_msg": message.ErrorMsg,
+			"device_id": message.DeviceID,
+			"sim_id":    message.SIMID,
+		})
+		return err
+	}
+
+	message.Status = "pending"
+	message.DispatchedAt = &now
+	message.HeldUntil = nil
+	return d.db.Model(message).Updates(map[string]interface{}{
+		"status":        message.Status,
+		"device_id":     message.DeviceID,
+		"sim_id":        message.SIMID,
+		"segments":      message.Segments,
+		"dispatched_at": now,
+		"held_until":    nil,
+	}).Error
+}
+
+// deviceLock returns the lock serializing dispatches through a device
+func (d *Dispatcher) deviceLock(deviceID uint) *sync.Mutex {
+	d.locksMu.Lock()
+	defer d.locksMu.Unlock()
+
+	lock, ok := d.deviceLocks[deviceID]
+	if !ok {
+		lock = &sync.Mutex{}
+		d.deviceLocks[deviceID] = lock
+	}
+	return lock
+}
+
+// frame builds the send_sms or send_mms command for a message. MMS media
+// URLs are signed now, so they are valid for MEDIA_URL_TTL from dispatch.
+func (d *Dispatcher) frame(message *models.Message, r route) (websocket.Message, error) {
+	if message.Type != models.MessageTypeMMS {
+		return websocket.Message{
+			Type: "send_sms",
+			Data: websocket.SendSMSFrame{
+				ID:          message.ID,
+				PhoneNumber: message.PhoneNumber,
+				Message:     message.Content,
+				DeviceID:    r.device.DeviceID,
+				SIMSlot:     frameSIMSlot(d.hub, r.device, r.sim),
+				ExpiresAt:   message.ExpiresAt,
+				Priority:    message.Priority,
+			},
+		}, nil
+	}
+
+	if message.Attachments == nil {
+		if err := d.db.Model(message).Association("Attachments").Find(&message.Attachments); err != nil {
+			return websocket.Message{}, err
+		}
+	}
+	attachments := make([]websocket.MMSAttachment, 0, len(message.Attachments))
+	for i := range message.Attachments {
+		media := &message.Attachments[i]
+		attachments = append(attachments, websocket.MMSAttachment{
+			URL:         d.media.SignedURL(media),
+			ContentType: media.ContentType,
+			Size:        media.Size,
+			FileName:    media.FileName,
+		})
+	}
+
+	return websocket.Message{
+		Type: "send_mms",
+		Data: websocket.SendMMSFrame{
+			ID:          message.ID,
+			PhoneNumber: message.PhoneNumber,
+			Message:     message.Content,
+			Subject:     message.Subject,
+			Attachments: attachments,
+			DeviceID:    r.device.DeviceID,
+			SIMSlot:     frameSIMSlot(d.hub, r.device, r.sim),
+			ExpiresAt:   message.ExpiresAt,
+			Priority:    message.Priority,
+		},
+	}, nil
+}
+
+// messageSegments is how many SMS a message counts as against quotas. An
+// MMS is one message whatever its size.
+func messageSegments(message *models.Message) int {
+	if message.Type == models.MessageTypeMMS {
+		return 1
+	}
+	return SMSSegments(message.Content)
+}
+
+// messageCommand is the device command that sends a message
+func messageCommand(message *models.Message) string {
+	if message.Type == models.MessageTypeMMS {
+		return "send_mms"
+	}
+	return "send_sms"
+}
+
+// frameSIMSlot is the sim_slot to put in a command frame. Only dual_sim
+// devices understand it; others always use their default SIM.
+func frameSIMSlot(hub *websocket.Hub, device *models.Device, sim *models.SIM) *int {
+	if sim == nil || !hub.HasCapability(device.DeviceID, websocket.CapabilityDualSIM) {
+		return nil
+	}
+	slot := sim.Slot
+	return &slot
+}
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"remote-sim-gateway/internal/models"
+)
+
+const (
+	// SMS a rule may send because of one sender per window; more are dropped
+	ruleSMSLimit  = 5
+	ruleSMSPeriod = time.Minute
+
+	defaultForwardTemplate = "From {{sender}}: {{message}}"
+)
+
+type ruleSender struct {
+	ruleID uint
+	sender string
+}
+
+type ruleSMSWindow struct {
+	start time.Time
+	count int
+}
+
+// ApplyRules runs the user's enabled inbound rules on a received message,
+// in priority order, until one that matches says to stop
+func (i *Inbox) ApplyRules(message *models.Message) {
+	var rules []models.InboundRule
+	err := i.db.Where("user_id = ? AND enabled = ?", message.UserID, true).
+		Order("priority, id").
+		Find(&rules).Error
+	if err != nil {
+		log.Printf("Failed to load inbound rules for message %d: %v", message.ID, err)
+		return
+	}
+
+	var variables map[string]string
+	for j := range rules {
+		rule := &rules[j]
+		if !i.ruleMatches(rule, message) {
+			continue
+		}
+
+		if variables == nil {
+			variables = i.messageVariables(message)
+		}
+		if err := i.runAction(rule, message, variables); err != nil {
+			log.Printf("Inbound rule %d (%s) failed for message %d: %v", rule.ID, rule.Action, message.ID, err)
+		}
+
+		if rule.StopProcessing {
+			return
+		}
+	}
+}
+
+func (i *Inbox) ruleMatches(rule *models.InboundRule, message *models.Message) bool {
+	if rule.SIMID != nil && (message.SIMID == nil || *message.SIMID != *rule.SIMID) {
+		return false
+	}
+	if rule.Sender != "" && !i.senderMatches(rule.Sender, message.PhoneNumber) {
+		return false
+	}
+	if len(rule.Keywords) > 0 {
+		keyword := FirstWord(message.Content)
+		matched := false
+		for _, candidate := range rule.Keywords {
+			if strings.EqualFold(candidate, keyword) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil || !pattern.MatchString(message.Content) {
+			return false
+		}
+	}
+	return true
+}
+
+// senderMatches compares numbers in normalized form, so "09876543210" can
+// match "+919876543210"; a trailing * matches any number with that prefix.
+// Alphanumeric senders are compared as text.
+func (i *Inbox) senderMatches(pattern, sender string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		if strings.HasPrefix(strings.ToUpper(sender), strings.ToUpper(prefix)) {
+			return true
+		}
+		normalized, err := i.contacts.NormalizeNumber(sender)
+		return err == nil && strings.HasPrefix(normalized, prefix)
+	}
+
+	want, err := i.contacts.NormalizeNumber(pattern)
+	if err != nil {
+		return strings.EqualFold(pattern, sender)
+	}
+	got, err := i.contacts.NormalizeNumber(sender)
+	return err == nil && got == want
+}
+
+// messageVariables are the template variables for rule actions: the
+// sender's contact fields plus sender, message and keyword
+func (i *Inbox) messageVariables(message *models.Message) map[string]string {
+	variables := map[string]string{"phone_number": message.PhoneNumber}
+
+	contacts, err := i.contacts.Lookup(message.UserID, []string{message.PhoneNumber})
+	if err != nil {
+		log.Printf("Failed to look up contact for message %d: %v", message.ID, err)
+	} else if contact := contacts[message.PhoneNumber]; contact != nil {
+		variables = ContactVariables(contact)
+	}
+
+	variables["sender"] = message.PhoneNumber
+	variables["message"] = message.Content
+	variables["keyword"] = FirstWord(message.Content)
+	return variables
+}
+
+func (i *Inbox) runAction(rule *models.InboundRule, message *models.Message, variables map[string]string) error {
+	switch rule.Action {
+	case models.InboundActionReply:
+		if !i.allowRuleSMS(rule.ID, message.PhoneNumber) {
+			return fmt.Errorf("more than %d SMS to %s in %s, skipped", ruleSMSLimit, message.PhoneNumber, ruleSMSPeriod)
+		}
+		var conversation models.Conversation
+		if err := i.db.First(&conversation, message.ConversationID).Error; err != nil {
+			return err
+		}
+		_, err := i.Reply(&conversation, renderRuleTemplate(rule.Template, variables))
+		return err
+
+	case models.InboundActionWebhook:
+		return postJSON(i.client, rule.Target, map[string]interface{}{
+			"event":   "sms.received",
+			"rule_id": rule.ID,
+			"message": map[string]interface{}{
+				"id":              message.ID,
+				"from":            message.PhoneNumber,
+				"text":            message.Content,
+				"device_id":       message.DeviceID,
+				"sim_id":          message.SIMID,
+				"conversation_id": message.ConversationID,
+				"received_at":     message.SentAt,
+			},
+			"variables": variables,
+		})
+
+	case models.InboundActionForwardSMS:
+		if !i.allowRuleSMS(rule.ID, message.PhoneNumber) {
+			return fmt.Errorf("more than %d forwards from %s in %s, skipped", ruleSMSLimit, message.PhoneNumber, ruleSMSPeriod)
+		}
+		return i.forwardSMS(rule, message, variables)
+
+	case models.InboundActionForwardEmail:
+		text := "From: " + message.PhoneNumber + "\r\nReceived: " + message.SentAt.Format(time.RFC1123) + "\r\n\r\n" + message.Content
+		if rule.Template != "" {
+			text = renderRuleTemplate(rule.Template, variables)
+		}
+		return sendMail(i.smtp, rule.Target, "[Remote SIM Gateway] SMS from "+message.PhoneNumber, text)
+
+	case models.InboundActionTag:
+		return i.contacts.TagContact(message.UserID, message.PhoneNumber, rule.Target)
+
+	case models.InboundActionOptOut:
+		_, err := i.contacts.OptOut(message.UserID, message.PhoneNumber, &rule.ID)
+		return err
+
+	default:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+}
+
+// forwardSMS sends the message on to the rule's target from the device
+// that received it
+func (i *Inbox) forwardSMS(rule *models.InboundRule, message *models.Message, variables map[string]string) error {
+	var device models.Device
+	if err := i.db.Preload("SIMs").First(&device, message.DeviceID).Error; err != nil {
+		return err
+	}
+
+	template := rule.Template
+	if template == "" {
+		template = defaultForwardTemplate
+	}
+
+	var sim *models.SIM
+	if message.SIMID != nil {
+		for j := range device.SIMs {
+			if device.SIMs[j].ID == *message.SIMID {
+				sim = &device.SIMs[j]
+			}
+		}
+	}
+
+	forward := models.Message{
+		PhoneNumber: rule.Target,
+		Content:     renderRuleTemplate(template, variables),
+		Status:      "pending",
+		DeviceID:    device.ID,
+		UserID:      message.UserID,
+		Priority:    models.PriorityNormal,
+	}
+	if sim != nil {
+		forward.SIMID = &sim.ID
+	}
+
+	if err := i.db.Create(&forward).Error; err != nil {
+		return err
+	}
+	return i.dispatcher.SendSMS(&forward, &device, sim)
+}
+
+// renderRuleTemplate fills in a rule's template. Unlike bulk sends nothing
+// checks the variables up front, so ones the sender has no value for, like
+// {{name}} for an unknown number, are left blank.
+func renderRuleTemplate(template string, variables map[string]string) string {
+	filled := make(map[string]string, len(variables))
+	for name, value := range variables {
+		filled[name] = value
+	}
+	for _, name := range TemplateVariables(template) {
+		if _, ok := filled[name]; !ok {
+			filled[name] = ""
+		}
+	}
+	return RenderTemplate(template, filled)
+}
+
+// allowRuleSMS counts an SMS a rule sends because of sender, and reports
+// whether it is within ruleSMSLimit for the current window
+func (i *Inbox) allowRuleSMS(ruleID uint, sender string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	for key, window := range i.ruleSMS {
+		if now.Sub(window.start) >= ruleSMSPeriod {
+			delete(i.ruleSMS, key)
+		}
+	}
+
+	key := ruleSender{ruleID: ruleID, sender: sender}
+	window, ok := i.ruleSMS[key]
+	if !ok {
+		window = &ruleSMSWindow{start: now}
+		i.ruleSMS[key] = window
+	}
+	window.count++
+	return window.count <= ruleSMSLimit
+}
+
+// FirstWord is the keyword of a message: its first word without
+// surrounding punctuation, so "Stop." reads as "Stop"
+func FirstWord(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimFunc(fields[0], func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/websocket"
+)
+
+// Inbox stores the messages devices receive, threading them into
+// conversations per SIM and remote number, and runs the user's inbound
+// rules on them
+type Inbox struct {
+	db         *gorm.DB
+	dispatcher *Dispatcher
+	contacts   *ContactBook
+	smtp       config.SMTPConfig
+	client     *http.Client
+
+	// SMS sent per rule and sender in the current window, so two
+	// auto-responders can't keep replying to each other
+	mu      sync.Mutex
+	ruleSMS map[ruleSender]*ruleSMSWindow
+}
+
+func NewInbox(db *gorm.DB, dispatcher *Dispatcher, contacts *ContactBook, smtpConfig config.SMTPConfig) *Inbox {
+	return &Inbox{
+		db:         db,
+		dispatcher: dispatcher,
+		contacts:   contacts,
+		smtp:       smtpConfig,
+		client:     newWebhookClient(),
+		ruleSMS:    make(map[ruleSender]*ruleSMSWindow),
+	}
+}
+
+// Receive stores an sms_received frame and applies the inbound rules; it
+// is the hub's OnSMSReceived hook
+func (i *Inbox) Receive(deviceID string, frame *websocket.SMSReceivedFrame) {
+	message, err := i.Store(deviceID, frame)
+	if err != nil {
+		log.Printf("Failed to store SMS received by device %s: %v", deviceID, err)
+		return
+	}
+	i.ApplyRules(message)
+}
+
+// Store saves a received message in its conversation, starting one if this
+// is the first message from the number on that SIM
+func (i *Inbox) Store(deviceID string, frame *websocket.SMSReceivedFrame) (*models.Message, error) {
+	var device models.Device
+	if err := i.db.Select("id", "user_id").Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return nil, err
+	}
+
+	var simID *uint
+	if frame.SIMSlot != nil {
+		var sim models.SIM
+		err := i.db.Select("id").Where("device_id = ? AND slot = ?", device.ID, *frame.SIMSlot).First(&sim).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if err == nil {
+			simID = &sim.ID
+		}
+	}
+
+	conversation, err := i.conversation(&device, simID, strings.TrimSpace(frame.From))
+	if err != nil {
+		return nil, err
+	}
+
+	receivedAt := frame.ReceivedAt.UTC()
+	if frame.ReceivedAt.IsZero() {
+		receivedAt = time.Now().UTC()
+	}
+
+	message := models.Message{
+		PhoneNumber:    conversation.PhoneNumber,
+		Content:        frame.Message,
+		Status:         "received",
+		Direction:      models.MessageInbound,
+		DeviceID:       device.ID,
+		SIMID:          simID,
+		UserID:         device.UserID,
+		SentAt:         receivedAt,
+		ConversationID: &conversation.ID,
+	}
+
+	err = i.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		return tx.Model(conversation).Updates(map[string]interface{}{
+			"unread_count":    gorm.Expr("unread_count + 1"),
+			"last_message_id": message.ID,
+			"last_message_at": message.CreatedAt,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// conversation finds or starts the thread with phoneNumber on a SIM
+func (i *Inbox) conversation(device *models.Device, simID *uint, phoneNumber string) (*models.Conversation, error) {
+	find := func() (*models.Conversation, error) {
+		query := i.db.Where("device_id = ? AND phone_number = ?", device.ID, phoneNumber)
+		if simID != nil {
+			query = query.Where("sim_id = ?", *simID)
+		} else {
+			query = query.Where("sim_id IS NULL")
+		}
+
+		var conversation models.Conversation
+		if err := query.First(&conversation).Error; err != nil {
+			return nil, err
+		}
+		return &conversation, nil
+	}
+
+	conversation, err := find()
+	if err == nil || !errors.Is(err, gorm.ErrRecordNotFound) {
+		return conversation, err
+	}
+
+	conversation = &models.Conversation{
+		UserID:        device.UserID,
+		DeviceID:      device.ID,
+		SIMID:         simID,
+		PhoneNumber:   phoneNumber,
+		LastMessageAt: time.Now().UTC(),
+	}
+	if err := i.db.Create(conversation).Error; err != nil {
+		// Another message from the number may have started it first
+		if existing, findErr := find(); findErr == nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	return conversation, nil
+}
+
+// Reply sends content to a conversation's number through the SIM the
+// conversation is on, which also marks it read. Like other messages the
+// reply is queued while that SIM is over quota. The message is returned
+// once stored, even if the device then refused it.
+func (i *Inbox) Reply(conversation *models.Conversation, content string) (*models.Message, error) {
+	var device models.Device
+	if err := i.db.Preload("SIMs").First(&device, conversation.DeviceID).Error; err != nil {
+		return nil, err
+	}
+
+	var sim *models.SIM
+	if conversation.SIMID != nil {
+		for j := range device.SIMs {
+			if device.SIMs[j].ID == *conversation.SIMID {
+				sim = &device.SIMs[j]
+			}
+		}
+	}
+
+	message := models.Message{
+		PhoneNumber:    conversation.PhoneNumber,
+		Content:        content,
+		Status:         "pending",
+		Direction:      models.MessageOutbound,
+		DeviceID:       device.ID,
+		UserID:         conversation.UserID,
+		PinnedTo:       models.PinnedToDevice,
+		ConversationID: &conversation.ID,
+		Priority:       models.PriorityNormal,
+	}
+	if sim != nil {
+		message.SIMID = &sim.ID
+		message.PinnedTo = models.PinnedToSIM
+	}
+
+	if err := i.db.Create(&message).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	err := i.db.Model(conversation).Updates(map[string]interface{}{
+		"unread_count":    0,
+		"last_read_at":    now,
+		"last_message_id": message.ID,
+		"last_message_at": message.CreatedAt,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, i.dispatcher.SendSMS(&message, &device, sim)
+}
+
+// MarkRead clears a conversation's unread count
+func (i *Inbox) MarkRead(conversation *models.Conversation) error {
+	now := time.Now().UTC()
+	return i.db.Model(conversation).Updates(map[string]interface{}{
+		"unread_count": 0,
+		"last_read_at": now,
+	}).Error
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+)
+
+var (
+	ErrMediaTooLarge  = errors.New("media is too large")
+	ErrMediaType      = errors.New("media type is not allowed")
+	ErrMediaNotFound  = errors.New("media not found")
+	ErrMediaSignature = errors.New("invalid or expired media signature")
+)
+
+// MediaStore keeps uploaded MMS media on the local filesystem and signs the
+// URLs devices download it from
+type MediaStore struct {
+	db     *gorm.DB
+	config config.MediaConfig
+}
+
+func NewMediaStore(db *gorm.DB, mediaConfig config.MediaConfig) *MediaStore {
+	return &MediaStore{
+		db:     db,
+		config: mediaConfig,
+	}
+}
+
+// MaxSize is the most bytes of media accepted in a file or an MMS
+func (s *MediaStore) MaxSize() int {
+	return s.config.MaxSize
+}
+
+func (s *MediaStore) AllowedTypes() []string {
+	return s.config.AllowedTypes
+}
+
+// Save stores a file for the user. Its type is detected from the contents,
+// not taken from the upload.
+func (s *MediaStore) Save(userID uint, fileName string, data []byte) (*models.MediaFile, error) {
+	if len(data) > s.config.MaxSize {
+		return nil, ErrMediaTooLarge
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !s.allowed(contentType) {
+		return nil, fmt.Errorf("%w: %s", ErrMediaType, contentType)
+	}
+
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(strconv.FormatUint(uint64(userID), 10), hex.EncodeToString(name))
+
+	fullPath := filepath.Join(s.config.Dir, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o750); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(fullPath, data, 0o640); err != nil {
+		return nil, err
+	}
+
+	media := models.MediaFile{
+		UserID:      userID,
+		FileName:    filepath.Base(fileName),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Path:        path,
+	}
+	if err := s.db.Create(&media).Error; err != nil {
+		os.Remove(fullPath)
+		return nil, err
+	}
+	return &media, nil
+}
+
+// Attachments loads the user's media for an MMS, in the order given, and
+// checks they fit in one message
+func (s *MediaStore) Attachments(userID uint, mediaIDs []uint) ([]models.MediaFile, error) {
+	var files []models.MediaFile
+	if err := s.db.Where("id IN ? AND user_id = ?", mediaIDs, userID).Find(&files).Error; err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uint]models.MediaFile, len(files))
+	for _, file := range files {
+		byID[file.ID] = file
+	}
+
+	var total int64
+	attachments := make([]models.MediaFile, 0, len(mediaIDs))
+	seen := make(map[uint]bool, len(mediaIDs))
+	for _, id := range mediaIDs {
+		file, ok := byID[id]
+		if !ok {
+			return nil, ErrMediaNotFound
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		total += file.Size
+		attachments = append(attachments, file)
+	}
+	if total > int64(s.config.MaxSize) {
+		return nil, ErrMediaTooLarge
+	}
+	return attachments, nil
+}
+
+// SignedURL is where a device downloads the media, valid for MEDIA_URL_TTL
+// seconds from now
+func (s *MediaStore) SignedURL(media *models.MediaFile) string {
+	expires := time.Now().Add(time.Duration(s.config.URLTTL) * time.Second).Unix()
+	return fmt.Sprintf("%s/media/%d?expires=%d&signature=%s",
+		strings.TrimRight(s.config.PublicURL, "/"), media.ID, expires, s.sign(media.ID, expires))
+}
+
+// Open checks a signed URL's parameters and returns the media and the path
+// of its file
+func (s *MediaStore) Open(mediaID uint, expires, signature string) (*models.MediaFile, string, error) {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return nil, "", ErrMediaSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.sign(mediaID, expiresAt))) {
+		return nil, "", ErrMediaSignature
+	}
+
+	var media models.MediaFile
+	if err := s.db.First(&media, mediaID).Error; err != nil {
+		return nil, "", ErrMediaNotFound
+	}
+	return &media, filepath.Join(s.config.Dir, media.Path), nil
+}
+
+func (s *MediaStore) sign(mediaID uint, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(s.config.SigningKey))
+	fmt.Fprintf(mac, "%d:%d", mediaID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *MediaStore) allowed(contentType string) bool {
+	for _, allowed := range s.config.AllowedTypes {
+		if strings.EqualFold(allowed, contentType) {
+			return true
+		}
+	}
+	return false
+}
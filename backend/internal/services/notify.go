@@ -0,0 +1,121 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"remote-sim-gateway/internal/config"
+)
+
+var errInternalAddress = errors.New("webhook address is loopback, private or link-local")
+
+// sendMail sends a plain text email through the configured SMTP server
+func sendMail(smtpConfig config.SMTPConfig, to, subject, text string) error {
+	if smtpConfig.Host == "" {
+		return errors.New("SMTP is not configured")
+	}
+
+	body := strings.Join([]string{
+		"From: " + headerValue(smtpConfig.From),
+		"To: " + headerValue(to),
+		"Subject: " + mime.QEncoding.Encode("UTF-8", headerValue(subject)),
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		text,
+	}, "\r\n")
+
+	var auth smtp.Auth
+	if smtpConfig.Username != "" {
+		auth = smtp.PlainAuth("", smtpConfig.Username, smtpConfig.Password, smtpConfig.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", smtpConfig.Host, smtpConfig.Port)
+	return smtp.SendMail(addr, auth, smtpConfig.From, []string{to}, []byte(body))
+}
+
+// headerValue keeps a value on one header line, so text such as a device
+// name can't add headers of its own
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// ValidateWebhookURL checks that a webhook target is an http(s) URL that
+// doesn't name an internal address. Host names are checked again when the
+// webhook is sent, once they are resolved.
+func ValidateWebhookURL(raw string) error {
+	target, err := url.Parse(raw)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return errors.New("must be an http(s) URL")
+	}
+
+	host := strings.ToLower(target.Hostname())
+	ip := net.ParseIP(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && internalIP(ip)) {
+		return errors.New("must not point to a loopback, private or link-local address")
+	}
+	return nil
+}
+
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast()
+}
+
+// newWebhookClient returns the client webhooks are posted with. It refuses
+// to connect to internal addresses, whatever the URL's host resolves to
+// and wherever a redirect points.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+				return errInternalAddress
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// No proxy: the dialer must see the webhook's own address
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// postJSON posts payload to a webhook URL, failing on a non-2xx response
+func postJSON(client *http.Client, url string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
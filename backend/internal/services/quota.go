@@ -0,0 +1,184 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+)
+
+// QuotaTracker counts dispatched SMS segments against device and SIM quotas.
+// Windows are calendar based: the current minute, day and month, with days
+// starting at midnight in the configured time zone.
+type QuotaTracker struct {
+	db       *gorm.DB
+	location *time.Location
+}
+
+func NewQuotaTracker(db *gorm.DB, quotasConfig config.QuotasConfig) *QuotaTracker {
+	location, err := time.LoadLocation(quotasConfig.Timezone)
+	if err != nil {
+		log.Printf("Invalid QUOTA_TIMEZONE %q, using UTC: %v", quotasConfig.Timezone, err)
+		location = time.UTC
+	}
+
+	return &QuotaTracker{
+		db:       db,
+		location: location,
+	}
+}
+
+type quotaWindows struct {
+	minute, day, month             time.Time
+	nextMinute, nextDay, nextMonth time.Time
+}
+
+func (q *QuotaTracker) windows(now time.Time) quotaWindows {
+	local := now.In(q.location)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, q.location)
+	month := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, q.location)
+	minute := now.Truncate(time.Minute)
+
+	return quotaWindows{
+		minute:     minute.UTC(),
+		day:        day.UTC(),
+		month:      month.UTC(),
+		nextMinute: minute.Add(time.Minute).UTC(),
+		nextDay:    day.AddDate(0, 0, 1).UTC(),
+		nextMonth:  month.AddDate(0, 1, 0).UTC(),
+	}
+}
+
+// DeviceUsage counts the segments dispatched through the device
+func (q *QuotaTracker) DeviceUsage(device *models.Device, now time.Time) (*models.QuotaUsage, error) {
+	usage, err := q.usage("device_id", []uint{device.ID}, now)
+	if err != nil {
+		return nil, err
+	}
+	return usage[device.ID], nil
+}
+
+// SIMUsage counts the segments dispatched through the SIM
+func (q *QuotaTracker) SIMUsage(sim *models.SIM, now time.Time) (*models.QuotaUsage, error) {
+	usage, err := q.usage("sim_id", []uint{sim.ID}, now)
+	if err != nil {
+		return nil, err
+	}
+	return usage[sim.ID], nil
+}
+
+// DeviceUsages is DeviceUsage for several devices, in one query
+func (q *QuotaTracker) DeviceUsages(deviceIDs []uint, now time.Time) (map[uint]*models.QuotaUsage, error) {
+	return q.usage("device_id", deviceIDs, now)
+}
+
+// SIMUsages is SIMUsage for several SIMs, in one query
+func (q *QuotaTracker) SIMUsages(simIDs []uint, now time.Time) (map[uint]*models.QuotaUsage, error) {
+	return q.usage("sim_id", simIDs, now)
+}
+
+// usage counts the segments dispatched through each of ids, by column. Every
+// ID gets a usage, zero if nothing was dispatched through it.
+func (q *QuotaTracker) usage(column string, ids []uint, now time.Time) (map[uint]*models.QuotaUsage, error) {
+	w := q.windows(now)
+
+	usage := make(map[uint]*models.QuotaUsage, len(ids))
+	for _, id := range ids {
+		usage[id] = &models.QuotaUsage{DailyResetsAt: w.nextDay, MonthlyResetsAt: w.nextMonth}
+	}
+	if len(ids) == 0 {
+		return usage, nil
+	}
+
+	// At the start of a month the current minute can begin before the month
+	since := w.month
+	if w.minute.Before(since) {
+		since = w.minute
+	}
+
+	var counts []struct {
+		ID        uint
+		PerMinute int64
+		Daily     int64
+		Monthly   int64
+	}
+	err := q.db.Model(&models.Message{}).
+		Select(
+			column+" AS id, "+
+				"COALESCE(SUM(CASE WHEN dispatched_at >= ? THEN segments ELSE 0 END), 0) AS per_minute, "+
+				"COALESCE(SUM(CASE WHEN dispatched_at >= ? THEN segments ELSE 0 END), 0) AS daily, "+
+				"COALESCE(SUM(CASE WHEN dispatched_at >= ? THEN segments ELSE 0 END), 0) AS monthly",
+			w.minute, w.day, w.month,
+		).
+		Where(column+" IN ? AND dispatched_at >= ?", ids, since).
+		Group(column).
+		Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, count := range counts {
+		if u, ok := usage[count.ID]; ok {
+			u.PerMinute, u.Daily, u.Monthly = count.PerMinute, count.Daily, count.Monthly
+		}
+	}
+	return usage, nil
+}
+
+// Check returns the zero time if a message of segments parts may be
+// dispatched through the device and SIM, or the time the exceeded quota
+// windows reset. sim may be nil for devices that don't report their SIMs.
+func (q *QuotaTracker) Check(device *models.Device, sim *models.SIM, segments int, now time.Time) (time.Time, error) {
+	w := q.windows(now)
+	var resetAt time.Time
+
+	exceeded := func(quota models.Quota, usage *models.QuotaUsage) {
+		if overLimit(quota.PerMinuteLimit, usage.PerMinute, segments) {
+			resetAt = later(resetAt, w.nextMinute)
+		}
+		if overLimit(quota.DailyLimit, usage.Daily, segments) {
+			resetAt = later(resetAt, w.nextDay)
+		}
+		if overLimit(quota.MonthlyLimit, usage.Monthly, segments) {
+			resetAt = later(resetAt, w.nextMonth)
+		}
+	}
+
+	if hasLimits(device.Quota) {
+		usage, err := q.DeviceUsage(device, now)
+		if err != nil {
+			return time.Time{}, err
+		}
+		exceeded(device.Quota, usage)
+	}
+
+	if sim != nil && hasLimits(sim.Quota) {
+		usage, err := q.SIMUsage(sim, now)
+		if err != nil {
+			return time.Time{}, err
+		}
+		exceeded(sim.Quota, usage)
+	}
+
+	return resetAt, nil
+}
+
+// overLimit reports whether sending segments more parts would go past limit.
+// A message longer than the whole limit still goes out in an empty window,
+// or it could never be sent.
+func overLimit(limit int, used int64, segments int) bool {
+	return limit > 0 && used+int64(segments) > int64(limit) && used > 0
+}
+
+func hasLimits(quota models.Quota) bool {
+	return quota.DailyLimit > 0 || quota.MonthlyLimit > 0 || quota.PerMinuteLimit > 0
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"remote-sim-gateway/internal/models"
+)
+
+// Issues listed per category in an upload report; the counts cover them all
+const maxReportedIssues = 1000
+
+// Header names recognized as the phone column when none is given
+var phoneColumnNames = []string{"phone", "phonenumber", "mobile", "mobilenumber", "msisdn", "number", "to"}
+
+var (
+	variableNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	placeholderPattern  = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+
+	headerSeparators = strings.NewReplacer(" ", "", "_", "", "-", "")
+)
+
+// RecipientMapping says which spreadsheet columns hold the phone number and
+// the template variables
+type RecipientMapping struct {
+	PhoneColumn string            // header name; detected when empty
+	Variables   map[string]string // variable name -> header name
+
+	// Leave blank variables out instead of rejecting the row
+	OptionalVariables bool
+}
+
+// ParseVariableMapping reads "name,city" or "first_name=First Name,city"
+func ParseVariableMapping(value string) (map[string]string, error) {
+	variables := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, column, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		column = strings.TrimSpace(column)
+		if !ok {
+			column = name
+		}
+
+		if !variableNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable name %q: use letters, digits and underscores", name)
+		}
+		if column == "" {
+			return nil, fmt.Errorf("variable %q has no column", name)
+		}
+		variables[name] = column
+	}
+	return variables, nil
+}
+
+// RecipientReport is the outcome of validating an uploaded recipient list
+type RecipientReport struct {
+	PhoneColumn    string
+	TotalRows      int
+	Recipients     []models.Recipient
+	Invalid        []models.UploadRowIssue
+	Duplicates     []models.UploadRowIssue
+	InvalidCount   int
+	DuplicateCount int
+}
+
+// ReadSpreadsheet reads every row of a .csv or .xlsx file (the first sheet)
+func ReadSpreadsheet(fileName string, data []byte) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".csv", ".txt":
+		return readCSV(data)
+	case ".xlsx":
+		return readXLSX(data)
+	default:
+		return nil, errors.New("unsupported file type: upload a .csv or .xlsx file")
+	}
+}
+
+func readCSV(data []byte) ([][]string, error) {
+	// Spreadsheet exports often start with a byte order mark
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	// Excel in many locales writes semicolon-separated files
+	if firstLine, _, _ := bytes.Cut(data, []byte("\n")); bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+
+	var rows [][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		rows = append(rows, record)
+	}
+}
+
+// ParseRecipients validates and normalizes the rows of a spreadsheet whose
+// first row is the header. Invalid rows and repeats of an earlier number are
+// reported and left out.
+func ParseRecipients(rows [][]string, mapping RecipientMapping, defaultCountryCode string, maxRows int) (*RecipientReport, error) {
+	if len(rows) == 0 {
+		return nil, errors.New("the file is empty")
+	}
+
+	header := rows[0]
+	phoneIndex, err := findPhoneColumn(header, mapping.PhoneColumn)
+	if err != nil {
+		return nil, err
+	}
+
+	variableIndexes := make(map[string]int, len(mapping.Variables))
+	for name, column := range mapping.Variables {
+		index := columnIndex(header, column)
+		if index < 0 {
+			return nil, fmt.Errorf("column %q for variable %q not found in the header row", column, name)
+		}
+		variableIndexes[name] = index
+	}
+
+	report := &RecipientReport{PhoneColumn: strings.TrimSpace(header[phoneIndex])}
+	firstRow := make(map[string]int)
+
+	for i, row := range rows[1:] {
+		rowNumber := i + 2
+		if blankRow(row) {
+			continue
+		}
+
+		report.TotalRows++
+		if maxRows > 0 && report.TotalRows > maxRows {
+			return nil, fmt.Errorf("the file has more than %d recipients", maxRows)
+		}
+
+		value := cell(row, phoneIndex)
+		phoneNumber, err := NormalizePhoneNumber(value, defaultCountryCode)
+		if err != nil {
+			report.addInvalid(models.UploadRowIssue{Row: rowNumber, Value: value, Error: err.Error()})
+			continue
+		}
+
+		var variables map[string]string
+		var missing string
+		for name, index := range variableIndexes {
+			variableValue := strings.TrimSpace(cell(row, index))
+			if variableValue == "" {
+				if mapping.OptionalVariables {
+					continue
+				}
+				missing = name
+				break
+			}
+			if variables == nil {
+				variables = make(map[string]string, len(variableIndexes))
+			}
+			variables[name] = variableValue
+		}
+		if missing != "" {
+			report.addInvalid(models.UploadRowIssue{Row: rowNumber, Value: value, Error: "missing value for variable " + missing})
+			continue
+		}
+
+		if first, seen := firstRow[phoneNumber]; seen {
+			report.DuplicateCount++
+			if len(report.Duplicates) < maxReportedIssues {
+				report.Duplicates = append(report.Duplicates, models.UploadRowIssue{
+					Row:         rowNumber,
+					Value:       value,
+					Error:       "duplicate of row " + strconv.Itoa(first),
+					DuplicateOf: first,
+				})
+			}
+			continue
+		}
+		firstRow[phoneNumber] = rowNumber
+
+		report.Recipients = append(report.Recipients, models.Recipient{
+			Row:         rowNumber,
+			PhoneNumber: phoneNumber,
+			Variables:   variables,
+		})
+	}
+
+	return report, nil
+}
+
+// findPhoneColumn finds the named column, or detects it when name is empty
+func findPhoneColumn(header []string, name string) (int, error) {
+	if name != "" {
+		index := columnIndex(header, name)
+		if index < 0 {
+			return -1, fmt.Errorf("phone column %q not found in the header row", name)
+		}
+		return index, nil
+	}
+
+	for _, name := range phoneColumnNames {
+		if index := columnIndex(header, name); index >= 0 {
+			return index, nil
+		}
+	}
+	return -1, errors.New("no phone column found in the header row; set phone_column")
+}
+
+func (r *RecipientReport) addInvalid(issue models.UploadRowIssue) {
+	r.InvalidCount++
+	if len(r.Invalid) < maxReportedIssues {
+		r.Invalid = append(r.Invalid, issue)
+	}
+}
+
+// NormalizePhoneNumber strips formatting from a number and converts it to
+// international format. Numbers without a + or 00 prefix get
+// defaultCountryCode, if set, in place of their trunk prefix 0, unless they
+// already start with it and are too long to be national numbers.
+func NormalizePhoneNumber(value, defaultCountryCode string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", errors.New("phone number is empty")
+	}
+
+	// Spreadsheets turn long numbers into floats like 9.19876543210E+11
+	if strings.ContainsAny(value, "eE") {
+		if f, err := strconv.ParseFloat(value, 64); err == nil && f > 0 {
+			value = strconv.FormatFloat(f, 'f', 0, 64)
+		}
+	}
+
+	var digits strings.Builder
+	international := false
+	for i, ch := range value {
+		switch {
+		case ch >= '0' && ch <= '9':
+			digits.WriteRune(ch)
+		case ch == '+' && i == 0:
+			international = true
+		case ch == ' ' || ch == '-' || ch == '.' || ch == '(' || ch == ')' || ch == '/':
+		default:
+			return "", fmt.Errorf("phone number contains %q", ch)
+		}
+	}
+
+	number := digits.String()
+	if !international && strings.HasPrefix(number, "00") {
+		international = true
+		number = number[2:]
+	}
+
+	if countryCode := strings.TrimLeft(defaultCountryCode, "+"); !international && countryCode != "" {
+		international = true
+		switch {
+		case strings.HasPrefix(number, "0"):
+			number = countryCode + strings.TrimLeft(number, "0")
+		case strings.HasPrefix(number, countryCode) && len(number) > 10:
+			// Longer than a national number, so the country code is already there
+		default:
+			number = countryCode + number
+		}
+	}
+
+	if len(number) < 7 || len(number) > 15 {
+		return "", errors.New("phone number must have 7 to 15 digits")
+	}
+
+	if international {
+		return "+" + number, nil
+	}
+	return number, nil
+}
+
+// TemplateVariables lists the {{variables}} used in a message template
+func TemplateVariables(template string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, match := range placeholderPattern.FindAllStringSubmatch(template, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// HasTemplateVariable reports whether a message template uses {{name}}
+func HasTemplateVariable(template, name string) bool {
+	for _, variable := range TemplateVariables(template) {
+		if variable == name {
+			return true
+		}
+	}
+	return false
+}
+
+// RenderTemplate replaces {{variables}} in a message template. Unknown
+// variables are left as they are.
+func RenderTemplate(template string, variables map[string]string) string {
+	if len(variables) == 0 {
+		return template
+	}
+	return placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholderPattern.FindStringSubmatch(placeholder)[1]
+		if value, ok := variables[name]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+func columnIndex(header []string, name string) int {
+	name = headerKey(name)
+	for i, column := range header {
+		if headerKey(column) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// headerKey compares header names ignoring case, spaces, underscores and
+// hyphens, so "Phone Number" matches phone_number
+func headerKey(name string) string {
+	return strings.ToLower(headerSeparators.Replace(name))
+}
+
+func cell(row []string, index int) string {
+	if index < len(row) {
+		return row[index]
+	}
+	return ""
+}
+
+func blankRow(row []string) bool {
+	for _, value := range row {
+		if strings.TrimSpace(value) != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package services
+
+import "unicode/utf8"
+
+// Characters of the GSM 7-bit default alphabet, and of its extension table,
+// which take two septets each. Text with any other character is sent as
+// UCS-2.
+const (
+	gsmBasic     = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsmExtension = "^{}\\[~]|€\f"
+)
+
+var gsmSeptets = func() map[rune]int {
+	septets := make(map[rune]int)
+	for _, r := range gsmBasic {
+		septets[r] = 1
+	}
+	for _, r := range gsmExtension {
+		septets[r] = 2
+	}
+	return septets
+}()
+
+// SMSSegments returns how many parts a text is sent as: up to 160 GSM
+// characters fit one SMS and 153 each part of a longer one, or 70 and 67
+// UCS-2 code units for text outside the GSM alphabet
+func SMSSegments(text string) int {
+	septets := 0
+	for _, r := range text {
+		n, ok := gsmSeptets[r]
+		if !ok {
+			return ucs2Segments(text)
+		}
+		septets += n
+	}
+	return segmentCount(septets, 160, 153)
+}
+
+func ucs2Segments(text string) int {
+	units := 0
+	for _, r := range text {
+		// Characters beyond the BMP are a surrogate pair
+		if utf8.RuneLen(r) == 4 {
+			units += 2
+		} else {
+			units++
+		}
+	}
+	return segmentCount(units, 70, 67)
+}
+
+func segmentCount(length, single, part int) int {
+	if length <= single {
+		return 1
+	}
+	return (length + part - 1) / part
+}
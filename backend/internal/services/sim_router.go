@@ -0,0 +1,121 @@
+package services
+
+import (
+	"sort"
+	"strings"
+
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+)
+
+// SIMRouter picks the SIM to send through. Sending from a SIM on the same
+// carrier as the recipient is usually cheaper and delivers more reliably.
+type SIMRouter struct {
+	// carrier prefixes, normalized
+	prefixes map[string][]string
+}
+
+func NewSIMRouter(routingConfig config.RoutingConfig) *SIMRouter {
+	prefixes := make(map[string][]string, len(routingConfig.CarrierPrefixes))
+	for carrier, carrierPrefixes := range routingConfig.CarrierPrefixes {
+		for _, prefix := range carrierPrefixes {
+			prefixes[carrier] = append(prefixes[carrier], normalizeNumber(prefix))
+		}
+	}
+
+	return &SIMRouter{prefixes: prefixes}
+}
+
+// CarrierFor returns the carrier whose prefix matches the number best, or ""
+func (r *SIMRouter) CarrierFor(phoneNumber string) string {
+	number := normalizeNumber(phoneNumber)
+
+	carrier, longest := "", 0
+	for name, prefixes := range r.prefixes {
+		for _, prefix := range prefixes {
+			if len(prefix) > longest && strings.HasPrefix(number, prefix) {
+				carrier, longest = name, len(prefix)
+			}
+		}
+	}
+	return carrier
+}
+
+// SelectSIM returns the ready SIM on the recipient's carrier, falling back to
+// the ready SIM in the lowest slot. It returns nil if no SIM is ready, which
+// is the case for devices that don't report their SIMs.
+func (r *SIMRouter) SelectSIM(sims []models.SIM, phoneNumber string) *models.SIM {
+	if ranked := r.RankSIMs(sims, phoneNumber); len(ranked) > 0 {
+		return ranked[0]
+	}
+	return nil
+}
+
+// RankSIMs orders the ready SIMs from best to worst for the recipient:
+// SIMs on the recipient's carrier first, then by slot
+func (r *SIMRouter) RankSIMs(sims []models.SIM, phoneNumber string) []*models.SIM {
+	carrier := r.CarrierFor(phoneNumber)
+
+	var ranked []*models.SIM
+	for i := range sims {
+		if sims[i].Status == models.SIMStatusReady {
+			ranked = append(ranked, &sims[i])
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		iMatch, jMatch := matchesCarrier(ranked[i], carrier), matchesCarrier(ranked[j], carrier)
+		if iMatch != jMatch {
+			return iMatch
+		}
+		return ranked[i].Slot < ranked[j].Slot
+	})
+	return ranked
+}
+
+// SelectDevice prefers the first device with a SIM on the recipient's
+// carrier, falling back to the first device. SIMs must be preloaded.
+func (r *SIMRouter) SelectDevice(devices []models.Device, phoneNumber string) *models.Device {
+	if ranked := r.RankDevices(devices, phoneNumber); len(ranked) > 0 {
+		return ranked[0]
+	}
+	return nil
+}
+
+// RankDevices moves devices with a ready SIM on the recipient's carrier to
+// the front, keeping the order otherwise
+func (r *SIMRouter) RankDevices(devices []models.Device, phoneNumber string) []*models.Device {
+	carrier := r.CarrierFor(phoneNumber)
+
+	var matching, others []*models.Device
+	for i := range devices {
+		match := false
+		for j := range devices[i].SIMs {
+			if devices[i].SIMs[j].Status == models.SIMStatusReady && matchesCarrier(&devices[i].SIMs[j], carrier) {
+				match = true
+				break
+			}
+		}
+		if match {
+			matching = append(matching, &devices[i])
+		} else {
+			others = append(others, &devices[i])
+		}
+	}
+	return append(matching, others...)
+}
+
+func matchesCarrier(sim *models.SIM, carrier string) bool {
+	return carrier != "" && strings.EqualFold(sim.Carrier, carrier)
+}
+
+// normalizeNumber drops everything but digits and a leading +
+func normalizeNumber(phoneNumber string) string {
+	var b strings.Builder
+	for i, ch := range strings.TrimSpace(phoneNumber) {
+		if (ch >= '0' && ch <= '9') || (ch == '+' && i == 0) {
+			b.WriteRune(ch)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/websocket"
+)
+
+var (
+	ErrUSSDTimeout       = errors.New("device did not answer the USSD request in time")
+	ErrUSSDBusy          = errors.New("USSD session is still waiting for a response")
+	ErrUSSDSessionClosed = errors.New("USSD session is not waiting for a reply")
+)
+
+// Longest a USSD request waits for the device's response
+const maxUSSDTimeout = 120 * time.Second
+
+// USSDService runs USSD sessions on devices: it sends ussd_request
+// commands, waits for the matching ussd_response and keeps every step as
+// history
+type USSDService struct {
+	db      *gorm.DB
+	hub     *websocket.Hub
+	timeout time.Duration
+
+	mu sync.Mutex
+	// Closed when the step with that ID gets its response
+	waiters map[uint]chan struct{}
+	// Sessions with a request in flight
+	busy map[uint]bool
+}
+
+func NewUSSDService(db *gorm.DB, hub *websocket.Hub, devicesConfig config.DevicesConfig) *USSDService {
+	return &USSDService{
+		db:      db,
+		hub:     hub,
+		timeout: time.Duration(devicesConfig.USSDTimeout) * time.Second,
+		waiters: make(map[uint]chan struct{}),
+		busy:    make(map[uint]bool),
+	}
+}
+
+// Start dials code on the device and waits for the first response. Devices
+// run one USSD dialog at a time, so a session still open on the device is
+// cancelled. A zero timeout uses USSD_TIMEOUT.
+func (s *USSDService) Start(userID uint, device *models.Device, sim *models.SIM, code string, timeout time.Duration) (*models.USSDSession, error) {
+	if err := s.hub.CheckCommand(device.DeviceID, "ussd_request"); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	session := models.USSDSession{
+		UserID:   userID,
+		DeviceID: device.ID,
+		Code:     code,
+		Status:   models.USSDSessionActive,
+	}
+	if sim != nil {
+		session.SIMID = &sim.ID
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.USSDSession{}).
+			Where("device_id = ? AND status = ?", device.ID, models.USSDSessionActive).
+			Updates(map[string]interface{}{"status": models.USSDSessionCancelled, "ended_at": now}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&session).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.busy[session.ID] = true
+	s.mu.Unlock()
+
+	return s.send(&session, device, code, frameSIMSlot(s.hub, device, sim), timeout)
+}
+
+// Reply answers the menu an active session is showing and waits for the
+// next response
+func (s *USSDService) Reply(session *models.USSDSession, device *models.Device, input string, timeout time.Duration) (*models.USSDSession, error) {
+	if session.Status != models.USSDSessionActive {
+		return nil, ErrUSSDSessionClosed
+	}
+
+	s.mu.Lock()
+	if s.busy[session.ID] {
+		s.mu.Unlock()
+		return nil, ErrUSSDBusy
+	}
+	s.busy[session.ID] = true
+	s.mu.Unlock()
+
+	var last models.USSDStep
+	if err := s.db.Where("session_id = ?", session.ID).Order("id DESC").First(&last).Error; err != nil {
+		s.release(session.ID)
+		return nil, err
+	}
+	if last.Status != models.USSDStepContinue {
+		s.release(session.ID)
+		return nil, ErrUSSDSessionClosed
+	}
+
+	return s.send(session, device, input, nil, timeout)
+}
+
+// Cancel closes an active session and tells the device to close its dialog
+func (s *USSDService) Cancel(session *models.USSDSession, device *models.Device) error {
+	now := time.Now().UTC()
+	result := s.db.Model(&models.USSDSession{}).
+		Where("id = ? AND status = ?", session.ID, models.USSDSessionActive).
+		Updates(map[string]interface{}{"status": models.USSDSessionCancelled, "ended_at": now})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUSSDSessionClosed
+	}
+	session.Status = models.USSDSessionCancelled
+	session.EndedAt = &now
+
+	err := s.hub.SendCommand(device.DeviceID, websocket.Message{
+		Type: "ussd_request",
+		Data: websocket.USSDRequestFrame{
+			SessionID: session.ID,
+			DeviceID:  device.DeviceID,
+			End:       true,
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to close USSD session %d on device %s: %v", session.ID, device.DeviceID, err)
+	}
+	return nil
+}
+
+// HandleResponse records a ussd_response and wakes the request waiting for
+// it; it is the hub's OnUSSDResponse hook. Responses arriving after the
+// request timed out are still recorded.
+func (s *USSDService) HandleResponse(deviceID string, frame *websocket.USSDResponseFrame) {
+	var step models.USSDStep
+	err := s.db.Select("ussd_steps.*").
+		Joins("JOIN ussd_sessions ON ussd_sessions.id = ussd_steps.session_id").
+		Joins("JOIN devices ON devices.id = ussd_sessions.device_id").
+		Where("ussd_steps.id = ? AND devices.device_id = ?", frame.RequestID, deviceID).
+		First(&step).Error
+	if err != nil {
+		log.Printf("Ignoring USSD response for unknown request %d from device %s", frame.RequestID, deviceID)
+		return
+	}
+
+	stepStatus, sessionStatus := models.USSDStepCompleted, models.USSDSessionCompleted
+	switch frame.Status {
+	case "continue":
+		stepStatus, sessionStatus = models.USSDStepContinue, models.USSDSessionActive
+	case "failed":
+		stepStatus, sessionStatus = models.USSDStepFailed, models.USSDSessionFailed
+	}
+
+	now := time.Now().UTC()
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.USSDStep{}).
+			Where("id = ? AND status IN ?", step.ID, []string{models.USSDStepPending, models.USSDStepTimeout}).
+			Updates(map[string]interface{}{
+				"response":     frame.Message,
+				"status":       stepStatus,
+				"error_msg":    frame.ErrorMsg,
+				"responded_at": now,
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		updates := map[string]interface{}{"status": sessionStatus, "ended_at": nil}
+		if sessionStatus != models.USSDSessionActive {
+			updates["ended_at"] = now
+		}
+		// A session cancelled meanwhile stays cancelled
+		return tx.Model(&models.USSDSession{}).
+			Where("id = ? AND status IN ?", step.SessionID, []string{models.USSDSessionActive, models.USSDSessionTimeout}).
+			Updates(updates).Error
+	})
+	if err != nil {
+		log.Printf("Failed to record USSD response %d from device %s: %v", frame.RequestID, deviceID, err)
+	}
+
+	s.mu.Lock()
+	if waiter, ok := s.waiters[step.ID]; ok {
+		close(waiter)
+		delete(s.waiters, step.ID)
+	}
+	s.mu.Unlock()
+}
+
+// Timeout is how long a request asking for timeout waits for the device's
+// response: USSD_TIMEOUT when zero, and at most two minutes
+func (s *USSDService) Timeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		timeout = s.timeout
+	}
+	return min(timeout, maxUSSDTimeout)
+}
+
+// send records a step, sends it to the device and waits for the response,
+// returning the session with all its steps
+func (s *USSDService) send(session *models.USSDSession, device *models.Device, input string, simSlot *int, timeout time.Duration) (*models.USSDSession, error) {
+	defer s.release(session.ID)
+
+	timeout = s.Timeout(timeout)
+
+	step := models.USSDStep{
+		SessionID: session.ID,
+		Input:     input,
+		Status:    models.USSDStepPending,
+	}
+	if err := s.db.Create(&step).Error; err != nil {
+		return nil, err
+	}
+
+	waiter := make(chan struct{})
+	s.mu.Lock()
+	s.waiters[step.ID] = waiter
+	s.mu.Unlock()
+
+	err := s.hub.SendCommand(device.DeviceID, websocket.Message{
+		Type: "ussd_request",
+		Data: websocket.USSDRequestFrame{
+			ID:        step.ID,
+			SessionID: session.ID,
+			Input:     input,
+			DeviceID:  device.DeviceID,
+			SIMSlot:   simSlot,
+		},
+	})
+	if err != nil {
+		s.mu.Lock()
+		delete(s.waiters, step.ID)
+		s.mu.Unlock()
+		s.end(session.ID, step.ID, models.USSDStepFailed, models.USSDSessionFailed, err.Error())
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var timedOut bool
+	select {
+	case <-waiter:
+	case <-timer.C:
+		s.mu.Lock()
+		delete(s.waiters, step.ID)
+		s.mu.Unlock()
+		timedOut = s.end(session.ID, step.ID, models.USSDStepTimeout, models.USSDSessionTimeout, ErrUSSDTimeout.Error())
+	}
+
+	updated, err := s.session(session.ID)
+	if err != nil {
+		return nil, err
+	}
+	if timedOut {
+		// The step just sent is the session's last
+		if updated.Steps[len(updated.Steps)-1].Status == models.USSDStepTimeout {
+			return updated, ErrUSSDTimeout
+		}
+		// The response was recorded since the step timed out, after the
+		// session was read; its session update was committed with it
+		return s.session(session.ID)
+	}
+	return updated, nil
+}
+
+// session loads a session with all its steps
+func (s *USSDService) session(sessionID uint) (*models.USSDSession, error) {
+	var session models.USSDSession
+	if err := s.db.Preload("Steps", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).First(&session, sessionID).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// end marks a still pending step and its active session as ended without a
+// response. It reports false if the response arrived first.
+func (s *USSDService) end(sessionID, stepID uint, stepStatus, sessionStatus, errorMsg string) bool {
+	result := s.db.Model(&models.USSDStep{}).
+		Where("id = ? AND status = ?", stepID, models.USSDStepPending).
+		Updates(map[string]interface{}{"status": stepStatus, "error_msg": errorMsg})
+	if result.Error != nil {
+		log.Printf("Failed to update USSD step %d: %v", stepID, result.Error)
+		return false
+	}
+	if result.RowsAffected == 0 {
+		return false
+	}
+
+	err := s.db.Model(&models.USSDSession{}).
+		Where("id = ? AND status = ?", sessionID, models.USSDSessionActive).
+		Updates(map[string]interface{}{"status": sessionStatus, "ended_at": time.Now().UTC()}).Error
+	if err != nil {
+		log.Printf("Failed to update USSD session %d: %v", sessionID, err)
+	}
+	return true
+}
+
+func (s *USSDService) release(sessionID uint) {
+	s.mu.Lock()
+	delete(s.busy, sessionID)
+	s.mu.Unlock()
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/websocket"
+)
+
+var ErrVerificationNotFound = errors.New("verification not found")
+
+// VerifyThrottleError refuses a code that would go over a resend or hourly
+// limit
+type VerifyThrottleError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *VerifyThrottleError) Error() string {
+	return e.Reason
+}
+
+// VerifyService sends one-time codes by SMS or voice call and checks them.
+// Only a hash of each code is stored.
+type VerifyService struct {
+	db         *gorm.DB
+	hub        *websocket.Hub
+	router     *SIMRouter
+	dispatcher *Dispatcher
+	config     config.VerifyConfig
+
+	// Serializes the throttle checks with sending and storing the
+	// verification, so concurrent starts for a number can't all slip under
+	// the limits
+	startMu sync.Mutex
+}
+
+// NewVerifyService refuses configs that would make every code unusable,
+// such as a zero lifetime or no attempts
+func NewVerifyService(db *gorm.DB, hub *websocket.Hub, router *SIMRouter, dispatcher *Dispatcher, verifyConfig config.VerifyConfig) (*VerifyService, error) {
+	switch {
+	case verifyConfig.CodeLength < 4 || verifyConfig.CodeLength > 10:
+		return nil, fmt.Errorf("VERIFY_CODE_LENGTH must be 4 to 10 digits, got %d", verifyConfig.CodeLength)
+	case verifyConfig.TTL <= 0:
+		return nil, fmt.Errorf("VERIFY_TTL must be positive, got %d", verifyConfig.TTL)
+	case verifyConfig.MaxAttempts <= 0:
+		return nil, fmt.Errorf("VERIFY_MAX_ATTEMPTS must be positive, got %d", verifyConfig.MaxAttempts)
+	case verifyConfig.ResendCooldown < 0:
+		return nil, fmt.Errorf("VERIFY_RESEND_COOLDOWN must not be negative, got %d", verifyConfig.ResendCooldown)
+	case verifyConfig.MaxPerNumber <= 0:
+		return nil, fmt.Errorf("VERIFY_MAX_PER_NUMBER must be positive, got %d", verifyConfig.MaxPerNumber)
+	case verifyConfig.MaxPerUser <= 0:
+		return nil, fmt.Errorf("VERIFY_MAX_PER_USER must be positive, got %d", verifyConfig.MaxPerUser)
+	case !HasTemplateVariable(verifyConfig.Template, "code"):
+		return nil, errors.New("VERIFY_TEMPLATE must contain {{code}}")
+	}
+
+	return &VerifyService{
+		db:         db,
+		hub:        hub,
+		router:     router,
+		dispatcher: dispatcher,
+		config:     verifyConfig,
+	}, nil
+}
+
+// Start sends a new code to phoneNumber through device and stores the
+// verification once the code was handed on; a code that couldn't be sent
+// leaves nothing behind. For SMS, MessageStatus says whether the code was
+// dispatched ("pending") or is held until the device has room ("queued").
+// Zero codeLength and ttl, and an empty template, use the configured ones.
+func (s *VerifyService) Start(userID uint, device *models.Device, phoneNumber, channel string, codeLength, ttl int, template string) (*models.Verification, error) {
+	if codeLength == 0 {
+		codeLength = s.config.CodeLength
+	}
+	if ttl == 0 {
+		ttl = s.config.TTL
+	}
+	if template == "" {
+		template = s.config.Template
+	}
+
+	code, err := generateCode(codeLength)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	verification := models.Verification{
+		UserID:      userID,
+		PhoneNumber: phoneNumber,
+		Channel:     channel,
+		Status:      models.VerificationPending,
+		MaxAttempts: s.config.MaxAttempts,
+		ExpiresAt:   now.Add(time.Duration(ttl) * time.Second),
+	}
+	if err := verification.HashCode(code); err != nil {
+		return nil, err
+	}
+
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+
+	if err := s.throttle(userID, phoneNumber, now); err != nil {
+		return nil, err
+	}
+
+	sim := s.router.SelectSIM(device.SIMs, phoneNumber)
+	if channel == models.VerifyChannelCall {
+		err = s.sendCall(&verification, device, sim, code)
+	} else {
+		minutes := strconv.Itoa(int(math.Ceil(float64(ttl) / 60)))
+		text := RenderTemplate(template, map[string]string{"code": code, "minutes": minutes})
+		err = s.sendSMS(&verification, device, sim, text)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A new code replaces any the number was sent before
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Verification{}).
+			Where("user_id = ? AND phone_number = ? AND status = ?", userID, phoneNumber, models.VerificationPending).
+			Update("status", models.VerificationCancelled).Error; err != nil {
+			return err
+		}
+		return tx.Create(&verification).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &verification, nil
+}
+
+// Check validates a code for the verification with the ID, or if id is 0
+// the latest one sent to phoneNumber. Every check counts as an attempt; the
+// verification fails once MaxAttempts wrong codes were given.
+func (s *VerifyService) Check(userID, id uint, phoneNumber, code string) (*models.Verification, bool, error) {
+	query := s.db.Where("user_id = ?", userID)
+	if id != 0 {
+		query = query.Where("id = ?", id)
+	} else {
+		query = query.Where("phone_number = ?", phoneNumber).Order("created_at DESC, id DESC")
+	}
+
+	var verification models.Verification
+	if err := query.First(&verification).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, ErrVerificationNotFound
+		}
+		return nil, false, err
+	}
+
+	now := time.Now().UTC()
+	if verification.Status == models.VerificationPending && !now.Before(verification.ExpiresAt) {
+		s.db.Model(&models.Verification{}).
+			Where("id = ? AND status = ?", verification.ID, models.VerificationPending).
+			Update("status", models.VerificationExpired)
+		verification.Status = models.VerificationExpired
+	}
+	if verification.Status != models.VerificationPending {
+		return &verification, false, nil
+	}
+
+	// Count the attempt before comparing, so concurrent guesses can't exceed
+	// the limit
+	result := s.db.Model(&models.Verification{}).
+		Where("id = ? AND status = ? AND attempts < max_attempts", verification.ID, models.VerificationPending).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return s.reload(&verification)
+	}
+	verification.Attempts++
+
+	valid := verification.CheckCode(strings.TrimSpace(code))
+	updates := map[string]interface{}{}
+	switch {
+	case valid:
+		updates["status"] = models.VerificationApproved
+		updates["verified_at"] = now
+	case verification.Attempts >= verification.MaxAttempts:
+		updates["status"] = models.VerificationFailed
+	}
+	if len(updates) > 0 {
+		result := s.db.Model(&models.Verification{}).
+			Where("id = ? AND status = ?", verification.ID, models.VerificationPending).
+			Updates(updates)
+		if result.Error != nil {
+			return nil, false, result.Error
+		}
+		// Lost to a concurrent check that approved or failed it first
+		if result.RowsAffected == 0 {
+			return s.reload(&verification)
+		}
+		verification.Status = updates["status"].(string)
+		if valid {
+			verification.VerifiedAt = &now
+		}
+	}
+
+	return &verification, valid, nil
+}
+
+func (s *VerifyService) reload(verification *models.Verification) (*models.Verification, bool, error) {
+	if err := s.db.First(verification, verification.ID).Error; err != nil {
+		return nil, false, err
+	}
+	return verification, false, nil
+}
+
+// throttle refuses another code to the number with a *VerifyThrottleError
+// while the resend cooldown or an hourly limit holds
+func (s *VerifyService) throttle(userID uint, phoneNumber string, now time.Time) error {
+	byNumber := s.db.Model(&models.Verification{}).Where("user_id = ? AND phone_number = ?", userID, phoneNumber)
+
+	if s.config.ResendCooldown > 0 {
+		var latest models.Verification
+		err := byNumber.Session(&gorm.Session{}).Order("created_at DESC").Limit(1).Find(&latest).Error
+		if err != nil {
+			return err
+		}
+		if latest.ID != 0 {
+			if wait := latest.CreatedAt.Add(time.Duration(s.config.ResendCooldown) * time.Second).Sub(now); wait > 0 {
+				return &VerifyThrottleError{Reason: "A code was sent to this number recently", RetryAfter: wait}
+			}
+		}
+	}
+
+	wait, err := hourlyWait(byNumber.Session(&gorm.Session{}), s.config.MaxPerNumber, now)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &VerifyThrottleError{Reason: "Too many codes sent to this number", RetryAfter: wait}
+	}
+
+	byUser := s.db.Model(&models.Verification{}).Where("user_id = ?", userID)
+	wait, err = hourlyWait(byUser, s.config.MaxPerUser, now)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &VerifyThrottleError{Reason: "Too many verification codes sent", RetryAfter: wait}
+	}
+	return nil
+}
+
+// hourlyWait returns how long until fewer than limit of the verifications
+// matched by query were created in the last hour
+func hourlyWait(query *gorm.DB, limit int, now time.Time) (time.Duration, error) {
+	// The limit-th newest verification is the one whose ageing out frees a slot
+	var rows []models.Verification
+	err := query.Select("created_at").
+		Where("created_at > ?", now.Add(-time.Hour)).
+		Order("created_at DESC").Offset(limit - 1).Limit(1).
+		Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	return rows[0].CreatedAt.Add(time.Hour).Sub(now), nil
+}
+
+// sendSMS sends the code as a high priority message that expires with the
+// verification
+func (s *VerifyService) sendSMS(verification *models.Verification, device *models.Device, sim *models.SIM, text string) error {
+	expiresAt := verification.ExpiresAt
+	message := models.Message{
+		PhoneNumber: verification.PhoneNumber,
+		Content:     text,
+		Status:      "pending",
+		DeviceID:    device.ID,
+		UserID:      verification.UserID,
+		ExpiresAt:   &expiresAt,
+		Priority:    models.PriorityHigh,
+	}
+	if sim != nil {
+		message.SIMID = &sim.ID
+	}
+	if err := s.db.Create(&message).Error; err != nil {
+		return err
+	}
+	if err := s.dispatcher.SendSMS(&message, device, sim); err != nil {
+		return err
+	}
+
+	verification.MessageID = &message.ID
+	verification.MessageStatus = message.Status
+	return nil
+}
+
+// sendCall calls the number and has the device read the code out
+func (s *VerifyService) sendCall(verification *models.Verification, device *models.Device, sim *models.SIM, code string) error {
+	call := models.Call{
+		PhoneNumber: verification.PhoneNumber,
+		Status:      "pending",
+		DeviceID:    device.ID,
+		UserID:      verification.UserID,
+	}
+	if sim != nil {
+		call.SIMID = &sim.ID
+	}
+	if err := s.db.Create(&call).Error; err != nil {
+		return err
+	}
+
+	frame := websocket.MakeCallFrame{
+		ID:          call.ID,
+		PhoneNumber: call.PhoneNumber,
+		DeviceID:    device.DeviceID,
+		Speak:       spokenCode(code),
+	}
+	if sim != nil && s.hub.HasCapability(device.DeviceID, websocket.CapabilityDualSIM) {
+		slot := sim.Slot
+		frame.SIMSlot = &slot
+	}
+
+	if err := s.hub.SendCommand(device.DeviceID, websocket.Message{Type: "make_call", Data: frame}); err != nil {
+		s.db.Model(&call).Updates(map[string]interface{}{"status": "failed", "error_msg": err.Error()})
+		return err
+	}
+
+	verification.CallID = &call.ID
+	return nil
+}
+
+// spokenCode is the text read out on a verification call. Digits are
+// separated so they are spoken one by one, and the code is said twice.
+func spokenCode(code string) string {
+	digits := strings.Join(strings.Split(code, ""), ", ")
+	return fmt.Sprintf("Your verification code is %s. Again, your code is %s.", digits, digits)
+}
+
+// generateCode returns a random code of length decimal digits
+func generateCode(length int) (string, error) {
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+	return string(code), nil
+}
@@ -1,7 +1,7 @@
 package websocket
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"time"
@@ -14,11 +14,19 @@ type Client struct {
 	Conn     *websocket.Conn
 	Send     chan Message
 	DeviceID string
+
+	// Wire encoding picked by the device at connect time
+	codec frameCodec
+
+	// Message commands waiting for room in the device's send window
+	lanes *commandLanes
 }
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// Negotiate permessage-deflate with devices that offer it
+	EnableCompression: true,
 	CheckOrigin: func(r *http.Request) bool {
 		// TODO: Implement proper origin checking based on configuration
 		return true
@@ -26,13 +34,23 @@ var upgrader = websocket.Upgrader{
 }
 
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
 )
 
 func HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if hub.IsShuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	codec, err := codecFor(r.URL.Query().Get("encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
@@ -51,9 +69,18 @@ func HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		Conn:     conn,
 		Send:     make(chan Message, 256),
 		DeviceID: deviceID,
+		codec:    codec,
+		lanes:    newCommandLanes(),
 	}
 
-	client.Hub.Register <- client
+	hub.pumps.Add(1)
+	select {
+	case client.Hub.Register <- client:
+	case <-client.Hub.quit:
+		hub.pumps.Done()
+		conn.Close()
+		return
+	}
 
 	// Start goroutines for handling read/write
 	go client.writePump()
@@ -62,14 +89,19 @@ func HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 
 func (c *Client) readPump() {
 	defer func() {
-		c.Hub.Unregister <- c
+		select {
+		case c.Hub.Unregister <- c:
+		case <-c.Hub.quit:
+		}
 		c.Conn.Close()
 	}()
 
-	c.Conn.SetReadLimit(maxMessageSize)
+	// Frames are bounded by their fields' limits; see maxFrameSize
+	c.Conn.SetReadLimit(maxFrameSize)
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.Conn.SetPongHandler(func(string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.Hub.touchDevice(c.DeviceID)
 		return nil
 	})
 
@@ -82,9 +114,12 @@ func (c *Client) readPump() {
 			break
 		}
 
-		var message Message
-		if err := json.Unmarshal(messageBytes, &message); err != nil {
-			log.Printf("JSON unmarshal error: %v", err)
+		c.Hub.recordReceived(c.codec.name(), len(messageBytes))
+
+		message, err := decodeFrame(c.codec, messageBytes)
+		if err != nil {
+			log.Printf("Rejected frame from device %s: %v", c.DeviceID, err)
+			c.sendFrameError(err)
 			continue
 		}
 
@@ -98,6 +133,7 @@ func (c *Client) writePump() {
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
+		c.Hub.pumps.Done()
 	}()
 
 	for {
@@ -109,12 +145,22 @@ func (c *Client) writePump() {
 				return
 			}
 
-			if err := c.Conn.WriteJSON(message); err != nil {
+			data, err := c.codec.marshal(message)
+			if err != nil {
+				log.Printf("Failed to encode %s frame for device %s: %v", message.Type, c.DeviceID, err)
+				continue
+			}
+
+			if err := c.Conn.WriteMessage(c.codec.messageType(), data); err != nil {
 				log.Printf("WebSocket write error: %v", err)
 				return
 			}
+			c.Hub.recordSent(c.codec.name(), len(data))
 
 		case <-ticker.C:
+			// Free window slots of commands the device never reported on
+			c.Hub.releaseCommands(c)
+
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
@@ -126,50 +172,118 @@ func (c *Client) writePump() {
 func (c *Client) handleMessage(message Message) {
 	log.Printf("Received message from device %s: %s", c.DeviceID, message.Type)
 
-	switch message.Type {
-	case "sms_status":
-		c.handleSMSStatus(message)
-	case "call_status":
-		c.handleCallStatus(message)
-	case "device_status":
-		c.handleDeviceStatus(message)
-	case "heartbeat":
-		c.handleHeartbeat(message)
+	switch frame := message.Data.(type) {
+	case *HelloFrame:
+		c.handleHello(frame)
+	case *SMSStatusFrame:
+		c.handleSMSStatus(frame)
+	case *SMSReceivedFrame:
+		c.handleSMSReceived(frame)
+	case *CallStatusFrame:
+		c.handleCallStatus(frame)
+	case *USSDResponseFrame:
+		c.handleUSSDResponse(frame)
+	case *DeviceStatusFrame:
+		c.handleDeviceStatus(frame)
+	case *HeartbeatFrame:
+		c.handleHeartbeat(frame)
 	default:
 		log.Printf("Unknown message type: %s", message.Type)
 	}
 }
 
-func (c *Client) handleSMSStatus(message Message) {
-	// Update SMS status in database
-	log.Printf("SMS status update: %+v", message.Data)
-	// TODO: Implement database update logic
+// sendFrameError tells the device why one of its frames was rejected
+func (c *Client) sendFrameError(err error) {
+	errorFrame := ErrorFrame{Reason: err.Error()}
+	var frameErr *FrameError
+	if errors.As(err, &frameErr) {
+		errorFrame = ErrorFrame{Reason: frameErr.Reason, Type: frameErr.Type}
+	}
+
+	response := Message{
+		Type:      "error",
+		Timestamp: time.Now(),
+		Data:      errorFrame,
+	}
+
+	if !c.Hub.sendToClient(c, response) {
+		log.Printf("Failed to send error frame to device: %s", c.DeviceID)
+	}
+}
+
+func (c *Client) handleHello(frame *HelloFrame) {
+	negotiated, accepted := c.Hub.SetDeviceProtocol(c.DeviceID, frame.AppVersion, frame.ProtocolVersion, frame.Capabilities)
+
+	response := Message{
+		Type:      "hello_ack",
+		Version:   negotiated,
+		Timestamp: time.Now(),
+		Data: HelloAckFrame{
+			ProtocolVersion:       negotiated,
+			ServerProtocolVersion: ProtocolVersion,
+			Capabilities:          accepted,
+		},
+	}
+
+	if !c.Hub.sendToClient(c, response) {
+		log.Printf("Failed to send hello ack to device: %s", c.DeviceID)
+	}
 }
 
-func (c *Client) handleCallStatus(message Message) {
-	// Update call status in database
-	log.Printf("Call status update: %+v", message.Data)
-	// TODO: Implement database update logic
+func (c *Client) handleSMSStatus(frame *SMSStatusFrame) {
+	c.Hub.ackCommand(c, frame.MessageID)
+
+	if c.Hub.OnSMSStatus == nil {
+		log.Printf("Dropping SMS status from device %s: no dispatcher", c.DeviceID)
+		return
+	}
+	c.Hub.OnSMSStatus(c.DeviceID, frame)
 }
 
-func (c *Client) handleDeviceStatus(message Message) {
-	// Update device status in database
-	log.Printf("Device status update: %+v", message.Data)
-	// TODO: Implement database update logic
+func (c *Client) handleSMSReceived(frame *SMSReceivedFrame) {
+	if c.Hub.OnSMSReceived == nil {
+		log.Printf("Dropping SMS received by device %s: no inbox", c.DeviceID)
+		return
+	}
+	c.Hub.OnSMSReceived(c.DeviceID, frame)
 }
 
-func (c *Client) handleHeartbeat(message Message) {
+func (c *Client) handleCallStatus(frame *CallStatusFrame) {
+	if c.Hub.OnCallStatus == nil {
+		log.Printf("Dropping call status from device %s: no call recorder", c.DeviceID)
+		return
+	}
+	c.Hub.OnCallStatus(c.DeviceID, frame)
+}
+
+func (c *Client) handleUSSDResponse(frame *USSDResponseFrame) {
+	if c.Hub.OnUSSDResponse == nil {
+		log.Printf("Dropping USSD response from device %s: no USSD service", c.DeviceID)
+		return
+	}
+	c.Hub.OnUSSDResponse(c.DeviceID, frame)
+}
+
+func (c *Client) handleDeviceStatus(frame *DeviceStatusFrame) {
+	c.Hub.UpdateDeviceStatus(c.DeviceID, frame)
+	c.Hub.RecordTelemetry(c.DeviceID, frame)
+	if frame.SIMs != nil {
+		c.Hub.RecordSIMs(c.DeviceID, frame.SIMs)
+	}
+}
+
+func (c *Client) handleHeartbeat(frame *HeartbeatFrame) {
+	c.Hub.touchDevice(c.DeviceID)
+
 	// Send heartbeat response
 	response := Message{
 		Type: "heartbeat_ack",
-		Data: map[string]interface{}{
-			"timestamp": time.Now().Unix(),
+		Data: HeartbeatAckFrame{
+			Timestamp: time.Now().Unix(),
 		},
 	}
-	
-	select {
-	case c.Send <- response:
-	default:
+
+	if !c.Hub.sendToClient(c, response) {
 		log.Printf("Failed to send heartbeat ack to device: %s", c.DeviceID)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,139 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+// Frame encodings a device can pick with the ?encoding= query parameter.
+// JSON stays the default for app versions that predate CBOR support.
+const (
+	EncodingJSON = "json"
+	EncodingCBOR = "cbor"
+)
+
+// frameCodec encodes outbound frames and decodes inbound ones for a single
+// wire encoding. Both codecs use the frame structs' json tags as field names.
+type frameCodec interface {
+	name() string
+	messageType() int
+	marshal(v interface{}) ([]byte, error)
+	// Strict decoding rejects unknown fields
+	decodeEnvelope(raw []byte, strict bool) (inboundEnvelope, error)
+	decodeData(raw []byte, v interface{}, strict bool) error
+	isEmpty(raw []byte) bool
+}
+
+func codecFor(encoding string) (frameCodec, error) {
+	switch encoding {
+	case "", EncodingJSON:
+		return jsonCodec{}, nil
+	case EncodingCBOR:
+		return cborCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q (expected %q or %q)", encoding, EncodingJSON, EncodingCBOR)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) name() string {
+	return EncodingJSON
+}
+
+func (jsonCodec) messageType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) decodeEnvelope(raw []byte, strict bool) (inboundEnvelope, error) {
+	var envelope struct {
+		Type      string          `json:"type"`
+		Version   int             `json:"version,omitempty"`
+		Data      json.RawMessage `json:"data"`
+		Timestamp time.Time       `json:"timestamp"`
+		DeviceID  string          `json:"device_id,omitempty"`
+	}
+	if err := c.decodeData(raw, &envelope, strict); err != nil {
+		return inboundEnvelope{}, err
+	}
+
+	return inboundEnvelope{
+		Type:      envelope.Type,
+		Version:   envelope.Version,
+		Data:      envelope.Data,
+		Timestamp: envelope.Timestamp,
+		DeviceID:  envelope.DeviceID,
+	}, nil
+}
+
+func (jsonCodec) decodeData(raw []byte, v interface{}, strict bool) error {
+	if strict {
+		return decodeStrict(raw, v)
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (jsonCodec) isEmpty(raw []byte) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+var (
+	cborEncMode, _        = cbor.EncOptions{Time: cbor.TimeUnixDynamic}.EncMode()
+	cborDecMode, _        = cbor.DecOptions{ExtraReturnErrors: cbor.ExtraDecErrorUnknownField}.DecMode()
+	cborLenientDecMode, _ = cbor.DecOptions{}.DecMode()
+)
+
+type cborCodec struct{}
+
+func (cborCodec) name() string {
+	return EncodingCBOR
+}
+
+func (cborCodec) messageType() int {
+	return websocket.BinaryMessage
+}
+
+func (cborCodec) marshal(v interface{}) ([]byte, error) {
+	return cborEncMode.Marshal(v)
+}
+
+func (c cborCodec) decodeEnvelope(raw []byte, strict bool) (inboundEnvelope, error) {
+	var envelope struct {
+		Type      string          `json:"type"`
+		Version   int             `json:"version,omitempty"`
+		Data      cbor.RawMessage `json:"data"`
+		Timestamp time.Time       `json:"timestamp"`
+		DeviceID  string          `json:"device_id,omitempty"`
+	}
+	if err := c.decodeData(raw, &envelope, strict); err != nil {
+		return inboundEnvelope{}, err
+	}
+
+	return inboundEnvelope{
+		Type:      envelope.Type,
+		Version:   envelope.Version,
+		Data:      envelope.Data,
+		Timestamp: envelope.Timestamp,
+		DeviceID:  envelope.DeviceID,
+	}, nil
+}
+
+func (cborCodec) decodeData(raw []byte, v interface{}, strict bool) error {
+	if strict {
+		return cborDecMode.Unmarshal(raw, v)
+	}
+	return cborLenientDecMode.Unmarshal(raw, v)
+}
+
+func (cborCodec) isEmpty(raw []byte) bool {
+	// 0xf6 is CBOR null
+	return len(raw) == 0 || (len(raw) == 1 && raw[0] == 0xf6)
+}
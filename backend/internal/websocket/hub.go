@@ -1,9 +1,16 @@
 package websocket
 
 import (
+	"context"
+	"errors"
 	"log"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
 )
 
 type Hub struct {
@@ -27,6 +34,59 @@ type Hub struct {
 
 	// Device status tracking
 	DeviceStatus map[string]*DeviceInfo
+
+	db *gorm.DB
+
+	// Frame and payload byte counters per wire encoding
+	traffic map[string]*trafficStats
+
+	// How long device telemetry is kept; zero keeps it forever
+	TelemetryRetention time.Duration
+
+	// Stores messages devices report receiving; set before devices connect
+	OnSMSReceived func(deviceID string, frame *SMSReceivedFrame)
+
+	// Records sent and delivery reports for outbound messages; set before
+	// devices connect
+	OnSMSStatus func(deviceID string, frame *SMSStatusFrame)
+
+	// Records call progress and ends reported by devices; set before devices
+	// connect
+	OnCallStatus func(deviceID string, frame *CallStatusFrame)
+
+	// Records answers to ussd_request commands; set before devices connect
+	OnUSSDResponse func(deviceID string, frame *USSDResponseFrame)
+
+	// Message commands a device may have unreported before the rest wait
+	// in its priority lanes; zero means no limit
+	SendWindow int
+
+	// Requeues messages whose send_sms or send_mms command was held for a
+	// device that disconnected, or that expired while held; set before
+	// devices connect
+	OnCommandsDropped func(deviceID string, messageIDs []uint)
+
+	// Closed when the hub is shutting down; stops Run and background routines
+	quit chan struct{}
+
+	// Tracks Run and background routines (cleanup, heartbeat)
+	wg sync.WaitGroup
+
+	// Tracks client write pumps so pending sends can be flushed on shutdown
+	pumps sync.WaitGroup
+
+	// Latest connection state of each device waiting to be stored; written
+	// by the presence writer so a slow database can't stall Run
+	presenceMu    sync.Mutex
+	presence      map[string]presenceUpdate
+	presenceReady chan struct{}
+
+	shuttingDown bool
+}
+
+type presenceUpdate struct {
+	online bool
+	at     time.Time
 }
 
 type DeviceInfo struct {
@@ -34,39 +94,78 @@ type DeviceInfo struct {
 	IsOnline       bool      `json:"is_online"`
 	LastSeen       time.Time `json:"last_seen"`
 	BatteryLevel   int       `json:"battery_level"`
+	Charging       bool      `json:"charging"`
 	SignalStrength int       `json:"signal_strength"`
+	NetworkType    string    `json:"network_type,omitempty"`
+	Operator       string    `json:"operator,omitempty"`
+	SIMState       string    `json:"sim_state,omitempty"`
 	PhoneNumber    string    `json:"phone_number"`
+	SIMs           []SIMStatus `json:"sims,omitempty"`
+
+	// Negotiated in the hello frame; legacy devices keep the defaults
+	AppVersion      string   `json:"app_version,omitempty"`
+	ProtocolVersion int      `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
 }
 
-type Message struct {
-	Type      string                 `json:"type"`
-	Data      map[string]interface{} `json:"data"`
-	Timestamp time.Time              `json:"timestamp"`
-	DeviceID  string                 `json:"device_id,omitempty"`
+// trafficStats counts frames and uncompressed payload bytes for one encoding
+type trafficStats struct {
+	framesSent     atomic.Int64
+	bytesSent      atomic.Int64
+	framesReceived atomic.Int64
+	bytesReceived  atomic.Int64
 }
 
-func NewHub() *Hub {
+const (
+	// Devices are asked to wait at least this long before reconnecting after
+	// a shutdown, plus a random jitter so they don't all come back at once.
+	shutdownReconnectDelay  = 5 * time.Second
+	shutdownReconnectJitter = 25 * time.Second
+)
+
+func NewHub(db *gorm.DB) *Hub {
 	return &Hub{
-		Clients:      make(map[*Client]bool),
-		DeviceMap:    make(map[string]*Client),
-		Broadcast:    make(chan Message, 256),
-		Register:     make(chan *Client),
-		Unregister:   make(chan *Client),
-		DeviceStatus: make(map[string]*DeviceInfo),
+		db:            db,
+		Clients:       make(map[*Client]bool),
+		DeviceMap:     make(map[string]*Client),
+		Broadcast:     make(chan Message, 256),
+		Register:      make(chan *Client),
+		Unregister:    make(chan *Client),
+		DeviceStatus:  make(map[string]*DeviceInfo),
+		quit:          make(chan struct{}),
+		presence:      make(map[string]presenceUpdate),
+		presenceReady: make(chan struct{}, 1),
+		traffic: map[string]*trafficStats{
+			EncodingJSON: {},
+			EncodingCBOR: {},
+		},
 	}
 }
 
 func (h *Hub) Run() {
-	// Start cleanup routine
+	h.wg.Add(1)
+	defer h.wg.Done()
+
+	// Start cleanup routines and the presence writer
+	h.wg.Add(3)
 	go h.startCleanupRoutine()
+	go h.startTelemetryRetention()
+	go h.presenceWriter()
 
 	for {
 		select {
+		case <-h.quit:
+			return
+
 		case client := <-h.Register:
-			h.registerClient(client)
+			if h.registerClient(client) {
+				h.persistPresence(client.DeviceID, true)
+			}
 
 		case client := <-h.Unregister:
-			h.unregisterClient(client)
+			if h.unregisterClient(client) {
+				h.persistPresence(client.DeviceID, false)
+			}
 
 		case message := <-h.Broadcast:
 			h.broadcastMessage(message)
@@ -74,19 +173,26 @@ func (h *Hub) Run() {
 	}
 }
 
-func (h *Hub) registerClient(client *Client) {
+// registerClient reports whether a device connection was added
+func (h *Hub) registerClient(client *Client) bool {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	if h.shuttingDown {
+		close(client.Send)
+		return false
+	}
+
 	h.Clients[client] = true
 	if client.DeviceID != "" {
 		h.DeviceMap[client.DeviceID] = client
 		
 		// Update device status
 		h.DeviceStatus[client.DeviceID] = &DeviceInfo{
-			DeviceID: client.DeviceID,
-			IsOnline: true,
-			LastSeen: time.Now(),
+			DeviceID:     client.DeviceID,
+			IsOnline:     true,
+			LastSeen:     time.Now(),
+			Capabilities: legacyCapabilities,
 		}
 	}
 
@@ -96,10 +202,13 @@ func (h *Hub) registerClient(client *Client) {
 	welcomeMsg := Message{
 		Type:      "welcome",
 		Timestamp: time.Now(),
-		Data: map[string]interface{}{
-			"message":   "Connected to Remote SIM Gateway",
-			"device_id": client.DeviceID,
-			"server_time": time.Now().Unix(),
+		Version:   ProtocolVersion,
+		Data: WelcomeFrame{
+			Message:         "Connected to Remote SIM Gateway",
+			DeviceID:        client.DeviceID,
+			ServerTime:      time.Now().Unix(),
+			ProtocolVersion: ProtocolVersion,
+			Encoding:        client.codec.name(),
 		},
 	}
 
@@ -113,18 +222,25 @@ func (h *Hub) registerClient(client *Client) {
 			delete(h.DeviceMap, client.DeviceID)
 			delete(h.DeviceStatus, client.DeviceID)
 		}
+		return false
 	}
+
+	return client.DeviceID != ""
 }
 
-func (h *Hub) unregisterClient(client *Client) {
+// unregisterClient reports whether the device went offline. A device that
+// reconnected before its old connection was cleaned up stays online.
+func (h *Hub) unregisterClient(client *Client) bool {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	wentOffline := false
 	if _, ok := h.Clients[client]; ok {
 		delete(h.Clients, client)
 		
-		if client.DeviceID != "" {
+		if client.DeviceID != "" && h.DeviceMap[client.DeviceID] == client {
 			delete(h.DeviceMap, client.DeviceID)
+			wentOffline = true
 			
 			// Update device status to offline
 			if deviceInfo, exists := h.DeviceStatus[client.DeviceID]; exists {
@@ -134,51 +250,320 @@ func (h *Hub) unregisterClient(client *Client) {
 		}
 		
 		close(client.Send)
+		h.dropCommands(client)
 		log.Printf("Client unregistered: %s (Total clients: %d)", client.DeviceID, len(h.Clients))
 	}
+	return wentOffline
 }
 
-func (h *Hub) broadcastMessage(message Message) {
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
+// persistPresence queues a device's connection state for the presence
+// writer to store, so queries on devices.is_online agree with the hub. Only
+// the latest state of a device is kept while it waits.
+func (h *Hub) persistPresence(deviceID string, online bool) {
+	if h.db == nil || deviceID == "" {
+		return
+	}
 
+	h.presenceMu.Lock()
+	h.presence[deviceID] = presenceUpdate{online: online, at: time.Now().UTC()}
+	h.presenceMu.Unlock()
+
+	select {
+	case h.presenceReady <- struct{}{}:
+	default:
+	}
+}
+
+// presenceWriter stores queued presence changes until the hub stops, then
+// stores whatever is still queued
+func (h *Hub) presenceWriter() {
+	defer h.wg.Done()
+
+	for {
+		select {
+		case <-h.presenceReady:
+			h.writePresence()
+		case <-h.quit:
+			h.writePresence()
+			return
+		}
+	}
+}
+
+func (h *Hub) writePresence() {
+	h.presenceMu.Lock()
+	pending := h.presence
+	h.presence = make(map[string]presenceUpdate)
+	h.presenceMu.Unlock()
+
+	for deviceID, update := range pending {
+		err := h.db.Model(&models.Device{}).Where("device_id = ?", deviceID).Updates(map[string]interface{}{
+			"is_online":    update.online,
+			"last_seen_at": update.at,
+		}).Error
+		if err != nil {
+			log.Printf("Failed to store presence for device %s: %v", deviceID, err)
+		}
+	}
+}
+
+// ReconcilePresence brings devices.is_online in line with the devices that
+// are actually connected. Called on startup it clears rows left online by a
+// previous process; the cleanup routine repeats it to catch missed writes.
+func (h *Hub) ReconcilePresence() error {
+	if h.db == nil {
+		return nil
+	}
+
+	connected := h.GetConnectedDevices()
+
+	stale := h.db.Model(&models.Device{}).Where("is_online = ?", true)
+	if len(connected) > 0 {
+		stale = stale.Where("device_id NOT IN ?", connected)
+	}
+	result := stale.Update("is_online", false)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Marked %d disconnected devices as offline", result.RowsAffected)
+	}
+
+	if len(connected) > 0 {
+		// Devices registered over the API after they connected
+		err := h.db.Model(&models.Device{}).
+			Where("is_online = ? AND device_id IN ?", false, connected).
+			Updates(map[string]interface{}{
+				"is_online":    true,
+				"last_seen_at": time.Now().UTC(),
+			}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// broadcastMessage sends a message to every client. Clients whose send
+// buffer is full are disconnected like any other unregistered client.
+func (h *Hub) broadcastMessage(message Message) {
 	message.Timestamp = time.Now()
-	
+
+	h.mutex.RLock()
+	var evicted []*Client
 	for client := range h.Clients {
 		select {
 		case client.Send <- message:
 		default:
-			log.Printf("Failed to send broadcast message to %s", client.DeviceID)
-			close(client.Send)
-			delete(h.Clients, client)
-			if client.DeviceID != "" {
-				delete(h.DeviceMap, client.DeviceID)
-			}
+			evicted = append(evicted, client)
 		}
 	}
-	
-	log.Printf("Broadcast message sent to %d clients: %s", len(h.Clients), message.Type)
+	sent := len(h.Clients) - len(evicted)
+	h.mutex.RUnlock()
+
+	for _, client := range evicted {
+		log.Printf("Failed to send broadcast message to %s: send buffer full", client.DeviceID)
+		if h.unregisterClient(client) {
+			h.persistPresence(client.DeviceID, false)
+		}
+	}
+
+	log.Printf("Broadcast message sent to %d clients: %s", sent, message.Type)
 }
 
 func (h *Hub) SendToDevice(deviceID string, message Message) bool {
+	if err := h.SendCommand(deviceID, message); err != nil {
+		log.Printf("Failed to send message to device %s: %v", deviceID, err)
+		return false
+	}
+	return true
+}
+
+// SendCommand queues a command for a connected device. Commands the device
+// hasn't advertised a capability for are refused with a *CommandError.
+func (h *Hub) SendCommand(deviceID string, message Message) error {
+	// Hold the read lock while sending so the channel can't be closed underneath us
 	h.mutex.RLock()
-	client, ok := h.DeviceMap[deviceID]
-	h.mutex.RUnlock()
+	defer h.mutex.RUnlock()
 
+	client, ok := h.DeviceMap[deviceID]
 	if !ok {
-		log.Printf("Device not found or offline: %s", deviceID)
-		return false
+		return &CommandError{DeviceID: deviceID, Command: message.Type, Err: ErrDeviceNotConnected}
+	}
+
+	if err := h.checkCommandLocked(deviceID, message.Type); err != nil {
+		return err
 	}
 
 	message.Timestamp = time.Now()
 	message.DeviceID = deviceID
+	message.Version = ProtocolVersion
+
+	// SMS and MMS wait in the device's priority lanes until its send window
+	// has room
+	if command, ok := message.Data.(messageCommand); ok && client.lanes != nil {
+		if !client.lanes.push(message, command.messagePriority()) {
+			return &CommandError{DeviceID: deviceID, Command: message.Type, Err: ErrSendQueueFull}
+		}
+		h.releaseCommandsLocked(client)
+		log.Printf("Message queued for device %s: %s (%s priority)", deviceID, message.Type, lane(command.messagePriority()))
+		return nil
+	}
 
 	select {
 	case client.Send <- message:
 		log.Printf("Message sent to device %s: %s", deviceID, message.Type)
+		return nil
+	default:
+		return &CommandError{DeviceID: deviceID, Command: message.Type, Err: ErrSendQueueFull}
+	}
+}
+
+// ackCommand frees a device's window slot once it reports on a message and
+// releases the next held commands
+func (h *Hub) ackCommand(client *Client, messageID uint) {
+	if client.lanes == nil {
+		return
+	}
+	client.lanes.ack(messageID)
+	h.releaseCommands(client)
+}
+
+// releaseCommands hands a client's held commands to its write pump as its
+// send window allows
+func (h *Hub) releaseCommands(client *Client) {
+	// Hold the read lock so Send can't be closed underneath us
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if !h.Clients[client] {
+		return
+	}
+	h.releaseCommandsLocked(client)
+}
+
+func (h *Hub) releaseCommandsLocked(client *Client) {
+	expired := client.lanes.release(h.SendWindow, func(message Message) bool {
+		select {
+		case client.Send <- message:
+			return true
+		default:
+			return false
+		}
+	})
+	if len(expired) > 0 {
+		go h.requeueCommands(client.DeviceID, expired)
+	}
+}
+
+// dropCommands hands the commands still held for a client that is going
+// away back to the dispatcher
+func (h *Hub) dropCommands(client *Client) {
+	if client.lanes == nil {
+		return
+	}
+	if held := client.lanes.drain(); len(held) > 0 {
+		go h.requeueCommands(client.DeviceID, held)
+	}
+}
+
+func (h *Hub) requeueCommands(deviceID string, messageIDs []uint) {
+	if h.OnCommandsDropped == nil {
+		log.Printf("Dropped %d held message commands for device %s", len(messageIDs), deviceID)
+		return
+	}
+	h.OnCommandsDropped(deviceID, messageIDs)
+}
+
+// HeldCommands reports how many message commands of a priority wait in a
+// connected device's lanes
+func (h *Hub) HeldCommands(deviceID, priority string) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	client, ok := h.DeviceMap[deviceID]
+	if !ok || client.lanes == nil {
+		return 0
+	}
+	return client.lanes.count(priority)
+}
+
+// CheckCommand reports whether a command could be routed to the device right now
+func (h *Hub) CheckCommand(deviceID, command string) error {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if _, ok := h.DeviceMap[deviceID]; !ok {
+		return &CommandError{DeviceID: deviceID, Command: command, Err: ErrDeviceNotConnected}
+	}
+	return h.checkCommandLocked(deviceID, command)
+}
+
+func (h *Hub) checkCommandLocked(deviceID, command string) error {
+	required, ok := commandCapabilities[command]
+	if !ok {
+		return nil
+	}
+
+	capabilities := legacyCapabilities
+	if deviceInfo, exists := h.DeviceStatus[deviceID]; exists {
+		capabilities = deviceInfo.Capabilities
+	}
+
+	if !hasCapability(capabilities, required) {
+		return &CommandError{DeviceID: deviceID, Command: command, Err: ErrCommandNotSupported}
+	}
+	return nil
+}
+
+// SetDeviceProtocol records what a device reported in its hello frame and
+// returns the negotiated protocol version and accepted capabilities
+func (h *Hub) SetDeviceProtocol(deviceID, appVersion string, protocolVersion int, capabilities []string) (int, []string) {
+	negotiated := negotiateProtocolVersion(protocolVersion)
+	accepted := filterCapabilities(capabilities)
+
+	h.mutex.Lock()
+	deviceInfo, exists := h.DeviceStatus[deviceID]
+	if !exists {
+		deviceInfo = &DeviceInfo{DeviceID: deviceID}
+		h.DeviceStatus[deviceID] = deviceInfo
+	}
+	deviceInfo.AppVersion = appVersion
+	deviceInfo.ProtocolVersion = negotiated
+	deviceInfo.Capabilities = accepted
+	deviceInfo.LastSeen = time.Now()
+	h.mutex.Unlock()
+
+	if h.db != nil {
+		err := h.db.Model(&models.Device{}).Where("device_id = ?", deviceID).Updates(map[string]interface{}{
+			"app_version":      appVersion,
+			"protocol_version": negotiated,
+			"capabilities":     models.StringList(accepted),
+		}).Error
+		if err != nil {
+			log.Printf("Failed to store protocol info for device %s: %v", deviceID, err)
+		}
+	}
+
+	log.Printf("Device %s speaks protocol v%d (app %s), capabilities: %v", deviceID, negotiated, appVersion, accepted)
+	return negotiated, accepted
+}
+
+// sendToClient queues a message for a specific connection, skipping clients
+// that have already been unregistered
+func (h *Hub) sendToClient(client *Client, message Message) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if _, ok := h.Clients[client]; !ok {
+		return false
+	}
+
+	select {
+	case client.Send <- message:
 		return true
 	default:
-		log.Printf("Failed to send message to device %s: channel full", deviceID)
 		return false
 	}
 }
@@ -196,6 +581,28 @@ func (h *Hub) GetConnectedDevices() []string {
 	return devices
 }
 
+func (h *Hub) IsDeviceConnected(deviceID string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	_, ok := h.DeviceMap[deviceID]
+	return ok
+}
+
+// touchDevice records activity from a connected device
+func (h *Hub) touchDevice(deviceID string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.DeviceMap[deviceID]; !ok {
+		return
+	}
+	if deviceInfo, exists := h.DeviceStatus[deviceID]; exists {
+		deviceInfo.LastSeen = time.Now()
+		deviceInfo.IsOnline = true
+	}
+}
+
 func (h *Hub) GetDeviceStatus(deviceID string) (*DeviceInfo, bool) {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
@@ -204,7 +611,7 @@ func (h *Hub) GetDeviceStatus(deviceID string) (*DeviceInfo, bool) {
 	return deviceInfo, exists
 }
 
-func (h *Hub) UpdateDeviceStatus(deviceID string, update map[string]interface{}) {
+func (h *Hub) UpdateDeviceStatus(deviceID string, update *DeviceStatusFrame) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
@@ -217,17 +624,37 @@ func (h *Hub) UpdateDeviceStatus(deviceID string, update map[string]interface{})
 		h.DeviceStatus[deviceID] = deviceInfo
 	}
 
-	// Update fields from the update map
-	if batteryLevel, ok := update["battery_level"].(float64); ok {
-		deviceInfo.BatteryLevel = int(batteryLevel)
+	// Only fields present in the frame are updated
+	if update.BatteryLevel != nil {
+		deviceInfo.BatteryLevel = *update.BatteryLevel
+	}
+
+	if update.Charging != nil {
+		deviceInfo.Charging = *update.Charging
+	}
+
+	if update.SignalStrength != nil {
+		deviceInfo.SignalStrength = *update.SignalStrength
+	}
+
+	if update.NetworkType != "" {
+		deviceInfo.NetworkType = update.NetworkType
 	}
-	
-	if signalStrength, ok := update["signal_strength"].(float64); ok {
-		deviceInfo.SignalStrength = int(signalStrength)
+
+	if update.Operator != "" {
+		deviceInfo.Operator = update.Operator
 	}
-	
-	if phoneNumber, ok := update["phone_number"].(string); ok {
-		deviceInfo.PhoneNumber = phoneNumber
+
+	if update.SIMState != "" {
+		deviceInfo.SIMState = update.SIMState
+	}
+
+	if update.PhoneNumber != "" {
+		deviceInfo.PhoneNumber = update.PhoneNumber
+	}
+
+	if update.SIMs != nil {
+		deviceInfo.SIMs = update.SIMs
 	}
 
 	deviceInfo.LastSeen = time.Now()
@@ -236,6 +663,95 @@ func (h *Hub) UpdateDeviceStatus(deviceID string, update map[string]interface{})
 	log.Printf("Device status updated: %s", deviceID)
 }
 
+// RecordTelemetry stores a device_status report in the telemetry history
+func (h *Hub) RecordTelemetry(deviceID string, update *DeviceStatusFrame) {
+	if h.db == nil {
+		return
+	}
+
+	var device models.Device
+	if err := h.db.Select("id").Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		log.Printf("Skipping telemetry for unregistered device %s: %v", deviceID, err)
+		return
+	}
+
+	telemetry := models.DeviceTelemetry{
+		DeviceID:       device.ID,
+		BatteryLevel:   update.BatteryLevel,
+		Charging:       update.Charging,
+		SignalStrength: update.SignalStrength,
+		NetworkType:    update.NetworkType,
+		Operator:       update.Operator,
+		SIMState:       update.SIMState,
+		RecordedAt:     time.Now().UTC(),
+	}
+
+	if err := h.db.Create(&telemetry).Error; err != nil {
+		log.Printf("Failed to store telemetry for device %s: %v", deviceID, err)
+	}
+}
+
+// RecordSIMs stores the SIM slots a device reported. Slots missing from the
+// report are kept, so SIM ids stay stable, but marked absent.
+func (h *Hub) RecordSIMs(deviceID string, sims []SIMStatus) {
+	if h.db == nil {
+		return
+	}
+
+	var device models.Device
+	if err := h.db.Select("id").Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		log.Printf("Skipping SIM report for unregistered device %s: %v", deviceID, err)
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		reported := make([]int, 0, len(sims))
+		for _, status := range sims {
+			reported = append(reported, status.Slot)
+
+			var sim models.SIM
+			err := tx.Where("device_id = ? AND slot = ?", device.ID, status.Slot).First(&sim).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+
+			sim.DeviceID = device.ID
+			sim.Slot = status.Slot
+			sim.ICCID = status.ICCID
+			sim.Carrier = status.Carrier
+			sim.PhoneNumber = status.PhoneNumber
+			sim.Status = status.State
+			if err := tx.Save(&sim).Error; err != nil {
+				return err
+			}
+		}
+
+		missing := tx.Model(&models.SIM{}).Where("device_id = ?", device.ID)
+		if len(reported) > 0 {
+			missing = missing.Where("slot NOT IN ?", reported)
+		}
+		return missing.Update("status", models.SIMStatusAbsent).Error
+	})
+	if err != nil {
+		log.Printf("Failed to store SIMs for device %s: %v", deviceID, err)
+	}
+}
+
+// HasCapability reports whether a connected device advertised a capability
+func (h *Hub) HasCapability(deviceID, capability string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if _, ok := h.DeviceMap[deviceID]; !ok {
+		return false
+	}
+	capabilities := legacyCapabilities
+	if deviceInfo, exists := h.DeviceStatus[deviceID]; exists {
+		capabilities = deviceInfo.Capabilities
+	}
+	return hasCapability(capabilities, capability)
+}
+
 func (h *Hub) GetHubStats() map[string]interface{} {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
@@ -247,33 +763,123 @@ func (h *Hub) GetHubStats() map[string]interface{} {
 		}
 	}
 
+	traffic := make(map[string]interface{}, len(h.traffic))
+	for encoding, stats := range h.traffic {
+		framesSent, bytesSent := stats.framesSent.Load(), stats.bytesSent.Load()
+		framesReceived, bytesReceived := stats.framesReceived.Load(), stats.bytesReceived.Load()
+		traffic[encoding] = map[string]interface{}{
+			"frames_sent":                  framesSent,
+			"bytes_sent":                   bytesSent,
+			"avg_bytes_per_frame_sent":     averageBytes(bytesSent, framesSent),
+			"frames_received":              framesReceived,
+			"bytes_received":               bytesReceived,
+			"avg_bytes_per_frame_received": averageBytes(bytesReceived, framesReceived),
+		}
+	}
+
 	return map[string]interface{}{
 		"total_clients":    len(h.Clients),
 		"online_devices":   onlineDevices,
 		"total_devices":    len(h.DeviceStatus),
+		"traffic":          traffic,
 		"uptime":          time.Since(time.Now()).String(), // This would be set when hub starts
 	}
 }
 
+func (h *Hub) recordSent(encoding string, size int) {
+	if stats, ok := h.traffic[encoding]; ok {
+		stats.framesSent.Add(1)
+		stats.bytesSent.Add(int64(size))
+	}
+}
+
+func (h *Hub) recordReceived(encoding string, size int) {
+	if stats, ok := h.traffic[encoding]; ok {
+		stats.framesReceived.Add(1)
+		stats.bytesReceived.Add(int64(size))
+	}
+}
+
+func averageBytes(bytes, frames int64) float64 {
+	if frames == 0 {
+		return 0
+	}
+	return float64(bytes) / float64(frames)
+}
+
 func (h *Hub) startCleanupRoutine() {
+	defer h.wg.Done()
+
 	ticker := time.NewTicker(5 * time.Minute) // Clean up every 5 minutes
 	defer ticker.Stop()
 
-	for range ticker.C {
-		h.cleanupStaleDevices()
+	for {
+		select {
+		case <-ticker.C:
+			h.cleanupStaleDevices()
+			if err := h.ReconcilePresence(); err != nil {
+				log.Printf("Failed to reconcile device presence: %v", err)
+			}
+		case <-h.quit:
+			return
+		}
 	}
 }
 
-func (h *Hub) cleanupStaleDevices() {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
+func (h *Hub) startTelemetryRetention() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(time.Hour) // Prune old telemetry every hour
+	defer ticker.Stop()
 
+	for {
+		select {
+		case <-ticker.C:
+			h.pruneTelemetry()
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+func (h *Hub) pruneTelemetry() {
+	if h.db == nil || h.TelemetryRetention <= 0 {
+		return
+	}
+
+	cutoff := time.Now().UTC().Add(-h.TelemetryRetention)
+	result := h.db.Where("recorded_at < ?", cutoff).Delete(&models.DeviceTelemetry{})
+	if result.Error != nil {
+		log.Printf("Failed to prune device telemetry: %v", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Pruned %d device telemetry rows older than %s", result.RowsAffected, cutoff.Format(time.RFC3339))
+	}
+}
+
+// cleanupStaleDevices unregisters devices that have been silent too long,
+// closing their connections, so commands are no longer routed to them
+func (h *Hub) cleanupStaleDevices() {
 	staleThreshold := time.Now().Add(-10 * time.Minute) // 10 minutes
 
+	var stale []*Client
+	h.mutex.Lock()
 	for deviceID, deviceInfo := range h.DeviceStatus {
 		if deviceInfo.LastSeen.Before(staleThreshold) && deviceInfo.IsOnline {
-			deviceInfo.IsOnline = false
-			log.Printf("Marked device as offline due to inactivity: %s", deviceID)
+			if client, ok := h.DeviceMap[deviceID]; ok {
+				stale = append(stale, client)
+			} else {
+				deviceInfo.IsOnline = false
+			}
+		}
+	}
+	h.mutex.Unlock()
+
+	for _, client := range stale {
+		if h.unregisterClient(client) {
+			h.persistPresence(client.DeviceID, false)
+			log.Printf("Disconnected device due to inactivity: %s", client.DeviceID)
 		}
 	}
 }
@@ -282,21 +888,134 @@ func (h *Hub) cleanupStaleDevices() {
 func (h *Hub) SendHeartbeat() {
 	heartbeatMsg := Message{
 		Type: "heartbeat",
-		Data: map[string]interface{}{
-			"timestamp": time.Now().Unix(),
+		Data: HeartbeatFrame{
+			Timestamp: time.Now().Unix(),
 		},
 	}
 
-	h.Broadcast <- heartbeatMsg
+	select {
+	case h.Broadcast <- heartbeatMsg:
+	case <-h.quit:
+	}
 }
 
-// StartHeartbeat starts a routine to send periodic heartbeats
+// StartHeartbeat starts a routine to send periodic heartbeats until
+// Shutdown
 func (h *Hub) StartHeartbeat() {
 	ticker := time.NewTicker(30 * time.Second) // Send heartbeat every 30 seconds
+	h.wg.Add(1)
 	go func() {
+		defer h.wg.Done()
 		defer ticker.Stop()
-		for range ticker.C {
-			h.SendHeartbeat()
+		for {
+			select {
+			case <-ticker.C:
+				h.SendHeartbeat()
+			case <-h.quit:
+				return
+			}
+		}
+	}()
+}
+
+// IsShuttingDown reports whether Shutdown has been called
+func (h *Hub) IsShuttingDown() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.shuttingDown
+}
+
+// Shutdown tells every connected device that the server is going away,
+// flushes whatever is still queued for them and stops the hub's background
+// routines. If ctx expires first the routines are still told to stop, but
+// Shutdown returns the context's error without waiting for them.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mutex.Lock()
+	if h.shuttingDown {
+		h.mutex.Unlock()
+		return nil
+	}
+	h.shuttingDown = true
+
+	var disconnected []string
+	held := make(map[string][]uint)
+	for client := range h.Clients {
+		reconnectAfter := shutdownReconnectDelay + time.Duration(rand.Int63n(int64(shutdownReconnectJitter)))
+		shutdownMsg := Message{
+			Type:      "server_shutdown",
+			Timestamp: time.Now(),
+			DeviceID:  client.DeviceID,
+			Data: ServerShutdownFrame{
+				Message:        "Server is shutting down",
+				ReconnectAfter: int(reconnectAfter.Seconds()),
+			},
+		}
+
+		select {
+		case client.Send <- shutdownMsg:
+		default:
+			log.Printf("Failed to send shutdown notice to %s: channel full", client.DeviceID)
 		}
+
+		// Closing Send lets the write pump drain what is already queued and
+		// then send a close frame
+		close(client.Send)
+		if client.lanes != nil {
+			if ids := client.lanes.drain(); len(ids) > 0 {
+				held[client.DeviceID] = append(held[client.DeviceID], ids...)
+			}
+		}
+		delete(h.Clients, client)
+		if client.DeviceID != "" && h.DeviceMap[client.DeviceID] == client {
+			delete(h.DeviceMap, client.DeviceID)
+			disconnected = append(disconnected, client.DeviceID)
+			if deviceInfo, exists := h.DeviceStatus[client.DeviceID]; exists {
+				deviceInfo.IsOnline = false
+				deviceInfo.LastSeen = time.Now()
+			}
+		}
+	}
+	h.mutex.Unlock()
+
+	// Requeue commands still waiting in priority lanes before the database goes away
+	for deviceID, ids := range held {
+		h.requeueCommands(deviceID, ids)
+	}
+
+	// Queued behind any earlier presence change, and stored by the presence
+	// writer once quit is closed
+	for _, deviceID := range disconnected {
+		h.persistPresence(deviceID, false)
+	}
+
+	log.Println("Flushing pending device messages...")
+	flushErr := waitContext(ctx, &h.pumps)
+
+	// Background routines stop even if devices didn't drain in time
+	close(h.quit)
+	if flushErr != nil {
+		return flushErr
+	}
+	if err := waitContext(ctx, &h.wg); err != nil {
+		return err
+	}
+
+	log.Println("WebSocket hub stopped")
+	return nil
+}
+
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
 	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
\ No newline at end of file
@@ -0,0 +1,177 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"remote-sim-gateway/internal/models"
+)
+
+const (
+	// Message commands held per device across all lanes; more are refused
+	maxHeldCommands = 1000
+
+	// While bulk commands wait, at least one command in this many is bulk,
+	// so a steady stream of other traffic can't starve a bulk job
+	bulkLaneEvery = 5
+
+	// A command the device hasn't reported on after this long no longer
+	// counts against its send window
+	commandTimeout = time.Minute
+)
+
+// Lanes in the order they are served
+var laneOrder = []string{models.PriorityHigh, models.PriorityNormal, models.PriorityBulk}
+
+// commandLanes holds a device's message commands (send_sms, send_mms) by
+// priority and hands them to the write pump while the device's send window
+// has room
+type commandLanes struct {
+	mu     sync.Mutex
+	queues map[string][]Message
+	held   int
+
+	// Commands written to the device that it hasn't sent an sms_status for
+	inFlight map[uint]time.Time
+	// The window only applies once the device has reported a status, so
+	// apps that never do aren't throttled
+	reportsStatus bool
+
+	// Non-bulk commands released while bulk ones waited
+	sinceBulk int
+}
+
+func newCommandLanes() *commandLanes {
+	return &commandLanes{
+		queues:   make(map[string][]Message),
+		inFlight: make(map[uint]time.Time),
+	}
+}
+
+func lane(priority string) string {
+	switch priority {
+	case models.PriorityHigh, models.PriorityBulk:
+		return priority
+	default:
+		return models.PriorityNormal
+	}
+}
+
+// push holds a message command in the lane for its priority, or reports
+// false if the device already has too many held
+func (l *commandLanes) push(message Message, priority string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held >= maxHeldCommands {
+		return false
+	}
+	name := lane(priority)
+	l.queues[name] = append(l.queues[name], message)
+	l.held++
+	return true
+}
+
+// ack records that the device reported on a message, freeing its slot in
+// the window
+func (l *commandLanes) ack(messageID uint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.reportsStatus = true
+	delete(l.inFlight, messageID)
+}
+
+// release hands held commands to send, best lane first, until the window
+// of in-flight commands is full (window <= 0 means no limit) or send
+// reports the write queue full. It returns the IDs of messages dropped
+// because they expired while held.
+func (l *commandLanes) release(window int, send func(Message) bool) []uint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for id, sentAt := range l.inFlight {
+		if now.Sub(sentAt) >= commandTimeout {
+			delete(l.inFlight, id)
+		}
+	}
+
+	var expired []uint
+	for {
+		if l.reportsStatus && window > 0 && len(l.inFlight) >= window {
+			break
+		}
+		name := l.next()
+		if name == "" {
+			break
+		}
+
+		message := l.queues[name][0]
+		command := message.Data.(messageCommand)
+		if expiresAt := command.messageExpiresAt(); expiresAt != nil && !now.Before(*expiresAt) {
+			l.pop(name)
+			expired = append(expired, command.messageID())
+			continue
+		}
+
+		if !send(message) {
+			break
+		}
+		l.pop(name)
+		l.inFlight[command.messageID()] = now
+
+		if name == models.PriorityBulk {
+			l.sinceBulk = 0
+		} else if len(l.queues[models.PriorityBulk]) > 0 {
+			l.sinceBulk++
+		}
+	}
+	return expired
+}
+
+// next picks the lane to serve: the best non-empty one, unless bulk has
+// waited through bulkLaneEvery-1 other commands
+func (l *commandLanes) next() string {
+	if len(l.queues[models.PriorityBulk]) > 0 && l.sinceBulk >= bulkLaneEvery-1 {
+		return models.PriorityBulk
+	}
+	for _, name := range laneOrder {
+		if len(l.queues[name]) > 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+func (l *commandLanes) pop(name string) {
+	l.queues[name][0] = Message{}
+	l.queues[name] = l.queues[name][1:]
+	l.held--
+}
+
+// count reports how many commands wait in a lane
+func (l *commandLanes) count(priority string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.queues[lane(priority)])
+}
+
+// drain empties the lanes and returns the message IDs that were held
+func (l *commandLanes) drain() []uint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ids []uint
+	for _, name := range laneOrder {
+		for _, message := range l.queues[name] {
+			if command, ok := message.Data.(messageCommand); ok {
+				ids = append(ids, command.messageID())
+			}
+		}
+		delete(l.queues, name)
+	}
+	l.held = 0
+	return ids
+}
@@ -0,0 +1,505 @@
+package websocket
+
+//go:generate go run ../../cmd/schemagen ../../api/device-protocol.schema.json
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Message is the envelope for every frame exchanged with a device. Data holds
+// one of the typed frames below.
+type Message struct {
+	Type      string      `json:"type"`
+	Version   int         `json:"version,omitempty"`
+	Data      interface{} `json:"data"`
+	Timestamp time.Time   `json:"timestamp"`
+	DeviceID  string      `json:"device_id,omitempty"`
+}
+
+const (
+	// Most parts a concatenated SMS can have
+	maxSMSSegments = 255
+
+	// Longest text a received SMS can have: 153 GSM characters per part of
+	// a concatenated message
+	maxSMSLength = maxSMSSegments * 153
+
+	// Longest USSD response text, in characters
+	maxUSSDLength = 182
+
+	// Limits for the other strings devices send
+	maxNameLength  = 64
+	maxErrorLength = 512
+
+	// Most capabilities a hello may list, including ones this server
+	// doesn't know
+	maxCapabilities = 32
+
+	// Largest frame a device may send: a received SMS of maxSMSLength
+	// characters, each up to 6 bytes once JSON-escaped (\uXXXX), plus room
+	// for the envelope and the frame's other fields
+	maxFrameSize = maxSMSLength*6 + 16*1024
+)
+
+// InboundFrame is a frame sent by a device to the server
+type InboundFrame interface {
+	Validate() error
+}
+
+// Device -> server frames
+
+type HelloFrame struct {
+	AppVersion      string   `json:"app_version" jsonschema:"minLength=1,maxLength=64"`
+	ProtocolVersion int      `json:"protocol_version" jsonschema:"minimum=0"`
+	Capabilities    []string `json:"capabilities"`
+}
+
+// SMSStatusFrame reports what the radio did with a message (sent, failed),
+// that the device skipped it past its expires_at (expired) or, from
+// delivery_reports devices, the carrier's delivery report (delivered,
+// undelivered). Multipart messages are reported per segment.
+type SMSStatusFrame struct {
+	MessageID   uint      `json:"message_id" jsonschema:"minimum=1"`
+	Status      string    `json:"status" jsonschema:"enum=sent|failed|expired|delivered|undelivered"`
+	ErrorMsg    string    `json:"error_msg,omitempty" jsonschema:"maxLength=512"`
+	SentAt      time.Time `json:"sent_at,omitempty"`
+	DeliveredAt time.Time `json:"delivered_at,omitempty"`
+
+	// 0-based part the report is for, out of Segments; omitted for
+	// single-part messages
+	Segment  int `json:"segment,omitempty" jsonschema:"minimum=0,maximum=254"`
+	Segments int `json:"segments,omitempty" jsonschema:"minimum=0,maximum=255"`
+}
+
+// SMSReceivedFrame reports a message the device received
+type SMSReceivedFrame struct {
+	From       string    `json:"from" jsonschema:"minLength=1,maxLength=64"`
+	Message    string    `json:"message" jsonschema:"maxLength=39015"`
+	SIMSlot    *int      `json:"sim_slot,omitempty" jsonschema:"minimum=0,maximum=7"`
+	ReceivedAt time.Time `json:"received_at,omitempty"`
+}
+
+type CallStatusFrame struct {
+	CallID    uint      `json:"call_id" jsonschema:"minimum=1"`
+	Status    string    `json:"status" jsonschema:"enum=connected|failed|ended"`
+	Duration  int       `json:"duration,omitempty" jsonschema:"minimum=0"`
+	ErrorMsg  string    `json:"error_msg,omitempty" jsonschema:"maxLength=512"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	EndedAt   time.Time `json:"ended_at,omitempty"`
+}
+
+// USSDResponseFrame answers a ussd_request: a menu waiting for input
+// (continue), the final response (completed), or an error (failed)
+type USSDResponseFrame struct {
+	RequestID uint   `json:"request_id" jsonschema:"minimum=1"`
+	Status    string `json:"status" jsonschema:"enum=continue|completed|failed"`
+	Message   string `json:"message,omitempty" jsonschema:"maxLength=182"`
+	ErrorMsg  string `json:"error_msg,omitempty" jsonschema:"maxLength=512"`
+}
+
+type DeviceStatusFrame struct {
+	BatteryLevel   *int   `json:"battery_level,omitempty" jsonschema:"minimum=0,maximum=100"`
+	Charging       *bool  `json:"charging,omitempty"`
+	SignalStrength *int   `json:"signal_strength,omitempty" jsonschema:"minimum=0,maximum=4"`
+	NetworkType    string `json:"network_type,omitempty" jsonschema:"enum=none|2g|3g|4g|5g|wifi|unknown"`
+	Operator       string `json:"operator,omitempty" jsonschema:"maxLength=64"`
+	SIMState       string `json:"sim_state,omitempty" jsonschema:"enum=ready|absent|locked|not_ready|unknown"`
+	PhoneNumber    string `json:"phone_number,omitempty" jsonschema:"maxLength=64"`
+
+	// Every SIM slot of the device; omitted by single-SIM apps
+	SIMs []SIMStatus `json:"sims,omitempty"`
+}
+
+type SIMStatus struct {
+	Slot        int    `json:"slot" jsonschema:"minimum=0,maximum=7"`
+	ICCID       string `json:"iccid,omitempty" jsonschema:"maxLength=64"`
+	Carrier     string `json:"carrier,omitempty" jsonschema:"maxLength=64"`
+	PhoneNumber string `json:"phone_number,omitempty" jsonschema:"maxLength=64"`
+	State       string `json:"state" jsonschema:"enum=ready|absent|locked|not_ready|unknown"`
+}
+
+type HeartbeatFrame struct {
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// messageCommand is a server frame that sends a message. These wait in the
+// device's priority lanes and are reported on with sms_status.
+type messageCommand interface {
+	messageID() uint
+	messagePriority() string
+	messageExpiresAt() *time.Time
+}
+
+// Server -> device frames
+
+type WelcomeFrame struct {
+	Message         string `json:"message"`
+	DeviceID        string `json:"device_id"`
+	ServerTime      int64  `json:"server_time"`
+	ProtocolVersion int    `json:"protocol_version"`
+	Encoding        string `json:"encoding" jsonschema:"enum=json|cbor"`
+}
+
+type HelloAckFrame struct {
+	ProtocolVersion       int      `json:"protocol_version"`
+	ServerProtocolVersion int      `json:"server_protocol_version"`
+	Capabilities          []string `json:"capabilities"`
+}
+
+type HeartbeatAckFrame struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+type SendSMSFrame struct {
+	ID          uint   `json:"id"`
+	PhoneNumber string `json:"phone_number"`
+	Message     string `json:"message"`
+	DeviceID    string `json:"device_id"`
+	SIMSlot     *int   `json:"sim_slot,omitempty"` // only sent to dual_sim devices
+
+	// Devices must not send the message after this time, and report it
+	// expired instead
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Devices with their own outbox should send high before normal before bulk
+	Priority string `json:"priority,omitempty" jsonschema:"enum=high|normal|bulk"`
+}
+
+// SendMMSFrame is sent to devices with the mms capability. Devices download
+// each attachment from its signed URL, which expires, and report the
+// message with sms_status like send_sms.
+type SendMMSFrame struct {
+	ID          uint            `json:"id"`
+	PhoneNumber string          `json:"phone_number"`
+	Message     string          `json:"message,omitempty"`
+	Subject     string          `json:"subject,omitempty"`
+	Attachments []MMSAttachment `json:"attachments"`
+	DeviceID    string          `json:"device_id"`
+	SIMSlot     *int            `json:"sim_slot,omitempty"` // only sent to dual_sim devices
+
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Priority  string     `json:"priority,omitempty" jsonschema:"enum=high|normal|bulk"`
+}
+
+func (f SendSMSFrame) messageID() uint              { return f.ID }
+func (f SendSMSFrame) messagePriority() string      { return f.Priority }
+func (f SendSMSFrame) messageExpiresAt() *time.Time { return f.ExpiresAt }
+func (f SendMMSFrame) messageID() uint              { return f.ID }
+func (f SendMMSFrame) messagePriority() string      { return f.Priority }
+func (f SendMMSFrame) messageExpiresAt() *time.Time { return f.ExpiresAt }
+
+type MMSAttachment struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	FileName    string `json:"file_name,omitempty"`
+}
+
+type MakeCallFrame struct {
+	ID          uint   `json:"id"`
+	PhoneNumber string `json:"phone_number"`
+	DeviceID    string `json:"device_id"`
+	SIMSlot     *int   `json:"sim_slot,omitempty"` // only sent to dual_sim devices
+	// Text to read out with text-to-speech once the call is answered, then
+	// hang up; used for verification codes
+	Speak string `json:"speak,omitempty"`
+}
+
+// USSDRequestFrame dials a USSD code, or sends the reply to the menu of an
+// open session. End closes the session's dialog instead; devices don't
+// answer that with a ussd_response.
+type USSDRequestFrame struct {
+	ID        uint   `json:"id"`
+	SessionID uint   `json:"session_id"`
+	Input     string `json:"input,omitempty"`
+	DeviceID  string `json:"device_id"`
+	SIMSlot   *int   `json:"sim_slot,omitempty"` // only sent to dual_sim devices
+	End       bool   `json:"end,omitempty"`
+}
+
+// UploadRecordingFrame is sent to devices with the call_recording
+// capability when a call ends. A device that recorded the call POSTs the
+// audio as the "file" form field to URL before ExpiresAt.
+type UploadRecordingFrame struct {
+	CallID    uint      `json:"call_id"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxSize   int       `json:"max_size"` // bytes
+}
+
+type ServerShutdownFrame struct {
+	Message        string `json:"message"`
+	ReconnectAfter int    `json:"reconnect_after"` // seconds
+}
+
+// ErrorFrame is sent back when a device frame can't be decoded or validated
+type ErrorFrame struct {
+	Reason string `json:"reason"`
+	Type   string `json:"type,omitempty"` // type of the offending frame, if known
+}
+
+// inboundFrames lists every frame type a device may send
+var inboundFrames = map[string]func() InboundFrame{
+	"hello":         func() InboundFrame { return &HelloFrame{} },
+	"sms_status":    func() InboundFrame { return &SMSStatusFrame{} },
+	"sms_received":  func() InboundFrame { return &SMSReceivedFrame{} },
+	"call_status":   func() InboundFrame { return &CallStatusFrame{} },
+	"ussd_response": func() InboundFrame { return &USSDResponseFrame{} },
+	"device_status": func() InboundFrame { return &DeviceStatusFrame{} },
+	"heartbeat":     func() InboundFrame { return &HeartbeatFrame{} },
+}
+
+// Frames that newer app versions may extend: unknown fields in them are
+// ignored rather than rejected, so an old server still accepts the device
+var lenientFrames = map[string]bool{
+	"hello": true,
+}
+
+// outboundFrames lists every frame type the server may send
+var outboundFrames = map[string]interface{}{
+	"welcome":          WelcomeFrame{},
+	"hello_ack":        HelloAckFrame{},
+	"heartbeat":        HeartbeatFrame{},
+	"heartbeat_ack":    HeartbeatAckFrame{},
+	"send_sms":         SendSMSFrame{},
+	"send_mms":         SendMMSFrame{},
+	"make_call":        MakeCallFrame{},
+	"ussd_request":     USSDRequestFrame{},
+	"upload_recording": UploadRecordingFrame{},
+	"server_shutdown":  ServerShutdownFrame{},
+	"error":            ErrorFrame{},
+}
+
+// FrameError is returned by DecodeFrame for frames that are malformed or fail
+// validation
+type FrameError struct {
+	Type   string
+	Reason string
+}
+
+func (e *FrameError) Error() string {
+	if e.Type == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s: %s", e.Type, e.Reason)
+}
+
+// inboundEnvelope is a device frame whose data is still encoded
+type inboundEnvelope struct {
+	Type      string
+	Version   int
+	Data      []byte
+	Timestamp time.Time
+	DeviceID  string
+}
+
+// DecodeFrame strictly decodes a JSON device frame: unknown types, unknown
+// fields and invalid values are rejected with a *FrameError. Unknown fields
+// are allowed in hello frames.
+func DecodeFrame(raw []byte) (Message, error) {
+	return decodeFrame(jsonCodec{}, raw)
+}
+
+func decodeFrame(codec frameCodec, raw []byte) (Message, error) {
+	envelope, err := codec.decodeEnvelope(raw, true)
+	if err != nil {
+		lenient, lenientErr := codec.decodeEnvelope(raw, false)
+		if lenientErr != nil || !lenientFrames[lenient.Type] {
+			return Message{}, &FrameError{Reason: "invalid envelope: " + err.Error()}
+		}
+		envelope = lenient
+	}
+
+	if envelope.Type == "" {
+		return Message{}, &FrameError{Reason: "missing frame type"}
+	}
+
+	newFrame, ok := inboundFrames[envelope.Type]
+	if !ok {
+		return Message{}, &FrameError{Type: envelope.Type, Reason: "unknown frame type"}
+	}
+
+	frame := newFrame()
+	if !codec.isEmpty(envelope.Data) {
+		if err := codec.decodeData(envelope.Data, frame, !lenientFrames[envelope.Type]); err != nil {
+			return Message{}, &FrameError{Type: envelope.Type, Reason: "invalid data: " + err.Error()}
+		}
+	}
+	if err := frame.Validate(); err != nil {
+		return Message{}, &FrameError{Type: envelope.Type, Reason: err.Error()}
+	}
+
+	return Message{
+		Type:      envelope.Type,
+		Version:   envelope.Version,
+		Data:      frame,
+		Timestamp: envelope.Timestamp,
+		DeviceID:  envelope.DeviceID,
+	}, nil
+}
+
+func decodeStrict(raw []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+func (f *HelloFrame) Validate() error {
+	if f.AppVersion == "" {
+		return errors.New("app_version is required")
+	}
+	if err := checkLength("app_version", f.AppVersion, maxNameLength); err != nil {
+		return err
+	}
+	if f.ProtocolVersion < 0 {
+		return errors.New("protocol_version must not be negative")
+	}
+	// Unknown capabilities are dropped when the hello is handled
+	if len(f.Capabilities) > maxCapabilities {
+		return fmt.Errorf("at most %d capabilities are allowed", maxCapabilities)
+	}
+	return nil
+}
+
+func (f *SMSStatusFrame) Validate() error {
+	if f.MessageID == 0 {
+		return errors.New("message_id is required")
+	}
+	switch f.Status {
+	case "sent", "failed", "expired", "delivered", "undelivered":
+	default:
+		return fmt.Errorf("invalid status %q", f.Status)
+	}
+	if f.Segments < 0 || f.Segments > maxSMSSegments {
+		return fmt.Errorf("segments %d out of range 0-%d", f.Segments, maxSMSSegments)
+	}
+	if f.Segment < 0 || f.Segment >= max(f.Segments, 1) {
+		return fmt.Errorf("segment %d out of range for %d segments", f.Segment, f.Segments)
+	}
+	return checkLength("error_msg", f.ErrorMsg, maxErrorLength)
+}
+
+func (f *SMSReceivedFrame) Validate() error {
+	if strings.TrimSpace(f.From) == "" {
+		return errors.New("from is required")
+	}
+	if err := checkLength("from", f.From, maxNameLength); err != nil {
+		return err
+	}
+	if err := checkLength("message", f.Message, maxSMSLength); err != nil {
+		return err
+	}
+	if f.SIMSlot != nil && (*f.SIMSlot < 0 || *f.SIMSlot > 7) {
+		return fmt.Errorf("sim slot %d out of range 0-7", *f.SIMSlot)
+	}
+	return nil
+}
+
+func (f *CallStatusFrame) Validate() error {
+	if f.CallID == 0 {
+		return errors.New("call_id is required")
+	}
+	switch f.Status {
+	case "connected", "failed", "ended":
+	default:
+		return fmt.Errorf("invalid status %q", f.Status)
+	}
+	if f.Duration < 0 {
+		return errors.New("duration must not be negative")
+	}
+	return checkLength("error_msg", f.ErrorMsg, maxErrorLength)
+}
+
+func (f *USSDResponseFrame) Validate() error {
+	if f.RequestID == 0 {
+		return errors.New("request_id is required")
+	}
+	switch f.Status {
+	case "continue", "completed", "failed":
+	default:
+		return fmt.Errorf("invalid status %q", f.Status)
+	}
+	if err := checkLength("message", f.Message, maxUSSDLength); err != nil {
+		return err
+	}
+	return checkLength("error_msg", f.ErrorMsg, maxErrorLength)
+}
+
+func (f *DeviceStatusFrame) Validate() error {
+	if f.BatteryLevel != nil && (*f.BatteryLevel < 0 || *f.BatteryLevel > 100) {
+		return fmt.Errorf("battery_level %d out of range 0-100", *f.BatteryLevel)
+	}
+	if f.SignalStrength != nil && (*f.SignalStrength < 0 || *f.SignalStrength > 4) {
+		return fmt.Errorf("signal_strength %d out of range 0-4", *f.SignalStrength)
+	}
+	switch f.NetworkType {
+	case "", "none", "2g", "3g", "4g", "5g", "wifi", "unknown":
+	default:
+		return fmt.Errorf("invalid network_type %q", f.NetworkType)
+	}
+	switch f.SIMState {
+	case "", "ready", "absent", "locked", "not_ready", "unknown":
+	default:
+		return fmt.Errorf("invalid sim_state %q", f.SIMState)
+	}
+	if err := checkLength("operator", f.Operator, maxNameLength); err != nil {
+		return err
+	}
+	if err := checkLength("phone_number", f.PhoneNumber, maxNameLength); err != nil {
+		return err
+	}
+
+	// Slots are 0-7 and unique, so there can't be more than 8
+	if len(f.SIMs) > 8 {
+		return errors.New("at most 8 sims are allowed")
+	}
+	slots := make(map[int]bool, len(f.SIMs))
+	for _, sim := range f.SIMs {
+		if sim.Slot < 0 || sim.Slot > 7 {
+			return fmt.Errorf("sim slot %d out of range 0-7", sim.Slot)
+		}
+		if slots[sim.Slot] {
+			return fmt.Errorf("duplicate sim slot %d", sim.Slot)
+		}
+		slots[sim.Slot] = true
+
+		switch sim.State {
+		case "ready", "absent", "locked", "not_ready", "unknown":
+		default:
+			return fmt.Errorf("invalid state %q for sim slot %d", sim.State, sim.Slot)
+		}
+		for _, field := range []struct{ name, value string }{
+			{"iccid", sim.ICCID},
+			{"carrier", sim.Carrier},
+			{"phone_number", sim.PhoneNumber},
+		} {
+			if err := checkLength(field.name, field.value, maxNameLength); err != nil {
+				return fmt.Errorf("sim slot %d: %w", sim.Slot, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *HeartbeatFrame) Validate() error {
+	return nil
+}
+
+// checkLength rejects a string field longer than limit characters
+func checkLength(field, value string, limit int) error {
+	if utf8.RuneCountInString(value) > limit {
+		return fmt.Errorf("%s must be at most %d characters", field, limit)
+	}
+	return nil
+}
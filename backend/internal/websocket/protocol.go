@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the device protocol version spoken by this server.
+// Devices that never send a hello frame are treated as version 0.
+const ProtocolVersion = 1
+
+// Capabilities a device can advertise in its hello frame
+const (
+	CapabilitySMS             = "sms"
+	CapabilityCalls           = "calls"
+	CapabilityDualSIM         = "dual_sim"
+	CapabilityMMS             = "mms"
+	CapabilityUSSD            = "ussd"
+	CapabilityDeliveryReports = "delivery_reports"
+	CapabilityCallRecording   = "call_recording"
+)
+
+var knownCapabilities = map[string]bool{
+	CapabilitySMS:             true,
+	CapabilityCalls:           true,
+	CapabilityDualSIM:         true,
+	CapabilityMMS:             true,
+	CapabilityUSSD:            true,
+	CapabilityDeliveryReports: true,
+	CapabilityCallRecording:   true,
+}
+
+// legacyCapabilities is what app versions predating the hello frame support
+var legacyCapabilities = []string{CapabilitySMS, CapabilityCalls}
+
+// commandCapabilities maps server-to-device commands to the capability a
+// device must advertise before the command is routed to it
+var commandCapabilities = map[string]string{
+	"send_sms":         CapabilitySMS,
+	"make_call":        CapabilityCalls,
+	"send_mms":         CapabilityMMS,
+	"ussd_request":     CapabilityUSSD,
+	"upload_recording": CapabilityCallRecording,
+}
+
+var (
+	ErrDeviceNotConnected  = errors.New("device is not connected")
+	ErrCommandNotSupported = errors.New("command not supported by device")
+	ErrSendQueueFull       = errors.New("device send queue is full")
+)
+
+// CommandError describes why a command could not be routed to a device
+type CommandError struct {
+	DeviceID string
+	Command  string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	if errors.Is(e.Err, ErrCommandNotSupported) {
+		return fmt.Sprintf("device %s does not support %s (requires %q capability)",
+			e.DeviceID, e.Command, commandCapabilities[e.Command])
+	}
+	return fmt.Sprintf("cannot send %s to device %s: %v", e.Command, e.DeviceID, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func negotiateProtocolVersion(deviceVersion int) int {
+	if deviceVersion < ProtocolVersion {
+		return deviceVersion
+	}
+	return ProtocolVersion
+}
+
+// filterCapabilities drops unknown and duplicate capability names
+func filterCapabilities(capabilities []string) []string {
+	seen := make(map[string]bool)
+	var accepted []string
+	for _, capability := range capabilities {
+		if knownCapabilities[capability] && !seen[capability] {
+			seen[capability] = true
+			accepted = append(accepted, capability)
+		}
+	}
+	return accepted
+}
+
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
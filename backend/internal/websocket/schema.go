@@ -0,0 +1,188 @@
+package websocket
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const schemaID = "https://remote-sim-gateway/schemas/device-protocol.json"
+
+// JSONSchema builds a JSON Schema (draft 2020-12) describing every frame of
+// the device protocol, generated from the typed frame structs in message.go
+func JSONSchema() ([]byte, error) {
+	defs := make(map[string]interface{})
+
+	inbound := make(map[string]interface{}, len(inboundFrames))
+	for frameType, newFrame := range inboundFrames {
+		inbound[frameType] = newFrame()
+	}
+
+	schema := map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"$id":         schemaID,
+		"title":       "Remote SIM Gateway device protocol",
+		"description": "Frames exchanged over the /ws WebSocket, protocol version " + strconv.Itoa(ProtocolVersion),
+		// anyOf rather than oneOf: heartbeat is valid in both directions
+		"anyOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/device_to_server"},
+			map[string]interface{}{"$ref": "#/$defs/server_to_device"},
+		},
+		"$defs": defs,
+	}
+
+	defs["device_to_server"] = envelopeUnion(defs, "in_", inbound)
+	defs["server_to_device"] = envelopeUnion(defs, "out_", outboundFrames)
+
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+func envelopeUnion(defs map[string]interface{}, prefix string, frames map[string]interface{}) map[string]interface{} {
+	frameTypes := make([]string, 0, len(frames))
+	for frameType := range frames {
+		frameTypes = append(frameTypes, frameType)
+	}
+	sort.Strings(frameTypes)
+
+	var variants []interface{}
+	for _, frameType := range frameTypes {
+		name := prefix + frameType
+		data := typeSchema(reflect.TypeOf(frames[frameType]))
+		// Devices may add fields to frames the server decodes leniently
+		strict := prefix != "in_" || !lenientFrames[frameType]
+		data["additionalProperties"] = !strict
+		defs[name] = map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"type":      map[string]interface{}{"const": frameType},
+				"version":   map[string]interface{}{"type": "integer", "minimum": 0},
+				"data":      data,
+				"timestamp": map[string]interface{}{"type": "string", "format": "date-time"},
+				"device_id": map[string]interface{}{"type": "string"},
+			},
+			"required":             []string{"type"},
+			"additionalProperties": !strict,
+		}
+		variants = append(variants, map[string]interface{}{"$ref": "#/$defs/" + name})
+	}
+
+	return map[string]interface{}{"oneOf": variants}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, omitEmpty := jsonFieldName(field)
+		if name == "-" {
+			continue
+		}
+
+		property := typeSchema(field.Type)
+		applySchemaTag(property, field.Tag.Get("jsonschema"))
+		properties[name] = property
+
+		if !omitEmpty && field.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "" {
+		return field.Name, false
+	}
+
+	parts := strings.Split(tag, ",")
+	name := parts[0]
+	if name == "" {
+		name = field.Name
+	}
+
+	omitEmpty := false
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return name, omitEmpty
+}
+
+// applySchemaTag applies `jsonschema:"enum=a|b,minimum=0,maximum=100,minLength=1"`
+// constraints. Enums on slices constrain the items.
+func applySchemaTag(property map[string]interface{}, tag string) {
+	if tag == "" {
+		return
+	}
+
+	target := property
+	if items, ok := property["items"].(map[string]interface{}); ok {
+		target = items
+	}
+
+	for _, constraint := range strings.Split(tag, ",") {
+		key, value, ok := strings.Cut(constraint, "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "enum":
+			target["enum"] = strings.Split(value, "|")
+		case "minimum", "maximum", "minLength", "maxLength":
+			if n, err := strconv.Atoi(value); err == nil {
+				target[key] = n
+			}
+		}
+	}
+}
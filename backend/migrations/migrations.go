@@ -0,0 +1,13 @@
+// Package migrations embeds the versioned SQL schema migrations so they ship
+// inside the server binary.
+//
+// Each supported database driver has its own directory (postgres, sqlite)
+// holding the same set of versions. Files are named <version>_<name>.sql and
+// contain an "-- +migrate Up" section followed by an "-- +migrate Down"
+// section.
+package migrations
+
+import "embed"
+
+//go:embed postgres/*.sql sqlite/*.sql
+var FS embed.FS
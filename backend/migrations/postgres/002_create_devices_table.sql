@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS devices (
+    id            BIGSERIAL PRIMARY KEY,
+    device_id     TEXT NOT NULL UNIQUE,
+    name          TEXT,
+    phone_number  TEXT,
+    is_online     BOOLEAN DEFAULT FALSE,
+    last_seen_at  TIMESTAMPTZ,
+    user_id       BIGINT REFERENCES users (id),
+    created_at    TIMESTAMPTZ,
+    updated_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_devices_user_id ON devices (user_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS devices;
@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS messages (
+    id            BIGSERIAL PRIMARY KEY,
+    phone_number  TEXT NOT NULL,
+    content       TEXT NOT NULL,
+    status        TEXT DEFAULT 'pending',
+    error_msg     TEXT,
+    device_id     BIGINT REFERENCES devices (id),
+    user_id       BIGINT REFERENCES users (id),
+    sent_at       TIMESTAMPTZ,
+    created_at    TIMESTAMPTZ,
+    updated_at    TIMESTAMPTZ
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS messages;
@@ -0,0 +1,19 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS calls (
+    id            BIGSERIAL PRIMARY KEY,
+    phone_number  TEXT NOT NULL,
+    duration      BIGINT,
+    status        TEXT DEFAULT 'pending',
+    error_msg     TEXT,
+    device_id     BIGINT REFERENCES devices (id),
+    user_id       BIGINT REFERENCES users (id),
+    started_at    TIMESTAMPTZ,
+    ended_at      TIMESTAMPTZ,
+    created_at    TIMESTAMPTZ,
+    updated_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_calls_user_id ON calls (user_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS calls;
@@ -0,0 +1,12 @@
+-- +migrate Up
+CREATE INDEX IF NOT EXISTS idx_messages_user_id ON messages (user_id);
+CREATE INDEX IF NOT EXISTS idx_messages_status ON messages (status);
+CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages (created_at);
+-- Covers the history listing: filter by user, newest first
+CREATE INDEX IF NOT EXISTS idx_messages_user_id_created_at ON messages (user_id, created_at DESC);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_messages_user_id_created_at;
+DROP INDEX IF EXISTS idx_messages_created_at;
+DROP INDEX IF EXISTS idx_messages_status;
+DROP INDEX IF EXISTS idx_messages_user_id;
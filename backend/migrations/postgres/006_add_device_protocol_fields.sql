@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE devices ADD COLUMN app_version TEXT;
+ALTER TABLE devices ADD COLUMN protocol_version INTEGER DEFAULT 0;
+ALTER TABLE devices ADD COLUMN capabilities TEXT;
+
+-- +migrate Down
+ALTER TABLE devices DROP COLUMN capabilities;
+ALTER TABLE devices DROP COLUMN protocol_version;
+ALTER TABLE devices DROP COLUMN app_version;
@@ -0,0 +1,19 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS device_telemetry (
+    id               BIGSERIAL PRIMARY KEY,
+    device_id        BIGINT NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    battery_level    INTEGER,
+    charging         BOOLEAN,
+    signal_strength  INTEGER,
+    network_type     TEXT,
+    operator         TEXT,
+    sim_state        TEXT,
+    recorded_at      TIMESTAMPTZ NOT NULL,
+    created_at       TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_telemetry_device_recorded ON device_telemetry (device_id, recorded_at);
+CREATE INDEX IF NOT EXISTS idx_device_telemetry_recorded_at ON device_telemetry (recorded_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS device_telemetry;
@@ -0,0 +1,39 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS alert_rules (
+    id              BIGSERIAL PRIMARY KEY,
+    user_id         BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    device_id       BIGINT REFERENCES devices (id) ON DELETE CASCADE,
+    name            TEXT,
+    metric          TEXT NOT NULL,
+    threshold       DOUBLE PRECISION DEFAULT 0,
+    hysteresis      DOUBLE PRECISION DEFAULT 0,
+    window_minutes  INTEGER DEFAULT 0,
+    channel         TEXT NOT NULL,
+    target          TEXT NOT NULL,
+    enabled         BOOLEAN DEFAULT TRUE,
+    created_at      TIMESTAMPTZ,
+    updated_at      TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_alert_rules_user_id ON alert_rules (user_id);
+
+CREATE TABLE IF NOT EXISTS alerts (
+    id           BIGSERIAL PRIMARY KEY,
+    rule_id      BIGINT NOT NULL REFERENCES alert_rules (id) ON DELETE CASCADE,
+    device_id    BIGINT NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    user_id      BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    state        TEXT DEFAULT 'firing',
+    value        DOUBLE PRECISION,
+    message      TEXT,
+    fired_at     TIMESTAMPTZ,
+    resolved_at  TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ,
+    updated_at   TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_alerts_rule_device_state ON alerts (rule_id, device_id, state);
+CREATE INDEX IF NOT EXISTS idx_alerts_user_id_fired_at ON alerts (user_id, fired_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS alerts;
+DROP TABLE IF EXISTS alert_rules;
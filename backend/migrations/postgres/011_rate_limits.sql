@@ -0,0 +1,15 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN plan TEXT DEFAULT 'free';
+
+-- Token buckets shared by every instance when RATE_LIMIT_STORE=database
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    bucket_key  TEXT PRIMARY KEY,
+    tokens      DOUBLE PRECISION NOT NULL,
+    updated_at  TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_updated_at ON rate_limit_buckets (updated_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS rate_limit_buckets;
+ALTER TABLE users DROP COLUMN plan;
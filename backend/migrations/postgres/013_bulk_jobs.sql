@@ -0,0 +1,24 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS bulk_jobs (
+    id           BIGSERIAL PRIMARY KEY,
+    user_id      BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    device_id    BIGINT REFERENCES devices (id) ON DELETE SET NULL,
+    content      TEXT NOT NULL,
+    status       TEXT NOT NULL DEFAULT 'running',
+    total        INTEGER NOT NULL DEFAULT 0,
+    created_at   TIMESTAMPTZ,
+    updated_at   TIMESTAMPTZ,
+    finished_at  TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_bulk_jobs_user_id ON bulk_jobs (user_id);
+CREATE INDEX IF NOT EXISTS idx_bulk_jobs_status ON bulk_jobs (status);
+
+ALTER TABLE messages ADD COLUMN bulk_job_id BIGINT REFERENCES bulk_jobs (id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_bulk_job_status ON messages (bulk_job_id, status);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_messages_bulk_job_status;
+ALTER TABLE messages DROP COLUMN bulk_job_id;
+DROP TABLE IF EXISTS bulk_jobs;
@@ -0,0 +1,20 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS recipient_uploads (
+    id              BIGSERIAL PRIMARY KEY,
+    user_id         BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    file_name       TEXT,
+    phone_column    TEXT,
+    variables       TEXT,
+    total_rows      INTEGER NOT NULL DEFAULT 0,
+    valid_rows      INTEGER NOT NULL DEFAULT 0,
+    invalid_rows    INTEGER NOT NULL DEFAULT 0,
+    duplicate_rows  INTEGER NOT NULL DEFAULT 0,
+    recipients      TEXT,
+    bulk_job_id     BIGINT REFERENCES bulk_jobs (id) ON DELETE SET NULL,
+    created_at      TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_recipient_uploads_user_id ON recipient_uploads (user_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS recipient_uploads;
@@ -0,0 +1,37 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS contacts (
+    id            BIGSERIAL PRIMARY KEY,
+    user_id       BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name          TEXT,
+    phone_number  TEXT NOT NULL,
+    tags          TEXT,
+    fields        TEXT,
+    created_at    TIMESTAMPTZ,
+    updated_at    TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_contacts_user_phone ON contacts (user_id, phone_number);
+
+CREATE TABLE IF NOT EXISTS contact_groups (
+    id           BIGSERIAL PRIMARY KEY,
+    user_id      BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name         TEXT NOT NULL,
+    description  TEXT,
+    created_at   TIMESTAMPTZ,
+    updated_at   TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_contact_groups_user_name ON contact_groups (user_id, name);
+
+CREATE TABLE IF NOT EXISTS contact_group_members (
+    contact_group_id  BIGINT NOT NULL REFERENCES contact_groups (id) ON DELETE CASCADE,
+    contact_id        BIGINT NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+    PRIMARY KEY (contact_group_id, contact_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_contact_group_members_contact_id ON contact_group_members (contact_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS contact_group_members;
+DROP TABLE IF EXISTS contact_groups;
+DROP TABLE IF EXISTS contacts;
@@ -0,0 +1,29 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS conversations (
+    id               BIGSERIAL PRIMARY KEY,
+    user_id          BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    device_id        BIGINT NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    sim_id           BIGINT REFERENCES sims (id) ON DELETE SET NULL,
+    phone_number     TEXT NOT NULL,
+    unread_count     INTEGER NOT NULL DEFAULT 0,
+    last_message_id  BIGINT,
+    last_message_at  TIMESTAMPTZ,
+    last_read_at     TIMESTAMPTZ,
+    created_at       TIMESTAMPTZ,
+    updated_at       TIMESTAMPTZ
+);
+
+-- One thread per SIM and remote number; devices without SIM reports use sim_id NULL
+CREATE UNIQUE INDEX IF NOT EXISTS idx_conversations_thread ON conversations (device_id, COALESCE(sim_id, 0), phone_number);
+CREATE INDEX IF NOT EXISTS idx_conversations_user_last_message ON conversations (user_id, last_message_at);
+
+ALTER TABLE messages ADD COLUMN direction TEXT NOT NULL DEFAULT 'outbound';
+ALTER TABLE messages ADD COLUMN conversation_id BIGINT REFERENCES conversations (id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages (conversation_id, id);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_messages_conversation_id;
+ALTER TABLE messages DROP COLUMN conversation_id;
+ALTER TABLE messages DROP COLUMN direction;
+DROP TABLE IF EXISTS conversations;
@@ -0,0 +1,34 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS inbound_rules (
+    id               BIGSERIAL PRIMARY KEY,
+    user_id          BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name             TEXT,
+    priority         INTEGER NOT NULL DEFAULT 0,
+    keywords         TEXT,
+    pattern          TEXT,
+    sender           TEXT,
+    sim_id           BIGINT REFERENCES sims (id) ON DELETE CASCADE,
+    action           TEXT NOT NULL,
+    target           TEXT,
+    template         TEXT,
+    stop_processing  BOOLEAN DEFAULT FALSE,
+    enabled          BOOLEAN DEFAULT TRUE,
+    created_at       TIMESTAMPTZ,
+    updated_at       TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_inbound_rules_user_priority ON inbound_rules (user_id, priority);
+
+CREATE TABLE IF NOT EXISTS opt_outs (
+    id            BIGSERIAL PRIMARY KEY,
+    user_id       BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    phone_number  TEXT NOT NULL,
+    rule_id       BIGINT REFERENCES inbound_rules (id) ON DELETE SET NULL,
+    created_at    TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_opt_outs_user_phone ON opt_outs (user_id, phone_number);
+
+-- +migrate Down
+DROP TABLE IF EXISTS opt_outs;
+DROP TABLE IF EXISTS inbound_rules;
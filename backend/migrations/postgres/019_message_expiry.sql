@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE messages ADD COLUMN expires_at TIMESTAMPTZ;
+
+-- The dispatcher looks for queued messages past their expiry
+CREATE INDEX IF NOT EXISTS idx_messages_status_expires_at ON messages (status, expires_at);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_messages_status_expires_at;
+ALTER TABLE messages DROP COLUMN expires_at;
@@ -0,0 +1,24 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS verifications (
+    id            BIGSERIAL PRIMARY KEY,
+    user_id       BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    phone_number  TEXT NOT NULL,
+    channel       TEXT NOT NULL DEFAULT 'sms',
+    code_hash     TEXT NOT NULL,
+    status        TEXT NOT NULL DEFAULT 'pending',
+    attempts      INTEGER NOT NULL DEFAULT 0,
+    max_attempts  INTEGER NOT NULL,
+    expires_at    TIMESTAMPTZ NOT NULL,
+    verified_at   TIMESTAMPTZ,
+    message_id    BIGINT REFERENCES messages (id) ON DELETE SET NULL,
+    call_id       BIGINT REFERENCES calls (id) ON DELETE SET NULL,
+    created_at    TIMESTAMPTZ,
+    updated_at    TIMESTAMPTZ
+);
+
+-- Resend cooldowns and throttles count a user's recent verifications per number
+CREATE INDEX IF NOT EXISTS idx_verifications_user_phone ON verifications (user_id, phone_number, created_at);
+CREATE INDEX IF NOT EXISTS idx_verifications_user_created_at ON verifications (user_id, created_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS verifications;
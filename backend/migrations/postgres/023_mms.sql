@@ -0,0 +1,29 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS media_files (
+    id            BIGSERIAL PRIMARY KEY,
+    user_id       BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    file_name     TEXT,
+    content_type  TEXT NOT NULL,
+    size          BIGINT NOT NULL,
+    path          TEXT NOT NULL,
+    created_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_media_files_user_id ON media_files (user_id);
+
+ALTER TABLE messages ADD COLUMN type TEXT NOT NULL DEFAULT 'sms';
+ALTER TABLE messages ADD COLUMN subject TEXT;
+
+CREATE TABLE IF NOT EXISTS message_attachments (
+    message_id  BIGINT NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    media_id    BIGINT NOT NULL REFERENCES media_files (id) ON DELETE CASCADE,
+    PRIMARY KEY (message_id, media_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_attachments_media_id ON message_attachments (media_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS message_attachments;
+ALTER TABLE messages DROP COLUMN subject;
+ALTER TABLE messages DROP COLUMN type;
+DROP TABLE IF EXISTS media_files;
@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS call_recordings (
+    id            BIGSERIAL PRIMARY KEY,
+    call_id       BIGINT NOT NULL UNIQUE REFERENCES calls (id) ON DELETE CASCADE,
+    user_id       BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    content_type  TEXT NOT NULL,
+    size          BIGINT NOT NULL,
+    path          TEXT NOT NULL,
+    created_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_call_recordings_created_at ON call_recordings (created_at);
+CREATE INDEX IF NOT EXISTS idx_calls_created_at ON calls (created_at);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_calls_created_at;
+DROP TABLE IF EXISTS call_recordings;
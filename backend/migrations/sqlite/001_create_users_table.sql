@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS users (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    email       TEXT NOT NULL UNIQUE,
+    password    TEXT NOT NULL,
+    role        TEXT DEFAULT 'user',
+    is_active   BOOLEAN DEFAULT TRUE,
+    created_at  DATETIME,
+    updated_at  DATETIME
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS users;
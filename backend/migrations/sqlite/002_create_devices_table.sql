@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS devices (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    device_id     TEXT NOT NULL UNIQUE,
+    name          TEXT,
+    phone_number  TEXT,
+    is_online     BOOLEAN DEFAULT FALSE,
+    last_seen_at  DATETIME,
+    user_id       INTEGER REFERENCES users (id),
+    created_at    DATETIME,
+    updated_at    DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_devices_user_id ON devices (user_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS devices;
@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS messages (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    phone_number  TEXT NOT NULL,
+    content       TEXT NOT NULL,
+    status        TEXT DEFAULT 'pending',
+    error_msg     TEXT,
+    device_id     INTEGER REFERENCES devices (id),
+    user_id       INTEGER REFERENCES users (id),
+    sent_at       DATETIME,
+    created_at    DATETIME,
+    updated_at    DATETIME
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS messages;
@@ -0,0 +1,19 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS calls (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    phone_number  TEXT NOT NULL,
+    duration      INTEGER,
+    status        TEXT DEFAULT 'pending',
+    error_msg     TEXT,
+    device_id     INTEGER REFERENCES devices (id),
+    user_id       INTEGER REFERENCES users (id),
+    started_at    DATETIME,
+    ended_at      DATETIME,
+    created_at    DATETIME,
+    updated_at    DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_calls_user_id ON calls (user_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS calls;
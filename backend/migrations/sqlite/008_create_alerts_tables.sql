@@ -0,0 +1,39 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS alert_rules (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id         INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    device_id       INTEGER REFERENCES devices (id) ON DELETE CASCADE,
+    name            TEXT,
+    metric          TEXT NOT NULL,
+    threshold       REAL DEFAULT 0,
+    hysteresis      REAL DEFAULT 0,
+    window_minutes  INTEGER DEFAULT 0,
+    channel         TEXT NOT NULL,
+    target          TEXT NOT NULL,
+    enabled         BOOLEAN DEFAULT TRUE,
+    created_at      DATETIME,
+    updated_at      DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_alert_rules_user_id ON alert_rules (user_id);
+
+CREATE TABLE IF NOT EXISTS alerts (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    rule_id      INTEGER NOT NULL REFERENCES alert_rules (id) ON DELETE CASCADE,
+    device_id    INTEGER NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    user_id      INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    state        TEXT DEFAULT 'firing',
+    value        REAL,
+    message      TEXT,
+    fired_at     DATETIME,
+    resolved_at  DATETIME,
+    created_at   DATETIME,
+    updated_at   DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_alerts_rule_device_state ON alerts (rule_id, device_id, state);
+CREATE INDEX IF NOT EXISTS idx_alerts_user_id_fired_at ON alerts (user_id, fired_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS alerts;
+DROP TABLE IF EXISTS alert_rules;
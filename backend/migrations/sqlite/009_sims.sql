@@ -0,0 +1,28 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS sims (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    device_id     INTEGER NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    slot          INTEGER NOT NULL,
+    iccid         TEXT,
+    carrier       TEXT,
+    phone_number  TEXT,
+    status        TEXT NOT NULL DEFAULT 'unknown',
+    created_at    DATETIME,
+    updated_at    DATETIME
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sims_device_slot ON sims (device_id, slot);
+
+-- No REFERENCES here: SQLite can't drop a column that is part of a foreign key
+ALTER TABLE messages ADD COLUMN sim_id INTEGER;
+ALTER TABLE calls ADD COLUMN sim_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_messages_sim_id ON messages (sim_id);
+CREATE INDEX IF NOT EXISTS idx_calls_sim_id ON calls (sim_id);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_calls_sim_id;
+DROP INDEX IF EXISTS idx_messages_sim_id;
+ALTER TABLE calls DROP COLUMN sim_id;
+ALTER TABLE messages DROP COLUMN sim_id;
+DROP TABLE IF EXISTS sims;
@@ -0,0 +1,31 @@
+-- +migrate Up
+ALTER TABLE devices ADD COLUMN daily_limit INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE devices ADD COLUMN monthly_limit INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE devices ADD COLUMN per_minute_limit INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE sims ADD COLUMN daily_limit INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE sims ADD COLUMN monthly_limit INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE sims ADD COLUMN per_minute_limit INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE messages ADD COLUMN dispatched_at DATETIME;
+ALTER TABLE messages ADD COLUMN held_until DATETIME;
+ALTER TABLE messages ADD COLUMN pinned_to TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_messages_device_dispatched ON messages (device_id, dispatched_at);
+CREATE INDEX IF NOT EXISTS idx_messages_sim_dispatched ON messages (sim_id, dispatched_at);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_messages_sim_dispatched;
+DROP INDEX IF EXISTS idx_messages_device_dispatched;
+
+ALTER TABLE messages DROP COLUMN pinned_to;
+ALTER TABLE messages DROP COLUMN held_until;
+ALTER TABLE messages DROP COLUMN dispatched_at;
+
+ALTER TABLE sims DROP COLUMN per_minute_limit;
+ALTER TABLE sims DROP COLUMN monthly_limit;
+ALTER TABLE sims DROP COLUMN daily_limit;
+
+ALTER TABLE devices DROP COLUMN per_minute_limit;
+ALTER TABLE devices DROP COLUMN monthly_limit;
+ALTER TABLE devices DROP COLUMN daily_limit;
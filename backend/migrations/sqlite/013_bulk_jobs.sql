@@ -0,0 +1,25 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS bulk_jobs (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id      INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    device_id    INTEGER REFERENCES devices (id) ON DELETE SET NULL,
+    content      TEXT NOT NULL,
+    status       TEXT NOT NULL DEFAULT 'running',
+    total        INTEGER NOT NULL DEFAULT 0,
+    created_at   DATETIME,
+    updated_at   DATETIME,
+    finished_at  DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_bulk_jobs_user_id ON bulk_jobs (user_id);
+CREATE INDEX IF NOT EXISTS idx_bulk_jobs_status ON bulk_jobs (status);
+
+-- No REFERENCES here: SQLite can't drop a column that is part of a foreign key
+ALTER TABLE messages ADD COLUMN bulk_job_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_messages_bulk_job_status ON messages (bulk_job_id, status);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_messages_bulk_job_status;
+ALTER TABLE messages DROP COLUMN bulk_job_id;
+DROP TABLE IF EXISTS bulk_jobs;
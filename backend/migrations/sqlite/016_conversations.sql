@@ -0,0 +1,30 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS conversations (
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id          INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    device_id        INTEGER NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    sim_id           INTEGER REFERENCES sims (id) ON DELETE SET NULL,
+    phone_number     TEXT NOT NULL,
+    unread_count     INTEGER NOT NULL DEFAULT 0,
+    last_message_id  INTEGER,
+    last_message_at  DATETIME,
+    last_read_at     DATETIME,
+    created_at       DATETIME,
+    updated_at       DATETIME
+);
+
+-- One thread per SIM and remote number; devices without SIM reports use sim_id NULL
+CREATE UNIQUE INDEX IF NOT EXISTS idx_conversations_thread ON conversations (device_id, COALESCE(sim_id, 0), phone_number);
+CREATE INDEX IF NOT EXISTS idx_conversations_user_last_message ON conversations (user_id, last_message_at);
+
+ALTER TABLE messages ADD COLUMN direction TEXT NOT NULL DEFAULT 'outbound';
+-- No REFERENCES here: SQLite can't drop a column that is part of a foreign key
+ALTER TABLE messages ADD COLUMN conversation_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages (conversation_id, id);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_messages_conversation_id;
+ALTER TABLE messages DROP COLUMN conversation_id;
+ALTER TABLE messages DROP COLUMN direction;
+DROP TABLE IF EXISTS conversations;
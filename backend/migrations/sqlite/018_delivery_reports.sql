@@ -0,0 +1,23 @@
+-- +migrate Up
+ALTER TABLE messages ADD COLUMN segments INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE messages ADD COLUMN delivered_at DATETIME;
+
+-- What the radio and the carrier reported for each part of a message
+CREATE TABLE IF NOT EXISTS message_segments (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id    INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    segment       INTEGER NOT NULL,
+    status        TEXT NOT NULL DEFAULT 'pending',
+    error_msg     TEXT,
+    sent_at       DATETIME,
+    delivered_at  DATETIME,
+    created_at    DATETIME,
+    updated_at    DATETIME
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_message_segments_message_segment ON message_segments (message_id, segment);
+
+-- +migrate Down
+DROP TABLE IF EXISTS message_segments;
+ALTER TABLE messages DROP COLUMN delivered_at;
+ALTER TABLE messages DROP COLUMN segments;
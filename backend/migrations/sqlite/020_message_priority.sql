@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE messages ADD COLUMN priority TEXT NOT NULL DEFAULT 'normal';
+
+UPDATE messages SET priority = 'bulk' WHERE bulk_job_id IS NOT NULL;
+
+-- +migrate Down
+ALTER TABLE messages DROP COLUMN priority;
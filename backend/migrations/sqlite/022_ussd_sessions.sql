@@ -0,0 +1,33 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS ussd_sessions (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id     INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    device_id   INTEGER NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    sim_id      INTEGER REFERENCES sims (id) ON DELETE SET NULL,
+    code        TEXT NOT NULL,
+    status      TEXT NOT NULL DEFAULT 'active',
+    created_at  DATETIME,
+    updated_at  DATETIME,
+    ended_at    DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_ussd_sessions_device_created_at ON ussd_sessions (device_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_ussd_sessions_device_status ON ussd_sessions (device_id, status);
+
+-- One row per request sent in a session and the network's answer to it
+CREATE TABLE IF NOT EXISTS ussd_steps (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_id    INTEGER NOT NULL REFERENCES ussd_sessions (id) ON DELETE CASCADE,
+    input         TEXT NOT NULL,
+    response      TEXT,
+    status        TEXT NOT NULL DEFAULT 'pending',
+    error_msg     TEXT,
+    created_at    DATETIME,
+    responded_at  DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_ussd_steps_session_id ON ussd_steps (session_id, id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS ussd_steps;
+DROP TABLE IF EXISTS ussd_sessions;
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/database"
+)
+
+// openTestDB opens an empty SQLite database in a temporary directory
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := database.NewConnection(config.DatabaseConfig{
+		Driver: database.DriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "test.db"),
+	})
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	db.Logger = logger.Default.LogMode(logger.Silent)
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// newTestDB opens a SQLite database with every migration applied
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db := openTestDB(t)
+	if err := database.RunMigrations(db); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	return db
+}
+
+// schema lists the tables, indexes and columns of a SQLite database, without
+// the migrations bookkeeping table
+func schema(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+
+	var objects, tables []string
+	err := db.Raw(`SELECT type || ' ' || name FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%' AND name != 'schema_migrations'`).Scan(&objects).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Raw(`SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != 'schema_migrations'`).Scan(&tables).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		var columns []string
+		if err := db.Raw(`SELECT name FROM pragma_table_info(?)`, table).Scan(&columns).Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, column := range columns {
+			objects = append(objects, "column "+table+"."+column)
+		}
+	}
+
+	sort.Strings(objects)
+	return objects
+}
+
+func TestMigrationsRollBackAndReapply(t *testing.T) {
+	db := openTestDB(t)
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	latest, err := migrator.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == 0 {
+		t.Fatal("no migrations were applied")
+	}
+	migrated := schema(t, db)
+
+	if err := migrator.To(0); err != nil {
+		t.Fatalf("To(0): %v", err)
+	}
+	if left := schema(t, db); len(left) > 0 {
+		t.Fatalf("rolling back every migration left %v", left)
+	}
+
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("Up after rolling back: %v", err)
+	}
+	if version, _ := migrator.Version(); version != latest {
+		t.Fatalf("version = %d, want %d", version, latest)
+	}
+	if got := schema(t, db); !reflect.DeepEqual(got, migrated) {
+		t.Fatalf("schema differs after down and up again:\n%v\nwant\n%v", got, migrated)
+	}
+}
+
+func TestMigrationsRevertOneAtATime(t *testing.T) {
+	db := openTestDB(t)
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(statuses) - 1; i >= 0; i-- {
+		if !statuses[i].Applied {
+			t.Fatalf("migration %03d_%s was not applied", statuses[i].Version, statuses[i].Name)
+		}
+		if err := migrator.Down(); err != nil {
+			t.Fatalf("reverting %03d_%s: %v", statuses[i].Version, statuses[i].Name, err)
+		}
+
+		want := 0
+		if i > 0 {
+			want = statuses[i-1].Version
+		}
+		if version, _ := migrator.Version(); version != want {
+			t.Fatalf("version after reverting %03d_%s = %d, want %d", statuses[i].Version, statuses[i].Name, version, want)
+		}
+	}
+}
@@ -0,0 +1,659 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/handlers"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+	"remote-sim-gateway/internal/websocket"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// asUser stands in for AuthRequired, authenticating every request as user
+func asUser(user *models.User) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("user_id", user.ID)
+		c.Set("role", user.Role)
+		c.Next()
+	}
+}
+
+// doJSON sends body as JSON to the router and decodes the JSON response
+// into out, if given
+func doJSON(t *testing.T, router http.Handler, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &reader)
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	if out != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, path, recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestInboundRuleWebhookTargets(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "rules@example.com")
+
+	router := gin.New()
+	router.Use(asUser(user))
+	rules := handlers.NewInboundRuleHandler(db, services.NewContactBook(db, config.RecipientsConfig{}))
+	router.POST("/inbound-rules", rules.CreateRule)
+
+	targets := map[string]int{
+		"https://hooks.example.com/sms":            http.StatusCreated,
+		"http://127.0.0.1:9000/sms":                http.StatusBadRequest,
+		"http://localhost/sms":                     http.StatusBadRequest,
+		"http://192.168.0.10/sms":                  http.StatusBadRequest,
+		"http://169.254.169.254/latest/meta-data/": http.StatusBadRequest,
+		"file:///etc/passwd":                       http.StatusBadRequest,
+	}
+	for target, want := range targets {
+		var resp map[string]interface{}
+		code := doJSON(t, router, http.MethodPost, "/inbound-rules", map[string]interface{}{
+			"name":     "forward",
+			"keywords": []string{"STOP"},
+			"action":   "webhook",
+			"target":   target,
+		}, &resp)
+		if code != want {
+			t.Errorf("%s: status %d, want %d (%v)", target, code, want, resp)
+		}
+	}
+}
+
+func TestMakeCallSelectsSIM(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "calls@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	sims := []models.SIM{
+		{DeviceID: device.ID, Slot: 0, Carrier: "Alpha", Status: models.SIMStatusReady},
+		{DeviceID: device.ID, Slot: 1, Carrier: "Beta", Status: models.SIMStatusReady},
+	}
+	if err := db.Create(&sims).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	hub, url := startHub(t, db)
+	conn := connectDevice(t, url, device.DeviceID, websocket.CapabilityCalls, websocket.CapabilityDualSIM)
+	eventually(t, "the device to be stored online", func() bool {
+		var stored models.Device
+		db.First(&stored, device.ID)
+		return stored.IsOnline
+	})
+
+	frames := make(chan websocket.MakeCallFrame, 1)
+	go func() {
+		for {
+			var frame struct {
+				Type string                  `json:"type"`
+				Data websocket.MakeCallFrame `json:"data"`
+			}
+			if err := conn.ReadJSON(&frame); err != nil {
+				return
+			}
+			if frame.Type == "make_call" {
+				frames <- frame.Data
+			}
+		}
+	}()
+
+	router := gin.New()
+	router.Use(asUser(user))
+	simRouter := services.NewSIMRouter(config.RoutingConfig{CarrierPrefixes: map[string][]string{"Beta": {"+4477"}}})
+	router.POST("/make-call", handlers.NewCallHandler(db, hub, simRouter).MakeCall)
+
+	slot0 := 0
+	tests := []struct {
+		name     string
+		request  models.MakeCallRequest
+		wantSlot int
+	}{
+		{"requested slot", models.MakeCallRequest{PhoneNumber: "+447700900123", SIMSlot: &slot0}, 0},
+		{"requested SIM", models.MakeCallRequest{PhoneNumber: "+15550100", SIMID: &sims[1].ID}, 1},
+		{"routed by carrier", models.MakeCallRequest{PhoneNumber: "+447700900123", DeviceID: device.ID}, 1},
+		{"default SIM", models.MakeCallRequest{PhoneNumber: "+15550100"}, 0},
+	}
+	for _, tt := range tests {
+		var resp models.CallResponse
+		if code := doJSON(t, router, http.MethodPost, "/make-call", tt.request, &resp); code != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.name, code)
+		}
+
+		select {
+		case frame := <-frames:
+			if frame.ID != resp.ID || frame.SIMSlot == nil || *frame.SIMSlot != tt.wantSlot {
+				t.Errorf("%s: frame %+v, want call %d from slot %d", tt.name, frame, resp.ID, tt.wantSlot)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: device got no make_call", tt.name)
+		}
+
+		var call models.Call
+		db.First(&call, resp.ID)
+		if call.SIMID == nil || *call.SIMID != sims[tt.wantSlot].ID {
+			t.Errorf("%s: call stored with SIM %v, want %d", tt.name, call.SIMID, sims[tt.wantSlot].ID)
+		}
+	}
+}
+
+func TestUpdateDeviceKeepsPresenceAndSIMStatus(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "edit@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	sim := models.SIM{DeviceID: device.ID, Slot: 0, Status: models.SIMStatusReady}
+	if err := db.Create(&sim).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.Use(asUser(user))
+	devices := handlers.NewDeviceHandler(db, websocket.NewHub(db), services.NewQuotaTracker(db, config.QuotasConfig{}))
+	router.PUT("/devices/:id", devices.UpdateDevice)
+	router.PUT("/devices/:id/sims/:sim_id", devices.UpdateSIM)
+	router.GET("/devices", devices.GetDevices)
+
+	// The hub marks the device online and the SIM absent while the edits
+	// are on their way
+	db.Model(device).Update("is_online", true)
+	db.Model(&sim).Update("status", models.SIMStatusAbsent)
+
+	path := "/devices/" + strconv.Itoa(int(device.ID))
+	if code := doJSON(t, router, http.MethodPut, path, map[string]interface{}{"name": "Office phone", "daily_limit": 100}, nil); code != http.StatusOK {
+		t.Fatalf("updating device: status %d", code)
+	}
+	if code := doJSON(t, router, http.MethodPut, path+"/sims/"+strconv.Itoa(int(sim.ID)), map[string]interface{}{"monthly_limit": 3000}, nil); code != http.StatusOK {
+		t.Fatalf("updating SIM: status %d", code)
+	}
+
+	var resp struct {
+		Devices []models.Device `json:"devices"`
+	}
+	if code := doJSON(t, router, http.MethodGet, "/devices", nil, &resp); code != http.StatusOK || len(resp.Devices) != 1 {
+		t.Fatalf("listing devices: status %d, %d devices", code, len(resp.Devices))
+	}
+	got := resp.Devices[0]
+	if got.Name != "Office phone" || got.DailyLimit != 100 || !got.IsOnline {
+		t.Errorf("device = name %q, daily limit %d, online %v", got.Name, got.DailyLimit, got.IsOnline)
+	}
+	if len(got.SIMs) != 1 || got.SIMs[0].MonthlyLimit != 3000 || got.SIMs[0].Status != models.SIMStatusAbsent {
+		t.Errorf("SIMs = %+v", got.SIMs)
+	}
+	if got.Usage == nil || len(got.SIMs) == 0 || got.SIMs[0].Usage == nil {
+		t.Errorf("devices listed without quota usage")
+	}
+}
+
+func TestContactsImportAndExport(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "contacts@example.com")
+	group := models.ContactGroup{UserID: user.ID, Name: "Customers"}
+	if err := db.Create(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.Use(asUser(user))
+	contacts := handlers.NewContactHandler(db, services.NewContactBook(db, config.RecipientsConfig{DefaultCountryCode: "+44"}))
+	router.POST("/contacts/import", contacts.ImportContacts)
+	router.GET("/contacts/export", contacts.ExportContacts)
+
+	importFile := func(name, content string, fields map[string]string) (int, map[string]interface{}) {
+		t.Helper()
+
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		for key, value := range fields {
+			form.WriteField(key, value)
+		}
+		file, _ := form.CreateFormFile("file", name)
+		file.Write([]byte(content))
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/contacts/import", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+
+		var resp map[string]interface{}
+		json.Unmarshal(recorder.Body.Bytes(), &resp)
+		return recorder.Code, resp
+	}
+
+	code, report := importFile("contacts.csv", "Name,Mobile,Tags,First Order\n"+
+		"Ann,07700 900123,\"VIP, north\",2024-01-02\n"+
+		"Bob,07700 900124,,\n"+
+		"Cat,07700 900125,bad tag!,\n"+
+		"Ann again,+447700900123,,\n"+
+		"Dan,nope,,\n",
+		map[string]string{"group_id": strconv.Itoa(int(group.ID))})
+	if code != http.StatusOK {
+		t.Fatalf("import: status %d (%v)", code, report)
+	}
+	if report["created"] != 2.0 || report["invalid_rows"] != 2.0 || report["duplicate_rows"] != 1.0 {
+		t.Fatalf("import report %v, want 2 created, 2 invalid and 1 duplicate", report)
+	}
+
+	var ann models.Contact
+	db.Preload("Groups").Where("phone_number = ?", "+447700900123").First(&ann)
+	if ann.Name != "Ann" || strings.Join(ann.Tags, ",") != "vip,north" || ann.Fields["first_order"] != "2024-01-02" {
+		t.Errorf("imported contact %+v", ann)
+	}
+	if len(ann.Groups) != 1 || ann.Groups[0].ID != group.ID {
+		t.Errorf("imported contact is in groups %+v, want Customers", ann.Groups)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/contacts/export", nil))
+	exported := recorder.Body.String()
+	want := "name,phone_number,tags,groups,first_order\n" +
+		"Ann,+447700900123,\"vip,north\",Customers,2024-01-02\n" +
+		"Bob,+447700900124,,Customers,\n"
+	if exported != want {
+		t.Fatalf("export:\n%s\nwant:\n%s", exported, want)
+	}
+
+	// The export imports again as updates of the same contacts
+	db.Model(&ann).Update("name", "Ann Smith")
+	code, report = importFile("contacts.csv", exported, nil)
+	if code != http.StatusOK || report["created"] != 0.0 || report["updated"] != 2.0 {
+		t.Fatalf("re-import: status %d, report %v", code, report)
+	}
+	db.First(&ann, ann.ID)
+	if ann.Name != "Ann" || len(ann.Tags) != 2 {
+		t.Errorf("re-imported contact %+v", ann)
+	}
+
+	if code, _ := importFile("contacts.txt", "Name\nAnn\n", nil); code != http.StatusBadRequest {
+		t.Errorf("file without a phone column: status %d, want 400", code)
+	}
+	if code, _ := importFile("contacts.csv", "phone\n1", map[string]string{"group_id": "999"}); code != http.StatusNotFound {
+		t.Errorf("unknown group: status %d, want 404", code)
+	}
+}
+
+func TestVerifyStartQueuedCodeGets202(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "otp@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	// Room for one more SMS today
+	db.Model(device).Update("daily_limit", 1)
+
+	hub, url := startHub(t, db)
+	connectDevice(t, url, device.DeviceID, websocket.CapabilitySMS)
+	eventually(t, "the device to be stored online", func() bool {
+		var stored models.Device
+		db.First(&stored, device.ID)
+		return stored.IsOnline
+	})
+
+	simRouter := services.NewSIMRouter(config.RoutingConfig{})
+	dispatcher := services.NewDispatcher(db, hub, simRouter, services.NewQuotaTracker(db, config.QuotasConfig{}), nil, config.QuotasConfig{})
+	verify, err := services.NewVerifyService(db, hub, simRouter, dispatcher, testVerifyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.Use(asUser(user))
+	verifyHandler := handlers.NewVerifyHandler(db, hub, simRouter, services.NewContactBook(db, config.RecipientsConfig{}), verify)
+	router.POST("/verify/start", verifyHandler.Start)
+
+	var sent models.Verification
+	if code := doJSON(t, router, http.MethodPost, "/verify/start", map[string]string{"phone_number": "+15550100"}, &sent); code != http.StatusCreated {
+		t.Fatalf("first code: status %d", code)
+	}
+	if sent.MessageStatus != "pending" || sent.MessageID == nil {
+		t.Errorf("first code: message %v is %q, want pending", sent.MessageID, sent.MessageStatus)
+	}
+
+	// The device is now at its daily limit, so the next code waits
+	var queued models.Verification
+	if code := doJSON(t, router, http.MethodPost, "/verify/start", map[string]string{"phone_number": "+15550101"}, &queued); code != http.StatusAccepted {
+		t.Fatalf("second code: status %d, want 202", code)
+	}
+	if queued.MessageStatus != "queued" || queued.ID == 0 {
+		t.Errorf("second code: %+v, want a stored verification with a queued message", queued)
+	}
+}
+
+func TestMediaDownloadChecksSignature(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "mms@example.com")
+	mediaConfig := config.MediaConfig{
+		Dir:          t.TempDir(),
+		MaxSize:      1024,
+		AllowedTypes: []string{"image/png"},
+		PublicURL:    "https://gateway.example.com/",
+		URLTTL:       60,
+		SigningKey:   "media-key",
+	}
+	store := services.NewMediaStore(db, mediaConfig)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 32)...)
+	media, err := store.Save(user.ID, "../../photo.png", png)
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if media.FileName != "photo.png" || media.ContentType != "image/png" {
+		t.Errorf("saved %q as %s", media.FileName, media.ContentType)
+	}
+
+	router := gin.New()
+	router.GET("/media/:id", handlers.NewMediaHandler(store).Download)
+	get := func(signedURL string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, strings.TrimPrefix(signedURL, "https://gateway.example.com"), nil))
+		return recorder
+	}
+
+	signed := store.SignedURL(media)
+	recorder := get(signed)
+	if recorder.Code != http.StatusOK || !bytes.Equal(recorder.Body.Bytes(), png) {
+		t.Fatalf("signed URL %s: status %d", signed, recorder.Code)
+	}
+	if recorder.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("served as %q", recorder.Header().Get("Content-Type"))
+	}
+
+	link, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires, _ := strconv.ParseInt(link.Query().Get("expires"), 10, 64)
+	signature := link.Query().Get("signature")
+	otherKey := mediaConfig
+	otherKey.SigningKey = "another-key"
+	expired := mediaConfig
+	expired.URLTTL = -1
+
+	forged := []struct {
+		name string
+		url  string
+	}{
+		{"another media ID", fmt.Sprintf("/media/%d?expires=%d&signature=%s", media.ID+1, expires, signature)},
+		{"a later expiry", fmt.Sprintf("/media/%d?expires=%d&signature=%s", media.ID, expires+3600, signature)},
+		{"a changed signature", fmt.Sprintf("/media/%d?expires=%d&signature=%s", media.ID, expires, strings.Repeat("0", len(signature)))},
+		{"no signature", fmt.Sprintf("/media/%d?expires=%d", media.ID, expires)},
+		{"no expiry", fmt.Sprintf("/media/%d?signature=%s", media.ID, signature)},
+		{"another key", services.NewMediaStore(db, otherKey).SignedURL(media)},
+		{"an expired link", services.NewMediaStore(db, expired).SignedURL(media)},
+	}
+	for _, link := range forged {
+		if code := get(link.url).Code; code != http.StatusForbidden {
+			t.Errorf("URL with %s: status %d, want 403", link.name, code)
+		}
+	}
+
+	// A valid link to media since deleted
+	if err := db.Delete(media).Error; err != nil {
+		t.Fatal(err)
+	}
+	if code := get(signed).Code; code != http.StatusNotFound {
+		t.Errorf("deleted media: status %d, want 404", code)
+	}
+}
+
+func TestRecordingUpload(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "calls@example.com")
+	device := createDevice(t, db, user, "phone-1")
+
+	var recorder *services.CallRecorder
+	_, wsURL := startHub(t, db, func(hub *websocket.Hub) {
+		recorder = services.NewCallRecorder(db, hub, config.RecordingsConfig{
+			Dir:          t.TempDir(),
+			MaxSize:      2048,
+			AllowedTypes: []string{"audio/mpeg", "audio/amr"},
+			UploadTTL:    300,
+			PublicURL:    "https://gateway.example.com",
+			SigningKey:   "recording-key",
+		})
+		hub.OnCallStatus = recorder.RecordStatus
+	})
+	phone := connectDevice(t, wsURL, device.DeviceID, websocket.CapabilityCalls, websocket.CapabilityCallRecording)
+
+	calls := handlers.NewCallRecordHandler(db, recorder)
+	router := gin.New()
+	router.POST("/calls/:id/recording", calls.UploadRecording)
+	router.GET("/calls/:id/recording", asUser(user), calls.GetRecording)
+
+	// endCall reports the call ended and returns the upload URL the device
+	// is sent for it
+	endCall := func() (*models.Call, string) {
+		t.Helper()
+
+		call := models.Call{PhoneNumber: "+15550100", Status: "connected", DeviceID: device.ID, UserID: user.ID, StartedAt: time.Now().UTC()}
+		if err := db.Create(&call).Error; err != nil {
+			t.Fatal(err)
+		}
+		err := phone.WriteJSON(map[string]interface{}{
+			"type": "call_status",
+			"data": websocket.CallStatusFrame{CallID: call.ID, Status: "ended", Duration: 42},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			var frame struct {
+				Type string                         `json:"type"`
+				Data websocket.UploadRecordingFrame `json:"data"`
+			}
+			if err := phone.ReadJSON(&frame); err != nil {
+				t.Fatalf("waiting for upload_recording: %v", err)
+			}
+			if frame.Type == "upload_recording" {
+				if frame.Data.CallID != call.ID || frame.Data.MaxSize != 2048 {
+					t.Fatalf("upload_recording %+v for call %d", frame.Data, call.ID)
+				}
+				return &call, strings.TrimPrefix(frame.Data.URL, "https://gateway.example.com")
+			}
+		}
+	}
+	upload := func(path, contentType string, audio []byte) int {
+		t.Helper()
+
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("note", "sent before the file")
+		part, _ := form.CreatePart(map[string][]string{
+			"Content-Disposition": {`form-data; name="file"; filename="call"`},
+			"Content-Type":        {contentType},
+		})
+		part.Write(audio)
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, path, &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response.Code
+	}
+
+	mp3 := append([]byte("ID3"), bytes.Repeat([]byte{1}, 600)...)
+	call, path := endCall()
+
+	link, _ := url.Parse(path)
+	forged := link.Query()
+	forged.Set("signature", strings.Repeat("0", 64))
+	if code := upload(link.Path+"?"+forged.Encode(), "audio/mpeg", mp3); code != http.StatusForbidden {
+		t.Errorf("forged signature: status %d, want 403", code)
+	}
+	if code := upload(fmt.Sprintf("/calls/%d/recording?%s", call.ID+1, link.RawQuery), "audio/mpeg", mp3); code != http.StatusForbidden {
+		t.Errorf("another call's URL: status %d, want 403", code)
+	}
+
+	if code := upload(path, "text/plain", []byte("not audio at all")); code != http.StatusUnsupportedMediaType {
+		t.Errorf("text upload: status %d, want 415", code)
+	}
+	if code := upload(path, "audio/mpeg", append([]byte("ID3"), bytes.Repeat([]byte{1}, 2048)...)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("2051 byte upload: status %d, want 413", code)
+	}
+	var stored int64
+	db.Model(&models.CallRecording{}).Count(&stored)
+	if stored != 0 {
+		t.Fatalf("%d recordings stored from refused uploads", stored)
+	}
+
+	if code := upload(path, "application/octet-stream", mp3); code != http.StatusCreated {
+		t.Fatalf("upload: status %d, want 201", code)
+	}
+	if code := upload(path, "audio/mpeg", mp3); code != http.StatusConflict {
+		t.Errorf("second upload: status %d, want 409", code)
+	}
+
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/calls/%d/recording", call.ID), nil))
+	if response.Code != http.StatusOK || !bytes.Equal(response.Body.Bytes(), mp3) {
+		t.Fatalf("download: status %d, %d bytes", response.Code, response.Body.Len())
+	}
+	if disposition := response.Header().Get("Content-Disposition"); !strings.Contains(disposition, fmt.Sprintf("call-%d.mp3", call.ID)) {
+		t.Errorf("downloaded as %q", disposition)
+	}
+
+	// AMR can't be detected from its contents, so the declared type is used
+	_, path = endCall()
+	if code := upload(path, "audio/amr", []byte("#!AMR\n"+strings.Repeat("\x3c\x91\x17\x16\xbe", 20))); code != http.StatusCreated {
+		t.Errorf("AMR upload: status %d, want 201", code)
+	}
+}
+
+func TestCDRExportFilters(t *testing.T) {
+	db := newTestDB(t)
+	alice := createUser(t, db, "alice@example.com")
+	bob := createUser(t, db, "bob@example.com")
+	admin := createUser(t, db, "admin@example.com")
+	admin.Role = "admin"
+	db.Model(admin).Update("role", "admin")
+
+	office := createDevice(t, db, alice, "office")
+	spare := createDevice(t, db, alice, "spare")
+	bobs := createDevice(t, db, bob, "bobs")
+	sims := []models.SIM{
+		{DeviceID: office.ID, Slot: 0, ICCID: "8944000000000000001", Carrier: "Vodafone", PhoneNumber: "+447700900001"},
+		{DeviceID: office.ID, Slot: 1, ICCID: "8944000000000000002", Carrier: "EE"},
+	}
+	if err := db.Create(&sims).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(d, hour int) time.Time { return time.Date(2026, 3, d, hour, 0, 0, 0, time.UTC) }
+	call := func(user *models.User, device *models.Device, sim *models.SIM, status string, createdAt time.Time) uint {
+		call := models.Call{PhoneNumber: "+15550100", Status: status, DeviceID: device.ID, UserID: user.ID, CreatedAt: createdAt}
+		if sim != nil {
+			call.SIMID = &sim.ID
+		}
+		if status == "ended" {
+			call.StartedAt, call.EndedAt, call.Duration = createdAt.Add(5*time.Second), createdAt.Add(47*time.Second), 42
+		}
+		if err := db.Create(&call).Error; err != nil {
+			t.Fatal(err)
+		}
+		return call.ID
+	}
+	first := call(alice, office, &sims[0], "ended", day(1, 10))
+	call(alice, office, &sims[1], "failed", day(2, 10))
+	call(alice, spare, nil, "ended", day(3, 10))
+	call(bob, bobs, nil, "ended", day(2, 12))
+	if err := db.Create(&models.CallRecording{CallID: first, UserID: alice.ID, ContentType: "audio/mpeg", Size: 1, Path: "x"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	export := func(user *models.User, query string) (int, [][]string) {
+		t.Helper()
+
+		router := gin.New()
+		router.GET("/calls/cdr", asUser(user), handlers.NewCallRecordHandler(db, nil).ExportCDR)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/calls/cdr?"+query, nil))
+		if recorder.Code != http.StatusOK {
+			return recorder.Code, nil
+		}
+		rows, err := csv.NewReader(recorder.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("reading CDR: %v", err)
+		}
+		return recorder.Code, rows[1:]
+	}
+	// placed lists the device, SIM slot and status of each exported call
+	placed := func(user *models.User, query string) string {
+		t.Helper()
+
+		code, rows := export(user, query)
+		if code != http.StatusOK {
+			t.Fatalf("export ?%s: status %d", query, code)
+		}
+		var calls []string
+		for _, row := range rows {
+			calls = append(calls, row[2]+"/"+row[3]+"/"+row[8])
+		}
+		return strings.Join(calls, " ")
+	}
+
+	_, rows := export(alice, "")
+	want := []string{strconv.Itoa(int(first)), "alice@example.com", "office", "0", "8944000000000000001", "Vodafone", "+447700900001",
+		"+15550100", "ended", "2026-03-01T10:00:00Z", "2026-03-01T10:00:05Z", "2026-03-01T10:00:47Z", "42", "", "true"}
+	if len(rows) != 3 || strings.Join(rows[0], ",") != strings.Join(want, ",") {
+		t.Fatalf("alice's CDR %q, want three calls starting with %q", rows, want)
+	}
+	if rows[2][3] != "" || rows[2][14] != "false" {
+		t.Errorf("call without a SIM or recording: %q", rows[2])
+	}
+
+	if got := placed(alice, "from=2026-03-02T00:00:00Z"); got != "office/1/failed spare//ended" {
+		t.Errorf("from the 2nd: %s", got)
+	}
+	if got := placed(alice, fmt.Sprintf("to=%d", day(2, 10).Unix())); got != "office/0/ended office/1/failed" {
+		t.Errorf("to the 2nd at 10:00, in unix seconds: %s", got)
+	}
+	if got := placed(alice, fmt.Sprintf("device_id=%d&status=ended", spare.ID)); got != "spare//ended" {
+		t.Errorf("ended calls from the spare phone: %s", got)
+	}
+	if got := placed(alice, fmt.Sprintf("sim_id=%d", sims[1].ID)); got != "office/1/failed" {
+		t.Errorf("calls from the second SIM: %s", got)
+	}
+
+	// Only admins export other users' calls
+	if got := placed(alice, fmt.Sprintf("user_id=%d", bob.ID)); got != "office/0/ended office/1/failed spare//ended" {
+		t.Errorf("alice asking for bob's calls got %s", got)
+	}
+	if got := placed(admin, "from=2026-03-02T00:00:00Z&to=2026-03-02T23:59:59Z"); got != "office/1/failed bobs//ended" {
+		t.Errorf("admin export of the 2nd: %s", got)
+	}
+	if got := placed(admin, fmt.Sprintf("user_id=%d", bob.ID)); got != "bobs//ended" {
+		t.Errorf("admin export of bob's calls: %s", got)
+	}
+
+	for _, query := range []string{"from=yesterday", "to=2026-03-02"} {
+		if code, _ := export(alice, query); code != http.StatusBadRequest {
+			t.Errorf("?%s: status %d, want 400", query, code)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/middleware"
+	"remote-sim-gateway/internal/models"
+)
+
+func TestShippedRateLimitPolicyLoads(t *testing.T) {
+	policy, err := middleware.LoadRateLimitPolicy(config.RateLimitConfig{
+		PolicyFile: "../../security/policies/rate-limits.json",
+		Requests:   100,
+		Window:     3600,
+	})
+	if err != nil {
+		t.Fatalf("LoadRateLimitPolicy: %v", err)
+	}
+	for _, group := range []string{"auth", "api", "sms", "calls", "verify", "replies"} {
+		if _, ok := policy.Groups[group]; !ok {
+			t.Errorf("no limit for the %s group", group)
+		}
+	}
+}
+
+func TestRateLimitStores(t *testing.T) {
+	rule := middleware.RateLimitRule{Requests: 2, Window: 60} // a token every 30s
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	stores := map[string]middleware.RateLimitStore{
+		"memory":   middleware.NewMemoryRateLimitStore(),
+		"database": middleware.NewDatabaseRateLimitStore(newTestDB(t)),
+	}
+	for name, store := range stores {
+		take := func(key string, at time.Duration) middleware.RateLimitResult {
+			t.Helper()
+			result, err := store.Take(key, rule, start.Add(at))
+			if err != nil {
+				t.Fatalf("%s: Take: %v", name, err)
+			}
+			return result
+		}
+
+		if !take("a", 0).Allowed || !take("a", time.Second).Allowed {
+			t.Fatalf("%s: a full bucket refused a request", name)
+		}
+		result := take("a", 2*time.Second)
+		if result.Allowed || result.RetryAfter.Round(time.Second) != 28*time.Second {
+			t.Fatalf("%s: empty bucket: %+v, want a refusal for 28s", name, result)
+		}
+		if !take("b", 2*time.Second).Allowed {
+			t.Fatalf("%s: another key shared the empty bucket", name)
+		}
+		if !take("a", 32*time.Second).Allowed {
+			t.Fatalf("%s: no token after refilling for 30s", name)
+		}
+
+		// A swept bucket starts full again
+		if err := store.Sweep(start.Add(time.Hour)); err != nil {
+			t.Fatalf("%s: Sweep: %v", name, err)
+		}
+		if result := take("a", 33*time.Second); !result.Allowed || result.Remaining != 1 {
+			t.Fatalf("%s: after sweeping: %+v, want a full bucket", name, result)
+		}
+	}
+}
+
+func TestRateLimitPicksMostSpecificRule(t *testing.T) {
+	db := newTestDB(t)
+	free := createUser(t, db, "free@example.com")
+	pro := createUser(t, db, "pro@example.com")
+	vip := createUser(t, db, "vip@example.com")
+	db.Model(pro).Update("plan", "pro")
+	db.Model(vip).Update("plan", "pro")
+
+	policy := &middleware.RateLimitPolicy{
+		Default: middleware.RateLimitRule{Requests: 1, Window: 3600},
+		Groups:  map[string]middleware.RateLimitRule{"sms": {Requests: 2, Window: 3600}},
+		Plans: map[string]map[string]middleware.RateLimitRule{
+			"pro": {"*": {Requests: 3, Window: 3600}},
+		},
+		Users: map[string]map[string]middleware.RateLimitRule{
+			strconv.Itoa(int(vip.ID)): {"sms": {Requests: 4, Window: 3600}},
+		},
+		APIKeys: map[string]map[string]middleware.RateLimitRule{
+			"key-1": {"sms": {Requests: 5, Window: 3600}},
+		},
+	}
+	limiter := middleware.NewRateLimiter(policy, middleware.NewMemoryRateLimitStore(), db)
+
+	limitFor := func(group string, identify gin.HandlerFunc) string {
+		router := gin.New()
+		router.GET("/", identify, middleware.RateLimit(limiter, group), func(c *gin.Context) { c.Status(http.StatusOK) })
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		return recorder.Header().Get("RateLimit-Limit")
+	}
+	anonymous := func(c *gin.Context) {}
+	withKey := func(c *gin.Context) {
+		c.Set("user_id", free.ID)
+		c.Set("api_key_id", "key-1")
+	}
+
+	if got := limitFor("api", anonymous); got != "1" {
+		t.Errorf("default limit %s, want 1", got)
+	}
+	if got := limitFor("sms", asUser(free)); got != "2" {
+		t.Errorf("group limit %s, want 2", got)
+	}
+	if got := limitFor("sms", asUser(pro)); got != "3" {
+		t.Errorf("plan limit %s, want 3", got)
+	}
+	if got := limitFor("sms", asUser(vip)); got != "4" {
+		t.Errorf("user limit %s, want 4 over the plan's", got)
+	}
+	if got := limitFor("sms", withKey); got != "5" {
+		t.Errorf("API key limit %s, want 5", got)
+	}
+	if got := limitFor("api", withKey); got != "1" {
+		t.Errorf("API key limit outside its group %s, want the default 1", got)
+	}
+}
+
+func TestRateLimitCountsAPIKeysSeparately(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "keys@example.com")
+
+	policy := &middleware.RateLimitPolicy{Default: middleware.RateLimitRule{Requests: 1, Window: 3600}}
+	limiter := middleware.NewRateLimiter(policy, middleware.NewMemoryRateLimitStore(), db)
+
+	router := gin.New()
+	router.Use(asUser(user), func(c *gin.Context) {
+		if key := c.Query("key"); key != "" {
+			c.Set("api_key_id", key)
+		}
+	})
+	router.GET("/", middleware.RateLimit(limiter, "sms"), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	for _, path := range []string{"/", "/?key=a", "/?key=b"} {
+		if code := get(path).Code; code != http.StatusOK {
+			t.Fatalf("first request to %s: status %d", path, code)
+		}
+	}
+	for _, path := range []string{"/", "/?key=a"} {
+		recorder := get(path)
+		if recorder.Code != http.StatusTooManyRequests {
+			t.Fatalf("second request to %s: status %d, want 429", path, recorder.Code)
+		}
+		if recorder.Header().Get("Retry-After") != "3600" {
+			t.Errorf("second request to %s: Retry-After %q", path, recorder.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestIdempotencyReplaysResponses(t *testing.T) {
+	db := newTestDB(t)
+	alice := createUser(t, db, "alice@example.com")
+	bob := createUser(t, db, "bob@example.com")
+
+	calls := 0
+	status := http.StatusCreated
+	handler := func(c *gin.Context) {
+		calls++
+		c.String(status, "call %d", calls)
+	}
+
+	routers := make(map[uint]*gin.Engine)
+	for _, user := range []*models.User{alice, bob} {
+		router := gin.New()
+		router.POST("/send", asUser(user), middleware.Idempotency(db, config.IdempotencyConfig{Window: 24}), handler)
+		routers[user.ID] = router
+	}
+	send := func(user *models.User, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		recorder := httptest.NewRecorder()
+		routers[user.ID].ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	first := send(alice, "k1", `{"to":"1"}`)
+	retry := send(alice, "k1", `{"to":"1"}`)
+	if calls != 1 || retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Fatalf("retry got %d %q after %d calls, want the first response replayed", retry.Code, retry.Body.String(), calls)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replayed response isn't marked Idempotent-Replayed")
+	}
+
+	if code := send(alice, "k1", `{"to":"2"}`).Code; code != http.StatusConflict {
+		t.Errorf("same key for another body: status %d, want 409", code)
+	}
+
+	// Keys belong to the user who sent them
+	if body := send(bob, "k1", `{"to":"1"}`).Body.String(); body != "call 2" {
+		t.Errorf("another user's k1 got %q, want a new call", body)
+	}
+
+	// Requests without a key always reach the handler
+	send(alice, "", `{"to":"1"}`)
+	send(alice, "", `{"to":"1"}`)
+	if calls != 4 {
+		t.Errorf("%d calls after two requests without a key, want 4", calls)
+	}
+
+	// Server errors aren't stored, so the client can retry with the same key
+	status = http.StatusBadGateway
+	send(alice, "k2", `{"to":"3"}`)
+	status = http.StatusCreated
+	if recorder := send(alice, "k2", `{"to":"3"}`); recorder.Code != http.StatusCreated || recorder.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after a 502: status %d, replayed %q", recorder.Code, recorder.Header().Get("Idempotent-Replayed"))
+	}
+
+	if code := send(alice, strings.Repeat("k", 256), `{}`).Code; code != http.StatusBadRequest {
+		t.Errorf("256 character key: status %d, want 400", code)
+	}
+}
+
+func TestIdempotencyUnfinishedRequests(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "pending@example.com")
+
+	router := gin.New()
+	router.POST("/send", asUser(user), middleware.Idempotency(db, config.IdempotencyConfig{Window: 24}), func(c *gin.Context) {
+		c.String(http.StatusCreated, "sent")
+	})
+	send := func(key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(`{}`))
+		req.Header.Set("Idempotency-Key", key)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// Claims with no stored response, as left by a request still running
+	// and by one that died a while ago
+	now := time.Now().UTC()
+	claims := []models.IdempotencyKey{
+		{UserID: user.ID, Key: "running", RequestHash: "x", CreatedAt: now.Add(-time.Second), ExpiresAt: now.Add(time.Hour)},
+		{UserID: user.ID, Key: "died", RequestHash: "x", CreatedAt: now.Add(-2 * time.Minute), ExpiresAt: now.Add(time.Hour)},
+		{UserID: user.ID, Key: "expired", RequestHash: "x", StatusCode: http.StatusOK, CreatedAt: now.Add(-48 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+	}
+	if err := db.Create(&claims).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if code := send("running"); code != http.StatusConflict {
+		t.Errorf("key of a running request: status %d, want 409", code)
+	}
+	if code := send("died"); code != http.StatusCreated {
+		t.Errorf("key of an abandoned request: status %d, want it reclaimed", code)
+	}
+	if code := send("expired"); code != http.StatusCreated {
+		t.Errorf("expired key: status %d, want it reclaimed", code)
+	}
+}
@@ -0,0 +1,982 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	gorillaws "github.com/gorilla/websocket"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/config"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/services"
+	"remote-sim-gateway/internal/websocket"
+)
+
+func createUser(t *testing.T, db *gorm.DB, email string) *models.User {
+	t.Helper()
+
+	user := models.User{Email: email, Password: "x"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	return &user
+}
+
+func createDevice(t *testing.T, db *gorm.DB, user *models.User, deviceID string) *models.Device {
+	t.Helper()
+
+	device := models.Device{DeviceID: deviceID, Name: deviceID, UserID: user.ID}
+	if err := db.Create(&device).Error; err != nil {
+		t.Fatalf("creating device: %v", err)
+	}
+	return &device
+}
+
+func newAlertService(db *gorm.DB) *services.AlertService {
+	hub := websocket.NewHub(db)
+	router := services.NewSIMRouter(config.RoutingConfig{})
+	dispatcher := services.NewDispatcher(db, hub, router, services.NewQuotaTracker(db, config.QuotasConfig{}), nil, config.QuotasConfig{})
+	contacts := services.NewContactBook(db, config.RecipientsConfig{})
+	return services.NewAlertService(db, hub, dispatcher, router, contacts, config.AlertsConfig{}, config.SMTPConfig{})
+}
+
+// setFailed makes failed of the device's ten messages failed, the rest sent
+func setFailed(t *testing.T, db *gorm.DB, device *models.Device, failed int) {
+	t.Helper()
+
+	if err := db.Where("device_id = ?", device.ID).Delete(&models.Message{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		status := "sent"
+		if i < failed {
+			status = "failed"
+		}
+		message := models.Message{PhoneNumber: "+15550100", Content: "hi", Status: status, DeviceID: device.ID, UserID: device.UserID}
+		if err := db.Create(&message).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAlertHysteresis(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "alerts@example.com")
+	device := createDevice(t, db, user, "phone-1")
+
+	rule := models.AlertRule{
+		UserID:     user.ID,
+		Metric:     models.AlertMetricFailureRate,
+		Threshold:  20,
+		Hysteresis: 5,
+		Channel:    models.AlertChannelEmail,
+		Target:     "ops@example.com",
+		Enabled:    true,
+	}
+	if err := db.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+	alerts := newAlertService(db)
+
+	steps := []struct {
+		failed     int
+		wantFiring int64
+		wantTotal  int64
+	}{
+		{failed: 2, wantFiring: 0, wantTotal: 0}, // at the threshold, not past it
+		{failed: 3, wantFiring: 1, wantTotal: 1}, // 30% fires
+		{failed: 2, wantFiring: 1, wantTotal: 1}, // 20% is inside the band
+		{failed: 1, wantFiring: 0, wantTotal: 1}, // 10% recovers past 15%
+		{failed: 3, wantFiring: 1, wantTotal: 2}, // and can fire again
+	}
+	for i, step := range steps {
+		setFailed(t, db, device, step.failed)
+		alerts.Evaluate()
+
+		var firing, total int64
+		db.Model(&models.Alert{}).Where("rule_id = ? AND state = ?", rule.ID, "firing").Count(&firing)
+		db.Model(&models.Alert{}).Where("rule_id = ?", rule.ID).Count(&total)
+		if firing != step.wantFiring || total != step.wantTotal {
+			t.Fatalf("step %d (%d0%% failed): %d firing of %d alerts, want %d of %d",
+				i, step.failed, firing, total, step.wantFiring, step.wantTotal)
+		}
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	valid := []string{
+		"https://hooks.example.com/alerts",
+		"http://203.0.113.10:8080/hook",
+	}
+	for _, target := range valid {
+		if err := services.ValidateWebhookURL(target); err != nil {
+			t.Errorf("%s: %v", target, err)
+		}
+	}
+
+	invalid := []string{
+		"ftp://example.com/hook",
+		"https:///no-host",
+		"http://localhost:8080/hook",
+		"http://127.0.0.1/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.20/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+	}
+	for _, target := range invalid {
+		if err := services.ValidateWebhookURL(target); err == nil {
+			t.Errorf("%s was accepted", target)
+		}
+	}
+}
+
+func TestAlertWebhookRefusesLoopback(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	db := newTestDB(t)
+	user := createUser(t, db, "webhooks@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	setFailed(t, db, device, 10)
+
+	// Stored directly, as rules saved before targets were validated were
+	rule := models.AlertRule{
+		UserID:    user.ID,
+		Metric:    models.AlertMetricFailureRate,
+		Threshold: 50,
+		Channel:   models.AlertChannelWebhook,
+		Target:    server.URL,
+		Enabled:   true,
+	}
+	if err := db.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	newAlertService(db).Evaluate()
+
+	var fired int64
+	db.Model(&models.Alert{}).Where("rule_id = ?", rule.ID).Count(&fired)
+	if fired != 1 {
+		t.Fatalf("%d alerts fired, want 1", fired)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("webhook on a loopback address got %d requests", n)
+	}
+}
+
+func TestSMSSegments(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 1},
+		{strings.Repeat("a", 160), 1},
+		{strings.Repeat("a", 161), 2},
+		{strings.Repeat("a", 306), 2},
+		{strings.Repeat("a", 307), 3},
+		// Extension characters take two septets
+		{strings.Repeat("€", 80), 1},
+		{strings.Repeat("€", 81), 2},
+		// Anything outside the GSM alphabet makes the whole text UCS-2
+		{strings.Repeat("a", 69) + "ś", 1},
+		{strings.Repeat("a", 70) + "ś", 2},
+		{strings.Repeat("😀", 35), 1},
+		{strings.Repeat("😀", 36), 2},
+	}
+	for _, tt := range tests {
+		if got := services.SMSSegments(tt.text); got != tt.want {
+			t.Errorf("SMSSegments of %d characters %.8q... = %d, want %d", utf8.RuneCountInString(tt.text), tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestQuotaCountsSegments(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "quota@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	device.Quota = models.Quota{DailyLimit: 5}
+
+	now := time.Now().UTC()
+	dispatch := func(segments int) {
+		message := models.Message{PhoneNumber: "+15550100", Content: "x", Status: "sent", DeviceID: device.ID, UserID: user.ID, Segments: segments, DispatchedAt: &now}
+		if err := db.Create(&message).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	quotas := services.NewQuotaTracker(db, config.QuotasConfig{Timezone: "UTC"})
+
+	// An empty window takes a message longer than the whole limit
+	if resetAt, _ := quotas.Check(device, nil, 7, now); !resetAt.IsZero() {
+		t.Fatalf("7 parts refused in an empty window until %v", resetAt)
+	}
+
+	dispatch(3)
+	usage, err := quotas.DeviceUsage(device, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Daily != 3 || usage.Monthly != 3 {
+		t.Fatalf("usage = %+v, want 3 segments", usage)
+	}
+
+	if resetAt, _ := quotas.Check(device, nil, 2, now); !resetAt.IsZero() {
+		t.Fatalf("2 more parts refused at 3 of 5, until %v", resetAt)
+	}
+	resetAt, err := quotas.Check(device, nil, 3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resetAt.Equal(usage.DailyResetsAt) {
+		t.Fatalf("3 more parts at 3 of 5 held until %v, want the daily reset %v", resetAt, usage.DailyResetsAt)
+	}
+}
+
+func TestQuotaWindowsFollowTimezone(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "tz@example.com")
+	device := createDevice(t, db, user, "phone-1")
+
+	tests := []struct {
+		timezone             string
+		now                  string
+		wantDaily, wantMonth string
+	}{
+		{"UTC", "2026-03-15T10:30:45Z", "2026-03-16T00:00:00Z", "2026-04-01T00:00:00Z"},
+		// Already April 1st in Tokyo
+		{"Asia/Tokyo", "2026-03-31T20:00:00Z", "2026-04-01T15:00:00Z", "2026-04-30T15:00:00Z"},
+		{"Asia/Kolkata", "2026-01-01T00:10:30Z", "2026-01-01T18:30:00Z", "2026-01-31T18:30:00Z"},
+		// The day clocks go forward is 23 hours long
+		{"America/New_York", "2026-03-08T12:00:00Z", "2026-03-09T04:00:00Z", "2026-04-01T04:00:00Z"},
+	}
+	for _, tt := range tests {
+		now, _ := time.Parse(time.RFC3339, tt.now)
+		usage, err := services.NewQuotaTracker(db, config.QuotasConfig{Timezone: tt.timezone}).DeviceUsage(device, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := usage.DailyResetsAt.Format(time.RFC3339); got != tt.wantDaily {
+			t.Errorf("%s at %s: daily reset %s, want %s", tt.timezone, tt.now, got, tt.wantDaily)
+		}
+		if got := usage.MonthlyResetsAt.Format(time.RFC3339); got != tt.wantMonth {
+			t.Errorf("%s at %s: monthly reset %s, want %s", tt.timezone, tt.now, got, tt.wantMonth)
+		}
+	}
+}
+
+func TestBulkJobPauseResumeCancel(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "bulk@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	hub, url := startHub(t, db)
+	conn := connectDevice(t, url, device.DeviceID, websocket.CapabilitySMS)
+	eventually(t, "the device to be stored online", func() bool {
+		var stored models.Device
+		db.First(&stored, device.ID)
+		return stored.IsOnline
+	})
+
+	var received atomic.Int32
+	go func() {
+		for {
+			var frame struct {
+				Type string `json:"type"`
+			}
+			if err := conn.ReadJSON(&frame); err != nil {
+				return
+			}
+			if frame.Type == "send_sms" {
+				received.Add(1)
+			}
+		}
+	}()
+
+	router := services.NewSIMRouter(config.RoutingConfig{})
+	dispatcher := services.NewDispatcher(db, hub, router, services.NewQuotaTracker(db, config.QuotasConfig{}), nil, config.QuotasConfig{})
+	sender := services.NewBulkSender(db, dispatcher, config.BulkConfig{SendRate: 2})
+
+	job := models.BulkJob{UserID: user.ID, DeviceID: &device.ID, Content: "hello"}
+	var messages []models.Message
+	for i := 0; i < 5; i++ {
+		messages = append(messages, models.Message{PhoneNumber: fmt.Sprintf("+1555010%d", i), Content: "hello", DeviceID: device.ID, UserID: user.ID})
+	}
+	if err := sender.CreateJob(&job, messages, nil); err != nil {
+		t.Fatalf("CreateJob: %v", err)
+	}
+
+	queued := func() int64 {
+		progress, err := sender.Progress(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return progress.Queued
+	}
+
+	sender.SendPending()
+	if n := queued(); n != 3 {
+		t.Fatalf("%d queued after one second at 2 a second, want 3", n)
+	}
+
+	if ok, err := sender.Pause(&job); !ok || err != nil || job.Status != models.BulkJobPaused {
+		t.Fatalf("Pause = %v, %v; job %s", ok, err, job.Status)
+	}
+	if ok, _ := sender.Pause(&job); ok {
+		t.Error("paused job paused again")
+	}
+	sender.SendPending()
+	if n := queued(); n != 3 {
+		t.Fatalf("paused job sent messages, %d queued", n)
+	}
+
+	if ok, err := sender.Resume(&job); !ok || err != nil || job.Status != models.BulkJobRunning {
+		t.Fatalf("Resume = %v, %v; job %s", ok, err, job.Status)
+	}
+	if ok, _ := sender.Resume(&job); ok {
+		t.Error("running job resumed")
+	}
+	sender.SendPending()
+	if n := queued(); n != 1 {
+		t.Fatalf("%d queued after resuming, want 1", n)
+	}
+
+	if ok, err := sender.Cancel(&job); !ok || err != nil || job.Status != models.BulkJobCancelled || job.FinishedAt == nil {
+		t.Fatalf("Cancel = %v, %v; job %+v", ok, err, job)
+	}
+	progress, err := sender.Progress(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Queued != 0 || progress.Cancelled != 1 {
+		t.Fatalf("progress after cancelling = %+v, want the queued message cancelled", progress)
+	}
+
+	// A cancelled job is finished for good
+	if ok, _ := sender.Resume(&job); ok {
+		t.Error("cancelled job resumed")
+	}
+	if ok, _ := sender.Cancel(&job); ok {
+		t.Error("cancelled job cancelled again")
+	}
+	sender.SendPending()
+	eventually(t, "the device to get the 4 dispatched messages", func() bool { return received.Load() == 4 })
+}
+
+func TestBulkJobCompletes(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "done@example.com")
+	device := createDevice(t, db, user, "phone-1")
+
+	dispatcher := services.NewDispatcher(db, websocket.NewHub(db), services.NewSIMRouter(config.RoutingConfig{}), services.NewQuotaTracker(db, config.QuotasConfig{}), nil, config.QuotasConfig{})
+	sender := services.NewBulkSender(db, dispatcher, config.BulkConfig{})
+	job := models.BulkJob{UserID: user.ID, DeviceID: &device.ID, Content: "hello"}
+	messages := []models.Message{{PhoneNumber: "+15550100", Content: "hello", DeviceID: device.ID, UserID: user.ID}}
+	if err := sender.CreateJob(&job, messages, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delivered outside the sender, as after a restart
+	db.Model(&models.Message{}).Where("bulk_job_id = ?", job.ID).Update("status", "delivered")
+	sender.SendPending()
+
+	db.First(&job, job.ID)
+	if job.Status != models.BulkJobCompleted || job.FinishedAt == nil {
+		t.Fatalf("job %s, finished at %v, want completed", job.Status, job.FinishedAt)
+	}
+	if ok, _ := sender.Pause(&job); ok {
+		t.Error("completed job paused")
+	}
+}
+
+func TestParseRecipientsFromCSV(t *testing.T) {
+	// Semicolon-separated with a byte order mark, as Excel exports it
+	data := "\xef\xbb\xbfName;Mobile Number;City\n" +
+		"Ann;07700 900123;Leeds\n" +
+		"Bob;+44 7700 900124;\n" +
+		";;\n" +
+		"Cat;not a number;York\n" +
+		"Dan;0044 7700 900123;Hull\n" +
+		"Eve;7700900125;Bath\n"
+
+	rows, err := services.ReadSpreadsheet("list.csv", []byte(data))
+	if err != nil {
+		t.Fatalf("ReadSpreadsheet: %v", err)
+	}
+	mapping := services.RecipientMapping{Variables: map[string]string{"name": "Name", "city": "City"}}
+	report, err := services.ParseRecipients(rows, mapping, "+44", 0)
+	if err != nil {
+		t.Fatalf("ParseRecipients: %v", err)
+	}
+
+	if report.PhoneColumn != "Mobile Number" || report.TotalRows != 5 {
+		t.Errorf("phone column %q, %d rows, want Mobile Number and 5", report.PhoneColumn, report.TotalRows)
+	}
+	var numbers []string
+	for _, recipient := range report.Recipients {
+		numbers = append(numbers, recipient.PhoneNumber)
+	}
+	if got := strings.Join(numbers, " "); got != "+447700900123 +447700900125" {
+		t.Errorf("recipients %s", got)
+	}
+	if report.Recipients[0].Variables["name"] != "Ann" || report.Recipients[0].Variables["city"] != "Leeds" {
+		t.Errorf("row 2 variables %v", report.Recipients[0].Variables)
+	}
+
+	if report.InvalidCount != 2 || report.Invalid[0].Row != 3 || report.Invalid[1].Row != 5 {
+		t.Errorf("invalid rows %+v, want rows 3 (no city) and 5", report.Invalid)
+	}
+	if report.DuplicateCount != 1 || report.Duplicates[0].Row != 6 || report.Duplicates[0].DuplicateOf != 2 {
+		t.Errorf("duplicates %+v, want row 6 repeating row 2", report.Duplicates)
+	}
+
+	// Blank variables can be left out instead
+	mapping.OptionalVariables = true
+	report, _ = services.ParseRecipients(rows, mapping, "+44", 0)
+	if len(report.Recipients) != 3 {
+		t.Errorf("%d recipients with optional variables, want 3", len(report.Recipients))
+	}
+
+	if _, err := services.ParseRecipients(rows, mapping, "+44", 4); err == nil {
+		t.Error("5 recipients accepted with a limit of 4")
+	}
+	if _, err := services.ParseRecipients(rows, services.RecipientMapping{PhoneColumn: "Phone"}, "", 0); err == nil {
+		t.Error("missing phone column accepted")
+	}
+	if _, err := services.ReadSpreadsheet("list.pdf", []byte(data)); err == nil {
+		t.Error(".pdf file accepted")
+	}
+}
+
+func TestParseRecipientsFromXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	parts := map[string]string{
+		"xl/sharedStrings.xml": `<sst><si><t>phone</t></si><si><t>name</t></si><si><r><t>Jo</t></r><r><t>hn</t></r></si></sst>`,
+		// Row 3 is left out and row 4 skips column A, as Excel writes them
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData>
+			<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c></row>
+			<row r="2"><c r="A2"><v>9.19876543210E+11</v></c><c r="B2" t="s"><v>2</v></c></row>
+			<row r="4"><c r="B4" t="inlineStr"><is><t>Nobody</t></is></c></row>
+		</sheetData></worksheet>`,
+	}
+	for name, content := range parts {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := services.ReadSpreadsheet("list.XLSX", buf.Bytes())
+	if err != nil {
+		t.Fatalf("ReadSpreadsheet: %v", err)
+	}
+	if len(rows) != 4 || rows[2] != nil || rows[3][0] != "" || rows[3][1] != "Nobody" {
+		t.Fatalf("rows = %q", rows)
+	}
+
+	report, err := services.ParseRecipients(rows, services.RecipientMapping{Variables: map[string]string{"name": "name"}}, "", 0)
+	if err != nil {
+		t.Fatalf("ParseRecipients: %v", err)
+	}
+	if len(report.Recipients) != 1 || report.Recipients[0].PhoneNumber != "919876543210" || report.Recipients[0].Variables["name"] != "John" {
+		t.Errorf("recipients %+v", report.Recipients)
+	}
+	if report.InvalidCount != 1 || report.Invalid[0].Row != 4 {
+		t.Errorf("invalid %+v, want row 4 without a number", report.Invalid)
+	}
+
+	if _, err := services.ReadSpreadsheet("list.xlsx", []byte("phone\n123")); err == nil {
+		t.Error("CSV named .xlsx accepted")
+	}
+}
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	valid := map[[2]string]string{
+		{"+1 (555) 010-0100", ""}: "+15550100100",
+		{"0044 20 7946 0018", ""}: "+442079460018",
+		{"020 7946 0018", "+44"}:  "+442079460018",
+		{"442079460018", "44"}:    "+442079460018",
+		{"5550100100", "1"}:       "+15550100100",
+		{"9.19876543210E+11", ""}: "919876543210",
+		{"  555.010.0100  ", ""}:  "5550100100",
+	}
+	for in, want := range valid {
+		got, err := services.NormalizePhoneNumber(in[0], in[1])
+		if err != nil || got != want {
+			t.Errorf("NormalizePhoneNumber(%q, %q) = %q, %v; want %q", in[0], in[1], got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "555-CALL-NOW", "12345", "1234567890123456", "1+5550100"} {
+		if got, err := services.NormalizePhoneNumber(in, ""); err == nil {
+			t.Errorf("NormalizePhoneNumber(%q) = %q, want an error", in, got)
+		}
+	}
+}
+
+func newDispatcher(db *gorm.DB, hub *websocket.Hub) *services.Dispatcher {
+	return services.NewDispatcher(db, hub, services.NewSIMRouter(config.RoutingConfig{}), services.NewQuotaTracker(db, config.QuotasConfig{}), nil, config.QuotasConfig{})
+}
+
+func TestDeliveryReportsForMultipartMessages(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "reports@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	dispatcher := newDispatcher(db, websocket.NewHub(db))
+
+	message := models.Message{PhoneNumber: "+15550100", Content: "hello", Status: "pending", DeviceID: device.ID, UserID: user.ID, Direction: models.MessageOutbound, Segments: 1}
+	if err := db.Create(&message).Error; err != nil {
+		t.Fatal(err)
+	}
+	report := func(frame websocket.SMSStatusFrame) models.Message {
+		t.Helper()
+		frame.MessageID = message.ID
+		dispatcher.RecordStatus(device.DeviceID, &frame)
+
+		var stored models.Message
+		db.First(&stored, message.ID)
+		return stored
+	}
+
+	// The device splits the text into three parts, reported in any order
+	if got := report(websocket.SMSStatusFrame{Status: "sent", Segment: 2, Segments: 3}); got.Status != "pending" || got.Segments != 3 {
+		t.Fatalf("after part 3 of 3 sent: %s, %d segments", got.Status, got.Segments)
+	}
+	if got := report(websocket.SMSStatusFrame{Status: "sent", Segment: 1, Segments: 3}); got.Status != "pending" {
+		t.Fatalf("after 2 of 3 parts sent: %s", got.Status)
+	}
+	// A delivery report overtaking the part's sent report counts as sent
+	if got := report(websocket.SMSStatusFrame{Status: "delivered", Segment: 0, Segments: 3}); got.Status != "sent" {
+		t.Fatalf("all parts sent or delivered: %s", got.Status)
+	}
+
+	// A late sent report can't undo a delivery
+	report(websocket.SMSStatusFrame{Status: "delivered", Segment: 1, Segments: 3})
+	report(websocket.SMSStatusFrame{Status: "sent", Segment: 1, Segments: 3})
+	if got := report(websocket.SMSStatusFrame{Status: "delivered", Segment: 2, Segments: 3}); got.Status != "delivered" || got.DeliveredAt == nil {
+		t.Fatalf("all parts delivered: %s, delivered at %v", got.Status, got.DeliveredAt)
+	}
+
+	// One part failing fails the whole message
+	failing := models.Message{PhoneNumber: "+15550100", Content: "hello", Status: "pending", DeviceID: device.ID, UserID: user.ID, Direction: models.MessageOutbound, Segments: 2}
+	db.Create(&failing)
+	message = failing
+	report(websocket.SMSStatusFrame{Status: "sent", Segment: 0})
+	if got := report(websocket.SMSStatusFrame{Status: "undelivered", Segment: 1, ErrorMsg: "unreachable"}); got.Status != "undelivered" || got.ErrorMsg != "unreachable" {
+		t.Fatalf("one part undelivered: %s %q", got.Status, got.ErrorMsg)
+	}
+}
+
+func TestDeliveryReportsFromDevices(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "wire@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	other := createDevice(t, db, user, "phone-2")
+	hub, url := startHub(t, db)
+	hub.OnSMSStatus = newDispatcher(db, hub).RecordStatus
+
+	create := func(status string) *models.Message {
+		message := models.Message{PhoneNumber: "+15550100", Content: "hi", Status: status, DeviceID: device.ID, UserID: user.ID, Direction: models.MessageOutbound, Segments: 1}
+		if err := db.Create(&message).Error; err != nil {
+			t.Fatal(err)
+		}
+		return &message
+	}
+	sent, stolen, queued := create("pending"), create("pending"), create("queued")
+
+	send := func(conn *gorillaws.Conn, message *models.Message, status string) {
+		err := conn.WriteJSON(map[string]interface{}{
+			"type": "sms_status",
+			"data": websocket.SMSStatusFrame{MessageID: message.ID, Status: status, SentAt: time.Now().UTC()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	phone := connectDevice(t, url, device.DeviceID, websocket.CapabilitySMS)
+	intruder := connectDevice(t, url, other.DeviceID, websocket.CapabilitySMS)
+
+	// Reports for a message sent through another device, or one that was
+	// never handed to a device, are ignored
+	send(intruder, stolen, "delivered")
+	send(phone, queued, "sent")
+	send(phone, sent, "sent")
+	send(phone, stolen, "failed")
+
+	status := func(message *models.Message) string {
+		var stored models.Message
+		db.First(&stored, message.ID)
+		return stored.Status
+	}
+	eventually(t, "the reports to be stored", func() bool { return status(sent) == "sent" && status(stolen) == "failed" })
+	if got := status(queued); got != "queued" {
+		t.Errorf("queued message reported %s", got)
+	}
+}
+
+var testVerifyConfig = config.VerifyConfig{
+	CodeLength:   6,
+	TTL:          300,
+	MaxAttempts:  3,
+	MaxPerNumber: 5,
+	MaxPerUser:   100,
+	Template:     "Your code is {{code}}",
+}
+
+func newVerifyService(t *testing.T, db *gorm.DB, hub *websocket.Hub) *services.VerifyService {
+	t.Helper()
+
+	verify, err := services.NewVerifyService(db, hub, services.NewSIMRouter(config.RoutingConfig{}), newDispatcher(db, hub), testVerifyConfig)
+	if err != nil {
+		t.Fatalf("NewVerifyService: %v", err)
+	}
+	return verify
+}
+
+// createVerification stores a pending verification of code for the number
+func createVerification(t *testing.T, db *gorm.DB, user *models.User, phoneNumber, code string, expiresAt time.Time) *models.Verification {
+	t.Helper()
+
+	verification := models.Verification{
+		UserID:      user.ID,
+		PhoneNumber: phoneNumber,
+		Channel:     models.VerifyChannelSMS,
+		Status:      models.VerificationPending,
+		MaxAttempts: testVerifyConfig.MaxAttempts,
+		ExpiresAt:   expiresAt,
+	}
+	if err := verification.HashCode(code); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&verification).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &verification
+}
+
+func TestNewVerifyServiceRejectsBadConfig(t *testing.T) {
+	db := newTestDB(t)
+	hub := websocket.NewHub(db)
+
+	broken := map[string]func(*config.VerifyConfig){
+		"zero code length":      func(c *config.VerifyConfig) { c.CodeLength = 0 },
+		"11 digit codes":        func(c *config.VerifyConfig) { c.CodeLength = 11 },
+		"zero lifetime":         func(c *config.VerifyConfig) { c.TTL = 0 },
+		"no attempts":           func(c *config.VerifyConfig) { c.MaxAttempts = 0 },
+		"negative cooldown":     func(c *config.VerifyConfig) { c.ResendCooldown = -1 },
+		"no codes per number":   func(c *config.VerifyConfig) { c.MaxPerNumber = 0 },
+		"no codes per user":     func(c *config.VerifyConfig) { c.MaxPerUser = -5 },
+		"template without code": func(c *config.VerifyConfig) { c.Template = "Welcome!" },
+	}
+	for name, breakConfig := range broken {
+		verifyConfig := testVerifyConfig
+		breakConfig(&verifyConfig)
+		if _, err := services.NewVerifyService(db, hub, nil, nil, verifyConfig); err == nil {
+			t.Errorf("%s: config accepted", name)
+		}
+	}
+}
+
+func TestVerifyCheckWrongCodes(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "verify@example.com")
+	verify := newVerifyService(t, db, websocket.NewHub(db))
+	verification := createVerification(t, db, user, "+15550100", "123456", time.Now().Add(time.Minute))
+
+	for attempt := 1; attempt < testVerifyConfig.MaxAttempts; attempt++ {
+		got, valid, err := verify.Check(user.ID, verification.ID, "", "000000")
+		if err != nil || valid {
+			t.Fatalf("wrong code %d: valid %v, err %v", attempt, valid, err)
+		}
+		if got.Status != models.VerificationPending || got.Attempts != attempt {
+			t.Fatalf("after wrong code %d: %s with %d attempts", attempt, got.Status, got.Attempts)
+		}
+	}
+
+	// The last allowed attempt fails the verification for good
+	got, _, _ := verify.Check(user.ID, verification.ID, "", "999999")
+	if got.Status != models.VerificationFailed {
+		t.Fatalf("out of attempts: %s", got.Status)
+	}
+	got, valid, err := verify.Check(user.ID, verification.ID, "", "123456")
+	if err != nil || valid || got.Status != models.VerificationFailed || got.Attempts != testVerifyConfig.MaxAttempts {
+		t.Fatalf("right code after failing: valid %v, %s with %d attempts, err %v", valid, got.Status, got.Attempts, err)
+	}
+}
+
+func TestVerifyCheckExpiry(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "expiry@example.com")
+	verify := newVerifyService(t, db, websocket.NewHub(db))
+	expired := createVerification(t, db, user, "+15550100", "123456", time.Now().Add(-time.Second))
+
+	got, valid, err := verify.Check(user.ID, expired.ID, "", "123456")
+	if err != nil || valid || got.Status != models.VerificationExpired {
+		t.Fatalf("expired code: valid %v, status %s, err %v", valid, got.Status, err)
+	}
+	var stored models.Verification
+	db.First(&stored, expired.ID)
+	if stored.Status != models.VerificationExpired || stored.Attempts != 0 {
+		t.Fatalf("stored %s with %d attempts, want expired with none counted", stored.Status, stored.Attempts)
+	}
+}
+
+func TestVerifyCheckByPhoneNumber(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "latest@example.com")
+	other := createUser(t, db, "other@example.com")
+	verify := newVerifyService(t, db, websocket.NewHub(db))
+
+	createVerification(t, db, user, "+15550100", "111111", time.Now().Add(time.Minute))
+	latest := createVerification(t, db, user, "+15550100", "222222", time.Now().Add(time.Minute))
+
+	if _, valid, _ := verify.Check(user.ID, 0, "+15550100", "111111"); valid {
+		t.Error("an older code for the number was accepted")
+	}
+	got, valid, err := verify.Check(user.ID, 0, "+15550100", "222222")
+	if err != nil || !valid || got.ID != latest.ID || got.Status != models.VerificationApproved || got.VerifiedAt == nil {
+		t.Fatalf("latest code: valid %v, %+v, err %v", valid, got, err)
+	}
+
+	if _, _, err := verify.Check(other.ID, latest.ID, "", "222222"); !errors.Is(err, services.ErrVerificationNotFound) {
+		t.Errorf("another user's verification: err %v, want ErrVerificationNotFound", err)
+	}
+}
+
+func TestVerifyStartStoresNothingWhenSendFails(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "unsent@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	verify := newVerifyService(t, db, websocket.NewHub(db))
+
+	// The device isn't connected, so the call can't be placed
+	_, err := verify.Start(user.ID, device, "+15550100", models.VerifyChannelCall, 0, 0, "")
+	if !errors.Is(err, websocket.ErrDeviceNotConnected) {
+		t.Fatalf("Start: %v, want ErrDeviceNotConnected", err)
+	}
+
+	var verifications int64
+	db.Model(&models.Verification{}).Count(&verifications)
+	if verifications != 0 {
+		t.Fatalf("%d verifications stored for a code that was never sent", verifications)
+	}
+	var call models.Call
+	db.First(&call)
+	if call.Status != "failed" {
+		t.Errorf("call is %s, want failed", call.Status)
+	}
+}
+
+// ussdPhone is a connected device with the ussd capability. The test reads
+// the ussd_request frames it receives and answers them.
+type ussdPhone struct {
+	conn     *gorillaws.Conn
+	requests chan websocket.USSDRequestFrame
+}
+
+func newUSSDTest(t *testing.T) (*gorm.DB, *services.USSDService, *models.Device, *ussdPhone) {
+	t.Helper()
+
+	db := newTestDB(t)
+	user := createUser(t, db, "ussd@example.com")
+	device := createDevice(t, db, user, "phone-1")
+
+	var ussd *services.USSDService
+	_, url := startHub(t, db, func(hub *websocket.Hub) {
+		ussd = services.NewUSSDService(db, hub, config.DevicesConfig{USSDTimeout: 5})
+		hub.OnUSSDResponse = ussd.HandleResponse
+	})
+	phone := &ussdPhone{
+		conn:     connectDevice(t, url, device.DeviceID, websocket.CapabilitySMS, websocket.CapabilityUSSD),
+		requests: make(chan websocket.USSDRequestFrame, 10),
+	}
+	go func() {
+		defer close(phone.requests)
+		for {
+			var frame struct {
+				Type string                     `json:"type"`
+				Data websocket.USSDRequestFrame `json:"data"`
+			}
+			if err := phone.conn.ReadJSON(&frame); err != nil {
+				return
+			}
+			if frame.Type == "ussd_request" {
+				phone.requests <- frame.Data
+			}
+		}
+	}()
+	return db, ussd, device, phone
+}
+
+func (p *ussdPhone) next(t *testing.T) websocket.USSDRequestFrame {
+	t.Helper()
+
+	select {
+	case request, ok := <-p.requests:
+		if !ok {
+			t.Fatal("phone disconnected")
+		}
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatal("phone got no ussd_request")
+	}
+	return websocket.USSDRequestFrame{}
+}
+
+func (p *ussdPhone) answer(t *testing.T, request websocket.USSDRequestFrame, status, message string) {
+	t.Helper()
+
+	err := p.conn.WriteJSON(map[string]interface{}{
+		"type": "ussd_response",
+		"data": websocket.USSDResponseFrame{RequestID: request.ID, Status: status, Message: message},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type ussdResult struct {
+	session *models.USSDSession
+	err     error
+}
+
+func TestUSSDMenuSession(t *testing.T) {
+	_, ussd, device, phone := newUSSDTest(t)
+
+	results := make(chan ussdResult, 1)
+	go func() {
+		session, err := ussd.Start(device.UserID, device, nil, "*100#", 0)
+		results <- ussdResult{session, err}
+	}()
+	request := phone.next(t)
+	if request.Input != "*100#" {
+		t.Fatalf("device dialled %q", request.Input)
+	}
+	phone.answer(t, request, "continue", "1. Balance\n2. Data")
+
+	result := <-results
+	if result.err != nil {
+		t.Fatalf("Start: %v", result.err)
+	}
+	session := result.session
+	if session.Status != models.USSDSessionActive || len(session.Steps) != 1 || session.Steps[0].Response != "1. Balance\n2. Data" {
+		t.Fatalf("after the menu: %+v", session)
+	}
+
+	go func() {
+		updated, err := ussd.Reply(session, device, "1", 0)
+		results <- ussdResult{updated, err}
+	}()
+	request = phone.next(t)
+	if request.Input != "1" || request.SessionID != session.ID {
+		t.Fatalf("device got %+v, want the reply to session %d", request, session.ID)
+	}
+
+	// The menu was answered already and the response isn't back yet
+	if _, err := ussd.Reply(session, device, "2", 0); !errors.Is(err, services.ErrUSSDBusy) {
+		t.Errorf("second reply while waiting: %v, want ErrUSSDBusy", err)
+	}
+
+	phone.answer(t, request, "completed", "Balance: 5.00")
+	result = <-results
+	if result.err != nil {
+		t.Fatalf("Reply: %v", result.err)
+	}
+	session = result.session
+	if session.Status != models.USSDSessionCompleted || session.EndedAt == nil {
+		t.Errorf("session %s, ended at %v; want completed", session.Status, session.EndedAt)
+	}
+	if len(session.Steps) != 2 || session.Steps[1].Response != "Balance: 5.00" {
+		t.Errorf("steps %+v, want the code and the reply", session.Steps)
+	}
+
+	if _, err := ussd.Reply(session, device, "1", 0); !errors.Is(err, services.ErrUSSDSessionClosed) {
+		t.Errorf("reply to a completed session: %v, want ErrUSSDSessionClosed", err)
+	}
+}
+
+// A response arriving after the request timed out is still recorded
+func TestUSSDLateResponse(t *testing.T) {
+	db, ussd, device, phone := newUSSDTest(t)
+
+	session, err := ussd.Start(device.UserID, device, nil, "*100#", 50*time.Millisecond)
+	if !errors.Is(err, services.ErrUSSDTimeout) {
+		t.Fatalf("Start: %v, want ErrUSSDTimeout", err)
+	}
+	if session.Status != models.USSDSessionTimeout || session.Steps[0].Status != models.USSDStepTimeout {
+		t.Fatalf("session %s with step %s, want both timed out", session.Status, session.Steps[0].Status)
+	}
+	if _, err := ussd.Reply(session, device, "1", 0); !errors.Is(err, services.ErrUSSDSessionClosed) {
+		t.Errorf("reply to a timed out session: %v, want ErrUSSDSessionClosed", err)
+	}
+
+	phone.answer(t, phone.next(t), "completed", "Balance: 5.00")
+
+	var stored models.USSDSession
+	eventually(t, "the late response to be recorded", func() bool {
+		stored = models.USSDSession{}
+		db.Preload("Steps").First(&stored, session.ID)
+		return stored.Status == models.USSDSessionCompleted
+	})
+	if stored.Steps[0].Response != "Balance: 5.00" || stored.Steps[0].Status != models.USSDStepCompleted {
+		t.Errorf("late step %+v", stored.Steps[0])
+	}
+}
+
+func TestUSSDCancel(t *testing.T) {
+	db, ussd, device, phone := newUSSDTest(t)
+
+	start := func() *models.USSDSession {
+		t.Helper()
+		results := make(chan ussdResult, 1)
+		go func() {
+			session, err := ussd.Start(device.UserID, device, nil, "*123#", 0)
+			results <- ussdResult{session, err}
+		}()
+		phone.answer(t, phone.next(t), "continue", "1. Data")
+		result := <-results
+		if result.err != nil {
+			t.Fatalf("Start: %v", result.err)
+		}
+		return result.session
+	}
+
+	first := start()
+	if err := ussd.Cancel(first, device); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if request := phone.next(t); !request.End || request.SessionID != first.ID {
+		t.Errorf("device got %+v, want session %d ended", request, first.ID)
+	}
+	if err := ussd.Cancel(first, device); !errors.Is(err, services.ErrUSSDSessionClosed) {
+		t.Errorf("cancelling twice: %v, want ErrUSSDSessionClosed", err)
+	}
+
+	// Starting a session closes the one still open on the device
+	second := start()
+	third := start()
+	var stored models.USSDSession
+	db.First(&stored, second.ID)
+	if stored.Status != models.USSDSessionCancelled {
+		t.Errorf("session left open by a new one is %s, want cancelled", stored.Status)
+	}
+	if third.Status != models.USSDSessionActive {
+		t.Errorf("new session is %s", third.Status)
+	}
+}
@@ -0,0 +1,280 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gorillaws "github.com/gorilla/websocket"
+	"gorm.io/gorm"
+	"remote-sim-gateway/internal/models"
+	"remote-sim-gateway/internal/websocket"
+)
+
+// startHub runs a hub with a WebSocket endpoint devices can connect to, and
+// returns the endpoint's ws:// URL. setup runs before the hub starts. The hub
+// is shut down when the test ends.
+func startHub(t *testing.T, db *gorm.DB, setup ...func(*websocket.Hub)) (*websocket.Hub, string) {
+	t.Helper()
+
+	hub := websocket.NewHub(db)
+	for _, configure := range setup {
+		configure(hub)
+	}
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		websocket.HandleWebSocket(hub, w, r)
+	}))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := hub.Shutdown(ctx); err != nil {
+			t.Errorf("shutting down hub: %v", err)
+		}
+		server.Close()
+	})
+	return hub, "ws" + strings.TrimPrefix(server.URL, "http") + "/"
+}
+
+// connectDevice connects deviceID to the hub, says hello with capabilities
+// and waits for the hub's hello_ack
+func connectDevice(t *testing.T, url, deviceID string, capabilities ...string) *gorillaws.Conn {
+	t.Helper()
+
+	conn, _, err := gorillaws.DefaultDialer.Dial(url+"?device_id="+deviceID, nil)
+	if err != nil {
+		t.Fatalf("connecting %s: %v", deviceID, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	err = conn.WriteJSON(map[string]interface{}{
+		"type": "hello",
+		"data": websocket.HelloFrame{AppVersion: "1.0", ProtocolVersion: websocket.ProtocolVersion, Capabilities: capabilities},
+	})
+	if err != nil {
+		t.Fatalf("sending hello: %v", err)
+	}
+	for {
+		var frame struct {
+			Type string `json:"type"`
+		}
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("waiting for hello_ack: %v", err)
+		}
+		if frame.Type == "hello_ack" {
+			return conn
+		}
+	}
+}
+
+// eventually fails the test unless done reports true within five seconds
+func eventually(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDecodeFrameAcceptsHelloFromNewerApps(t *testing.T) {
+	raw := []byte(`{
+		"type": "hello",
+		"trace_id": "abc",
+		"data": {
+			"app_version": "9.0.0",
+			"protocol_version": 7,
+			"capabilities": ["sms", "rcs", "calls"],
+			"battery_saver": true
+		}
+	}`)
+
+	message, err := websocket.DecodeFrame(raw)
+	if err != nil {
+		t.Fatalf("DecodeFrame: %v", err)
+	}
+	hello, ok := message.Data.(*websocket.HelloFrame)
+	if !ok {
+		t.Fatalf("data is %T, want *HelloFrame", message.Data)
+	}
+	if hello.AppVersion != "9.0.0" || len(hello.Capabilities) != 3 {
+		t.Fatalf("hello = %+v", hello)
+	}
+}
+
+func TestDecodeFrameRejectsUnknownFieldsInReports(t *testing.T) {
+	frames := map[string]string{
+		"data field":     `{"type":"sms_status","data":{"message_id":1,"status":"sent","extra":1}}`,
+		"envelope field": `{"type":"sms_status","extra":1,"data":{"message_id":1,"status":"sent"}}`,
+	}
+	for name, raw := range frames {
+		_, err := websocket.DecodeFrame([]byte(raw))
+		var frameErr *websocket.FrameError
+		if !errors.As(err, &frameErr) {
+			t.Errorf("%s: err = %v, want a *FrameError", name, err)
+		}
+	}
+}
+
+func TestDecodeFrameStillValidatesHello(t *testing.T) {
+	_, err := websocket.DecodeFrame([]byte(`{"type":"hello","data":{"protocol_version":1,"capabilities":["sms"]}}`))
+	if err == nil {
+		t.Fatal("hello without app_version was accepted")
+	}
+}
+
+func TestDevicePresenceIsPersisted(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "presence@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	hub, url := startHub(t, db)
+
+	isOnline := func() bool {
+		var stored models.Device
+		db.First(&stored, device.ID)
+		return stored.IsOnline
+	}
+
+	conn := connectDevice(t, url, device.DeviceID, websocket.CapabilitySMS)
+	eventually(t, "the device to be stored online", isOnline)
+
+	conn.Close()
+	eventually(t, "the device to be stored offline", func() bool { return !isOnline() })
+	if hub.IsDeviceConnected(device.DeviceID) {
+		t.Fatal("hub still routes commands to the disconnected device")
+	}
+}
+
+func TestReconcilePresenceClearsStaleRows(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "reconcile@example.com")
+	stale := createDevice(t, db, user, "phone-1")
+	db.Model(stale).Update("is_online", true)
+
+	hub := websocket.NewHub(db)
+	if err := hub.ReconcilePresence(); err != nil {
+		t.Fatalf("ReconcilePresence: %v", err)
+	}
+
+	var stored models.Device
+	db.First(&stored, stale.ID)
+	if stored.IsOnline {
+		t.Fatal("device with no connection is still stored online")
+	}
+}
+
+func TestSendWindowReleasesCommandsByPriority(t *testing.T) {
+	db := newTestDB(t)
+	user := createUser(t, db, "lanes@example.com")
+	device := createDevice(t, db, user, "phone-1")
+	reported := make(chan uint)
+	hub, url := startHub(t, db, func(hub *websocket.Hub) {
+		hub.SendWindow = 1
+		hub.OnSMSStatus = func(deviceID string, frame *websocket.SMSStatusFrame) { reported <- frame.MessageID }
+	})
+	conn := connectDevice(t, url, device.DeviceID, websocket.CapabilitySMS)
+
+	received := make(chan uint, 32)
+	go func() {
+		for {
+			var frame struct {
+				Type string                 `json:"type"`
+				Data websocket.SendSMSFrame `json:"data"`
+			}
+			if err := conn.ReadJSON(&frame); err != nil {
+				return
+			}
+			if frame.Type == "send_sms" {
+				received <- frame.Data.ID
+			}
+		}
+	}()
+
+	send := func(id uint, priority string) {
+		t.Helper()
+		frame := websocket.SendSMSFrame{ID: id, PhoneNumber: "+15550100", Message: "hi", Priority: priority}
+		if err := hub.SendCommand(device.DeviceID, websocket.Message{Type: "send_sms", Data: frame}); err != nil {
+			t.Fatalf("sending %d: %v", id, err)
+		}
+	}
+	expect := func(want uint) {
+		t.Helper()
+		select {
+		case id := <-received:
+			if id != want {
+				t.Fatalf("device got message %d, want %d", id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("device never got message %d", want)
+		}
+	}
+	expectNothing := func() {
+		t.Helper()
+		select {
+		case id := <-received:
+			t.Fatalf("device got message %d past its send window", id)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	report := func(id uint) {
+		t.Helper()
+		err := conn.WriteJSON(map[string]interface{}{
+			"type": "sms_status",
+			"data": websocket.SMSStatusFrame{MessageID: id, Status: "sent", SentAt: time.Now().UTC()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The hub frees the window slot before passing the report on
+		select {
+		case <-reported:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("report on %d never arrived", id)
+		}
+	}
+
+	// Devices that never report aren't held to the window, so report once
+	// to turn it on
+	send(100, models.PriorityNormal)
+	expect(100)
+	report(100)
+
+	send(1, models.PriorityNormal)
+	expect(1)
+	send(2, models.PriorityBulk)
+	send(3, models.PriorityNormal)
+	send(4, models.PriorityHigh)
+	expectNothing()
+	if held := hub.HeldCommands(device.DeviceID, models.PriorityBulk); held != 1 {
+		t.Errorf("%d bulk commands held, want 1", held)
+	}
+
+	for _, next := range []struct{ report, want uint }{{1, 4}, {4, 3}, {3, 2}} {
+		report(next.report)
+		expect(next.want)
+		expectNothing()
+	}
+	report(2)
+
+	// A waiting bulk command goes out after four others, however many wait
+	send(10, models.PriorityNormal)
+	expect(10)
+	send(20, models.PriorityBulk)
+	for id := uint(11); id <= 16; id++ {
+		send(id, models.PriorityNormal)
+	}
+	last := uint(10)
+	for _, want := range []uint{11, 12, 13, 14, 20, 15, 16} {
+		report(last)
+		expect(want)
+		last = want
+	}
+}
@@ -80,6 +80,14 @@ export default function Dashboard() {
       color: 'bg-emerald-500',
       change: `${stats?.success_rate_change || 0}% from yesterday`,
       trend: stats?.success_rate_change > 0 ? 'up' : 'down'
+    },
+    {
+      title: 'Delivery Rate',
+      value: `${stats?.delivery_rate || 0}%`,
+      icon: Activity,
+      color: 'bg-teal-500',
+      change: `${stats?.delivery_rate_change || 0}% from yesterday`,
+      trend: stats?.delivery_rate_change > 0 ? 'up' : 'down'
     }
   ];
 
@@ -75,20 +75,57 @@ export const authAPI = {
 
 // SMS API
 export const smsAPI = {
-  sendSMS: async (phoneNumber, message, deviceId = null) => {
+  // options may set valid_until or ttl (seconds) for messages that go stale
+  sendSMS: async (phoneNumber, message, deviceId = null, options = {}) => {
     const response = await api.post('/api/send-sms', {
       phone_number: phoneNumber,
       message: message,
       device_id: deviceId,
+      ...options,
     });
     return response;
   },
 
-  sendBulkSMS: async (phoneNumbers, message, deviceId = null) => {
+  sendBulkSMS: async (phoneNumbers, message, deviceId = null, options = {}) => {
     const response = await api.post('/api/send-bulk-sms', {
       phone_numbers: phoneNumbers,
       message: message,
       device_id: deviceId,
+      ...options,
+    });
+    return response;
+  },
+
+  // Validates a CSV/XLSX recipient list; send it with sendUploadedBulkSMS
+  uploadRecipients: async (file, phoneColumn = '', variables = '') => {
+    const formData = new FormData();
+    formData.append('file', file);
+    formData.append('phone_column', phoneColumn);
+    formData.append('variables', variables);
+
+    const response = await api.post('/api/recipient-uploads', formData, {
+      headers: { 'Content-Type': 'multipart/form-data' },
+    });
+    return response;
+  },
+
+  // mediaIds come from mediaAPI.upload; options may set subject
+  sendMMS: async (phoneNumber, message, mediaIds, deviceId = null, options = {}) => {
+    const response = await api.post('/api/send-mms', {
+      phone_number: phoneNumber,
+      message: message,
+      media_ids: mediaIds,
+      device_id: deviceId,
+      ...options,
+    });
+    return response;
+  },
+
+  sendUploadedBulkSMS: async (uploadId, message, deviceId = null) => {
+    const response = await api.post('/api/send-bulk-sms', {
+      upload_id: uploadId,
+      message: message,
+      device_id: deviceId,
     });
     return response;
   },
@@ -104,12 +141,258 @@ export const smsAPI = {
     return response;
   },
 
+  // Includes per-segment sent and delivery reports
+  getMessage: async (messageId) => {
+    const response = await api.get(`/api/sms/${messageId}`);
+    return response;
+  },
+
   updateStatus: async (messageId, status) => {
     const response = await api.put(`/api/sms/${messageId}/status`, { status });
     return response;
   },
 };
 
+// Bulk job API
+export const bulkJobAPI = {
+  getJobs: async (page = 1, limit = 10, filters = {}) => {
+    const params = new URLSearchParams({
+      page: page.toString(),
+      limit: limit.toString(),
+      ...filters,
+    });
+
+    const response = await api.get(`/api/bulk-jobs?${params}`);
+    return response;
+  },
+
+  getJob: async (jobId) => {
+    const response = await api.get(`/api/bulk-jobs/${jobId}`);
+    return response;
+  },
+
+  pauseJob: async (jobId) => {
+    const response = await api.post(`/api/bulk-jobs/${jobId}/pause`);
+    return response;
+  },
+
+  resumeJob: async (jobId) => {
+    const response = await api.post(`/api/bulk-jobs/${jobId}/resume`);
+    return response;
+  },
+
+  cancelJob: async (jobId) => {
+    const response = await api.post(`/api/bulk-jobs/${jobId}/cancel`);
+    return response;
+  },
+};
+
+// Conversation API
+export const conversationAPI = {
+  getConversations: async (page = 1, limit = 20, filters = {}) => {
+    const params = new URLSearchParams({
+      page: page.toString(),
+      limit: limit.toString(),
+      ...filters,
+    });
+
+    const response = await api.get(`/api/conversations?${params}`);
+    return response;
+  },
+
+  getConversation: async (conversationId) => {
+    const response = await api.get(`/api/conversations/${conversationId}`);
+    return response;
+  },
+
+  getMessages: async (conversationId, page = 1, limit = 50) => {
+    const params = new URLSearchParams({
+      page: page.toString(),
+      limit: limit.toString(),
+    });
+
+    const response = await api.get(`/api/conversations/${conversationId}/messages?${params}`);
+    return response;
+  },
+
+  markRead: async (conversationId) => {
+    const response = await api.post(`/api/conversations/${conversationId}/read`);
+    return response;
+  },
+
+  reply: async (conversationId, message) => {
+    const response = await api.post(`/api/conversations/${conversationId}/reply`, { message });
+    return response;
+  },
+};
+
+// Inbound rule API
+export const inboundRuleAPI = {
+  getRules: async () => {
+    const response = await api.get('/api/inbound-rules');
+    return response;
+  },
+
+  createRule: async (rule) => {
+    const response = await api.post('/api/inbound-rules', rule);
+    return response;
+  },
+
+  updateRule: async (ruleId, rule) => {
+    const response = await api.put(`/api/inbound-rules/${ruleId}`, rule);
+    return response;
+  },
+
+  deleteRule: async (ruleId) => {
+    const response = await api.delete(`/api/inbound-rules/${ruleId}`);
+    return response;
+  },
+
+  getOptOuts: async () => {
+    const response = await api.get('/api/opt-outs');
+    return response;
+  },
+
+  createOptOut: async (phoneNumber) => {
+    const response = await api.post('/api/opt-outs', { phone_number: phoneNumber });
+    return response;
+  },
+
+  deleteOptOut: async (optOutId) => {
+    const response = await api.delete(`/api/opt-outs/${optOutId}`);
+    return response;
+  },
+};
+
+// Contact API
+export const contactAPI = {
+  getContacts: async (page = 1, limit = 20, filters = {}) => {
+    const params = new URLSearchParams({
+      page: page.toString(),
+      limit: limit.toString(),
+      ...filters,
+    });
+
+    const response = await api.get(`/api/contacts?${params}`);
+    return response;
+  },
+
+  getContact: async (contactId) => {
+    const response = await api.get(`/api/contacts/${contactId}`);
+    return response;
+  },
+
+  createContact: async (contact) => {
+    const response = await api.post('/api/contacts', contact);
+    return response;
+  },
+
+  updateContact: async (contactId, contact) => {
+    const response = await api.put(`/api/contacts/${contactId}`, contact);
+    return response;
+  },
+
+  deleteContact: async (contactId) => {
+    const response = await api.delete(`/api/contacts/${contactId}`);
+    return response;
+  },
+
+  importContacts: async (file, groupId = null, phoneColumn = '') => {
+    const formData = new FormData();
+    formData.append('file', file);
+    formData.append('phone_column', phoneColumn);
+    if (groupId) {
+      formData.append('group_id', groupId);
+    }
+
+    const response = await api.post('/api/contacts/import', formData, {
+      headers: { 'Content-Type': 'multipart/form-data' },
+    });
+    return response;
+  },
+
+  exportContacts: async () => {
+    const response = await api.get('/api/contacts/export', { responseType: 'blob' });
+    return response;
+  },
+
+  getGroups: async () => {
+    const response = await api.get('/api/contact-groups');
+    return response;
+  },
+
+  createGroup: async (name, description = '') => {
+    const response = await api.post('/api/contact-groups', { name, description });
+    return response;
+  },
+
+  updateGroup: async (groupId, name, description = '') => {
+    const response = await api.put(`/api/contact-groups/${groupId}`, { name, description });
+    return response;
+  },
+
+  deleteGroup: async (groupId) => {
+    const response = await api.delete(`/api/contact-groups/${groupId}`);
+    return response;
+  },
+
+  addGroupMembers: async (groupId, contactIds) => {
+    const response = await api.post(`/api/contact-groups/${groupId}/members`, {
+      contact_ids: contactIds,
+    });
+    return response;
+  },
+
+  removeGroupMembers: async (groupId, contactIds) => {
+    const response = await api.delete(`/api/contact-groups/${groupId}/members`, {
+      data: { contact_ids: contactIds },
+    });
+    return response;
+  },
+
+  // Sends to a group and/or tag query such as "vip -churned"
+  sendBulkSMS: async (message, { groupId = null, tagQuery = '' } = {}, deviceId = null) => {
+    const response = await api.post('/api/send-bulk-sms', {
+      group_id: groupId,
+      tag_query: tagQuery,
+      message: message,
+      device_id: deviceId,
+    });
+    return response;
+  },
+};
+
+// Verification API
+export const mediaAPI = {
+  // Stores an image for MMS attachments
+  upload: async (file) => {
+    const formData = new FormData();
+    formData.append('file', file);
+
+    const response = await api.post('/api/media', formData, {
+      headers: { 'Content-Type': 'multipart/form-data' },
+    });
+    return response;
+  },
+};
+
+export const verifyAPI = {
+  // channel is 'sms' or 'call'
+  start: async (phoneNumber, channel = 'sms', options = {}) => {
+    const response = await api.post('/api/verify/start', {
+      phone_number: phoneNumber,
+      channel,
+      ...options,
+    });
+    return response;
+  },
+
+  check: async (id, code) => {
+    const response = await api.post('/api/verify/check', { id, code });
+    return response;
+  },
+};
+
 // Call API
 export const callAPI = {
   makeCall: async (phoneNumber, deviceId = null) => {
@@ -138,6 +421,24 @@ export const callAPI = {
     });
     return response;
   },
+
+  getRecording: async (callId) => {
+    const response = await api.get(`/api/calls/${callId}/recording`, { responseType: 'blob' });
+    return response;
+  },
+
+  deleteRecording: async (callId) => {
+    const response = await api.delete(`/api/calls/${callId}/recording`);
+    return response;
+  },
+
+  // CSV of call detail records; filters may set from, to, device_id, sim_id
+  // and status
+  exportCDR: async (filters = {}) => {
+    const params = new URLSearchParams(filters);
+    const response = await api.get(`/api/calls/cdr?${params}`, { responseType: 'blob' });
+    return response;
+  },
 };
 
 // Device API
@@ -170,6 +471,31 @@ export const deviceAPI = {
     const response = await api.get(`/api/devices/${deviceId}/status`);
     return response;
   },
+
+  // Dials a USSD code such as *123#; an active session shows a menu to reply to
+  startUSSD: async (deviceId, code, options = {}) => {
+    const response = await api.post(`/api/devices/${deviceId}/ussd`, { code, ...options });
+    return response;
+  },
+
+  replyUSSD: async (deviceId, sessionId, input) => {
+    const response = await api.post(`/api/devices/${deviceId}/ussd/${sessionId}/reply`, { input });
+    return response;
+  },
+
+  cancelUSSD: async (deviceId, sessionId) => {
+    const response = await api.delete(`/api/devices/${deviceId}/ussd/${sessionId}`);
+    return response;
+  },
+
+  getUSSDSessions: async (deviceId, page = 1, limit = 10) => {
+    const params = new URLSearchParams({
+      page: page.toString(),
+      limit: limit.toString(),
+    });
+    const response = await api.get(`/api/devices/${deviceId}/ussd?${params}`);
+    return response;
+  },
 };
 
 // Dashboard API